@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/chezky/blemflarck/core"
+	"github.com/spf13/cobra"
+	"log"
+	"time"
+)
+
+var (
+	addressHistoryAddress  string
+	addressHistoryPage     int
+	addressHistoryPageSize int
+	addressHistoryCmd      = &cobra.Command{
+		Use:   "address-history",
+		Short: "List every payment to and from an address",
+		Long:  "List every output an address received and every input that spent one, oldest first, one page at a time. Needs the address index, see --addrindex",
+		Run:   addressHistory(),
+	}
+)
+
+func addressHistory() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		if !core.ChainExists() {
+			log.Fatal("No blockchain exists yet! Create with the 'create-chain' cmd.")
+		}
+		if !core.CheckValidAddress([]byte(addressHistoryAddress)) {
+			log.Fatal("Please enter a valid address!")
+		}
+		if addressHistoryPage < 1 || addressHistoryPageSize < 1 {
+			log.Fatal("The page and page size must be at least 1!")
+		}
+
+		bc, err := core.CreateBlockchain()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		pubKeyHash := core.PubKeyHashFromAddress([]byte(addressHistoryAddress))
+		offset := (addressHistoryPage - 1) * addressHistoryPageSize
+
+		entries, total, err := bc.AddressHistory(pubKeyHash, offset, addressHistoryPageSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		pages := (total + addressHistoryPageSize - 1) / addressHistoryPageSize
+		fmt.Printf("History of address %s, page %d of %d, %d entries in total\n", addressHistoryAddress, addressHistoryPage, pages, total)
+
+		for _, entry := range entries {
+			date := time.Unix(entry.Timestamp, 0).UTC().Format("2006-01-02 15:04:05")
+			if entry.Kind == core.EntryReceived {
+				fmt.Printf("#%d %s received %d in %s:%d\n", entry.Height, date, entry.Value, hex.EncodeToString(entry.TransactionID), entry.Index)
+			} else {
+				fmt.Printf("#%d %s spent %d in %s, input #%d spent %s:%d\n", entry.Height, date, entry.Value, hex.EncodeToString(entry.TransactionID), entry.Index,
+					hex.EncodeToString(entry.PrevTxID), entry.PrevIndex)
+			}
+		}
+	}
+}
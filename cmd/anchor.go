@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/chezky/blemflarck/core"
+	"github.com/spf13/cobra"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+var (
+	anchorFrom   string
+	anchorFile   string
+	anchorHash   string
+	anchorFee    int
+	anchorNode   string
+	anchorReward string
+	anchorCmd    = &cobra.Command{
+		Use:   "anchor",
+		Short: "Anchor the hash of a file on the chain",
+		Long:  "Put the sha256 of --file, or any --hash, on the chain in a data output, paid for by --from. The block it goes in proves the file existed by the time of that block, see find-anchor",
+		Run:   anchor(),
+	}
+
+	findAnchorFile string
+	findAnchorHash string
+	findAnchorCmd  = &cobra.Command{
+		Use:   "find-anchor",
+		Short: "Find the blocks that anchored the hash of a file",
+		Long:  "List every block on the main chain that anchored the sha256 of --file, or any --hash, oldest first. Needs the anchor index, see --anchorindex",
+		Run:   findAnchor(),
+	}
+)
+
+func anchor() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		if !core.CheckValidAddress([]byte(anchorFrom)) {
+			log.Fatalf("Please enter a valid %s address to pay for the anchor with --from!", core.Params.Name)
+		}
+		if anchorNode == "" && !core.CheckValidAddress([]byte(anchorReward)) {
+			log.Fatalf("Please enter a valid %s address for the block reward with --reward, or a node with --node!", core.Params.Name)
+		}
+
+		hash, err := anchorData(anchorFile, anchorHash)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		bc, err := core.CreateBlockchain()
+		if err != nil {
+			log.Fatal(err)
+		}
+		tx, err := bc.NewAnchorTransaction(anchorFrom, hash, core.TxOptions{Fee: anchorFee})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := submitTransaction(bc, tx, anchorNode, anchorReward); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Anchored %x in transaction %x\n", hash, tx.ID)
+	}
+}
+
+func findAnchor() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		if !core.ChainExists() {
+			log.Fatal("No blockchain exists yet! Create with the 'create-chain' cmd.")
+		}
+
+		hash, err := anchorData(findAnchorFile, findAnchorHash)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		bc, err := core.CreateBlockchain()
+		if err != nil {
+			log.Fatal(err)
+		}
+		entries, err := bc.FindAnchors(hash)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(entries) == 0 {
+			fmt.Printf("%x was never anchored on the main chain\n", hash)
+			return
+		}
+		for _, entry := range entries {
+			date := time.Unix(entry.Timestamp, 0).UTC().Format("2006-01-02 15:04:05")
+			fmt.Printf("%x anchored in block #%d %s at %s, in %s:%d\n", hash, entry.Height, hex.EncodeToString(entry.BlockHash), date,
+				hex.EncodeToString(entry.TransactionID), entry.Index)
+		}
+	}
+}
+
+// anchorData returns the data to anchor, either the sha256 of a file, or a hex hash. Exactly one of them has to be given.
+func anchorData(file, hash string) ([]byte, error) {
+	if (file == "") == (hash == "") {
+		return nil, fmt.Errorf("please enter either a --file or a --hash")
+	}
+
+	if hash != "" {
+		data, err := hex.DecodeString(hash)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a hex hash: %v", hash, err)
+		}
+		return data, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -7,23 +7,21 @@ import (
 )
 
 var (
-	createChainAddress string
-
 	createChainCmd = &cobra.Command{
 		Use: "create-chain",
 		Short: "Create a new blockchain",
-		Long: "Create a new blockchain, if no current one exists, then the genesis reward will go to the address",
+		Long: "Create a new blockchain from the genesis block of the network, if no current one exists. A new network's genesis block is made with create-genesis",
 		Run: createChain(),
 	}
 )
 
 func createChain() func(cmd *cobra.Command, args []string) {
 	return func(cmd *cobra.Command, args []string) {
-		if !core.CheckValidAddress([]byte(createChainAddress)) {
-			log.Fatal("Please enter a valid address!")
+		if core.ChainExists() {
+			log.Fatal("A blockchain already exists!")
 		}
-		if _, err := core.CreateBlockchain(createChainAddress); err != nil {
+		if _, err := core.CreateBlockchain(); err != nil {
 			log.Fatal("error creating blockchain", err)
 		}
 	}
-}
\ No newline at end of file
+}
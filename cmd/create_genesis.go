@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/chezky/blemflarck/core"
+	"github.com/spf13/cobra"
+	"log"
+)
+
+var (
+	createGenesisParams string
+	createGenesisForce  bool
+	createGenesisCmd    = &cobra.Command{
+		Use:   "create-genesis",
+		Short: "Create the genesis block of a new network",
+		Long:  "Create a genesis block from a JSON parameter file with its timestamp, message, premine allocations and initial validators, and write it to the genesis file of the network. Then run create-chain to start the chain from it",
+		Run:   createGenesis(),
+	}
+)
+
+func createGenesis() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		if core.ChainExists() {
+			log.Fatal("A blockchain already exists, a new genesis block won't change it!")
+		}
+		if core.Params.GenesisHash != "" {
+			log.Fatalf("%s only accepts its own genesis block, create a new network on regtest", core.Params.Name)
+		}
+
+		params, err := core.ReadGenesisParams(createGenesisParams)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		genesis, err := core.NewGenesisBlock(params)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		path, err := core.WriteGenesis(genesis, createGenesisForce)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Wrote genesis block to %s\n", path)
+		fmt.Printf("Genesis Hash: %s\n", hex.EncodeToString(genesis.Hash))
+		for _, out := range genesis.Transactions[0].Vout {
+			fmt.Printf("Allocation: %d to %s\n", out.Value, out.Address())
+		}
+		for _, validator := range core.GenesisValidators(genesis.BlockHeader) {
+			fmt.Printf("Validator: %s\n", core.AddressFromPubKeyHash(validator))
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/chezky/blemflarck/core"
+	"github.com/spf13/cobra"
+	"log"
+)
+
+var (
+	dumpUTXOFile string
+	dumpUTXOCmd  = &cobra.Command{
+		Use:   "dump-utxo",
+		Short: "Write the chainstate to a snapshot file",
+		Long:  "Write the unspent transaction outputs at the tip, and the header of every block, to a snapshot file. A new node can load it with load-utxo instead of replaying every block",
+		Run:   dumpUTXO(),
+	}
+)
+
+func dumpUTXO() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		if !core.ChainExists() {
+			log.Fatal("No blockchain exists yet! Create with the 'create-chain' cmd.")
+		}
+
+		bc, err := core.CreateBlockchain()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		info, err := bc.DumpSnapshot(dumpUTXOFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Wrote %d unspent output(s) at height %d to %s\n", info.Coins, info.Height, dumpUTXOFile)
+		fmt.Printf("Tip Hash: %s\n", hex.EncodeToString(info.TipHash))
+		fmt.Printf("Snapshot Hash: %s\n", hex.EncodeToString(info.Hash))
+	}
+}
@@ -22,28 +22,29 @@ func getBalance() func(cmd *cobra.Command, args []string) {
 		if !core.ChainExists() {
 			log.Fatal("Chain does not exist! Please create one first.")
 		}
-		bc, err := core.CreateBlockchain("")
+		if !core.CheckValidAddress([]byte(getBalanceAddress)) {
+			log.Fatal("Please enter a valid address!")
+		}
+		bc, err := core.CreateBlockchain()
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		utxo := core.UTXO{Blockchain: bc}
 
-		UTXOs, err := utxo.FindUTXOs()
+		acc, err := utxo.GetBalance(core.PubKeyHashFromAddress([]byte(getBalanceAddress)))
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		acc := 0
-
-		for _, outs := range UTXOs {
-			for _, out := range outs.Outputs {
-				if out.CanBeUnlocked([]byte(getBalanceAddress)) {
-					acc += out.Value
-				}
-			}
+		immature, err := utxo.GetImmatureBalance(core.PubKeyHashFromAddress([]byte(getBalanceAddress)))
+		if err != nil {
+			log.Fatal(err)
 		}
 
 		fmt.Printf("Total balance for address %s is %d blemflarck(s)\n", getBalanceAddress, acc)
+		if immature > 0 {
+			fmt.Printf("Of that, %d blemflarck(s) are immature coinbase rewards, spendable once they are %d blocks deep\n", immature, core.Params.CoinbaseMaturity)
+		}
 	}
 }
\ No newline at end of file
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/chezky/blemflarck/core"
+	"github.com/spf13/cobra"
+	"log"
+)
+
+var (
+	getTxID string
+	getTxCmd = &cobra.Command{
+		Use:   "get-tx",
+		Short: "Look up a transaction by its ID",
+		Long:  "Print out any transaction on the main chain, along with the block it is in and its confirmations. Needs the transaction index, see --txindex",
+		Run:   getTx(),
+	}
+)
+
+func getTx() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		if !core.ChainExists() {
+			log.Fatal("No blockchain exists yet! Create with the 'create-chain' cmd.")
+		}
+
+		txID, err := hex.DecodeString(getTxID)
+		if err != nil {
+			log.Fatal("Please enter a valid transaction ID!")
+		}
+
+		bc, err := core.CreateBlockchain()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		tx, loc, err := bc.GetTransaction(txID)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		tipHeight, err := bc.GetChainHeight()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Block Hash: %s\n", hex.EncodeToString(loc.BlockHash))
+		fmt.Printf("Block Height: %d\n", loc.Height)
+		fmt.Printf("Position in Block: %d\n", loc.Position)
+		fmt.Printf("Confirmations: %d\n", int(tipHeight)-loc.Height+1)
+		printTransaction(tx)
+	}
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/chezky/blemflarck/core"
+	"github.com/spf13/cobra"
+	"log"
+)
+
+var (
+	loadUTXOFile string
+	loadUTXOHash string
+	loadUTXOCmd  = &cobra.Command{
+		Use:   "load-utxo",
+		Short: "Load the chainstate from a snapshot file",
+		Long:  "Start a new chain from a snapshot made with dump-utxo, instead of replaying every block. The snapshot has to be pinned for the network, or its hash has to be passed with --hash. No snapshots are pinned yet, so the file is trusted as it is: only load a snapshot from someone you trust. The chain can never reorganize below the snapshot's tip, and can't have the --txindex, --addrindex or --anchorindex indexes",
+		Run:   loadUTXO(),
+	}
+)
+
+func loadUTXO() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		var trusted []byte
+		if loadUTXOHash != "" {
+			var err error
+			trusted, err = hex.DecodeString(loadUTXOHash)
+			if err != nil {
+				log.Fatal("Please enter a valid snapshot hash!")
+			}
+		}
+
+		// a new chain is created from the genesis block if there is none yet
+		bc, err := core.CreateBlockchain()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		info, err := bc.LoadSnapshot(loadUTXOFile, trusted)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Loaded %d unspent output(s) at height %d\n", info.Coins, info.Height)
+		fmt.Printf("Tip Hash: %s\n", hex.EncodeToString(info.TipHash))
+	}
+}
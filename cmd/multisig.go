@@ -0,0 +1,263 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/chezky/blemflarck/core"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+var (
+	createMultisigRequired int
+	createMultisigKeys     []string
+	createMultisigCmd      = &cobra.Command{
+		Use:   "create-multisig",
+		Short: "Create an M-of-N multisig address",
+		Long:  "Create a multisig address that needs --required signatures out of the public keys of every --key, and remember it in the wallet file. A key is either a hex public key, or the address of one of our wallets. Every signer creates the same address from the same keys, in any order",
+		Run:   createMultisig(),
+	}
+
+	spendMultisigFrom          string
+	spendMultisigTo            []string
+	spendMultisigAmount        int
+	spendMultisigFile          string
+	spendMultisigFee           int
+	spendMultisigCoinSelection string
+	spendMultisigLockTime      int64
+	spendMultisigSequence      int
+	spendMultisigOut           string
+	spendMultisigCmd           = &cobra.Command{
+		Use:   "spend-multisig",
+		Short: "Create an unsigned transaction that spends from a multisig address",
+		Long:  "Create a transaction that pays from a multisig address, and write it to a file for the signers to sign with sign-multisig",
+		Run:   spendMultisig(),
+	}
+
+	signMultisigIn  string
+	signMultisigOut string
+	signMultisigCmd = &cobra.Command{
+		Use:   "sign-multisig",
+		Short: "Sign a multisig transaction with our keys",
+		Long:  "Add a signature to every multisig input of a transaction file, with every key in the wallet file that can sign it",
+		Run:   signMultisig(),
+	}
+
+	combineMultisigIn     []string
+	combineMultisigOut    string
+	combineMultisigSubmit bool
+	combineMultisigNode   string
+	combineMultisigReward string
+	combineMultisigCmd    = &cobra.Command{
+		Use:   "combine-multisig",
+		Short: "Combine the signatures of signed multisig transactions",
+		Long:  "Put the signatures of several signed copies of a multisig transaction together, and submit it with --submit once it has enough signatures, to a node with --node, or in a new block that pays its reward to --reward",
+		Run:   combineMultisig(),
+	}
+)
+
+func createMultisig() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		wallets, err := core.ReadWalletsFromFile()
+		if err != nil {
+			log.Fatal("error reading in wallets from file: ", err)
+		}
+
+		var pubKeys [][]byte
+		for _, key := range createMultisigKeys {
+			if wallet, ok := wallets.Wallets[key]; ok {
+				pubKeys = append(pubKeys, wallet.PublicKey)
+				continue
+			}
+			pubKey, err := hex.DecodeString(key)
+			if err != nil {
+				log.Fatalf("%s is neither one of our addresses, nor a hex public key!", key)
+			}
+			pubKeys = append(pubKeys, pubKey)
+		}
+
+		script, err := core.NewMultisigScript(createMultisigRequired, pubKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		address, err := script.Address()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		wallets.Multisig[string(address)] = script
+		if err := wallets.SaveToFile(); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Your %d-of-%d multisig address is: %s\n", script.Required, len(script.PubKeys), address)
+	}
+}
+
+func spendMultisig() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		wallets, err := core.ReadWalletsFromFile()
+		if err != nil {
+			log.Fatal("error reading in wallets from file: ", err)
+		}
+		script, ok := wallets.Multisig[spendMultisigFrom]
+		if !ok {
+			log.Fatalf("%s is not a multisig address in the wallet file, add it with create-multisig!", spendMultisigFrom)
+		}
+
+		payments, err := parsePayments(spendMultisigTo, spendMultisigAmount, spendMultisigFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		selector, err := core.GetCoinSelector(spendMultisigCoinSelection)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		bc, err := core.CreateBlockchain()
+		if err != nil {
+			log.Fatal(err)
+		}
+		tx, err := bc.NewMultisigTransaction(script, payments, core.TxOptions{
+			Fee:          spendMultisigFee,
+			CoinSelector: selector,
+			LockTime:     spendMultisigLockTime,
+			Sequence:     spendMultisigSequence,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := writeTxFile(spendMultisigOut, tx); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Wrote unsigned transaction %s to %s, it needs %d signature(s)\n", hex.EncodeToString(tx.ID), spendMultisigOut, script.Required)
+	}
+}
+
+func signMultisig() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		tx, err := readTxFile(signMultisigIn)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		wallets, err := core.ReadWalletsFromFile()
+		if err != nil {
+			log.Fatal("error reading in wallets from file: ", err)
+		}
+
+		bc, err := core.CreateBlockchain()
+		if err != nil {
+			log.Fatal(err)
+		}
+		utxo := core.UTXO{Blockchain: bc}
+
+		added, err := utxo.SignMultisigTransaction(&tx, wallets)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		out := signMultisigOut
+		if out == "" {
+			out = signMultisigIn
+		}
+		if err := writeTxFile(out, tx); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Added %d signature(s), wrote transaction to %s\n", added, out)
+		printMultisigProgress(tx)
+	}
+}
+
+func combineMultisig() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		var txs []core.Transaction
+		for _, path := range combineMultisigIn {
+			tx, err := readTxFile(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			txs = append(txs, tx)
+		}
+
+		tx, err := core.CombineMultisig(txs)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if combineMultisigOut != "" {
+			if err := writeTxFile(combineMultisigOut, tx); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Wrote combined transaction to %s\n", combineMultisigOut)
+		}
+		complete := printMultisigProgress(tx)
+
+		if !combineMultisigSubmit {
+			return
+		}
+		if !complete {
+			log.Fatal("The transaction doesn't have enough signatures yet!")
+		}
+		if combineMultisigNode == "" && !core.CheckValidAddress([]byte(combineMultisigReward)) {
+			log.Fatalf("Please enter a valid %s address for the block reward with --reward, or a node with --node!", core.Params.Name)
+		}
+
+		bc, err := core.CreateBlockchain()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := submitTransaction(bc, tx, combineMultisigNode, combineMultisigReward); err != nil {
+			log.Fatal(err)
+		}
+		if combineMultisigNode == "" {
+			fmt.Printf("Successfully added transaction %s in a new block\n", hex.EncodeToString(tx.ID))
+		}
+	}
+}
+
+// printMultisigProgress prints how many signatures every input of a multisig transaction has, and returns whether all of them have
+// enough.
+func printMultisigProgress(tx core.Transaction) bool {
+	complete := true
+	for inIdx, in := range tx.Vin {
+		signed, required, err := in.MultisigProgress()
+		if err != nil {
+			fmt.Printf("Input #%d: %v\n", inIdx, err)
+			complete = false
+			continue
+		}
+		fmt.Printf("Input #%d: %d of %d signature(s)\n", inIdx, signed, required)
+		if signed < required {
+			complete = false
+		}
+	}
+	return complete
+}
+
+// readTxFile reads in a transaction from a file, where it is stored as hex.
+func readTxFile(path string) (core.Transaction, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return core.Transaction{}, err
+	}
+	enc, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return core.Transaction{}, fmt.Errorf("%s is not a hex transaction: %v", path, err)
+	}
+	return core.DeserializeTransaction(enc)
+}
+
+// writeTxFile writes a transaction to a file as hex.
+func writeTxFile(path string, tx core.Transaction) error {
+	enc, err := tx.Serialize()
+	if err != nil {
+		return err
+	}
+	return core.WriteFileAtomic(path, []byte(hex.EncodeToString(enc)+"\n"), 0644)
+}
@@ -6,12 +6,16 @@ import (
 	"github.com/chezky/blemflarck/core"
 	"github.com/spf13/cobra"
 	"log"
+	"strconv"
 )
 
 var (
+	printChainFrom string
+	printChainTo string
 	printChainCmd = &cobra.Command{
 		Use: "print-chain",
 		Short: "Print out the current blockchain",
+		Long: "Print out the blocks of the main chain from --from to --to, both a height or a block hash. Goes down the chain if --from is above --to, otherwise up. By default the whole chain is printed from the tip down",
 		Run: printChain(),
 	}
 )
@@ -21,41 +25,108 @@ func printChain() func(cmd *cobra.Command, args []string) {
 		if !core.ChainExists() {
 			log.Fatal("No blockchain exists yet! Create with the 'create-chain' cmd.")
 		}
-		bc, err := core.CreateBlockchain("")
+		bc, err := core.CreateBlockchain()
 		if err != nil {
 			log.Fatal(err)
 		}
-		iter, err := bc.NewIterator()
+		tipHeight, err := bc.GetChainHeight()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		from, err := parseBlockRef(bc, printChainFrom, int(tipHeight))
+		if err != nil {
+			log.Fatal(err)
+		}
+		to, err := parseBlockRef(bc, printChainTo, 0)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		iter, err := bc.NewRangeIterator(from, to)
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		for {
-			blk := iter.Next()
+			blk, err := iter.Next()
+			if err == core.ErrIteratorDone {
+				break
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
 
 			fmt.Printf("############ Block height: %d ############\n", blk.Height)
 			fmt.Printf("Hash: %s\n", hex.EncodeToString(blk.Hash))
 			fmt.Printf("Prev. Hash: %s\n", hex.EncodeToString(blk.PrevHash))
+			fmt.Printf("Merkle Root: %s\n", hex.EncodeToString(blk.MerkleRoot))
+			// every block has a coinbase, so a block without transactions has been pruned
+			if len(blk.Transactions) == 0 {
+				fmt.Printf("Transactions: pruned\n\n")
+				continue
+			}
 			fmt.Printf("Transaction Count: %d\n", len(blk.Transactions))
 			for i, tx := range blk.Transactions {
 				fmt.Printf("--------- TRANSACTION #%d ---------\n", i)
-				fmt.Printf("TX ID: %s\n", hex.EncodeToString(tx.ID))
-				fmt.Printf("Output count: %d\n", len(tx.Vout))
-				for outIdx, out := range tx.Vout {
-					fmt.Printf("Output #%d Value is: %d\n", outIdx, out.Value)
-					fmt.Printf("Output #%d PubKeyHash is: %s\n", outIdx, hex.EncodeToString(out.PubKeyHash))
-				}
-				fmt.Printf("Input count: %d\n", len(tx.Vin))
-				for inIdx, in := range tx.Vin {
-					fmt.Printf("Input #%d PubKey: %s\n", inIdx, hex.EncodeToString(in.PubKey))
-					fmt.Printf("Input #%d Signature: %s\n", inIdx, hex.EncodeToString(in.Signature))
-				}
+				printTransaction(tx)
 			}
 			fmt.Println()
+		}
+	}
+}
 
-			if len(blk.PrevHash) == 0 {
-				break
-			}
+// parseBlockRef turns a block given on the command line, either a height or a block hash in hex, into the height of the block on the
+// main chain. An empty ref is def.
+func parseBlockRef(bc *core.Blockchain, ref string, def int) (int, error) {
+	if ref == "" {
+		return def, nil
+	}
+
+	if height, err := strconv.Atoi(ref); err == nil {
+		return height, nil
+	}
+
+	hash, err := hex.DecodeString(ref)
+	if err != nil {
+		return 0, fmt.Errorf("ERROR: %q is neither a block height nor a block hash", ref)
+	}
+
+	return bc.MainChainHeight(hash)
+}
+
+// printTransaction prints out every field of a transaction.
+func printTransaction(tx core.Transaction) {
+	fmt.Printf("TX ID: %s\n", hex.EncodeToString(tx.ID))
+	if tx.LockTime != 0 {
+		fmt.Printf("Locked until: %s\n", core.FormatLockTime(tx.LockTime))
+	}
+	fmt.Printf("Output count: %d\n", len(tx.Vout))
+	for outIdx, out := range tx.Vout {
+		fmt.Printf("Output #%d Value is: %d\n", outIdx, out.Value)
+		fmt.Printf("Output #%d PubKeyHash is: %s\n", outIdx, hex.EncodeToString(out.PubKeyHash))
+		if len(out.Script) > 0 {
+			fmt.Printf("Output #%d Script is: %s\n", outIdx, disassemble(out.Script))
+		}
+	}
+	fmt.Printf("Input count: %d\n", len(tx.Vin))
+	for inIdx, in := range tx.Vin {
+		fmt.Printf("Input #%d PubKey: %s\n", inIdx, hex.EncodeToString(in.PubKey))
+		fmt.Printf("Input #%d Signature: %s\n", inIdx, hex.EncodeToString(in.Signature))
+		if len(in.Script) > 0 {
+			fmt.Printf("Input #%d Script: %s\n", inIdx, disassemble(in.Script))
 		}
+		if in.Sequence != 0 {
+			fmt.Printf("Input #%d Sequence: %d blocks\n", inIdx, in.Sequence)
+		}
+	}
+}
+
+// disassemble turns a script into readable text, or into hex if it can't be parsed.
+func disassemble(script []byte) string {
+	text, err := core.DisassembleScript(script)
+	if err != nil {
+		return hex.EncodeToString(script)
 	}
+	return text
 }
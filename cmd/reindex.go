@@ -21,7 +21,7 @@ func reindex() func(cmd *cobra.Command, args []string) {
 			log.Fatal("No blockchain exists yet! Create with the 'create-chain' cmd.")
 		}
 
-		bc, err := core.CreateBlockchain("")
+		bc, err := core.CreateBlockchain()
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/chezky/blemflarck/core"
+	"github.com/spf13/cobra"
+	"log"
+)
+
+var (
+	rewindHeight int
+
+	rewindCmd = &cobra.Command{
+		Use:   "rewind",
+		Short: "Rewind the chain to a height",
+		Long:  "Disconnect blocks from the tip of the chain until the given height is the tip. The chainstate is rolled back using each block's undo data",
+		Run:   rewind(),
+	}
+)
+
+func rewind() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		if !core.ChainExists() {
+			log.Fatal("No blockchain exists yet! Create with the 'create-chain' cmd.")
+		}
+
+		bc, err := core.CreateBlockchain()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := bc.RewindTo(rewindHeight); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Chain rewound to height %d\n", rewindHeight)
+	}
+}
@@ -2,45 +2,208 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/chezky/blemflarck/core"
+	"github.com/chezky/blemflarck/p2p"
 	"github.com/spf13/cobra"
+	"log"
 	"os"
 )
 
 var (
+	dataDir string
+	network string
 	rootCmd = cobra.Command{
 		Use: "blem",
 		Short: "Blemflarck is a cryptocurrency based on the X web",
 		Long: "Blemflarck is the cryptocurrency for the X web. Built with love and dedication",
+		PersistentPreRun: selectNetwork(),
 	}
 )
 
 func init() {
-	// flags and parameters of the create-chain cmd
-	createChainCmd.Flags().StringVarP(&createChainAddress, "address", "a", "",  "Address to send genesis reward")
-	createChainCmd.MarkFlagRequired("address")
+	// global flags, every command runs against one network in one data directory
+	rootCmd.PersistentFlags().StringVar(&dataDir, "datadir", "", "Directory to keep the chain and wallets in (default ~/.blemflarck)")
+	rootCmd.PersistentFlags().StringVar(&network, "network", core.MainNet.Name, "Network to run on, one of mainnet, testnet or regtest")
+	rootCmd.PersistentFlags().BoolVar(&core.BuildTxIndex, "txindex", false, "Build an index of every transaction, so any transaction can be looked up by its ID")
+	rootCmd.PersistentFlags().BoolVar(&core.BuildAddrIndex, "addrindex", false, "Build an index of every payment to and from every address, needed for address-history")
+	rootCmd.PersistentFlags().BoolVar(&core.BuildAnchorIndex, "anchorindex", false, "Build an index of every anchored hash, needed for find-anchor")
+	rootCmd.PersistentFlags().Int64Var(&core.PruneTarget, "prune", 0, "Delete the oldest block files once they take up more than this many MiB, 0 keeps every block")
+	rootCmd.PersistentFlags().IntVar(&core.PruneDepth, "prune-depth", core.PruneDepth, "Number of blocks below the tip that are never pruned")
+
+	// flags and parameters of the create-genesis cmd
+	createGenesisCmd.Flags().StringVarP(&createGenesisParams, "params", "p", "", "JSON file with the parameters of the genesis block")
+	createGenesisCmd.Flags().BoolVar(&createGenesisForce, "force", false, "Replace the genesis file of the network if there already is one")
+	createGenesisCmd.MarkFlagRequired("params")
 
 	// flags and parameters of the send cmd
 	sendCmd.Flags().StringVarP(&sendFrom, "from", "f", "", "Address of the sender")
-	sendCmd.Flags().StringVarP(&sendTo, "to", "t", "", "Address of the receiver")
-	sendCmd.Flags().IntVarP(&sendAmount, "amount", "a", 0,"Amount being transferred")
+	sendCmd.Flags().StringArrayVarP(&sendTo, "to", "t", nil, "Receiver and amount as address:amount, repeat it to pay several addresses in one transaction")
+	sendCmd.Flags().IntVarP(&sendAmount, "amount", "a", 0,"Amount being transferred, for a --to without an amount")
+	sendCmd.Flags().StringVar(&sendFile, "file", "", "CSV or JSON file of payments, with an address and an amount each")
+	sendCmd.Flags().IntVar(&sendFee, "fee", 0, "Fee paid to the block producer, on top of the amount")
+	sendCmd.Flags().StringVar(&sendCoinSelection, "coin-selection", core.LargestFirst{}.Name(), "How to pick the outputs to spend, one of largest, smallest, oldest or bnb (exact match without change)")
+	sendCmd.Flags().StringVar(&sendNode, "node", "", "Address (host:port) of a node to send the transaction to, instead of adding a block with it locally")
+	sendCmd.Flags().Int64Var(&sendLockTime, "locktime", 0, "Block height, or unix time from 500000000 on, before which the transaction can't be in a block")
+	sendCmd.Flags().IntVar(&sendSequence, "sequence", 0, "Number of blocks old the spent outputs have to be before the transaction can be in a block")
+	sendCmd.Flags().StringVarP(&sendOut, "out", "o", "", "File to write the signed transaction to, instead of sending it")
 	sendCmd.MarkFlagRequired("from")
-	sendCmd.MarkFlagRequired("to")
-	sendCmd.MarkFlagRequired("amount")
 
 	// flags for getBalance
 	getBalanceCmd.Flags().StringVarP(&getBalanceAddress, "address", "a", "", "Address of whom you would like to" +
 		"get the balance of" )
 	getBalanceCmd.MarkFlagRequired("address")
 
+	// flags for getTx
+	getTxCmd.Flags().StringVar(&getTxID, "id", "", "ID of the transaction, in hex")
+	getTxCmd.MarkFlagRequired("id")
+
+	// flags for addressHistory
+	addressHistoryCmd.Flags().StringVarP(&addressHistoryAddress, "address", "a", "", "Address to list the history of")
+	addressHistoryCmd.Flags().IntVar(&addressHistoryPage, "page", 1, "Page of the history to show, starting at 1")
+	addressHistoryCmd.Flags().IntVar(&addressHistoryPageSize, "page-size", 20, "Number of entries on a page")
+	addressHistoryCmd.MarkFlagRequired("address")
+
+	// flags for dumpUTXO and loadUTXO
+	dumpUTXOCmd.Flags().StringVarP(&dumpUTXOFile, "file", "f", "", "File to write the snapshot to")
+	dumpUTXOCmd.MarkFlagRequired("file")
+	loadUTXOCmd.Flags().StringVarP(&loadUTXOFile, "file", "f", "", "Snapshot file to load")
+	loadUTXOCmd.Flags().StringVar(&loadUTXOHash, "hash", "", "Hash of the snapshot to trust, in hex, if it isn't pinned for the network")
+	loadUTXOCmd.MarkFlagRequired("file")
+
+	// flags for printWallets
+	printWalletCmd.Flags().BoolVar(&printWalletsPubKeys, "pubkeys", false, "Print the public key of every wallet, to share for create-multisig")
+
+	// flags of the multisig cmds
+	createMultisigCmd.Flags().IntVarP(&createMultisigRequired, "required", "m", 0, "Number of signatures needed to spend")
+	createMultisigCmd.Flags().StringArrayVarP(&createMultisigKeys, "key", "k", nil, "Hex public key, or address of one of our wallets, repeat it for every key")
+	createMultisigCmd.MarkFlagRequired("required")
+	createMultisigCmd.MarkFlagRequired("key")
+	spendMultisigCmd.Flags().StringVarP(&spendMultisigFrom, "from", "f", "", "Multisig address to spend from")
+	spendMultisigCmd.Flags().StringArrayVarP(&spendMultisigTo, "to", "t", nil, "Receiver and amount as address:amount, repeat it to pay several addresses")
+	spendMultisigCmd.Flags().IntVarP(&spendMultisigAmount, "amount", "a", 0, "Amount being transferred, for a --to without an amount")
+	spendMultisigCmd.Flags().StringVar(&spendMultisigFile, "file", "", "CSV or JSON file of payments, with an address and an amount each")
+	spendMultisigCmd.Flags().IntVar(&spendMultisigFee, "fee", 0, "Fee paid to the block producer, on top of the amount")
+	spendMultisigCmd.Flags().StringVar(&spendMultisigCoinSelection, "coin-selection", core.LargestFirst{}.Name(), "How to pick the outputs to spend, one of largest, smallest, oldest or bnb")
+	spendMultisigCmd.Flags().Int64Var(&spendMultisigLockTime, "locktime", 0, "Block height, or unix time from 500000000 on, before which the transaction can't be in a block")
+	spendMultisigCmd.Flags().IntVar(&spendMultisigSequence, "sequence", 0, "Number of blocks old the spent outputs have to be before the transaction can be in a block")
+	spendMultisigCmd.Flags().StringVarP(&spendMultisigOut, "out", "o", "", "File to write the unsigned transaction to")
+	spendMultisigCmd.MarkFlagRequired("from")
+	spendMultisigCmd.MarkFlagRequired("out")
+	signMultisigCmd.Flags().StringVarP(&signMultisigIn, "in", "i", "", "File of the transaction to sign")
+	signMultisigCmd.Flags().StringVarP(&signMultisigOut, "out", "o", "", "File to write the signed transaction to (default the input file)")
+	signMultisigCmd.MarkFlagRequired("in")
+	combineMultisigCmd.Flags().StringArrayVarP(&combineMultisigIn, "in", "i", nil, "File of a signed copy of the transaction, repeat it for every copy")
+	combineMultisigCmd.Flags().StringVarP(&combineMultisigOut, "out", "o", "", "File to write the combined transaction to")
+	combineMultisigCmd.Flags().BoolVar(&combineMultisigSubmit, "submit", false, "Submit the transaction once it has enough signatures")
+	combineMultisigCmd.Flags().StringVar(&combineMultisigNode, "node", "", "Address (host:port) of a node to submit the transaction to")
+	combineMultisigCmd.Flags().StringVar(&combineMultisigReward, "reward", "", "Address for the reward of the block the transaction is added in, without --node")
+	combineMultisigCmd.MarkFlagRequired("in")
+
+	// flags for submitTx
+	submitTxCmd.Flags().StringVarP(&submitTxIn, "in", "i", "", "File of the signed transaction")
+	submitTxCmd.Flags().StringVar(&submitTxNode, "node", "", "Address (host:port) of a node to submit the transaction to")
+	submitTxCmd.Flags().StringVar(&submitTxReward, "reward", "", "Address for the reward of the block the transaction is added in, without --node")
+	submitTxCmd.MarkFlagRequired("in")
+
+	// flags for swap
+	swapInitiateCmd.Flags().StringVarP(&swapInitiateFrom, "from", "f", "", "Address of ours that pays the contract, and gets it back with a refund")
+	swapInitiateCmd.Flags().StringVarP(&swapInitiateTo, "to", "t", "", "Address of the participant, who can redeem the contract")
+	swapInitiateCmd.Flags().IntVarP(&swapInitiateAmount, "amount", "a", 0, "Amount paid to the contract")
+	swapInitiateCmd.Flags().Int64Var(&swapInitiateLockTime, "locktime", 0, "Block height, or unix time from 500000000 on, from which the contract can be refunded (default 48 hours from now)")
+	swapInitiateCmd.Flags().IntVar(&swapInitiateFee, "fee", 0, "Fee paid to the block producer, on top of the amount")
+	swapInitiateCmd.Flags().StringVar(&swapInitiateNode, "node", "", "Address (host:port) of a node to send the transaction to")
+	swapInitiateCmd.Flags().StringVar(&swapInitiateReward, "reward", "", "Address for the reward of the block the transaction is added in, without --node")
+	swapInitiateCmd.MarkFlagRequired("from")
+	swapInitiateCmd.MarkFlagRequired("to")
+	swapInitiateCmd.MarkFlagRequired("amount")
+	swapParticipateCmd.Flags().StringVarP(&swapParticipateFrom, "from", "f", "", "Address of ours that pays the contract, and gets it back with a refund")
+	swapParticipateCmd.Flags().StringVarP(&swapParticipateTo, "to", "t", "", "Address of the initiator, who can redeem the contract")
+	swapParticipateCmd.Flags().IntVarP(&swapParticipateAmount, "amount", "a", 0, "Amount paid to the contract")
+	swapParticipateCmd.Flags().StringVar(&swapParticipateSecretHash, "secret-hash", "", "Secret hash of the initiator's contract, in hex")
+	swapParticipateCmd.Flags().Int64Var(&swapParticipateLockTime, "locktime", 0, "Block height, or unix time from 500000000 on, from which the contract can be refunded (default 24 hours from now)")
+	swapParticipateCmd.Flags().Int64Var(&swapParticipateInitiator, "initiator-locktime", 0, "Lock time of the initiator's contract, as swap audit prints it")
+	swapParticipateCmd.Flags().IntVar(&swapParticipateFee, "fee", 0, "Fee paid to the block producer, on top of the amount")
+	swapParticipateCmd.Flags().StringVar(&swapParticipateNode, "node", "", "Address (host:port) of a node to send the transaction to")
+	swapParticipateCmd.Flags().StringVar(&swapParticipateReward, "reward", "", "Address for the reward of the block the transaction is added in, without --node")
+	swapParticipateCmd.MarkFlagRequired("from")
+	swapParticipateCmd.MarkFlagRequired("to")
+	swapParticipateCmd.MarkFlagRequired("amount")
+	swapParticipateCmd.MarkFlagRequired("secret-hash")
+	swapParticipateCmd.MarkFlagRequired("initiator-locktime")
+	swapRedeemCmd.Flags().StringVarP(&swapRedeemContract, "contract", "c", "", "Contract to redeem, as txid:index")
+	swapRedeemCmd.Flags().StringVar(&swapRedeemSecret, "secret", "", "Secret of the contract, in hex")
+	swapRedeemCmd.Flags().IntVar(&swapRedeemFee, "fee", 0, "Fee paid to the block producer, out of the contract")
+	swapRedeemCmd.Flags().StringVar(&swapRedeemNode, "node", "", "Address (host:port) of a node to send the transaction to")
+	swapRedeemCmd.Flags().StringVar(&swapRedeemReward, "reward", "", "Address for the reward of the block the transaction is added in, without --node")
+	swapRedeemCmd.MarkFlagRequired("contract")
+	swapRedeemCmd.MarkFlagRequired("secret")
+	swapRefundCmd.Flags().StringVarP(&swapRefundContract, "contract", "c", "", "Contract to refund, as txid:index")
+	swapRefundCmd.Flags().IntVar(&swapRefundFee, "fee", 0, "Fee paid to the block producer, out of the contract")
+	swapRefundCmd.Flags().StringVar(&swapRefundNode, "node", "", "Address (host:port) of a node to send the transaction to")
+	swapRefundCmd.Flags().StringVar(&swapRefundReward, "reward", "", "Address for the reward of the block the transaction is added in, without --node")
+	swapRefundCmd.MarkFlagRequired("contract")
+	swapAuditCmd.Flags().StringVarP(&swapAuditContract, "contract", "c", "", "Contract to audit, as txid:index")
+	swapAuditCmd.MarkFlagRequired("contract")
+	swapExtractCmd.Flags().StringVarP(&swapExtractContract, "contract", "c", "", "Redeemed contract, as txid:index")
+	swapExtractCmd.Flags().StringVar(&swapExtractSecretHash, "secret-hash", "", "Secret hash of the contract, in hex")
+	swapExtractCmd.MarkFlagRequired("contract")
+	swapExtractCmd.MarkFlagRequired("secret-hash")
+	swapCmd.AddCommand(swapInitiateCmd, swapParticipateCmd, swapRedeemCmd, swapRefundCmd, swapAuditCmd, swapExtractCmd)
+
+	// flags for anchor
+	anchorCmd.Flags().StringVarP(&anchorFrom, "from", "f", "", "Address of ours that pays the fee")
+	anchorCmd.Flags().StringVar(&anchorFile, "file", "", "File to anchor the sha256 of")
+	anchorCmd.Flags().StringVar(&anchorHash, "hash", "", "Hash to anchor, in hex, instead of a file")
+	anchorCmd.Flags().IntVar(&anchorFee, "fee", 0, "Fee paid to the block producer")
+	anchorCmd.Flags().StringVar(&anchorNode, "node", "", "Address (host:port) of a node to send the transaction to")
+	anchorCmd.Flags().StringVar(&anchorReward, "reward", "", "Address for the reward of the block the transaction is added in, without --node")
+	anchorCmd.MarkFlagRequired("from")
+	findAnchorCmd.Flags().StringVar(&findAnchorFile, "file", "", "File to look up the sha256 of")
+	findAnchorCmd.Flags().StringVar(&findAnchorHash, "hash", "", "Hash to look up, in hex, instead of a file")
+
+	// flags for start
+	startServerCmd.Flags().IntVar(&p2p.MempoolSize, "mempool-size", p2p.MempoolSize, "Most MiB of unconfirmed transactions to keep in the mempool")
+
+	// flags for printChain
+	printChainCmd.Flags().StringVar(&printChainFrom, "from", "", "Height or hash of the first block to print (default the tip)")
+	printChainCmd.Flags().StringVar(&printChainTo, "to", "", "Height or hash of the last block to print (default the genesis block)")
+
+	// flags for rewind
+	rewindCmd.Flags().IntVar(&rewindHeight, "height", 0, "Height of the block that will become the new tip")
+	rewindCmd.MarkFlagRequired("height")
+
 	// Add the commands to the root command. This allows them to be executable.
 	rootCmd.AddCommand(printWalletCmd)
 	rootCmd.AddCommand(createWalletCmd)
 	rootCmd.AddCommand(createChainCmd)
+	rootCmd.AddCommand(createGenesisCmd)
 	rootCmd.AddCommand(sendCmd)
+	rootCmd.AddCommand(submitTxCmd)
+	rootCmd.AddCommand(createMultisigCmd)
+	rootCmd.AddCommand(spendMultisigCmd)
+	rootCmd.AddCommand(signMultisigCmd)
+	rootCmd.AddCommand(combineMultisigCmd)
+	rootCmd.AddCommand(swapCmd)
+	rootCmd.AddCommand(anchorCmd)
+	rootCmd.AddCommand(findAnchorCmd)
 	rootCmd.AddCommand(printChainCmd)
 	rootCmd.AddCommand(reindexCmd)
 	rootCmd.AddCommand(getBalanceCmd)
 	rootCmd.AddCommand(startServerCmd)
+	rootCmd.AddCommand(rewindCmd)
+	rootCmd.AddCommand(getTxCmd)
+	rootCmd.AddCommand(addressHistoryCmd)
+	rootCmd.AddCommand(dumpUTXOCmd)
+	rootCmd.AddCommand(loadUTXOCmd)
+}
+
+// selectNetwork points core at the network and data directory from the global flags, before any command runs.
+func selectNetwork() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		if err := core.SelectNetwork(network, dataDir); err != nil {
+			log.Fatal(err)
+		}
+	}
 }
 
 func Execute() {
@@ -1,43 +1,136 @@
 package cmd
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/chezky/blemflarck/core"
+	"github.com/chezky/blemflarck/mempool"
+	"github.com/chezky/blemflarck/p2p"
 	"github.com/spf13/cobra"
 	"log"
+	"strconv"
+	"strings"
 )
 
 var (
-	sendTo string
+	sendTo []string
+	sendFile string
 	sendFrom string
 	sendAmount int
+	sendFee int
+	sendNode string
+	sendCoinSelection string
+	sendLockTime int64
+	sendSequence int
+	sendOut string
 
 	sendCmd = &cobra.Command{
 		Use: "send",
-		Short: "Send blemflarcks from one address to another",
-		Long: "Create a transfer between address A to address B.",
+		Short: "Send blemflarcks from one address to others",
+		Long: "Create a transfer from address A to one or more addresses, with --to addr:amount for each, or a CSV or JSON file of payments. The transaction goes through a mempool and into a new block, or to the mempool of a running node with --node. A transaction with a --locktime that isn't past yet can be written to a file with --out, and submitted with submit-tx once it is.",
 		Run: send(),
 	}
 )
 
 func send() func(cmd *cobra.Command, args []string) {
 	return func(cmd *cobra.Command, args []string) {
-		bc, err := core.CreateBlockchain(sendFrom)
+		if !core.CheckValidAddress([]byte(sendFrom)) {
+			log.Fatalf("Please enter a valid %s address to send from!", core.Params.Name)
+		}
+
+		payments, err := parsePayments(sendTo, sendAmount, sendFile)
 		if err != nil {
 			log.Fatal(err)
 		}
-		tx, err := bc.NewTransaction(sendFrom, sendTo, sendAmount)
+
+		selector, err := core.GetCoinSelector(sendCoinSelection)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		cbTX, err := core.NewCoinbaseTransaction(sendFrom)
+		bc, err := core.CreateBlockchain()
 		if err != nil {
 			log.Fatal(err)
 		}
-		if err := bc.AddBlock([]core.Transaction{tx, cbTX}); err != nil {
+		opts := core.TxOptions{Fee: sendFee, CoinSelector: selector, LockTime: sendLockTime, Sequence: sendSequence}
+		tx, err := bc.NewTransaction(sendFrom, payments, opts)
+		if err != nil {
 			log.Fatal(err)
 		}
-		fmt.Printf("Successfully sent %d coins from address: \n%s\n to address: \n%s\n", sendAmount, sendFrom, sendTo)
+
+		if sendOut != "" {
+			if err := writeTxFile(sendOut, tx); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Wrote signed transaction %s to %s\n", hex.EncodeToString(tx.ID), sendOut)
+			return
+		}
+
+		if err := submitTransaction(bc, tx, sendNode, sendFrom); err != nil {
+			log.Fatal(err)
+		}
+		if sendNode != "" {
+			return
+		}
+		fmt.Printf("Successfully sent from address: \n%s\n", sendFrom)
+		for _, p := range payments {
+			fmt.Printf("%d coins to address: \n%s\n", p.Amount, p.Address)
+		}
+	}
+}
+
+// submitTransaction sends a signed transaction to the node at the address node. Without a node, we produce the block ourselves, from a
+// mempool with only this transaction in it, and the reward goes to the address reward.
+func submitTransaction(bc *core.Blockchain, tx core.Transaction, node, reward string) error {
+	if node != "" {
+		if err := p2p.SendTransaction(node, tx); err != nil {
+			return err
+		}
+		fmt.Printf("Sent transaction %s to node %s\n", hex.EncodeToString(tx.ID), node)
+		return nil
+	}
+
+	pool := mempool.New(bc, 0)
+	if _, err := pool.Add(tx); err != nil {
+		return err
+	}
+	txs, fees := pool.Select(0)
+
+	cbTX, err := core.NewCoinbaseTransaction(reward, fees)
+	if err != nil {
+		return err
+	}
+	return bc.AddBlock(append(txs, cbTX))
+}
+
+// parsePayments collects the payments from every --to flag, and from a payments file. A --to without an amount takes the amount from
+// amount.
+func parsePayments(recipients []string, amount int, file string) ([]core.Payment, error) {
+	var payments []core.Payment
+
+	for _, to := range recipients {
+		p := core.Payment{Address: to, Amount: amount}
+		if i := strings.LastIndex(to, ":"); i >= 0 {
+			amount, err := strconv.Atoi(to[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("bad amount in --to %s: %v", to, err)
+			}
+			p = core.Payment{Address: to[:i], Amount: amount}
+		}
+		payments = append(payments, p)
+	}
+
+	if file != "" {
+		filePayments, err := core.ReadPayments(file)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, filePayments...)
+	}
+
+	if len(payments) == 0 {
+		return nil, errors.New("Please enter an address to send to, with --to or --file!")
 	}
+	return payments, nil
 }
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/chezky/blemflarck/core"
+	"github.com/spf13/cobra"
+	"log"
+)
+
+var (
+	submitTxIn     string
+	submitTxNode   string
+	submitTxReward string
+	submitTxCmd    = &cobra.Command{
+		Use:   "submit-tx",
+		Short: "Submit a signed transaction from a file",
+		Long:  "Submit a transaction that was signed ahead of time, like one written by send --out, to a node with --node, or in a new block that pays its reward to --reward",
+		Run:   submitTx(),
+	}
+)
+
+func submitTx() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		tx, err := readTxFile(submitTxIn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if submitTxNode == "" && !core.CheckValidAddress([]byte(submitTxReward)) {
+			log.Fatalf("Please enter a valid %s address for the block reward with --reward, or a node with --node!", core.Params.Name)
+		}
+
+		bc, err := core.CreateBlockchain()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := submitTransaction(bc, tx, submitTxNode, submitTxReward); err != nil {
+			log.Fatal(err)
+		}
+		if submitTxNode == "" {
+			fmt.Printf("Successfully added transaction %s in a new block\n", hex.EncodeToString(tx.ID))
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/chezky/blemflarck/core"
+	"github.com/spf13/cobra"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	swapCmd = &cobra.Command{
+		Use:   "swap",
+		Short: "Swap coins with another chain through hash time-locked contracts",
+		Long:  "Atomic swaps with another chain. The initiator pays the participant to a contract with swap initiate, the participant checks it with swap audit and pays back to a contract with the same secret hash with swap participate. The initiator then redeems the participant's contract, which shows the secret, and the participant takes the secret with swap extract-secret to redeem the initiator's contract. Either side can swap refund its own contract once its lock time is past",
+	}
+
+	swapInitiateFrom     string
+	swapInitiateTo       string
+	swapInitiateAmount   int
+	swapInitiateLockTime int64
+	swapInitiateFee      int
+	swapInitiateNode     string
+	swapInitiateReward   string
+	swapInitiateCmd      = &cobra.Command{
+		Use:   "initiate",
+		Short: "Start a swap by paying the participant to a new contract",
+		Long:  "Make up a secret, and pay --amount from --from to a contract that --to can redeem with the secret, or --from can refund after --locktime. Keep the secret to yourself until the participant paid you back with swap participate",
+		Run:   swapInitiate(),
+	}
+
+	swapParticipateFrom       string
+	swapParticipateTo         string
+	swapParticipateAmount     int
+	swapParticipateSecretHash string
+	swapParticipateLockTime   int64
+	swapParticipateInitiator  int64
+	swapParticipateFee        int
+	swapParticipateNode       string
+	swapParticipateReward     string
+	swapParticipateCmd        = &cobra.Command{
+		Use:   "participate",
+		Short: "Join a swap by paying the initiator to a contract with the same secret hash",
+		Long:  "Pay --amount from --from to a contract that --to can redeem with the secret of --secret-hash, or --from can refund after --locktime. The lock time has to be well before --initiator-locktime, the lock time of the initiator's contract that swap audit prints",
+		Run:   swapParticipate(),
+	}
+
+	swapRedeemContract string
+	swapRedeemSecret   string
+	swapRedeemFee      int
+	swapRedeemNode     string
+	swapRedeemReward   string
+	swapRedeemCmd      = &cobra.Command{
+		Use:   "redeem",
+		Short: "Redeem a contract with its secret",
+		Long:  "Spend the contract --contract to our wallet it pays to, with the --secret behind its secret hash",
+		Run:   swapRedeem(),
+	}
+
+	swapRefundContract string
+	swapRefundFee      int
+	swapRefundNode     string
+	swapRefundReward   string
+	swapRefundCmd      = &cobra.Command{
+		Use:   "refund",
+		Short: "Refund a contract once its lock time is past",
+		Long:  "Spend the contract --contract back to our wallet that paid it, once its lock time is past and it wasn't redeemed",
+		Run:   swapRefund(),
+	}
+
+	swapAuditContract string
+	swapAuditCmd      = &cobra.Command{
+		Use:   "audit",
+		Short: "Print the terms of a contract",
+		Long:  "Print the amount, addresses, lock time and secret hash of the contract --contract, to check it before paying back, or before redeeming it",
+		Run:   swapAudit(),
+	}
+
+	swapExtractContract   string
+	swapExtractSecretHash string
+	swapExtractCmd        = &cobra.Command{
+		Use:   "extract-secret",
+		Short: "Find the secret in the transaction that redeemed a contract",
+		Long:  "Find the transaction on the main chain that redeemed the contract --contract, and print the secret behind --secret-hash that it shows",
+		Run:   swapExtractSecret(),
+	}
+)
+
+func swapInitiate() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		secret, secretHash, err := core.NewSecret()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		lockTime := swapInitiateLockTime
+		if lockTime == 0 {
+			lockTime = time.Now().Add(48 * time.Hour).Unix()
+		}
+
+		txID := fundContract(swapInitiateFrom, swapInitiateTo, swapInitiateAmount, secretHash, lockTime, swapInitiateFee, swapInitiateNode, swapInitiateReward)
+
+		fmt.Printf("Secret:      %x\n", secret)
+		fmt.Printf("Secret hash: %x\n", secretHash)
+		fmt.Printf("Contract:    %x:0\n", txID)
+		fmt.Printf("Refundable:  %s\n", core.FormatLockTime(lockTime))
+	}
+}
+
+func swapParticipate() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		secretHash, err := hex.DecodeString(swapParticipateSecretHash)
+		if err != nil {
+			log.Fatalf("%s is not a hex secret hash!", swapParticipateSecretHash)
+		}
+
+		lockTime := swapParticipateLockTime
+		if lockTime == 0 {
+			lockTime = time.Now().Add(24 * time.Hour).Unix()
+		}
+		if err := core.CheckSwapLockTimes(lockTime, swapParticipateInitiator); err != nil {
+			log.Fatal(err)
+		}
+
+		txID := fundContract(swapParticipateFrom, swapParticipateTo, swapParticipateAmount, secretHash, lockTime, swapParticipateFee, swapParticipateNode, swapParticipateReward)
+
+		fmt.Printf("Contract:    %x:0\n", txID)
+		fmt.Printf("Refundable:  %s\n", core.FormatLockTime(lockTime))
+	}
+}
+
+func swapRedeem() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		txID, index := parseContract(swapRedeemContract)
+		secret, err := hex.DecodeString(swapRedeemSecret)
+		if err != nil {
+			log.Fatalf("%s is not a hex secret!", swapRedeemSecret)
+		}
+		checkSubmitFlags(swapRedeemNode, swapRedeemReward)
+
+		bc, err := core.CreateBlockchain()
+		if err != nil {
+			log.Fatal(err)
+		}
+		tx, err := bc.RedeemHTLC(txID, index, secret, swapRedeemFee)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := submitTransaction(bc, tx, swapRedeemNode, swapRedeemReward); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Redeemed contract %s in transaction %x\n", swapRedeemContract, tx.ID)
+	}
+}
+
+func swapRefund() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		txID, index := parseContract(swapRefundContract)
+		checkSubmitFlags(swapRefundNode, swapRefundReward)
+
+		bc, err := core.CreateBlockchain()
+		if err != nil {
+			log.Fatal(err)
+		}
+		tx, err := bc.RefundHTLC(txID, index, swapRefundFee)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := submitTransaction(bc, tx, swapRefundNode, swapRefundReward); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Refunded contract %s in transaction %x\n", swapRefundContract, tx.ID)
+	}
+}
+
+func swapAudit() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		txID, index := parseContract(swapAuditContract)
+
+		bc, err := core.CreateBlockchain()
+		if err != nil {
+			log.Fatal(err)
+		}
+		h, uo, err := core.UTXO{Blockchain: bc}.GetHTLC(txID, index)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		remaining, err := bc.LockTimeRemaining(h.LockTime)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Amount:      %d\n", uo.Output.Value)
+		fmt.Printf("Recipient:   %s\n", core.AddressFromPubKeyHash(h.Recipient))
+		fmt.Printf("Refund to:   %s\n", core.AddressFromPubKeyHash(h.Refund))
+		fmt.Printf("Secret hash: %x\n", h.SecretHash)
+		fmt.Printf("Refundable:  %s, %s\n", core.FormatLockTime(h.LockTime), remaining)
+		fmt.Printf("Lock time:   %d\n", h.LockTime)
+		fmt.Printf("Confirmed:   block #%d\n", uo.BlockHeight)
+	}
+}
+
+func swapExtractSecret() func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		txID, index := parseContract(swapExtractContract)
+		secretHash, err := hex.DecodeString(swapExtractSecretHash)
+		if err != nil {
+			log.Fatalf("%s is not a hex secret hash!", swapExtractSecretHash)
+		}
+
+		bc, err := core.CreateBlockchain()
+		if err != nil {
+			log.Fatal(err)
+		}
+		tx, err := bc.FindSpendingTransaction(txID, index)
+		if err != nil {
+			log.Fatal(err)
+		}
+		secret, err := core.ExtractSecret(tx, secretHash)
+		if err != nil {
+			log.Fatalf("Contract %s was spent in transaction %x, but not with the secret, it was likely refunded", swapExtractContract, tx.ID)
+		}
+
+		fmt.Printf("Secret: %x\n", secret)
+	}
+}
+
+// fundContract pays amount from the address from to a new contract, and submits it. It returns the ID of the transaction, the contract is
+// its first output.
+func fundContract(from, to string, amount int, secretHash []byte, lockTime int64, fee int, node, reward string) []byte {
+	checkSubmitFlags(node, reward)
+
+	h, err := core.NewHTLC(secretHash, to, from, lockTime)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bc, err := core.CreateBlockchain()
+	if err != nil {
+		log.Fatal(err)
+	}
+	tx, err := bc.NewHTLCTransaction(from, h, amount, core.TxOptions{Fee: fee})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := submitTransaction(bc, tx, node, reward); err != nil {
+		log.Fatal(err)
+	}
+	return tx.ID
+}
+
+// parseContract parses a contract in the form txid:index.
+func parseContract(contract string) ([]byte, int) {
+	i := strings.LastIndex(contract, ":")
+	if i < 0 {
+		log.Fatalf("Please enter the contract as txid:index, not %s!", contract)
+	}
+	txID, err := hex.DecodeString(contract[:i])
+	if err != nil {
+		log.Fatalf("%s is not a hex transaction ID!", contract[:i])
+	}
+	index, err := strconv.Atoi(contract[i+1:])
+	if err != nil {
+		log.Fatalf("%s is not an output index!", contract[i+1:])
+	}
+	return txID, index
+}
+
+// checkSubmitFlags makes sure a transaction can be submitted, either to a node, or in a new block with a reward address.
+func checkSubmitFlags(node, reward string) {
+	if node == "" && !core.CheckValidAddress([]byte(reward)) {
+		log.Fatalf("Please enter a valid %s address for the block reward with --reward, or a node with --node!", core.Params.Name)
+	}
+}
@@ -8,6 +8,8 @@ import (
 )
 
 var (
+	printWalletsPubKeys bool
+
 	createWalletCmd = &cobra.Command{
 		Use: "create-wallet",
 		Short: "create a new blemflarck wallet",
@@ -52,8 +54,17 @@ func printWallets() func(cmd *cobra.Command, args []string) {
 		}
 
 		idx := 1
-		for add, _ := range wallets.Wallets {
+		for add, wallet := range wallets.Wallets {
 			fmt.Printf("Wallet #%d address is: %s\n", idx, add)
+			if printWalletsPubKeys {
+				fmt.Printf("  public key: %x\n", wallet.PublicKey)
+			}
+			idx++
+		}
+
+		idx = 1
+		for add, script := range wallets.Multisig {
+			fmt.Printf("Multisig #%d address is: %s, %d-of-%d\n", idx, add, script.Required, len(script.PubKeys))
 			idx++
 		}
 	}
@@ -0,0 +1,249 @@
+// AddrIndex Bucket
+
+// 20-byte public key hash + 8-byte block height + 4-byte transaction position + 1-byte kind + 4-byte index : AddressEntry
+//
+// The keys of one address are sorted by height, then by where the transaction is in its block, so the history of an address is a
+// single range of keys, oldest first.
+
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+)
+
+// The address index records every output an address received, and every input that spent one of its outputs, on the main chain. Like
+// the transaction index it is optional, and once the bucket exists it is kept up to date whenever a block is connected or disconnected,
+// see BuildAddrIndex. Spending an output doesn't say who owned it, so the spent side is indexed from the undo data of the block.
+
+const (
+	addrIndexBucket = "addrindex"
+	// pubKeyHashLen is the length of a RIPEMD160 public key hash.
+	pubKeyHashLen = 20
+)
+
+const (
+	// EntrySpent is an entry for an input that spent an output of the address.
+	EntrySpent byte = 0
+	// EntryReceived is an entry for an output that was sent to the address.
+	EntryReceived byte = 1
+)
+
+var (
+	// BuildAddrIndex is set to build the address index when the chain is opened, if it doesn't exist yet.
+	BuildAddrIndex bool
+	// ErrNoAddrIndex is returned when looking up the history of an address while the address index isn't enabled.
+	ErrNoAddrIndex = errors.New("ERROR: the address index is not enabled, run with --addrindex to build it")
+)
+
+// AddressEntry is a single payment to or from an address.
+type AddressEntry struct {
+	Height        int    // Height is the height of the block the transaction is in.
+	Timestamp     int64  // Timestamp is the time of that block.
+	TransactionID []byte // TransactionID is the ID of the transaction that received or spent.
+	Kind          byte   // Kind is either EntryReceived or EntrySpent.
+	Index         int    // Index is the index of the output that was received, or of the input that spent.
+	Value         int    // Value is the amount that was received or spent.
+	PrevTxID      []byte // PrevTxID is the transaction of the output that was spent. Only set for EntrySpent.
+	PrevIndex     int    // PrevIndex is the index of the output that was spent. Only set for EntrySpent.
+}
+
+// FormatA formats the address index key of an entry, see the bucket description at the top of this file.
+func FormatA(pubKeyHash []byte, height, txPos int, kind byte, index int) []byte {
+	key := make([]byte, pubKeyHashLen+17)
+	copy(key, pubKeyHash)
+	binary.BigEndian.PutUint64(key[pubKeyHashLen:], uint64(height))
+	binary.BigEndian.PutUint32(key[pubKeyHashLen+8:], uint32(txPos))
+	key[pubKeyHashLen+12] = kind
+	binary.BigEndian.PutUint32(key[pubKeyHashLen+13:], uint32(index))
+	return key
+}
+
+// encodeEntry encodes the value of an address index entry with the canonical encoding. Height, Kind and Index are already in the key.
+//   bytes TransactionID | int64 Timestamp | int64 Value | bytes PrevTxID | int32 PrevIndex
+func (ae AddressEntry) encodeEntry() []byte {
+	var e encoder
+	e.writeBytes(ae.TransactionID)
+	e.writeInt64(ae.Timestamp)
+	e.writeInt64(int64(ae.Value))
+	e.writeBytes(ae.PrevTxID)
+	e.writeInt32(int32(ae.PrevIndex))
+	return e.buff.Bytes()
+}
+
+// decodeEntry decodes an address index entry from its key and value.
+func decodeEntry(key, value []byte) (AddressEntry, error) {
+	var ae AddressEntry
+
+	if len(key) != pubKeyHashLen+17 {
+		return ae, fmt.Errorf("ERROR: address index key of length %d", len(key))
+	}
+	ae.Height = int(binary.BigEndian.Uint64(key[pubKeyHashLen:]))
+	ae.Kind = key[pubKeyHashLen+12]
+	ae.Index = int(binary.BigEndian.Uint32(key[pubKeyHashLen+13:]))
+
+	d := newDecoder(value)
+	ae.TransactionID = d.readBytes()
+	ae.Timestamp = d.readInt64()
+	ae.Value = int(d.readInt64())
+	ae.PrevTxID = d.readBytes()
+	ae.PrevIndex = int(d.readInt32())
+
+	return ae, d.finish()
+}
+
+// addressEntries lists the address index entries of a block, along with their keys. undo is the undo data of the block, which has the
+// outputs the block spent.
+func addressEntries(block Block, undo BlockUndo) ([][]byte, []AddressEntry) {
+	var (
+		keys    [][]byte
+		entries []AddressEntry
+	)
+
+	for txPos, tx := range block.Transactions {
+		if txPos < len(undo.Transactions) {
+			for inIdx, spent := range undo.Transactions[txPos].Spent {
+				keys = append(keys, FormatA(spent.Output.PubKeyHash, block.Height, txPos, EntrySpent, inIdx))
+				entries = append(entries, AddressEntry{
+					Height:        block.Height,
+					Timestamp:     block.Timestamp,
+					TransactionID: tx.ID,
+					Kind:          EntrySpent,
+					Index:         inIdx,
+					Value:         spent.Output.Value,
+					PrevTxID:      spent.TransactionID,
+					PrevIndex:     spent.Index,
+				})
+			}
+		}
+
+		for outIdx, out := range tx.Vout {
+			// data outputs don't belong to anyone, see anchor.go
+			if out.IsData() {
+				continue
+			}
+			keys = append(keys, FormatA(out.PubKeyHash, block.Height, txPos, EntryReceived, outIdx))
+			entries = append(entries, AddressEntry{
+				Height:        block.Height,
+				Timestamp:     block.Timestamp,
+				TransactionID: tx.ID,
+				Kind:          EntryReceived,
+				Index:         outIdx,
+				Value:         out.Value,
+				PrevIndex:     -1,
+			})
+		}
+	}
+
+	return keys, entries
+}
+
+// indexAddresses adds the entries of a block that was just connected to the address index, if it is enabled.
+func indexAddresses(dbTX *bolt.Tx, block Block, undo BlockUndo) error {
+	b := dbTX.Bucket([]byte(addrIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	keys, entries := addressEntries(block, undo)
+	for i, key := range keys {
+		if err := b.Put(key, entries[i].encodeEntry()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexAddresses removes the entries of a block that was just disconnected from the address index, if it is enabled.
+func unindexAddresses(dbTX *bolt.Tx, block Block, undo BlockUndo) error {
+	b := dbTX.Bucket([]byte(addrIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	keys, _ := addressEntries(block, undo)
+	for _, key := range keys {
+		if err := b.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// buildAddrIndex creates the address index, and fills it with every block on the main chain.
+func (bc *Blockchain) buildAddrIndex() error {
+	if err := bc.checkNotPruned(); err != nil {
+		return err
+	}
+
+	tipHeight, err := bc.GetChainHeight()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("building the address index, this could take a bit of time...\n")
+
+	return bc.DB.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte(addrIndexBucket)); err != nil {
+			fmt.Printf("error creating %s bucket: %v\n", addrIndexBucket, err)
+			return err
+		}
+
+		blocks := tx.Bucket([]byte(blocksBucket))
+		for height := 0; height <= int(tipHeight); height++ {
+			blk, err := readMainBlock(blocks, height)
+			if err != nil {
+				return err
+			}
+			undo, err := getBlockUndo(tx, blk.Hash)
+			if err != nil {
+				return err
+			}
+			if err := indexAddresses(tx, blk, undo); err != nil {
+				fmt.Printf("error indexing addresses of block #%d: %v\n", height, err)
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// AddressHistory returns the entries of the address with this public key hash, oldest first. It skips the first offset entries and
+// returns at most limit of them, along with the total number of entries of the address.
+func (bc Blockchain) AddressHistory(pubKeyHash []byte, offset, limit int) ([]AddressEntry, int, error) {
+	var (
+		entries []AddressEntry
+		total   int
+	)
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(addrIndexBucket))
+		if b == nil {
+			return ErrNoAddrIndex
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(pubKeyHash); k != nil && len(k) > pubKeyHashLen && string(k[:pubKeyHashLen]) == string(pubKeyHash); k, v = c.Next() {
+			if total >= offset && len(entries) < limit {
+				entry, err := decodeEntry(k, v)
+				if err != nil {
+					return err
+				}
+				entries = append(entries, entry)
+			}
+			total++
+		}
+
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("error reading address history: %v\n", err)
+	}
+
+	return entries, total, err
+}
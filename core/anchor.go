@@ -0,0 +1,265 @@
+// AnchorIndex Bucket
+
+// 1-byte data length + data + 8-byte block height + 4-byte transaction position + 4-byte output index : AnchorEntry
+//
+// The keys of the same data are sorted by height, so the first anchor of a hash is the first key of its range.
+
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+)
+
+// Data outputs and anchors
+
+// A data output carries up to maxDataSize bytes of data instead of value. Its locking script is OpReturn followed by a single push of the
+// data, so it fails before it ever gets to the data, and no unlocking script can spend it. Since it can never be spent it never enters the
+// chainstate, and it always has a value of 0.
+//
+// Data outputs are used to anchor the hash of a file on the chain: the block the hash is in proves the file existed by the time of that
+// block. The anchor index records every data output on the main chain by its data, so the block that anchored a hash can be looked up.
+// Like the address index it is optional, and once the bucket exists it is kept up to date whenever a block is connected or disconnected,
+// see BuildAnchorIndex.
+
+const (
+	anchorIndexBucket = "anchorindex"
+	// maxDataSize is the most bytes a data output can carry, enough for a sha512 hash and a bit of context.
+	maxDataSize = 80
+)
+
+var (
+	// BuildAnchorIndex is set to build the anchor index when the chain is opened, if it doesn't exist yet.
+	BuildAnchorIndex bool
+	// ErrNoAnchorIndex is returned when looking up an anchor while the anchor index isn't enabled.
+	ErrNoAnchorIndex = errors.New("ERROR: the anchor index is not enabled, run with --anchorindex to build it")
+)
+
+// AnchorEntry is a single data output on the main chain.
+type AnchorEntry struct {
+	Data          []byte // Data is what the output carries.
+	Height        int    // Height is the height of the block the transaction is in.
+	BlockHash     []byte // BlockHash is the hash of that block.
+	Timestamp     int64  // Timestamp is the time of that block.
+	TransactionID []byte // TransactionID is the ID of the transaction with the output.
+	Index         int    // Index is the index of the output on its transaction.
+}
+
+// NewDataOutput creates an output that carries data, see the description at the top of this file.
+func NewDataOutput(data []byte) (Output, error) {
+	if len(data) == 0 || len(data) > maxDataSize {
+		return Output{}, fmt.Errorf("ERROR: data output carries %d bytes, it has to be between 1 and %d", len(data), maxDataSize)
+	}
+
+	var sb ScriptBuilder
+	return NewScriptOutput(0, sb.AddOp(OpReturn).AddData(data).Script())
+}
+
+// IsData checks if an output is a data output. Any script that starts with OpReturn can never be spent.
+func (out Output) IsData() bool {
+	return len(out.Script) > 0 && out.Script[0] == OpReturn
+}
+
+// Data returns the data a data output carries, or nil if it isn't a well formed data output.
+func (out Output) Data() []byte {
+	if !out.IsData() {
+		return nil
+	}
+	ops, err := parseScript(out.Script)
+	if err != nil || len(ops) != 2 || !ops[1].isPush() {
+		return nil
+	}
+	return ops[1].data
+}
+
+// checkData makes sure a data output carries a single push of at most maxDataSize bytes, and no value.
+func (out Output) checkData() error {
+	if out.Value != 0 {
+		return fmt.Errorf("ERROR: data output has a value of %d, it can't be spent so it has to be 0", out.Value)
+	}
+	data := out.Data()
+	if len(data) == 0 || len(data) > maxDataSize {
+		return fmt.Errorf("ERROR: data output has to push between 1 and %d bytes after OpReturn", maxDataSize)
+	}
+	return nil
+}
+
+// NewAnchorTransaction creates and signs a transaction that anchors data from one of our wallets. The data output is always the first
+// output, and the fee comes out of the wallet.
+func (bc *Blockchain) NewAnchorTransaction(from string, data []byte, opts TxOptions) (Transaction, error) {
+	return bc.NewTransaction(from, []Payment{{Data: data}}, opts)
+}
+
+// FormatN formats the anchor index key of a data output, see the bucket description at the top of this file.
+func FormatN(data []byte, height, txPos, index int) []byte {
+	key := make([]byte, 1+len(data)+16)
+	key[0] = byte(len(data))
+	copy(key[1:], data)
+	binary.BigEndian.PutUint64(key[1+len(data):], uint64(height))
+	binary.BigEndian.PutUint32(key[1+len(data)+8:], uint32(txPos))
+	binary.BigEndian.PutUint32(key[1+len(data)+12:], uint32(index))
+	return key
+}
+
+// encodeAnchor encodes the value of an anchor index entry with the canonical encoding. Data, Height and Index are already in the key.
+//   bytes BlockHash | int64 Timestamp | bytes TransactionID
+func (ae AnchorEntry) encodeAnchor() []byte {
+	var e encoder
+	e.writeBytes(ae.BlockHash)
+	e.writeInt64(ae.Timestamp)
+	e.writeBytes(ae.TransactionID)
+	return e.buff.Bytes()
+}
+
+// decodeAnchor decodes an anchor index entry from its key and value.
+func decodeAnchor(key, value []byte) (AnchorEntry, error) {
+	var ae AnchorEntry
+
+	if len(key) < 1 || len(key) != 1+int(key[0])+16 {
+		return ae, fmt.Errorf("ERROR: anchor index key of length %d", len(key))
+	}
+	dataLen := int(key[0])
+	ae.Data = append([]byte{}, key[1:1+dataLen]...)
+	ae.Height = int(binary.BigEndian.Uint64(key[1+dataLen:]))
+	ae.Index = int(binary.BigEndian.Uint32(key[1+dataLen+12:]))
+
+	d := newDecoder(value)
+	ae.BlockHash = d.readBytes()
+	ae.Timestamp = d.readInt64()
+	ae.TransactionID = d.readBytes()
+
+	return ae, d.finish()
+}
+
+// anchorEntries lists the anchor index entries of a block, along with their keys.
+func anchorEntries(block Block) ([][]byte, []AnchorEntry) {
+	var (
+		keys    [][]byte
+		entries []AnchorEntry
+	)
+
+	for txPos, tx := range block.Transactions {
+		for outIdx, out := range tx.Vout {
+			data := out.Data()
+			if data == nil {
+				continue
+			}
+			keys = append(keys, FormatN(data, block.Height, txPos, outIdx))
+			entries = append(entries, AnchorEntry{
+				Data:          data,
+				Height:        block.Height,
+				BlockHash:     block.Hash,
+				Timestamp:     block.Timestamp,
+				TransactionID: tx.ID,
+				Index:         outIdx,
+			})
+		}
+	}
+
+	return keys, entries
+}
+
+// indexAnchors adds the data outputs of a block that was just connected to the anchor index, if it is enabled.
+func indexAnchors(dbTX *bolt.Tx, block Block) error {
+	b := dbTX.Bucket([]byte(anchorIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	keys, entries := anchorEntries(block)
+	for i, key := range keys {
+		if err := b.Put(key, entries[i].encodeAnchor()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexAnchors removes the data outputs of a block that was just disconnected from the anchor index, if it is enabled.
+func unindexAnchors(dbTX *bolt.Tx, block Block) error {
+	b := dbTX.Bucket([]byte(anchorIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	keys, _ := anchorEntries(block)
+	for _, key := range keys {
+		if err := b.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// buildAnchorIndex creates the anchor index, and fills it with every block on the main chain.
+func (bc *Blockchain) buildAnchorIndex() error {
+	if err := bc.checkNotPruned(); err != nil {
+		return err
+	}
+
+	tipHeight, err := bc.GetChainHeight()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("building the anchor index, this could take a bit of time...\n")
+
+	return bc.DB.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte(anchorIndexBucket)); err != nil {
+			fmt.Printf("error creating %s bucket: %v\n", anchorIndexBucket, err)
+			return err
+		}
+
+		blocks := tx.Bucket([]byte(blocksBucket))
+		for height := 0; height <= int(tipHeight); height++ {
+			blk, err := readMainBlock(blocks, height)
+			if err != nil {
+				return err
+			}
+			if err := indexAnchors(tx, blk); err != nil {
+				fmt.Printf("error indexing anchors of block #%d: %v\n", height, err)
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// FindAnchors returns every data output on the main chain that carries exactly data, oldest first.
+func (bc Blockchain) FindAnchors(data []byte) ([]AnchorEntry, error) {
+	var entries []AnchorEntry
+
+	if len(data) == 0 || len(data) > maxDataSize {
+		return nil, fmt.Errorf("ERROR: anchors carry between 1 and %d bytes, not %d", maxDataSize, len(data))
+	}
+	prefix := append([]byte{byte(len(data))}, data...)
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(anchorIndexBucket))
+		if b == nil {
+			return ErrNoAnchorIndex
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			entry, err := decodeAnchor(k, v)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("error looking up anchors: %v\n", err)
+	}
+
+	return entries, err
+}
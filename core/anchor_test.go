@@ -0,0 +1,158 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestDataOutputs(t *testing.T) {
+	tx := testTransactions()[1].tx
+
+	dataOutput := func(value int, script []byte) Output {
+		hash, err := HashPublicKey(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Output{Value: value, PubKeyHash: hash, Script: script}
+	}
+
+	tests := []struct {
+		name string
+		out  Output
+		want string
+	}{
+		{name: "data", out: dataOutput(0, new(ScriptBuilder).AddOp(OpReturn).AddData(fill(0xab, 64)).Script())},
+		{name: "most data", out: dataOutput(0, new(ScriptBuilder).AddOp(OpReturn).AddData(fill(0xab, maxDataSize)).Script())},
+		{
+			name: "value",
+			out:  dataOutput(5, new(ScriptBuilder).AddOp(OpReturn).AddData(fill(0xab, 64)).Script()),
+			want: "has a value of 5",
+		},
+		{name: "no data", out: dataOutput(0, new(ScriptBuilder).AddOp(OpReturn).Script()), want: "has to push between 1 and"},
+		{
+			name: "too much data",
+			out:  dataOutput(0, new(ScriptBuilder).AddOp(OpReturn).AddData(fill(0xab, maxDataSize+1)).Script()),
+			want: "has to push between 1 and",
+		},
+		{
+			name: "two pushes",
+			out:  dataOutput(0, new(ScriptBuilder).AddOp(OpReturn).AddData(fill(0xab, 8)).AddData(fill(0xcd, 8)).Script()),
+			want: "has to push between 1 and",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := tx
+			tx.Vout = append([]Output{tt.out}, tx.Vout...)
+			tx.ID, _ = tx.Hash()
+			checkError(t, tx.CheckTransaction(), tt.want)
+		})
+	}
+
+	for _, size := range []int{0, maxDataSize + 1} {
+		if _, err := NewDataOutput(fill(0xab, size)); err == nil {
+			t.Errorf("NewDataOutput made an output with %d bytes of data", size)
+		}
+	}
+}
+
+func TestAnchorIndex(t *testing.T) {
+	BuildAnchorIndex = true
+	tc := func() testChain {
+		defer func() { BuildAnchorIndex = false }()
+		return newTestChain(t)
+	}()
+
+	// anchor pays a fee of 1 out of the wallet of the chain, with a data output for each of data
+	anchor := func(data ...[]byte) Transaction {
+		var payments []Payment
+		for _, d := range data {
+			payments = append(payments, Payment{Data: d})
+		}
+		tx, err := tc.buildTransaction(tc.address, tc.wallet.PublicKey, payments, TxOptions{Fee: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := (UTXO{Blockchain: tc.Blockchain}).SignTransaction(tx, tc.wallet.PrivateKey); err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+
+	hash, other := fill(0xab, 64), []byte("another file")
+	first := anchor(hash)
+	firstBlock := tc.mine(t, 1, first)
+	second := anchor(other, hash)
+	secondBlock := tc.mine(t, 1, second)
+
+	entry := func(block Block, tx Transaction, data []byte, index int) AnchorEntry {
+		return AnchorEntry{Data: data, Height: block.Height, BlockHash: block.Hash, Timestamp: block.Timestamp, TransactionID: tx.ID, Index: index}
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want []AnchorEntry
+		err  string
+	}{
+		{name: "anchored twice", data: hash, want: []AnchorEntry{entry(firstBlock, first, hash, 0), entry(secondBlock, second, hash, 1)}},
+		{name: "anchored once", data: other, want: []AnchorEntry{entry(secondBlock, second, other, 0)}},
+		{name: "prefix of anchored data", data: hash[:32]},
+		{name: "never anchored", data: []byte("nothing")},
+		{name: "no data", data: nil, err: "anchors carry between 1 and"},
+		{name: "too much data", data: fill(0xab, maxDataSize+1), err: "anchors carry between 1 and"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := tc.FindAnchors(tt.data)
+			checkError(t, err, tt.err)
+			checkAnchors(t, entries, tt.want)
+		})
+	}
+
+	t.Run("data output can't be spent", func(t *testing.T) {
+		spend := Transaction{
+			Vin:       []Input{{TransactionID: first.ID, OutputIndex: 0, PubKey: tc.wallet.PublicKey, Signature: fill(0x01, 64)}},
+			Vout:      []Output{CreateOutput(tc.address, 1)},
+			Timestamp: time.Now().Unix(),
+		}
+		spend.ID, _ = spend.Hash()
+		checkError(t, tc.ValidateBlock(tc.nextBlock(t, 0, spend)), "spent or doesn't exist")
+	})
+
+	t.Run("disconnected block", func(t *testing.T) {
+		if err := tc.RewindTo(firstBlock.Height); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := tc.FindAnchors(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkAnchors(t, entries, []AnchorEntry{entry(firstBlock, first, hash, 0)})
+	})
+
+	t.Run("index not enabled", func(t *testing.T) {
+		_, err := newTestChain(t).FindAnchors(hash)
+		if err != ErrNoAnchorIndex {
+			t.Errorf("got %v, want %v", err, ErrNoAnchorIndex)
+		}
+	})
+}
+
+// checkAnchors fails the test unless entries are want, in the same order.
+func checkAnchors(t *testing.T, entries, want []AnchorEntry) {
+	t.Helper()
+
+	if len(entries) != len(want) {
+		t.Fatalf("found %d anchors, want %d", len(entries), len(want))
+	}
+	for i, got := range entries {
+		w := want[i]
+		if !bytes.Equal(got.Data, w.Data) || got.Height != w.Height || !bytes.Equal(got.BlockHash, w.BlockHash) ||
+			got.Timestamp != w.Timestamp || !bytes.Equal(got.TransactionID, w.TransactionID) || got.Index != w.Index {
+			t.Errorf("anchor %d is %+v, want %+v", i, got, w)
+		}
+	}
+}
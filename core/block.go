@@ -1,7 +1,14 @@
 // Blocks Bucket
 
-// 'b' + 64-byte block hash : block height of that block hash
+// 'b' + 64-byte block hash : index of the block, its height and where it is stored in the block files, see blockstore.go
+// 'h' + 8-byte block height : hash of the main chain block at that height
 // 'l' : block height of latest block
+// 'f' : number of the block file that blocks are currently appended to
+// 'x' + 64-byte block hash : set if the block failed validation
+// 'p' : block height of the highest block that was pruned, see prune.go
+// 'v' : version of the on disk format, see migrate.go
+
+// Every known block has a 'b' entry, whether it is on the main chain or on a side branch. Only main chain blocks have an 'h' entry.
 
 package core
 
@@ -13,7 +20,6 @@ import (
 	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
-	"io/ioutil"
 	"strconv"
 	"time"
 )
@@ -33,15 +39,32 @@ const (
 	blocksBucket = "blocks"
 )
 
+const (
+	// legacyBlockVersion is the version of blocks whose merkle tree only commits to the IDs of their transactions, see merkle.go. Genesis
+	// blocks and blocks from before version 2 keep it, so that their hashes don't change. No other block can have it, see
+	// NetworkParams.MigrationHeight.
+	legacyBlockVersion = 1
+	// blockVersion is the version of the block header rules. Its merkle tree commits to the full transactions.
+	blockVersion = 2
+)
+
+// BlockHeader is everything that describes a block, without its transactions. The transactions are committed to by the MerkleRoot, so
+// the header alone is enough to know which block it is, and to prove a transaction is in it, see merkle.go.
+type BlockHeader struct {
+	Version    int32  // Version is the version of the block header rules, see blockVersion.
+	PrevHash   []byte // PrevHash is the previous blocks hash.
+	MerkleRoot []byte // MerkleRoot is the root of the merkle tree of the transactions in the block, see merkle.go.
+	Timestamp  int64  // Timestamp is the time when the block was created.
+	Height     int    // Height is the index of the block in the blockchain
+	Validator  []byte // Validator is the winner of the Proof of Stake lottery
+	Winner     []byte // Winner is the winner of the random file lottery
+}
+
 //Block is an instance of a single block.
 type Block struct {
-	Timestamp    int64  // Timestamp is the time when the block was created.
-	Hash         []byte // Hash is sha512 64-byte hash of the block. Its unique identifier.
-	PrevHash     []byte // PrevHash is the previous blocks hash.
+	BlockHeader
+	Hash         []byte // Hash is sha512 64-byte hash of the block header. Its unique identifier.
 	Transactions []Transaction
-	Height       int    // Height is the index of the block in the blockchain
-	Validator    []byte // Validator is the winner of the Proof of Stake lottery
-	Winner       []byte // Winner is the winner of the random file lottery
 }
 
 // NewBlock takes the previous block, some data, and then creates a new block
@@ -49,12 +72,16 @@ func NewBlock(PrevBlock Block, TXs []Transaction) (Block, error) {
 	var err error
 
 	block := Block{
-		Timestamp:    time.Now().Unix(),
-		PrevHash:     PrevBlock.Hash,
+		BlockHeader: BlockHeader{
+			Version:   blockVersion,
+			Timestamp: time.Now().Unix(),
+			PrevHash:  PrevBlock.Hash,
+			Height:    PrevBlock.Height + 1,
+		},
 		Transactions: TXs,
-		Height:       PrevBlock.Height + 1,
 	}
 
+	block.MerkleRoot = block.ComputeMerkleRoot()
 	block.Hash, err = block.GenerateHash()
 
 	return block, err
@@ -68,30 +95,11 @@ func (bc *Blockchain) AddBlock(TXs []Transaction) error {
 		err       error
 	)
 
-	utxo := UTXO{Blockchain: bc}
+	chainLock.Lock()
+	defer chainLock.Unlock()
 
-	for _, tx := range TXs {
-		if !tx.IsCoinbase() {
-			verified, err := utxo.VerifyTransaction(tx)
-			if err != nil {
-				return err
-			}
-			if !verified {
-				return errors.New("ERROR: TX is invalid")
-			}
-		}
-	}
-
-	if err := bc.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		lastIdxByte := b.Get([]byte("l"))
-		lastIdx, err := strconv.Atoi(string(lastIdxByte))
-		if err != nil {
-			return err
-		}
-		prevBlock, err = ReadBlockFromFile(lastIdx)
-		return err
-	}); err != nil {
+	prevBlock, err = bc.getTip()
+	if err != nil {
 		fmt.Printf("error getting prev block for AddBLock: %v\n", err)
 		return err
 	}
@@ -102,127 +110,211 @@ func (bc *Blockchain) AddBlock(TXs []Transaction) error {
 		return err
 	}
 
-	err = block.SaveToFile()
-	if err != nil {
-		fmt.Printf("error creating file for block #%d: %v\n", block.Height, err)
+	if err := bc.ValidateBlock(block); err != nil {
+		fmt.Printf("error validating new block #%d: %v\n", block.Height, err)
 		return err
 	}
 
-	if err := bc.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		if err := b.Put(FormatB(block.Hash), []byte(strconv.Itoa(block.Height))); err != nil {
-			return err
-		}
-		if err := b.Put([]byte("l"), []byte(strconv.Itoa(block.Height))); err != nil {
-			return err
-		}
-		return nil
-	}); err != nil {
-		fmt.Printf("error updating db with new block: %v\n", err)
-		return err
+	return bc.connectBlock(block)
+}
+
+// UpdateWithNewBlock updates the blockchain with a new block. Used when receiving a block from another node. A block that extends our
+// tip is validated and connected right away. A block that builds on any other known block is stored on a side branch, and if that branch
+// is now the best chain, the blockchain reorganizes onto it. A block whose parent we have never seen returns ErrOrphanBlock.
+//
+// It returns the blocks that were taken off the main chain, and the blocks that were put on it, both from the lowest up. They are read
+// while the chain is still locked, so they are exactly what this block changed, even if another block comes in right after.
+func (bc *Blockchain) UpdateWithNewBlock(block Block) (disconnected, connected []Block, err error) {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	_, known, err := bc.GetBlockHeight(block.Hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if known {
+		return nil, nil, ErrKnownBlock
 	}
 
-	if err := utxo.Update(block); err != nil {
-		fmt.Printf("error updating UTXO during new block: %v\n", err)
-		return err
+	if err := block.CheckBlock(); err != nil {
+		return nil, nil, err
 	}
 
-	return nil
-}
+	prevHeight, known, err := bc.GetBlockHeight(block.PrevHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !known {
+		return nil, nil, ErrOrphanBlock
+	}
 
-// UpdateWithNewBlock updates the blockchain with a new block. Used when receiving a block from another node.
-func (bc *Blockchain) UpdateWithNewBlock(block Block) error {
-	utxo := UTXO{bc}
+	invalid, err := bc.IsInvalid(block.PrevHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if invalid {
+		if err := bc.markInvalid(block.Hash); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, errors.New("ERROR: block builds on an invalid block")
+	}
+	if block.Height != prevHeight+1 {
+		return nil, nil, fmt.Errorf("ERROR: block #%d does not follow its previous block #%d", block.Height, prevHeight)
+	}
 
-	err := block.SaveToFile()
+	tipHash, err := bc.GetTailHash()
 	if err != nil {
-		fmt.Printf("error creating file for block #%d: %v\n", block.Height, err)
-		return err
+		return nil, nil, err
+	}
+
+	// the common case, the block builds right on top of our chain
+	if bytes.Compare(block.PrevHash, tipHash) == 0 {
+		if err := bc.ValidateBlock(block); err != nil {
+			return nil, nil, err
+		}
+		if err := bc.connectBlock(block); err != nil {
+			return nil, nil, err
+		}
+		return nil, []Block{block}, nil
+	}
+
+	tipHeight, err := bc.GetChainHeight()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := bc.storeBlock(block); err != nil {
+		fmt.Printf("error storing side block #%d: %v\n", block.Height, err)
+		return nil, nil, err
+	}
+
+	if !betterChain(block.Height, int(tipHeight)) {
+		fmt.Printf("stored block #%d %s on a side branch\n", block.Height, hex.EncodeToString(block.Hash))
+		return nil, nil, nil
 	}
 
+	return bc.reorganize(block)
+}
+
+// connectBlock stores a block that builds on the current tip if it isn't stored yet, makes it the new tip, and updates the chainstate
+// with its transactions. All of that happens in a single db transaction, so if the process dies halfway, the block was either connected
+// completely or not at all.
+func (bc *Blockchain) connectBlock(block Block) error {
+	utxo := UTXO{Blockchain: bc}
+
 	if err := bc.DB.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		if err := b.Put(FormatB(block.Hash), []byte(strconv.Itoa(block.Height))); err != nil {
+		if b.Get(FormatB(block.Hash)) == nil {
+			if err := putBlock(b, block); err != nil {
+				fmt.Printf("error storing block #%d: %v\n", block.Height, err)
+				return err
+			}
+		}
+		if err := b.Put(FormatH(block.Height), block.Hash); err != nil {
 			return err
 		}
 		if err := b.Put([]byte("l"), []byte(strconv.Itoa(block.Height))); err != nil {
 			return err
 		}
-		return nil
+		if err := indexBlock(tx, block); err != nil {
+			return err
+		}
+		return utxo.update(tx, block)
 	}); err != nil {
-		fmt.Printf("error updating db with new block: %v\n", err)
+		fmt.Printf("error connecting block #%d: %v\n", block.Height, err)
 		return err
 	}
 
-	if err := utxo.Update(block); err != nil {
-		fmt.Printf("error updating UTXO during new block: %v\n", err)
-		return err
-	}
-
-	return nil
+	return bc.prune()
 }
 
-// EncodeBlock encodes a block to a byte slice, this allows the block to be saved to file.
+// EncodeBlock encodes a block to a byte slice using the canonical encoding, see encoding.go. This allows the block to be saved to file
+// and sent to other nodes.
 func (b Block) EncodeBlock() ([]byte, error) {
-	var buff bytes.Buffer
-
-	enc := gob.NewEncoder(&buff)
-	if err := enc.Encode(b); err != nil {
-		fmt.Printf("error encoding Block: %v\n", err)
-		return nil, err
-	}
-
-	return buff.Bytes(), nil
+	var e encoder
+	b.encode(&e)
+	return e.buff.Bytes(), nil
 }
 
-// DecodeBlock takes in an encoded block, decodes it, and then returns the block.
+// DecodeBlock takes in an encoded block, decodes it, and then returns the block. Blocks that were saved before the canonical encoding
+// existed are still gob encoded, those get decoded as they are. They can only be used by migrate.go.
 func DecodeBlock(data []byte) (Block, error) {
-	var block Block
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	err := dec.Decode(&block)
-	if err != nil {
+	if isLegacyGob(data) {
+		return decodeLegacyBlock(data)
+	}
+
+	d := newDecoder(data)
+	block := decodeBlock(d)
+	if err := d.finish(); err != nil {
 		fmt.Printf("error decoding block, data is of length %d: %v\n", len(data), err)
+		return block, err
 	}
-	return block, err
+	return block, nil
+}
 
+// legacyBlock is the layout of a block from before block headers existed. gob matches fields by name, so gob encoded blocks have to be
+// decoded into this.
+type legacyBlock struct {
+	Timestamp    int64
+	Hash         []byte
+	PrevHash     []byte
+	Transactions []Transaction
+	Height       int
+	Validator    []byte
+	Winner       []byte
 }
 
-// GenerateHash generates a new sha512 hash for a block
-// Eventually replace this when implementing proof
-func (b Block) GenerateHash() ([]byte, error) {
-	enc, err := b.EncodeBlock()
+// decodeLegacyBlock decodes a gob encoded block.
+func decodeLegacyBlock(data []byte) (Block, error) {
+	var legacy legacyBlock
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&legacy)
 	if err != nil {
-		return nil, err
+		fmt.Printf("error decoding legacy block, data is of length %d: %v\n", len(data), err)
 	}
-	hash := sha512.Sum512(enc)
-	return hash[:], nil
+	return legacy.toBlock(), err
 }
 
-// SaveToFile saves a block to file. If the block height is 518 then the file will be 518.dat
-func (b Block) SaveToFile() error {
-	encoded, err := b.EncodeBlock()
-	if err != nil {
-		fmt.Printf("error trying to save block: %v\n", err)
-		return err
+func (lb legacyBlock) toBlock() Block {
+	return Block{
+		BlockHeader: BlockHeader{
+			Version:   legacyBlockVersion,
+			PrevHash:  lb.PrevHash,
+			Timestamp: lb.Timestamp,
+			Height:    lb.Height,
+			Validator: lb.Validator,
+			Winner:    lb.Winner,
+		},
+		Hash:         lb.Hash,
+		Transactions: lb.Transactions,
 	}
+}
 
-	err = ioutil.WriteFile(BlockFile(b.Height), encoded, 0666)
-	return err
+// GenerateHash generates a new sha512 hash for a block. Only the header is hashed, the transactions are part of it through the
+// MerkleRoot.
+// Eventually replace this when implementing proof
+func (b Block) GenerateHash() ([]byte, error) {
+	return b.BlockHeader.Hash(), nil
 }
 
-// ReadBlocksFromFile reads a block in from a file, with the file name being its height followed by .dat. For example, 400.dat
-//TODO: perhaps we should make height an in32 instead of int
-func ReadBlockFromFile(height int) (Block, error) {
-	var block Block
+// Hash is the sha512 of the canonical encoding of the header, see encoding.go.
+func (h BlockHeader) Hash() []byte {
+	hash := sha512.Sum512(h.EncodeHeader())
+	return hash[:]
+}
 
-	encBlock, err := ioutil.ReadFile(BlockFile(height))
-	if err != nil {
-		fmt.Printf("error reading file for block height %d: %v\n", height, err)
-		return block, err
-	}
+// EncodeHeader encodes just the header of a block, using the canonical encoding.
+func (h BlockHeader) EncodeHeader() []byte {
+	var e encoder
+	h.encode(&e)
+	return e.buff.Bytes()
+}
 
-	block, err = DecodeBlock(encBlock)
-	return block, err
+// DecodeHeader decodes a header that was encoded with EncodeHeader.
+func DecodeHeader(data []byte) (BlockHeader, error) {
+	d := newDecoder(data)
+	header := decodeHeader(d)
+	return header, d.finish()
 }
 
 // Proof of Stake
@@ -6,13 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
-	"io/ioutil"
 	"strconv"
-	"time"
+	"sync"
 )
 
-// Store the blocks in their own separate .dat file. For example genesis would be 0.dat, block 1 would be 1.dat, etc...
-// store as an int // 4 bytes
+// chainLock makes sure only one block is being connected or disconnected at a time. Blocks can arrive from many peers at once.
+var chainLock sync.Mutex
 
 // Blockchain is a single instance of the blockchain.
 type Blockchain struct {
@@ -20,56 +19,63 @@ type Blockchain struct {
 	DB *bolt.DB // DB is a pointer to an open boltDB connection
 }
 
-// BCIterator is an instance of a blockchain iterator
-type BCIterator struct {
-	LastHash []byte   // LastHash is the hash of the block the iterator will iterate over next.
-	DB       *bolt.DB // DB is a pointer to an open boltDB connection
-}
-
-// CreateGenesisBlock creates the first (genesis) block of a chain.
-func (bc *Blockchain) CreateGenesisBlock(address string) Block {
-	cbTX, err := NewCoinbaseTransaction(address)
-	if err != nil {
-		fmt.Printf("error creating cbTX in genesis: %v\n", err)
-	}
-
-	genesis := Block{
-		Timestamp:    time.Now().Unix(),
-		Transactions: []Transaction{cbTX},
-		Height:       0,
-	}
+// ErrIteratorDone is returned by BCIterator.Next once every block in its range has been returned.
+var ErrIteratorDone = errors.New("ERROR: no more blocks to iterate over")
 
-	genesis.Hash, _ = genesis.GenerateHash()
-
-	//bc.Tip = genesis.Hash
-
-	return genesis
+// BCIterator walks over a range of blocks on the main chain, either from the top down or from the bottom up.
+type BCIterator struct {
+	Blockchain Blockchain // Blockchain is the chain being iterated over.
+	next       int        // next is the height of the block Next returns next.
+	end        int        // end is the height of the last block in the range.
+	step       int        // step is 1 when going up the chain, -1 when going down.
+	link       []byte     // link is the hash the next block has to link up with the block Next returned last.
+	done       bool       // done is set once the range is used up, or after an error.
 }
 
 // CreateBlockchain is responsible for either creating and returning, or just returning a blockchain instance. If there are no blocks, then
-// create a new genesis and blockchain. Otherwise just return a blockchain instance.
-func CreateBlockchain(address string) (*Blockchain, error) {
+// create a new blockchain from the genesis block of the network, see genesis.go. Otherwise just return a blockchain instance.
+func CreateBlockchain() (*Blockchain, error) {
 	var (
 		bc  Blockchain
 		err error
 	)
 
 	// open a db connection
-	bc.DB, err = bolt.Open(dbFile, 0600, nil)
+	bc.DB, err = bolt.Open(dbPath(), 0600, nil)
 	if err != nil {
-		fmt.Printf("error opening boltDB for file %s: %v\n", dbFile, err)
+		fmt.Printf("error opening boltDB for file %s: %v\n", dbPath(), err)
 		return nil, err
 	}
 
 	// check if there already is a saved chain
 	if ChainExists() {
-		// just create a Blockchain instance without creating an entirely new chain
+		// just create a Blockchain instance without creating an entirely new chain, after bringing its storage up to date
+		if err := bc.migrate(); err != nil {
+			return nil, err
+		}
+		if err := bc.recover(); err != nil {
+			return nil, err
+		}
+		// a chain in the wrong data directory, or opened with the wrong --network, doesn't start with the network's genesis block
+		genesisHash, err := bc.GetMainHash(0)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkGenesis(genesisHash); err != nil {
+			return nil, err
+		}
+		if err := bc.enableIndexes(); err != nil {
+			return nil, err
+		}
+		if err := bc.prune(); err != nil {
+			return nil, err
+		}
 		return &bc, nil
 	}
 
-	enc, err := ioutil.ReadFile("./genesis")
+	enc, err := readGenesis()
 	if err != nil {
-		fmt.Printf("error reading in ./gensis file: %v\n", err)
+		fmt.Printf("error reading in %s genesis block: %v\n", Params.Name, err)
 		return nil, err
 	}
 
@@ -79,35 +85,48 @@ func CreateBlockchain(address string) (*Blockchain, error) {
 		return nil, err
 	}
 
-	// create a genesis block - UNCOMMENT here to create a completely new blockchain.
-	//genesis := bc.CreateGenesisBlock(address)
+	// a genesis file in an older format has to be rehashed
+	if blockNeedsUpgrade(enc) {
+		genesis, err = upgradeLegacyBlock(genesis, nil, make(map[string][]byte))
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	// save the genesis block
-	err = genesis.SaveToFile()
-	if err != nil {
-		fmt.Printf("error creating file for gensis block: %v\n", err)
+	if err := checkGenesis(genesis.Hash); err != nil {
 		return nil, err
 	}
 
-	// update the db with the genesis block
+	// save the genesis block, and update the db with it
 	err = bc.DB.Update(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucketIfNotExists([]byte(blocksBucket))
 		if err != nil {
 			fmt.Printf("error opening bucket %s: %v\n", blocksBucket, err)
 			return err
 		}
-		// b+64-byte block hash : height of the block
-		if err := b.Put(FormatB(genesis.Hash), []byte(strconv.Itoa(genesis.Height))); err != nil {
+		// b+64-byte block hash : index of the block
+		if err := putBlock(b, genesis); err != nil {
 			fmt.Printf("error inserting genesis block in db: %v\n", err)
 			return err
 		}
+		// h+height : hash of the block
+		if err := b.Put(FormatH(genesis.Height), genesis.Hash); err != nil {
+			return err
+		}
 		// l : height of the block
 		if err := b.Put([]byte("l"), []byte(strconv.Itoa(genesis.Height))); err != nil {
 			fmt.Printf("error updating l with genesis hash: %v\n", err)
 			return err
 		}
+		// v : version of the on disk format, a new chain is always up to date
+		if err := b.Put([]byte("v"), []byte(strconv.Itoa(dbVersion))); err != nil {
+			return err
+		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 
 	utxo := UTXO{Blockchain: &bc}
 
@@ -116,6 +135,10 @@ func CreateBlockchain(address string) (*Blockchain, error) {
 		return &bc, err
 	}
 
+	if err := bc.enableIndexes(); err != nil {
+		return &bc, err
+	}
+
 	fmt.Printf("Blockchain successfully created!\n")
 
 	return &bc, err
@@ -154,128 +177,181 @@ func (bc Blockchain) GetTailHash() ([]byte, error) {
 		return nil, err
 	}
 
-	blk, err := ReadBlockFromFile(int(lastHeight))
+	return bc.GetMainHash(int(lastHeight))
+}
+
+// getTip returns the tip of the main chain, with only its header and hash and no transactions. This works even if the tip block itself
+// isn't stored, like right after a snapshot was loaded, see snapshot.go.
+func (bc Blockchain) getTip() (Block, error) {
+	hash, err := bc.GetTailHash()
 	if err != nil {
-		fmt.Printf("error reading block height %d for GetTailHash: %v\n", lastHeight, err)
-		return nil, err
+		return Block{}, err
 	}
 
-	return blk.Hash, nil
+	header, err := bc.GetHeader(hash)
+	if err != nil {
+		return Block{}, err
+	}
+
+	return Block{BlockHeader: header, Hash: hash}, nil
+}
+
+// NextSpendContext returns where a transaction would be spent if it went in the next block on the tip, for checking a transaction that
+// isn't in a block yet.
+func (bc Blockchain) NextSpendContext() (SpendContext, error) {
+	tip, err := bc.getTip()
+	if err != nil {
+		return SpendContext{}, err
+	}
+	return SpendContext{Height: tip.Height + 1, PrevTime: tip.Timestamp}, nil
 }
 
 func (bc Blockchain) CompareBlocks(height int32, hash []byte) (bool, error) {
-	blk, err := ReadBlockFromFile(int(height))
+	mainHash, err := bc.GetMainHash(int(height))
 	if err != nil {
-		fmt.Printf("error reading block height %d from file for CompareBlocks: %v\n", height, err)
+		fmt.Printf("error getting main chain hash at height %d for CompareBlocks: %v\n", height, err)
 		return false, err
 	}
 
-	return bytes.Compare(hash, blk.Hash) == 0, nil
+	return bytes.Compare(hash, mainHash) == 0, nil
 }
 
-// NewIterator creates a new blockchain iterator
+// GetBlockHeight looks up the height of any known block, on the main chain or on a side branch. The bool is false if the block is unknown.
+func (bc Blockchain) GetBlockHeight(hash []byte) (int, bool, error) {
+	bi, found, err := bc.getIndex(hash)
+	if err != nil {
+		fmt.Printf("error looking up height of block %s: %v\n", hex.EncodeToString(hash), err)
+	}
+
+	return bi.Height, found, err
+}
+
+// IsMainChain checks if the block with this hash and height is part of the main chain.
+func (bc Blockchain) IsMainChain(height int, hash []byte) (bool, error) {
+	tipHeight, err := bc.GetChainHeight()
+	if err != nil {
+		return false, err
+	}
+
+	if height > int(tipHeight) {
+		return false, nil
+	}
+
+	return bc.CompareBlocks(int32(height), hash)
+}
+
+// NewIterator creates an iterator over the whole main chain, from the tip down to the genesis block.
 func (bc Blockchain) NewIterator() (*BCIterator, error) {
-	var iter BCIterator
+	tipHeight, err := bc.GetChainHeight()
+	if err != nil {
+		return nil, err
+	}
 
-	iter.DB = bc.DB
+	return bc.NewRangeIterator(int(tipHeight), 0)
+}
 
-	err := iter.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
+// NewRangeIterator creates an iterator over the main chain blocks from height from to height to, both included. If from is above to, it
+// goes down the chain, otherwise up. Use MainChainHeight to start or end at a block hash.
+func (bc Blockchain) NewRangeIterator(from, to int) (*BCIterator, error) {
+	tipHeight, err := bc.GetChainHeight()
+	if err != nil {
+		return nil, err
+	}
 
-		// get the height of the latest block
-		lastIdxByte := b.Get([]byte("l"))
-		// convert the height in bytes to an int
-		lastIdx, err := strconv.Atoi(string(lastIdxByte))
-		if err != nil {
-			fmt.Printf("lastIdx was not an integer: %v\n", err)
-			return err
-		}
-		// read the block in from its file
-		block, err := ReadBlockFromFile(lastIdx)
-		if err != nil {
-			return err
+	for _, height := range []int{from, to} {
+		if height < 0 || height > int(tipHeight) {
+			return nil, fmt.Errorf("ERROR: height %d is not on the chain, the chain height is %d", height, tipHeight)
 		}
-		iter.LastHash = block.Hash
-		return nil
-	})
+	}
 
-	return &iter, err
+	iter := BCIterator{Blockchain: bc, next: from, end: to, step: 1}
+	if from > to {
+		iter.step = -1
+	}
+
+	return &iter, nil
 }
 
-// Next iterates over a blockchain and gets each block in the chain. It starts with the top and goes top -> down
-func (bci *BCIterator) Next() Block {
-	var block Block
+// MainChainHeight returns the height of a block on the main chain by its hash. It returns an error if the block is unknown, or on a side
+// branch.
+func (bc Blockchain) MainChainHeight(hash []byte) (int, error) {
+	height, found, err := bc.GetBlockHeight(hash)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("ERROR: block %s not found", hex.EncodeToString(hash))
+	}
 
-	if err := bci.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		idxByte := b.Get(FormatB(bci.LastHash))
-		idx, err := strconv.Atoi(string(idxByte))
-		if err != nil {
-			fmt.Printf("idxByte was not an integer: %v\n", err)
-			return err
-		}
-		block, err = ReadBlockFromFile(idx)
-		bci.LastHash = block.PrevHash
-		return err
-	}); err != nil {
-		fmt.Printf("error getting next block in iter for block hash %s: %v\n", bci.LastHash, err)
+	main, err := bc.IsMainChain(height, hash)
+	if err != nil {
+		return 0, err
 	}
-	return block
+	if !main {
+		return 0, fmt.Errorf("ERROR: block %s is not on the main chain", hex.EncodeToString(hash))
+	}
+
+	return height, nil
 }
 
-// eventually create this where chainstate db stores state of UTXO's
-func (bc Blockchain) FindUTXOs() (map[string]*UTXOutputs, error) {
-	var (
-		// needs to be a slice of int, since one transaction can have multiple used outputs
-		// this is a map of transactionID's mapped to the output idx that is referenced by an input
-		references = make(map[string][]int)
-		UTXOs      = make(map[string]*UTXOutputs)
-	)
+// Next returns the next block of the iterator's range. Once every block has been returned, it returns ErrIteratorDone. Blocks that
+// have been pruned only have their header, and no transactions. Every block is checked to be at the height it should be, and to link up
+// with the block before it, so a corrupt chain returns an error instead of going on forever.
+func (bci *BCIterator) Next() (Block, error) {
+	if bci.done {
+		return Block{}, ErrIteratorDone
+	}
 
-	iter, err := bc.NewIterator()
+	block, err := bci.read(bci.next)
 	if err != nil {
-		return UTXOs, err
-	}
-
-	for {
-		// first get a block
-		blk := iter.Next()
-		// then begin looping over every transaction in the block
-		for _, tx := range blk.Transactions {
-			var outputs UTXOutputs
-
-			id := hex.EncodeToString(tx.ID)
-			// next, loop over every output, and check if that output is referenced by an input
-		Outputs:
-			for outIdx, out := range tx.Vout {
-				for _, usedIdx := range references[id] {
-					// error where coinbase tx are false positives
-					if usedIdx == outIdx {
-						continue Outputs
-					}
-				}
-				outputs.Outputs = append(outputs.Outputs, out)
-				outputs.Indexes = append(outputs.Indexes, outIdx)
-				outputs.BlockHeight = blk.Height
-			}
-
-			if len(outputs.Outputs) > 0 {
-				UTXOs[id] = &outputs
-			}
-
-			// for every input, store which output it references
-			for _, in := range tx.Vin {
-				// coinbase inputs never reference an output
-				if !tx.IsCoinbase() {
-					referencedID := hex.EncodeToString(in.TransactionID)
-					references[referencedID] = append(references[referencedID], in.OutputIndex)
-				}
-			}
+		bci.done = true
+		return Block{}, err
+	}
+
+	// going up, a block's previous hash is the hash of the last block. Going down, its hash is the previous hash of the last block.
+	if bci.link != nil {
+		linked := bytes.Compare(block.PrevHash, bci.link) == 0
+		if bci.step < 0 {
+			linked = bytes.Compare(block.Hash, bci.link) == 0
 		}
-		if len(blk.PrevHash) == 0 {
-			break
+		if !linked {
+			bci.done = true
+			return Block{}, fmt.Errorf("ERROR: block #%d doesn't link up with block #%d", block.Height, block.Height-bci.step)
 		}
+	}
+	bci.link = block.Hash
+	if bci.step < 0 {
+		bci.link = block.PrevHash
+	}
 
+	if bci.next == bci.end {
+		bci.done = true
 	}
-	return UTXOs, nil
-}
\ No newline at end of file
+	bci.next += bci.step
+
+	return block, nil
+}
+
+// read reads in the main chain block at height, or just its header if it has been pruned.
+func (bci *BCIterator) read(height int) (Block, error) {
+	hash, err := bci.Blockchain.GetMainHash(height)
+	if err != nil {
+		return Block{}, err
+	}
+
+	block, err := bci.Blockchain.GetBlock(hash)
+	if err == ErrBlockPruned {
+		block = Block{Hash: hash}
+		block.BlockHeader, err = bci.Blockchain.GetHeader(hash)
+	}
+	if err != nil {
+		fmt.Printf("error reading block #%d for the iterator: %v\n", height, err)
+		return Block{}, err
+	}
+
+	if block.Height != height || bytes.Compare(block.Hash, hash) != 0 {
+		return Block{}, fmt.Errorf("ERROR: block stored at height %d is block #%d %s", height, block.Height, hex.EncodeToString(block.Hash))
+	}
+
+	return block, nil
+}
@@ -0,0 +1,293 @@
+package core
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Block Files
+
+// Blocks are appended to rolling block files, blocks_gen/blk00000.dat, blk00001.dat, etc... in the network's directory, see network.go. Once a file would grow past
+// maxBlockFileSize, the next file is started. Every block in a file is stored as a record:
+//
+//   4-byte magic | uint32 length | the canonically encoded block
+//
+// The magic makes it easy to spot a bad offset, and lets a block file be scanned without the index. Blocks on the main chain and on
+// side branches are stored exactly the same way, the blocks bucket keeps track of where each block lives and which ones are on the
+// main chain.
+//
+// A block is flushed to disk before its index is committed, so the index never points at a block that isn't there. A crash can still
+// leave part of a record, or a record nothing indexes, at the end of the current file. Those are cut off the next time the chain is
+// opened, see recover.go.
+//
+// Block files aren't written to a temporary file and renamed into place, like WriteFileAtomic does. A block file holds many blocks, so
+// that would copy the whole file for every block. Appending gives the same guarantee: a record only ever goes after the end of every
+// record an index points at, so a write that is cut off can't damage a block the chain knows about, only the record being written.
+// Since the index of that record isn't committed until after the sync, nothing refers to it, and repairing the file on startup leaves it
+// exactly as it was before the write, the same as a rename that never happened.
+
+const (
+	// maxBlockFileSize is the size a block file is capped at, 128 MiB.
+	maxBlockFileSize = 128 * 1024 * 1024
+	// blockRecordHeader is the size of the magic and length in front of every block in a block file.
+	blockRecordHeader = 8
+)
+
+var blockMagic = []byte{0x62, 0x6c, 0x65, 0x6d} // "blem"
+
+// BlockIndex is the record stored in the blocks bucket for every known block. It keeps the header of the block, so the header is still
+// around once the block itself is pruned, see prune.go.
+type BlockIndex struct {
+	Height int         // Height is the height of the block.
+	File   int         // File is the number of the block file the block is in.
+	Offset int64       // Offset is where the block's record starts in the file.
+	Length int         // Length is the length of the encoded block, without the record header.
+	Pruned bool        // Pruned is set once the block file the block was in has been deleted.
+	Header BlockHeader // Header is the header of the block.
+}
+
+// EncodeIndex encodes a block index with the canonical encoding:
+//
+//	int64 Height | uint32 File | int64 Offset | uint32 Length | bool Pruned | BlockHeader
+func (bi BlockIndex) EncodeIndex() []byte {
+	var e encoder
+	e.writeInt64(int64(bi.Height))
+	e.writeUint32(uint32(bi.File))
+	e.writeInt64(bi.Offset)
+	e.writeUint32(uint32(bi.Length))
+	e.writeBool(bi.Pruned)
+	bi.Header.encode(&e)
+	return e.buff.Bytes()
+}
+
+// DecodeIndex decodes a block index that was encoded with EncodeIndex.
+func DecodeIndex(data []byte) (BlockIndex, error) {
+	var bi BlockIndex
+
+	d := newDecoder(data)
+	bi.Height = int(d.readInt64())
+	bi.File = int(d.readUint32())
+	bi.Offset = d.readInt64()
+	bi.Length = int(d.readUint32())
+	bi.Pruned = d.readBool()
+	bi.Header = decodeHeader(d)
+
+	return bi, d.finish()
+}
+
+// writeBlock appends a block to the current block file, starting a new file if the current one is full. It returns where the block was
+// written, and the number of the file that is now current. Nothing is stored in the db, that is up to the caller.
+func writeBlock(block Block, currentFile int) (BlockIndex, int, error) {
+	encoded, err := block.EncodeBlock()
+	if err != nil {
+		return BlockIndex{}, currentFile, err
+	}
+
+	if err := os.MkdirAll(blocksDir(), 0777); err != nil {
+		return BlockIndex{}, currentFile, err
+	}
+
+	size, err := blockFileSize(currentFile)
+	if err != nil {
+		return BlockIndex{}, currentFile, err
+	}
+
+	// the next file may already exist, with a block whose index was rolled back after it was written, so its real size is what counts
+	for size > 0 && size+int64(blockRecordHeader+len(encoded)) > maxBlockFileSize {
+		currentFile++
+		if size, err = blockFileSize(currentFile); err != nil {
+			return BlockIndex{}, currentFile, err
+		}
+	}
+
+	f, err := os.OpenFile(BlockFilePath(currentFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		fmt.Printf("error opening block file #%d: %v\n", currentFile, err)
+		return BlockIndex{}, currentFile, err
+	}
+	defer f.Close()
+
+	record := make([]byte, blockRecordHeader, blockRecordHeader+len(encoded))
+	copy(record, blockMagic)
+	binary.BigEndian.PutUint32(record[4:], uint32(len(encoded)))
+	record = append(record, encoded...)
+
+	if _, err := f.Write(record); err != nil {
+		fmt.Printf("error writing block #%d to block file #%d: %v\n", block.Height, currentFile, err)
+		return BlockIndex{}, currentFile, err
+	}
+
+	// the block has to be on disk before the index that points at it is committed
+	if err := f.Sync(); err != nil {
+		fmt.Printf("error syncing block file #%d: %v\n", currentFile, err)
+		return BlockIndex{}, currentFile, err
+	}
+	if size == 0 {
+		if err := syncDir(blocksDir()); err != nil {
+			return BlockIndex{}, currentFile, err
+		}
+	}
+
+	return BlockIndex{Height: block.Height, File: currentFile, Offset: size, Length: len(encoded), Header: block.BlockHeader}, currentFile, nil
+}
+
+// readBlock reads in the block stored at a block index. It returns ErrBlockPruned if the block has been pruned.
+func readBlock(bi BlockIndex) (Block, error) {
+	if bi.Pruned {
+		return Block{}, ErrBlockPruned
+	}
+
+	f, err := os.Open(BlockFilePath(bi.File))
+	if err != nil {
+		return Block{}, err
+	}
+	defer f.Close()
+
+	record := make([]byte, blockRecordHeader+bi.Length)
+	if _, err := f.ReadAt(record, bi.Offset); err != nil {
+		if err == io.EOF {
+			return Block{}, fmt.Errorf("ERROR: block file #%d is shorter than its index", bi.File)
+		}
+		return Block{}, err
+	}
+
+	if string(record[:4]) != string(blockMagic) || int(binary.BigEndian.Uint32(record[4:])) != bi.Length {
+		return Block{}, fmt.Errorf("ERROR: no block record at offset %d of block file #%d", bi.Offset, bi.File)
+	}
+
+	return DecodeBlock(record[blockRecordHeader:])
+}
+
+// storeBlock writes a block to the block files and indexes it under its hash, without touching the main chain. Blocks that are
+// already stored are left alone.
+func (bc *Blockchain) storeBlock(block Block) error {
+	_, known, err := bc.GetBlockHeight(block.Hash)
+	if err != nil {
+		return err
+	}
+	if known {
+		return nil
+	}
+
+	return bc.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		return putBlock(b, block)
+	})
+}
+
+// putBlock writes a block to the block files and adds its index to the blocks bucket b.
+func putBlock(b *bolt.Bucket, block Block) error {
+	bi, file, err := writeBlock(block, currentBlockFile(b))
+	if err != nil {
+		return err
+	}
+
+	if err := b.Put(FormatB(block.Hash), bi.EncodeIndex()); err != nil {
+		return err
+	}
+
+	return b.Put([]byte("f"), []byte(strconv.Itoa(file)))
+}
+
+// currentBlockFile returns the number of the block file that blocks are appended to. A new chain starts at file 0.
+func currentBlockFile(b *bolt.Bucket) int {
+	file, err := strconv.Atoi(string(b.Get([]byte("f"))))
+	if err != nil {
+		return 0
+	}
+	return file
+}
+
+// getIndex looks up the block index of a block hash. The bool is false if the block is unknown.
+func (bc Blockchain) getIndex(hash []byte) (BlockIndex, bool, error) {
+	var (
+		bi    BlockIndex
+		found bool
+	)
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		enc := tx.Bucket([]byte(blocksBucket)).Get(FormatB(hash))
+		if enc == nil {
+			return nil
+		}
+
+		var err error
+		bi, err = DecodeIndex(enc)
+		found = err == nil
+		return err
+	})
+
+	return bi, found, err
+}
+
+// GetHeader returns the header of any known block by its hash. Unlike GetBlock, this works for pruned blocks too.
+func (bc Blockchain) GetHeader(hash []byte) (BlockHeader, error) {
+	bi, found, err := bc.getIndex(hash)
+	if err != nil {
+		return BlockHeader{}, err
+	}
+	if !found {
+		return BlockHeader{}, fmt.Errorf("ERROR: block %s not found", hex.EncodeToString(hash))
+	}
+
+	return bi.Header, nil
+}
+
+// GetMainHash returns the hash of the main chain block at height.
+func (bc Blockchain) GetMainHash(height int) ([]byte, error) {
+	var hash []byte
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		hash = tx.Bucket([]byte(blocksBucket)).Get(FormatH(height))
+		if hash == nil {
+			return fmt.Errorf("ERROR: no main chain block at height %d", height)
+		}
+		hash = append([]byte{}, hash...)
+		return nil
+	})
+
+	return hash, err
+}
+
+// GetBlock reads in any known block by its hash, whether it is on the main chain or on a side branch.
+func (bc Blockchain) GetBlock(hash []byte) (Block, error) {
+	bi, found, err := bc.getIndex(hash)
+	if err != nil {
+		return Block{}, err
+	}
+	if !found {
+		return Block{}, fmt.Errorf("ERROR: block %s not found", hex.EncodeToString(hash))
+	}
+
+	return readBlock(bi)
+}
+
+// readMainBlock reads in the main chain block at height, from inside a db transaction on the blocks bucket b.
+func readMainBlock(b *bolt.Bucket, height int) (Block, error) {
+	hash := b.Get(FormatH(height))
+	if hash == nil {
+		return Block{}, fmt.Errorf("ERROR: no main chain block at height %d", height)
+	}
+
+	bi, err := DecodeIndex(b.Get(FormatB(hash)))
+	if err != nil {
+		return Block{}, err
+	}
+
+	return readBlock(bi)
+}
+
+// GetBlockByHeight reads in the main chain block at height.
+func (bc Blockchain) GetBlockByHeight(height int) (Block, error) {
+	hash, err := bc.GetMainHash(height)
+	if err != nil {
+		return Block{}, err
+	}
+
+	return bc.GetBlock(hash)
+}
@@ -0,0 +1,183 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Coin Selection
+
+// A transaction has to spend enough of the sender's unspent outputs to cover what it pays out plus its fee, and whatever is left over
+// goes back to the sender as change. Which outputs it spends is up to a CoinSelector:
+//
+// - largest: the largest outputs first, so the transaction has as few inputs as possible. This is the default.
+// - smallest: the smallest outputs first, which consolidates a wallet with a lot of small outputs, at the cost of a bigger transaction.
+// - oldest: the outputs from the lowest blocks first.
+// - bnb: branch and bound, searches for a set of outputs that adds up to exactly the amount, so the transaction has no change. If there
+//   is none, it falls back to largest.
+//
+// Every selector is deterministic, the same outputs and amount always give the same selection.
+
+const (
+	// bnbMaxTries is how many branches the branch and bound selector looks at before it gives up on an exact match.
+	bnbMaxTries = 100000
+)
+
+var (
+	// ErrInsufficientFunds is returned when the outputs of an address don't add up to the amount of a transaction.
+	ErrInsufficientFunds = errors.New("ERROR: not enough funds")
+
+	coinSelectors = []CoinSelector{LargestFirst{}, SmallestFirst{}, OldestFirst{}, BranchAndBound{}}
+)
+
+// CoinSelector picks which unspent outputs a transaction spends.
+type CoinSelector interface {
+	// Name is what the selector is called on the command line.
+	Name() string
+	// Select returns outputs from coins that add up to at least target, in the order they should be spent.
+	Select(coins []UnspentOutput, target int) ([]UnspentOutput, error)
+}
+
+// GetCoinSelector returns the coin selector called name.
+func GetCoinSelector(name string) (CoinSelector, error) {
+	var names []string
+	for _, selector := range coinSelectors {
+		if selector.Name() == name {
+			return selector, nil
+		}
+		names = append(names, selector.Name())
+	}
+	return nil, fmt.Errorf("ERROR: unknown coin selection %q, must be one of %v", name, names)
+}
+
+// sortCoins sorts coins by less, and by outpoint when less doesn't order two of them, so the order never depends on the order coins
+// came in.
+func sortCoins(coins []UnspentOutput, less func(a, b UnspentOutput) bool) []UnspentOutput {
+	sorted := append([]UnspentOutput{}, coins...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		if c := bytes.Compare(a.TransactionID, b.TransactionID); c != 0 {
+			return c < 0
+		}
+		return a.Index < b.Index
+	})
+	return sorted
+}
+
+// accumulate takes coins in order until they add up to target.
+func accumulate(coins []UnspentOutput, target int) ([]UnspentOutput, error) {
+	var (
+		selected []UnspentOutput
+		total    int
+	)
+
+	for _, uo := range coins {
+		if total >= target {
+			break
+		}
+		selected = append(selected, uo)
+		total += uo.Output.Value
+	}
+
+	if total < target {
+		return nil, ErrInsufficientFunds
+	}
+	return selected, nil
+}
+
+// LargestFirst spends the largest outputs first.
+type LargestFirst struct{}
+
+func (LargestFirst) Name() string { return "largest" }
+
+func (LargestFirst) Select(coins []UnspentOutput, target int) ([]UnspentOutput, error) {
+	return accumulate(sortCoins(coins, func(a, b UnspentOutput) bool {
+		return a.Output.Value > b.Output.Value
+	}), target)
+}
+
+// SmallestFirst spends the smallest outputs first.
+type SmallestFirst struct{}
+
+func (SmallestFirst) Name() string { return "smallest" }
+
+func (SmallestFirst) Select(coins []UnspentOutput, target int) ([]UnspentOutput, error) {
+	return accumulate(sortCoins(coins, func(a, b UnspentOutput) bool {
+		return a.Output.Value < b.Output.Value
+	}), target)
+}
+
+// OldestFirst spends the outputs from the lowest blocks first.
+type OldestFirst struct{}
+
+func (OldestFirst) Name() string { return "oldest" }
+
+func (OldestFirst) Select(coins []UnspentOutput, target int) ([]UnspentOutput, error) {
+	return accumulate(sortCoins(coins, func(a, b UnspentOutput) bool {
+		return a.BlockHeight < b.BlockHeight
+	}), target)
+}
+
+// BranchAndBound searches for outputs that add up to exactly the target, so the transaction needs no change. The search is a depth
+// first walk over including or leaving out each output, largest first, that cuts off every branch that has gone over the target or can't
+// reach it anymore. If it finds no exact match within bnbMaxTries branches, it falls back to LargestFirst.
+type BranchAndBound struct{}
+
+func (BranchAndBound) Name() string { return "bnb" }
+
+func (BranchAndBound) Select(coins []UnspentOutput, target int) ([]UnspentOutput, error) {
+	sorted := sortCoins(coins, func(a, b UnspentOutput) bool {
+		return a.Output.Value > b.Output.Value
+	})
+
+	// remaining[i] is the sum of every output from i on, the most a branch at i can still add
+	remaining := make([]int, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].Output.Value
+	}
+	if remaining[0] < target {
+		return nil, ErrInsufficientFunds
+	}
+
+	var (
+		included = make([]bool, len(sorted))
+		tries    int
+		search   func(i, total int) bool
+	)
+	search = func(i, total int) bool {
+		tries++
+		if total == target {
+			return true
+		}
+		if i == len(sorted) || total > target || total+remaining[i] < target || tries > bnbMaxTries {
+			return false
+		}
+
+		included[i] = true
+		if search(i+1, total+sorted[i].Output.Value) {
+			return true
+		}
+		included[i] = false
+		return search(i+1, total)
+	}
+
+	if !search(0, 0) {
+		return LargestFirst{}.Select(coins, target)
+	}
+
+	var selected []UnspentOutput
+	for i, uo := range sorted {
+		if included[i] {
+			selected = append(selected, uo)
+		}
+	}
+	return selected, nil
+}
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCoinSelectors(t *testing.T) {
+	coin := func(id byte, value, height int) UnspentOutput {
+		return UnspentOutput{TransactionID: fill(id, 64), Output: Output{Value: value}, BlockHeight: height}
+	}
+	// in no particular order, the selectors sort them
+	coins := map[string]UnspentOutput{
+		"a": coin(0x0a, 40, 3),
+		"b": coin(0x0b, 25, 1),
+		"c": coin(0x0c, 15, 2),
+		"d": coin(0x0d, 10, 4),
+	}
+	unordered := []UnspentOutput{coins["c"], coins["a"], coins["d"], coins["b"]}
+
+	tests := []struct {
+		name     string
+		selector CoinSelector
+		coins    []UnspentOutput
+		target   int
+		want     []string
+		change   int
+		err      error
+	}{
+		{name: "largest", selector: LargestFirst{}, target: 50, want: []string{"a", "b"}, change: 15},
+		{name: "largest exact match", selector: LargestFirst{}, target: 40, want: []string{"a"}},
+		{name: "largest everything", selector: LargestFirst{}, target: 90, want: []string{"a", "b", "c", "d"}},
+		{name: "largest insufficient funds", selector: LargestFirst{}, target: 91, err: ErrInsufficientFunds},
+		{name: "smallest", selector: SmallestFirst{}, target: 30, want: []string{"d", "c", "b"}, change: 20},
+		{name: "smallest exact match", selector: SmallestFirst{}, target: 25, want: []string{"d", "c"}},
+		{name: "smallest insufficient funds", selector: SmallestFirst{}, target: 91, err: ErrInsufficientFunds},
+		{name: "oldest", selector: OldestFirst{}, target: 50, want: []string{"b", "c", "a"}, change: 30},
+		{name: "oldest exact match", selector: OldestFirst{}, target: 40, want: []string{"b", "c"}},
+		{name: "oldest insufficient funds", selector: OldestFirst{}, target: 91, err: ErrInsufficientFunds},
+		// largest first would take a and b, with a change of 15
+		{name: "bnb exact match", selector: BranchAndBound{}, target: 50, want: []string{"a", "d"}},
+		{name: "bnb exact match without the largest", selector: BranchAndBound{}, target: 35, want: []string{"b", "d"}},
+		{name: "bnb no exact match falls back to largest", selector: BranchAndBound{}, target: 36, want: []string{"a"}, change: 4},
+		{name: "bnb everything", selector: BranchAndBound{}, target: 90, want: []string{"a", "b", "c", "d"}},
+		{name: "bnb insufficient funds", selector: BranchAndBound{}, target: 91, err: ErrInsufficientFunds},
+		{name: "no coins", selector: BranchAndBound{}, coins: []UnspentOutput{}, target: 1, err: ErrInsufficientFunds},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := unordered
+			if tt.coins != nil {
+				in = tt.coins
+			}
+
+			selected, err := tt.selector.Select(in, tt.target)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+
+			if len(selected) != len(tt.want) {
+				t.Fatalf("selected %d outputs, want %v", len(selected), tt.want)
+			}
+			total := 0
+			for i, name := range tt.want {
+				if selected[i].TransactionID[0] != coins[name].TransactionID[0] {
+					t.Errorf("output %d is %x, want %s", i, selected[i].TransactionID[0], name)
+				}
+				total += selected[i].Output.Value
+			}
+			if change := total - tt.target; change != tt.change {
+				t.Errorf("change is %d, want %d", change, tt.change)
+			}
+		})
+	}
+}
+
+func TestGetCoinSelector(t *testing.T) {
+	for _, selector := range coinSelectors {
+		got, err := GetCoinSelector(selector.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != selector {
+			t.Errorf("GetCoinSelector(%q) is %T", selector.Name(), got)
+		}
+	}
+
+	_, err := GetCoinSelector("random")
+	checkError(t, err, "unknown coin selection")
+}
@@ -0,0 +1,446 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Canonical Encoding
+
+// Blocks and transactions are hashed, saved to file, and sent to other nodes in the canonical encoding described here. Anyone writing
+// another client only needs this description to compute the exact same hashes.
+//
+// - integers are big endian and fixed size: uint32, int32 or int64
+// - bools are a single byte, 0 or 1
+// - byte slices are a uint32 length, followed by the bytes
+// - lists are a uint32 count, followed by the items
+//
+// Every block and transaction starts with the uint32 version of its encoding. Transactions are on version 1 to 4, blocks on version 2.
+//
+// Transaction (version 1):
+//   uint32 version | bytes ID | int64 Timestamp | uint32 len(Vin) | Vin... | uint32 len(Vout) | Vout...
+// Input:
+//   bytes TransactionID | int32 OutputIndex | bytes Signature | bytes PubKey
+// Output:
+//   int64 Value | bytes PubKeyHash
+// Transaction (version 2) is the same as version 1, except that every output says if it is a multisig output, see multisig.go:
+// Output:
+//   int64 Value | bytes PubKeyHash | bool Multisig
+// A transaction is only encoded as version 2 if it has a multisig output, so every transaction from before keeps its ID.
+// Transaction (version 3) is the same as version 2, except that every input and output has a script, see script.go:
+// Input:
+//   bytes TransactionID | int32 OutputIndex | bytes Signature | bytes PubKey | bytes Script
+// Output:
+//   int64 Value | bytes PubKeyHash | bool Multisig | bytes Script
+// A transaction is only encoded as version 3 if one of its inputs or outputs has a script.
+// Transaction (version 4) is the same as version 3, except that it has a lock time, and every input has a sequence:
+//   uint32 version | bytes ID | int64 Timestamp | int64 LockTime | uint32 len(Vin) | Vin... | uint32 len(Vout) | Vout...
+// Input:
+//   bytes TransactionID | int32 OutputIndex | bytes Signature | bytes PubKey | bytes Script | uint32 Sequence
+// A transaction is only encoded as version 4 if it has a lock time, or one of its inputs has a sequence.
+// BlockHeader:
+//   int32 Version | bytes PrevHash | bytes MerkleRoot | int64 Timestamp | int64 Height | bytes Validator | bytes Winner
+// Block (version 2):
+//   uint32 version | BlockHeader | bytes Hash | uint32 len(Transactions) | Transactions...
+//
+// A transaction ID is the sha512 of the transaction encoded without its ID and without the signatures and unlocking scripts of its
+// inputs, since the ID is created before the transaction is signed. The version it is encoded with is the one it has without its
+// unlocking scripts. A block hash is the sha512 of its encoded BlockHeader.
+//
+// Version 1 blocks had no header, they were encoded as:
+//   uint32 version | bytes Hash | int64 Timestamp | bytes PrevHash | int64 Height | bytes Validator | bytes Winner |
+//   uint32 len(Transactions) | Transactions...
+// They can still be decoded, but only for migration, their hash has to be recomputed.
+//
+// Undo data, see undo.go, and the messages nodes send each other, see the p2p package, are in the canonical encoding too.
+//
+// Before this encoding existed, everything was encoded with encoding/gob. gob is only still used to read in old data during migration,
+// see migrate.go. A gob encoding never starts with a zero byte, while the canonical encoding always does, so the two can't be confused.
+
+const (
+	// txEncodingVersion is the version an encoded transaction without multisig outputs starts with.
+	txEncodingVersion uint32 = 1
+	// txMultisigEncodingVersion is the version an encoded transaction with a multisig output starts with.
+	txMultisigEncodingVersion uint32 = 2
+	// txScriptEncodingVersion is the version an encoded transaction with a script starts with.
+	txScriptEncodingVersion uint32 = 3
+	// txLockEncodingVersion is the version an encoded transaction with a lock time or sequence starts with.
+	txLockEncodingVersion uint32 = 4
+	// blockEncodingVersion is the version every encoded block starts with.
+	blockEncodingVersion uint32 = 2
+)
+
+// encoder builds up a canonical encoding.
+type encoder struct {
+	buff bytes.Buffer
+}
+
+func (e *encoder) writeUint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buff.Write(b[:])
+}
+
+func (e *encoder) writeInt32(v int32) {
+	e.writeUint32(uint32(v))
+}
+
+func (e *encoder) writeInt64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.buff.Write(b[:])
+}
+
+func (e *encoder) writeBytes(data []byte) {
+	e.writeUint32(uint32(len(data)))
+	e.buff.Write(data)
+}
+
+func (e *encoder) writeBool(v bool) {
+	if v {
+		e.buff.WriteByte(1)
+		return
+	}
+	e.buff.WriteByte(0)
+}
+
+// decoder reads a canonical encoding. The first error sticks, so a whole struct can be read before checking err once.
+type decoder struct {
+	r   *bytes.Reader
+	err error
+}
+
+func newDecoder(data []byte) *decoder {
+	return &decoder{r: bytes.NewReader(data)}
+}
+
+// read fills b, or sets err if there isn't enough data left.
+func (d *decoder) read(b []byte) {
+	if d.err != nil {
+		return
+	}
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		d.err = errors.New("ERROR: unexpected end of data")
+	}
+}
+
+func (d *decoder) readUint32() uint32 {
+	var b [4]byte
+	d.read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func (d *decoder) readInt32() int32 {
+	return int32(d.readUint32())
+}
+
+func (d *decoder) readInt64() int64 {
+	var b [8]byte
+	d.read(b[:])
+	return int64(binary.BigEndian.Uint64(b[:]))
+}
+
+func (d *decoder) readBool() bool {
+	var b [1]byte
+	d.read(b[:])
+	if b[0] > 1 {
+		d.err = fmt.Errorf("ERROR: bool encoded as %d", b[0])
+	}
+	return b[0] == 1
+}
+
+func (d *decoder) readBytes() []byte {
+	length := d.readUint32()
+	if d.err != nil {
+		return nil
+	}
+	if int(length) > d.r.Len() {
+		d.err = fmt.Errorf("ERROR: byte slice of length %d is longer than the remaining data", length)
+		return nil
+	}
+	if length == 0 {
+		return nil
+	}
+
+	data := make([]byte, length)
+	d.read(data)
+	return data
+}
+
+// readCount reads the length of a list. Every item takes at least minSize bytes, which stops a bad count from allocating a huge list.
+func (d *decoder) readCount(minSize int) int {
+	count := d.readUint32()
+	if d.err != nil {
+		return 0
+	}
+	if int(count)*minSize > d.r.Len() {
+		d.err = fmt.Errorf("ERROR: list of %d items is longer than the remaining data", count)
+		return 0
+	}
+	return int(count)
+}
+
+// readVersion reads the version an encoding starts with, and makes sure it is one of the known versions.
+func (d *decoder) readVersion(known ...uint32) uint32 {
+	version := d.readUint32()
+	if d.err != nil {
+		return 0
+	}
+
+	for _, v := range known {
+		if v == version {
+			return version
+		}
+	}
+
+	d.err = fmt.Errorf("ERROR: unknown encoding version %d", version)
+	return 0
+}
+
+// finish makes sure all of the data was used up.
+func (d *decoder) finish() error {
+	if d.err == nil && d.r.Len() != 0 {
+		d.err = fmt.Errorf("ERROR: %d bytes left over after decoding", d.r.Len())
+	}
+	return d.err
+}
+
+// isLegacyGob checks if data was encoded with gob instead of the canonical encoding.
+func isLegacyGob(data []byte) bool {
+	return len(data) > 0 && data[0] != 0
+}
+
+// Encoder builds up a canonical encoding in another package. The messages nodes send each other are encoded with it, see the p2p package.
+type Encoder struct {
+	e encoder
+}
+
+func (e *Encoder) WriteUint32(v uint32) { e.e.writeUint32(v) }
+func (e *Encoder) WriteInt32(v int32)   { e.e.writeInt32(v) }
+func (e *Encoder) WriteInt64(v int64)   { e.e.writeInt64(v) }
+func (e *Encoder) WriteBytes(b []byte)  { e.e.writeBytes(b) }
+func (e *Encoder) WriteBool(v bool)     { e.e.writeBool(v) }
+
+// Bytes returns everything written so far.
+func (e *Encoder) Bytes() []byte {
+	return e.e.buff.Bytes()
+}
+
+// Decoder reads a canonical encoding in another package. Like decoder, the first error sticks until Finish.
+type Decoder struct {
+	d *decoder
+}
+
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{d: newDecoder(data)}
+}
+
+func (d *Decoder) ReadUint32() uint32 { return d.d.readUint32() }
+func (d *Decoder) ReadInt32() int32   { return d.d.readInt32() }
+func (d *Decoder) ReadInt64() int64   { return d.d.readInt64() }
+func (d *Decoder) ReadBytes() []byte  { return d.d.readBytes() }
+func (d *Decoder) ReadBool() bool     { return d.d.readBool() }
+
+// ReadCount reads the length of a list, see decoder.readCount.
+func (d *Decoder) ReadCount(minSize int) int {
+	return d.d.readCount(minSize)
+}
+
+// ReadVersion reads the version an encoding starts with, see decoder.readVersion.
+func (d *Decoder) ReadVersion(known ...uint32) uint32 {
+	return d.d.readVersion(known...)
+}
+
+// Finish returns the first error, or an error if not all of the data was used up.
+func (d *Decoder) Finish() error {
+	return d.d.finish()
+}
+
+// encodingVersion returns the version a transaction is encoded with. withUnlocking leaves out the unlocking scripts of the inputs.
+func (tx Transaction) encodingVersion(withUnlocking bool) uint32 {
+	if tx.LockTime != 0 {
+		return txLockEncodingVersion
+	}
+	for _, in := range tx.Vin {
+		if in.Sequence != 0 {
+			return txLockEncodingVersion
+		}
+	}
+
+	version := txEncodingVersion
+	for _, out := range tx.Vout {
+		if len(out.Script) > 0 {
+			return txScriptEncodingVersion
+		}
+		if out.Multisig {
+			version = txMultisigEncodingVersion
+		}
+	}
+	if withUnlocking {
+		for _, in := range tx.Vin {
+			if len(in.Script) > 0 {
+				return txScriptEncodingVersion
+			}
+		}
+	}
+	return version
+}
+
+// encode writes a transaction. forHash leaves out everything that isn't part of the transaction ID.
+func (tx Transaction) encode(e *encoder, forHash bool) {
+	version := tx.encodingVersion(!forHash)
+
+	e.writeUint32(version)
+	if !forHash {
+		e.writeBytes(tx.ID)
+	}
+	e.writeInt64(tx.Timestamp)
+	if version >= txLockEncodingVersion {
+		e.writeInt64(tx.LockTime)
+	}
+
+	e.writeUint32(uint32(len(tx.Vin)))
+	for _, in := range tx.Vin {
+		e.writeBytes(in.TransactionID)
+		e.writeInt32(int32(in.OutputIndex))
+		if !forHash {
+			e.writeBytes(in.Signature)
+		}
+		e.writeBytes(in.PubKey)
+		if version >= txScriptEncodingVersion && !forHash {
+			e.writeBytes(in.Script)
+		}
+		if version >= txLockEncodingVersion {
+			e.writeUint32(uint32(in.Sequence))
+		}
+	}
+
+	e.writeUint32(uint32(len(tx.Vout)))
+	for _, out := range tx.Vout {
+		e.writeInt64(int64(out.Value))
+		e.writeBytes(out.PubKeyHash)
+		if version >= txMultisigEncodingVersion {
+			e.writeBool(out.Multisig)
+		}
+		if version >= txScriptEncodingVersion {
+			e.writeBytes(out.Script)
+		}
+	}
+}
+
+func decodeTransaction(d *decoder) Transaction {
+	var tx Transaction
+
+	version := d.readVersion(txEncodingVersion, txMultisigEncodingVersion, txScriptEncodingVersion, txLockEncodingVersion)
+	tx.ID = d.readBytes()
+	tx.Timestamp = d.readInt64()
+	if version >= txLockEncodingVersion {
+		tx.LockTime = d.readInt64()
+	}
+
+	// an input is at least 4+4+4+4 bytes, an output at least 8+4
+	count := d.readCount(16)
+	for i := 0; i < count && d.err == nil; i++ {
+		var in Input
+		in.TransactionID = d.readBytes()
+		in.OutputIndex = int(d.readInt32())
+		in.Signature = d.readBytes()
+		in.PubKey = d.readBytes()
+		if version >= txScriptEncodingVersion {
+			in.Script = d.readBytes()
+		}
+		if version >= txLockEncodingVersion {
+			in.Sequence = int(d.readUint32())
+		}
+		tx.Vin = append(tx.Vin, in)
+	}
+
+	count = d.readCount(12)
+	for i := 0; i < count && d.err == nil; i++ {
+		var out Output
+		out.Value = int(d.readInt64())
+		out.PubKeyHash = d.readBytes()
+		if version >= txMultisigEncodingVersion {
+			out.Multisig = d.readBool()
+		}
+		if version >= txScriptEncodingVersion {
+			out.Script = d.readBytes()
+		}
+		tx.Vout = append(tx.Vout, out)
+	}
+
+	return tx
+}
+
+func (h BlockHeader) encode(e *encoder) {
+	e.writeInt32(h.Version)
+	e.writeBytes(h.PrevHash)
+	e.writeBytes(h.MerkleRoot)
+	e.writeInt64(h.Timestamp)
+	e.writeInt64(int64(h.Height))
+	e.writeBytes(h.Validator)
+	e.writeBytes(h.Winner)
+}
+
+func decodeHeader(d *decoder) BlockHeader {
+	var h BlockHeader
+
+	h.Version = d.readInt32()
+	h.PrevHash = d.readBytes()
+	h.MerkleRoot = d.readBytes()
+	h.Timestamp = d.readInt64()
+	h.Height = int(d.readInt64())
+	h.Validator = d.readBytes()
+	h.Winner = d.readBytes()
+
+	return h
+}
+
+// encode writes a full block.
+func (b Block) encode(e *encoder) {
+	e.writeUint32(blockEncodingVersion)
+	b.BlockHeader.encode(e)
+	e.writeBytes(b.Hash)
+
+	e.writeUint32(uint32(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		tx.encode(e, false)
+	}
+}
+
+func decodeBlock(d *decoder) Block {
+	var b Block
+
+	if d.readVersion(1, blockEncodingVersion) == 1 {
+		b.Version = legacyBlockVersion
+		b.Hash = d.readBytes()
+		b.Timestamp = d.readInt64()
+		b.PrevHash = d.readBytes()
+		b.Height = int(d.readInt64())
+		b.Validator = d.readBytes()
+		b.Winner = d.readBytes()
+	} else {
+		b.BlockHeader = decodeHeader(d)
+		b.Hash = d.readBytes()
+	}
+
+	// a transaction is at least 4+4+8+4+4 bytes
+	count := d.readCount(24)
+	for i := 0; i < count && d.err == nil; i++ {
+		b.Transactions = append(b.Transactions, decodeTransaction(d))
+	}
+
+	return b
+}
+
+// blockNeedsUpgrade checks if an encoded block is from before the current block encoding, meaning its hash has to be recomputed.
+func blockNeedsUpgrade(data []byte) bool {
+	if isLegacyGob(data) {
+		return true
+	}
+	d := newDecoder(data)
+	return d.readUint32() < blockEncodingVersion
+}
@@ -0,0 +1,406 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"github.com/boltdb/bolt"
+	"reflect"
+	"testing"
+)
+
+// testTransactions returns a transaction of every encoding version, with nothing random in them, so their IDs never change.
+func testTransactions() []struct {
+	name    string
+	version uint32
+	tx      Transaction
+} {
+	in := Input{TransactionID: fill(0x11, 64), OutputIndex: 1, Signature: fill(0xaa, 64), PubKey: fill(0xbb, 64)}
+	out := Output{Value: 10, PubKeyHash: fill(0x22, 20)}
+
+	return []struct {
+		name    string
+		version uint32
+		tx      Transaction
+	}{
+		{
+			name:    "coinbase",
+			version: txEncodingVersion,
+			tx: Transaction{
+				Vin:       []Input{{OutputIndex: -1, PubKey: fill(0x01, 8)}},
+				Vout:      []Output{out},
+				Timestamp: 1600000000,
+			},
+		},
+		{
+			name:    "pay to public key hash",
+			version: txEncodingVersion,
+			tx:      Transaction{Vin: []Input{in}, Vout: []Output{out, {Value: 3, PubKeyHash: fill(0x33, 20)}}, Timestamp: 1600000001},
+		},
+		{
+			name:    "multisig output",
+			version: txMultisigEncodingVersion,
+			tx:      Transaction{Vin: []Input{in}, Vout: []Output{{Value: 7, PubKeyHash: fill(0x44, 20), Multisig: true}}, Timestamp: 1600000002},
+		},
+		{
+			name:    "script",
+			version: txScriptEncodingVersion,
+			tx: Transaction{
+				Vin:       []Input{{TransactionID: fill(0x12, 64), Script: []byte{0x01, 0x02}}},
+				Vout:      []Output{{Value: 5, PubKeyHash: fill(0x55, 20), Script: []byte{OpTrue}}},
+				Timestamp: 1600000003,
+			},
+		},
+		{
+			name:    "lock time",
+			version: txLockEncodingVersion,
+			tx:      Transaction{Vin: []Input{in}, Vout: []Output{out}, Timestamp: 1600000004, LockTime: 1234},
+		},
+		{
+			name:    "sequence",
+			version: txLockEncodingVersion,
+			tx: Transaction{
+				Vin:       []Input{{TransactionID: fill(0x13, 64), Signature: fill(0xaa, 64), PubKey: fill(0xbb, 64), Sequence: 6}},
+				Vout:      []Output{out},
+				Timestamp: 1600000005,
+			},
+		},
+	}
+}
+
+// The IDs of the transactions of testTransactions. If one of these changes, the encoding changed, and every node computes different IDs
+// for the same transactions.
+var goldenTransactionIDs = map[string]string{
+	"coinbase":               "589a42077e55a650f39484f6167808b57fbaae0056105ab80322143452e88ca826fe7104e1ed75902edb369f9a99036e7cb93228d0f82af3607c9d3175fab903",
+	"pay to public key hash": "85ce3758db03e1f302653a049ebdbd318622032f5376bd60dc2f39f93c4f09ba962c71fc291de15c7329ceb69cbd18021ccde76858cbeeb6a36f02e9286c028d",
+	"multisig output":        "eeff7b0687961ef78ebb55fcbcfaed6638abb1837216318f3a374d65e3a02d8f6eb2c475d976fdc74385cc21cbcc0b65bd0a984cb55e60685a0c2230fe8a8d39",
+	"script":                 "6c2585d65ba34a2818ca3562327a80bbd01715b65eaf46e7d45f91ba722d7d37cb4478f2bf859d9db756dc4da7fbef06ecfd303afe6d4a0be07d092e7d72ec52",
+	"lock time":              "00e263f677b386fc11457a0d1399d45301f6c7ac622fa2ab7cb33bfe2ec493c7ca398202e2961f1af6d9139ef313b6217e32d7563a00d32fcf23e5108ee70771",
+	"sequence":               "4ab54e0b51ba24cbc3fa5ac0c80cc0ff77ef49bff6a62eb5e0ad57976a59db1b32c5e2bb1d83a531ca1e6fbaeaba54ee7304e22e89079bfcc82d58bea6f024df",
+}
+
+func TestTransactionEncoding(t *testing.T) {
+	for _, tt := range testTransactions() {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := tt.tx
+			id, err := tx.Hash()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tx.ID = id
+
+			if got := hex.EncodeToString(id); got != goldenTransactionIDs[tt.name] {
+				t.Errorf("ID is %s, want %s", got, goldenTransactionIDs[tt.name])
+			}
+
+			enc, err := tx.Serialize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version := binary.BigEndian.Uint32(enc); version != tt.version {
+				t.Errorf("encoded as version %d, want %d", version, tt.version)
+			}
+
+			decoded, err := DeserializeTransaction(enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := decoded.Serialize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(enc, again) {
+				t.Errorf("encoding changed after a round trip")
+			}
+			decodedID, err := decoded.Hash()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decodedID, id) || !bytes.Equal(decoded.ID, id) {
+				t.Errorf("ID changed after a round trip")
+			}
+			if !bytes.Equal(decoded.WitnessHash(), tx.WitnessHash()) {
+				t.Errorf("witness hash changed after a round trip")
+			}
+
+			// signatures and unlocking scripts aren't part of the ID
+			unsigned := tx
+			unsigned.Vin = append([]Input{}, tx.Vin...)
+			unsigned.Vin[0].Signature, unsigned.Vin[0].Script = nil, nil
+			unsignedID, err := unsigned.Hash()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(unsignedID, id) {
+				t.Errorf("ID covers the signatures")
+			}
+		})
+	}
+}
+
+func TestTransactionDecodingErrors(t *testing.T) {
+	tx := testTransactions()[1].tx
+	enc, err := tx.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknown := append([]byte{}, enc...)
+	binary.BigEndian.PutUint32(unknown, txLockEncodingVersion+1)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: []byte{}},
+		{name: "truncated", data: enc[:len(enc)-1]},
+		{name: "trailing bytes", data: append(append([]byte{}, enc...), 0)},
+		{name: "unknown version", data: unknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DeserializeTransaction(tt.data); err == nil {
+				t.Errorf("decoded without an error")
+			}
+		})
+	}
+}
+
+// testBlock returns a block of the given version with the transactions of testTransactions, with nothing random in it.
+func testBlock(version int32) Block {
+	var txs []Transaction
+	for _, tt := range testTransactions() {
+		tx := tt.tx
+		tx.ID, _ = tx.Hash()
+		txs = append(txs, tx)
+	}
+
+	block := Block{
+		BlockHeader: BlockHeader{
+			Version:   version,
+			PrevHash:  fill(0x66, 64),
+			Timestamp: 1600000100,
+			Height:    7,
+			Validator: fill(0x77, 20),
+		},
+		Transactions: txs,
+	}
+	block.MerkleRoot = block.ComputeMerkleRoot()
+	block.Hash, _ = block.GenerateHash()
+	return block
+}
+
+// The hashes of the blocks of testBlock, see goldenTransactionIDs.
+var goldenBlockHashes = map[int32]string{
+	legacyBlockVersion: "c43c14f158ae89463b8e3a628564874387eb133ab9e432146451552955afeb4151ab59431baa0f1b5edcb0fbb9d09b820398c995b36fe3cc11db726475019e99",
+	blockVersion:       "dfdd601b31665ee290467a829527589d25bb5dba7f0f5f60b8d8ecaf35ea922abfd5d3ee275fd6bb7dd4e57db67a44f1e9e1b4714f310034d86fe6dcab6cec68",
+}
+
+func TestBlockEncoding(t *testing.T) {
+	for _, version := range []int32{legacyBlockVersion, blockVersion} {
+		block := testBlock(version)
+
+		if got := hex.EncodeToString(block.Hash); got != goldenBlockHashes[version] {
+			t.Errorf("version %d block hash is %s, want %s", version, got, goldenBlockHashes[version])
+		}
+
+		enc, err := block.EncodeBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := DecodeBlock(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := decoded.EncodeBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(enc, again) {
+			t.Errorf("version %d block encoding changed after a round trip", version)
+		}
+		if decoded.Version != version || !bytes.Equal(decoded.BlockHeader.Hash(), block.Hash) {
+			t.Errorf("version %d block header changed after a round trip", version)
+		}
+
+		if _, err := DecodeBlock(enc[:len(enc)-1]); err == nil {
+			t.Errorf("decoded a truncated version %d block without an error", version)
+		}
+	}
+}
+
+func TestBlockIndexEncoding(t *testing.T) {
+	bi := BlockIndex{Height: 7, File: 2, Offset: 12345, Length: 678, Pruned: true, Header: testBlock(blockVersion).BlockHeader}
+
+	decoded, err := DecodeIndex(bi.EncodeIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.EncodeIndex(), bi.EncodeIndex()) || decoded.Height != 7 || decoded.File != 2 || decoded.Offset != 12345 ||
+		decoded.Length != 678 || !decoded.Pruned {
+		t.Errorf("block index changed after a round trip: %+v", decoded)
+	}
+}
+
+func testUndo() BlockUndo {
+	return BlockUndo{Transactions: []TxUndo{
+		// the coinbase spends nothing
+		{},
+		{Spent: []SpentOutput{
+			{TransactionID: fill(0x11, 64), Index: 0, Output: Output{Value: 5, PubKeyHash: fill(0x22, 20)}, BlockHeight: 3, Coinbase: true},
+			{TransactionID: fill(0x33, 64), Index: 2, Output: Output{Value: 7, PubKeyHash: fill(0x44, 20), Multisig: true}, BlockHeight: 4},
+		}},
+		{Spent: []SpentOutput{
+			{TransactionID: fill(0x55, 64), Index: 1, Output: Output{Value: 9, Script: []byte{OpTrue}}, BlockHeight: 6},
+		}},
+	}}
+}
+
+func TestUndoEncoding(t *testing.T) {
+	undo := testUndo()
+
+	enc, err := undo.EncodeUndo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isLegacyGob(enc) {
+		t.Errorf("undo data is encoded with gob")
+	}
+
+	decoded, err := DecodeUndo(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, undo) {
+		t.Errorf("undo data changed after a round trip:\n got %+v\nwant %+v", decoded, undo)
+	}
+}
+
+func TestUndoDecodingErrors(t *testing.T) {
+	undo := testUndo()
+	enc, err := undo.EncodeUndo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// how undo data was stored before version 7
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(undo); err != nil {
+		t.Fatal(err)
+	}
+	legacy := buff.Bytes()
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: []byte{}},
+		{name: "truncated", data: enc[:len(enc)-1]},
+		{name: "trailing bytes", data: append(append([]byte{}, enc...), 0)},
+		{name: "gob", data: legacy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeUndo(tt.data); err == nil {
+				t.Errorf("decoded without an error")
+			}
+		})
+	}
+
+	// gob undo data is only read to migrate it
+	migrated, err := decodeLegacyUndo(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(migrated, undo) {
+		t.Errorf("legacy undo data decoded as %+v, want %+v", migrated, undo)
+	}
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	var e Encoder
+	e.WriteUint32(1)
+	e.WriteInt32(-2)
+	e.WriteInt64(-3)
+	e.WriteBytes([]byte("four"))
+	e.WriteBool(true)
+	e.WriteUint32(2)
+	e.WriteBytes(fill(0x05, 3))
+	e.WriteBytes(nil)
+
+	d := NewDecoder(e.Bytes())
+	if v := d.ReadVersion(1); v != 1 {
+		t.Errorf("version is %d, want 1", v)
+	}
+	if v := d.ReadInt32(); v != -2 {
+		t.Errorf("int32 is %d, want -2", v)
+	}
+	if v := d.ReadInt64(); v != -3 {
+		t.Errorf("int64 is %d, want -3", v)
+	}
+	if v := d.ReadBytes(); string(v) != "four" {
+		t.Errorf("bytes are %q, want \"four\"", v)
+	}
+	if v := d.ReadBool(); !v {
+		t.Errorf("bool is false, want true")
+	}
+	if count := d.ReadCount(4); count != 2 {
+		t.Errorf("count is %d, want 2", count)
+	}
+	if v := d.ReadBytes(); !bytes.Equal(v, fill(0x05, 3)) {
+		t.Errorf("bytes are %x, want %x", v, fill(0x05, 3))
+	}
+	if v := d.ReadBytes(); v != nil {
+		t.Errorf("bytes are %x, want none", v)
+	}
+	if err := d.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a read past the end sticks until Finish
+	d = NewDecoder(e.Bytes()[:2])
+	d.ReadUint32()
+	d.ReadInt64()
+	if err := d.Finish(); err == nil {
+		t.Errorf("decoded past the end without an error")
+	}
+}
+
+func TestMigrateUndo(t *testing.T) {
+	tc := newTestChain(t)
+	undo := testUndo()
+	hash := fill(0x66, 64)
+
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(undo); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.DB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(undoBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put(hash, buff.Bytes())
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tc.migrateUndo(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tc.DB.View(func(tx *bolt.Tx) error {
+		migrated, err := getBlockUndo(tx, hash)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(migrated, undo) {
+			t.Errorf("undo data migrated to %+v, want %+v", migrated, undo)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
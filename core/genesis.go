@@ -0,0 +1,159 @@
+package core
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Genesis
+
+// Every network starts from its own genesis block, which is read from a genesis file, see readGenesis. The genesis files of mainnet,
+// testnet and regtest ship with the source, and are built into the binary. A new network's genesis block is made with create-genesis from a parameter file:
+//
+//   {
+//     "timestamp": 1600000000,
+//     "message": "Welcome to a world created by the people, for the people.",
+//     "allocations": [{"address": "1...", "amount": 50}, {"address": "1...", "amount": 25}],
+//     "validators": ["1...", "1..."]
+//   }
+//
+// The genesis block has a single coinbase transaction, with an output for every allocation and the message in its input, where a normal
+// coinbase has random extra data. The public key hashes of the initial validators are stored one after another in the Validator field
+// of the header, see GenesisValidators. The same parameter file always makes the same genesis block, so anyone can check it.
+//
+// Networks with a GenesisHash only ever accept that genesis block. Regtest has none, so a private network can run on it with any genesis
+// block made with create-genesis.
+
+// GenesisParams are the parameters of a genesis block.
+type GenesisParams struct {
+	Timestamp   int64               `json:"timestamp"`   // Timestamp is the time of the genesis block. Now if it is 0.
+	Message     string              `json:"message"`     // Message is stored in the coinbase. genesisData if it is empty.
+	Allocations []GenesisAllocation `json:"allocations"` // Allocations are the outputs of the coinbase.
+	Validators  []string            `json:"validators"`  // Validators are the addresses of the initial validators.
+}
+
+// GenesisAllocation is an amount that the genesis block pays to an address.
+type GenesisAllocation struct {
+	Address string `json:"address"`
+	Amount  int    `json:"amount"`
+}
+
+// ReadGenesisParams reads in a genesis parameter file.
+func ReadGenesisParams(path string) (GenesisParams, error) {
+	var gp GenesisParams
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Printf("error reading genesis parameter file %s: %v\n", path, err)
+		return gp, err
+	}
+
+	if err := json.Unmarshal(data, &gp); err != nil {
+		fmt.Printf("error decoding genesis parameter file %s: %v\n", path, err)
+		return gp, err
+	}
+
+	return gp, nil
+}
+
+// NewGenesisBlock builds a genesis block from its parameters. Every address has to be an address of the current network.
+func NewGenesisBlock(gp GenesisParams) (Block, error) {
+	if len(gp.Allocations) == 0 {
+		return Block{}, errors.New("ERROR: a genesis block needs at least one allocation")
+	}
+	if gp.Timestamp == 0 {
+		gp.Timestamp = time.Now().Unix()
+	}
+	if gp.Message == "" {
+		gp.Message = genesisData
+	}
+
+	cbTX := Transaction{
+		Timestamp: gp.Timestamp,
+		Vin: []Input{{
+			OutputIndex: -1,
+			PubKey:      []byte(gp.Message),
+		}},
+	}
+	for _, alloc := range gp.Allocations {
+		if !CheckValidAddress([]byte(alloc.Address)) {
+			return Block{}, fmt.Errorf("ERROR: allocation address %s is not a valid %s address", alloc.Address, Params.Name)
+		}
+		if alloc.Amount <= 0 {
+			return Block{}, fmt.Errorf("ERROR: allocation of %d to %s, amounts have to be positive", alloc.Amount, alloc.Address)
+		}
+		cbTX.Vout = append(cbTX.Vout, CreateOutput(alloc.Address, alloc.Amount))
+	}
+
+	var err error
+	cbTX.ID, err = cbTX.Hash()
+	if err != nil {
+		return Block{}, err
+	}
+
+	var validators []byte
+	for _, address := range gp.Validators {
+		if !CheckValidAddress([]byte(address)) || IsMultisigAddress([]byte(address)) {
+			return Block{}, fmt.Errorf("ERROR: validator address %s is not a valid %s address of a single key", address, Params.Name)
+		}
+		validators = append(validators, PubKeyHashFromAddress([]byte(address))...)
+	}
+
+	genesis := Block{
+		BlockHeader: BlockHeader{
+			Version:   legacyBlockVersion,
+			Timestamp: gp.Timestamp,
+			Height:    0,
+			Validator: validators,
+		},
+		Transactions: []Transaction{cbTX},
+	}
+
+	genesis.MerkleRoot = genesis.ComputeMerkleRoot()
+	genesis.Hash, err = genesis.GenerateHash()
+	return genesis, err
+}
+
+// GenesisValidators returns the public key hashes of the initial validators, from the header of a genesis block.
+func GenesisValidators(header BlockHeader) [][]byte {
+	var validators [][]byte
+	for i := 0; i+pubKeyHashLen <= len(header.Validator); i += pubKeyHashLen {
+		validators = append(validators, header.Validator[i:i+pubKeyHashLen])
+	}
+	return validators
+}
+
+// WriteGenesis writes a genesis block to the genesis file in the current network's directory, where it is picked up when the chain is
+// created, see readGenesis. An existing genesis file is only replaced if overwrite is set. It returns the path of the file.
+func WriteGenesis(genesis Block, overwrite bool) (string, error) {
+	path := networkGenesisPath()
+
+	if _, err := os.Stat(path); err == nil && !overwrite {
+		return path, fmt.Errorf("ERROR: %s already exists", path)
+	}
+
+	enc, err := genesis.EncodeBlock()
+	if err != nil {
+		return path, err
+	}
+
+	if err := WriteFileAtomic(path, enc, 0644); err != nil {
+		fmt.Printf("error writing genesis file %s: %v\n", path, err)
+		return path, err
+	}
+
+	return path, nil
+}
+
+// checkGenesis makes sure a genesis block hash is the genesis block of the current network, if the network has a fixed one.
+func checkGenesis(hash []byte) error {
+	if Params.GenesisHash == "" || Params.GenesisHash == hex.EncodeToString(hash) {
+		return nil
+	}
+	return fmt.Errorf("ERROR: genesis block %s is not the %s genesis block %s", hex.EncodeToString(hash), Params.Name, Params.GenesisHash)
+}
@@ -0,0 +1,156 @@
+package core
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fixtures every test of this package builds on.
+
+// fill returns n bytes of b, for fixed test data.
+func fill(b byte, n int) []byte {
+	return bytes.Repeat([]byte{b}, n)
+}
+
+// testChain is a regtest chain in a temporary data directory. Its genesis block allocates 100 to wallet, and every block mined with mine
+// pays its reward to wallet too.
+type testChain struct {
+	*Blockchain
+	wallet  Wallet
+	address string
+}
+
+// newTestChain creates a testChain, and closes it once the test is done.
+func newTestChain(t *testing.T) testChain {
+	t.Helper()
+
+	if err := SelectNetwork(RegTest.Name, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	w, address := newTestWallet(t)
+
+	genesis, err := NewGenesisBlock(GenesisParams{
+		Timestamp:   time.Now().Unix() - 60,
+		Allocations: []GenesisAllocation{{Address: address, Amount: 100}},
+		Validators:  []string{address},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteGenesis(genesis, false); err != nil {
+		t.Fatal(err)
+	}
+
+	bc, err := CreateBlockchain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bc.DB.Close() })
+
+	return testChain{Blockchain: bc, wallet: w, address: address}
+}
+
+// newTestWallet creates a wallet, along with its address.
+func newTestWallet(t *testing.T) (Wallet, string) {
+	t.Helper()
+
+	w, err := CreateWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := w.GetAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, string(address)
+}
+
+// pay creates a transaction that pays amount from the wallet of the chain to address, with a fee.
+func (tc testChain) pay(t *testing.T, address string, amount, fee int) Transaction {
+	t.Helper()
+
+	tx, err := tc.buildTransaction(tc.address, tc.wallet.PublicKey, []Payment{{Address: address, Amount: amount}}, TxOptions{Fee: fee})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (UTXO{Blockchain: tc.Blockchain}).SignTransaction(tx, tc.wallet.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// spend creates a transaction that pays amount to address out of the output at index of the transaction txID, which has to belong to the
+// wallet of the chain. Whatever is left of the output is the fee.
+func (tc testChain) spend(t *testing.T, txID []byte, index int, address string, amount int) Transaction {
+	t.Helper()
+
+	tx := Transaction{
+		Vin:       []Input{{TransactionID: txID, OutputIndex: index, PubKey: tc.wallet.PublicKey}},
+		Vout:      []Output{CreateOutput(address, amount)},
+		Timestamp: time.Now().Unix(),
+	}
+	var err error
+	if tx.ID, err = tx.Hash(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (UTXO{Blockchain: tc.Blockchain}).SignTransaction(tx, tc.wallet.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// nextBlock creates a block on the tip with txs, and a coinbase that claims fees.
+func (tc testChain) nextBlock(t *testing.T, fees int, txs ...Transaction) Block {
+	t.Helper()
+
+	tip, err := tc.getTip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase, err := NewCoinbaseTransaction(tc.address, fees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := NewBlock(tip, append([]Transaction{coinbase}, txs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// mine validates and connects the next block with txs.
+func (tc testChain) mine(t *testing.T, fees int, txs ...Transaction) Block {
+	t.Helper()
+
+	block := tc.nextBlock(t, fees, txs...)
+	if err := tc.ValidateBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.connectBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// rehash recomputes the merkle root and the hash of a block after its contents changed.
+func rehash(block *Block) {
+	block.MerkleRoot = block.ComputeMerkleRoot()
+	block.Hash, _ = block.GenerateHash()
+}
+
+// checkError fails the test unless err contains want, or is nil when want is empty.
+func checkError(t *testing.T, err error, want string) {
+	t.Helper()
+
+	if want == "" {
+		if err != nil {
+			t.Errorf("got %v, want no error", err)
+		}
+		return
+	}
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got %v, want an error with %q", err, want)
+	}
+}
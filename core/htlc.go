@@ -0,0 +1,335 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Hash Time-Locked Contracts
+
+// A hash time-locked contract, or HTLC, is an output that the recipient can spend by showing the secret behind a hash, and that the
+// sender can take back once its lock time is past. Its locking script is:
+//
+//   OpIf
+//     OpSize 32 OpEqualVerify OpSha256 <secret hash> OpEqualVerify OpDup OpHash <recipient public key hash>
+//   OpElse
+//     <lock time> OpCheckLockTimeVerify OpDup OpHash <refund public key hash>
+//   OpEndIf
+//   OpEqualVerify OpCheckSig
+//
+// The recipient redeems it with the unlocking script <signature> <public key> <secret> OpTrue, and the sender refunds it with
+// <signature> <public key> OpFalse. The secret is 32 bytes and its hash is a sha256, the same as the contracts of other chains, so the
+// same secret can lock a contract on both chains of an atomic swap:
+//
+//   1. The initiator makes up a secret, and pays the participant to a contract with its hash.
+//   2. The participant checks that contract, and pays the initiator to a contract with the same hash on the other chain, with a lock
+//      time that is well before the initiator's, see CheckSwapLockTimes.
+//   3. The initiator redeems the participant's contract, which shows the secret on the other chain.
+//   4. The participant takes the secret from that redeem transaction, see ExtractSecret, and redeems the initiator's contract with it.
+//
+// If either side stops half way, both get their coins back with a refund once the lock times are past. Nothing stops a recipient from
+// redeeming after the lock time, as long as the contract wasn't refunded yet.
+
+const (
+	// secretLen is the length of the secret of a contract.
+	secretLen = 32
+	// swapMarginTime is how many seconds before the initiator's contract the participant's contract has to be refundable, when both lock
+	// times are unix times. It leaves the participant time to redeem once the initiator shows the secret at the last moment.
+	swapMarginTime = 12 * 60 * 60
+	// swapMarginBlocks is the same as swapMarginTime, for lock times that are block heights.
+	swapMarginBlocks = 12
+)
+
+// HTLC is a hash time-locked contract.
+type HTLC struct {
+	SecretHash []byte // SecretHash is the sha256 of the secret.
+	Recipient  []byte // Recipient is the public key hash that can redeem the contract with the secret.
+	Refund     []byte // Refund is the public key hash that can refund the contract after LockTime.
+	LockTime   int64  // LockTime is when the contract can be refunded, see SpendContext.
+}
+
+// NewSecret makes up a random secret for a contract, and returns it with its hash.
+func NewSecret() ([]byte, []byte, error) {
+	secret := make([]byte, secretLen)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, err
+	}
+	hash := sha256.Sum256(secret)
+	return secret, hash[:], nil
+}
+
+// NewHTLC creates a contract that the address recipient can redeem with the secret behind secretHash, and the address refund can refund
+// after lockTime.
+func NewHTLC(secretHash []byte, recipient, refund string, lockTime int64) (HTLC, error) {
+	if len(secretHash) != sha256.Size {
+		return HTLC{}, fmt.Errorf("ERROR: secret hash is %d bytes, it has to be %d", len(secretHash), sha256.Size)
+	}
+	for _, address := range []string{recipient, refund} {
+		if !CheckValidAddress([]byte(address)) || IsMultisigAddress([]byte(address)) {
+			return HTLC{}, fmt.Errorf("ERROR: %s is not a valid %s address of a single key", address, Params.Name)
+		}
+	}
+	if lockTime <= 0 {
+		return HTLC{}, errors.New("ERROR: a contract needs a lock time")
+	}
+
+	return HTLC{
+		SecretHash: secretHash,
+		Recipient:  PubKeyHashFromAddress([]byte(recipient)),
+		Refund:     PubKeyHashFromAddress([]byte(refund)),
+		LockTime:   lockTime,
+	}, nil
+}
+
+// Script returns the locking script of the contract, see the description at the top of this file.
+func (h HTLC) Script() []byte {
+	var sb ScriptBuilder
+	sb.AddOp(OpIf)
+	sb.AddOp(OpSize).AddInt(secretLen).AddOp(OpEqualVerify, OpSha256).AddData(h.SecretHash).AddOp(OpEqualVerify)
+	sb.AddOp(OpDup, OpHash).AddData(h.Recipient)
+	sb.AddOp(OpElse)
+	sb.AddInt(h.LockTime).AddOp(OpCheckLockTimeVerify)
+	sb.AddOp(OpDup, OpHash).AddData(h.Refund)
+	sb.AddOp(OpEndIf)
+	sb.AddOp(OpEqualVerify, OpCheckSig)
+	return sb.Script()
+}
+
+// ParseHTLC reads a contract back out of a locking script, or returns an error if the script isn't a contract.
+func ParseHTLC(script []byte) (HTLC, error) {
+	ops, err := parseScript(script)
+	if err != nil {
+		return HTLC{}, err
+	}
+	if len(ops) != 19 {
+		return HTLC{}, errors.New("ERROR: script is not a contract")
+	}
+
+	lockTime, err := scriptNum(ops[11].data)
+	if err != nil || !ops[11].isPush() {
+		return HTLC{}, errors.New("ERROR: script is not a contract")
+	}
+	h := HTLC{
+		SecretHash: ops[5].data,
+		Recipient:  ops[9].data,
+		Refund:     ops[15].data,
+		LockTime:   lockTime,
+	}
+
+	// the easiest way to check every opcode is to build the script again
+	if len(h.SecretHash) != sha256.Size || bytes.Compare(h.Script(), script) != 0 {
+		return HTLC{}, errors.New("ERROR: script is not a contract")
+	}
+	return h, nil
+}
+
+// CheckSwapLockTimes makes sure the participant's contract of a swap can be refunded well before the initiator's. Otherwise the initiator
+// could wait for the participant's contract to be refundable, redeem it and show the secret, and refund their own contract before the
+// participant gets to redeem it. Both lock times have to be of the same kind, heights or unix times, for them to be compared.
+func CheckSwapLockTimes(participant, initiator int64) error {
+	if (participant < lockTimeThreshold) != (initiator < lockTimeThreshold) {
+		return fmt.Errorf("ERROR: can't compare the lock times %s and %s, use unix times for both or block heights for both",
+			FormatLockTime(participant), FormatLockTime(initiator))
+	}
+
+	margin := int64(swapMarginTime)
+	if participant < lockTimeThreshold {
+		margin = swapMarginBlocks
+	}
+	if initiator-participant < margin {
+		return fmt.Errorf("ERROR: the contract has to be refundable well before the initiator's at %s, %s is too late",
+			FormatLockTime(initiator), FormatLockTime(participant))
+	}
+	return nil
+}
+
+// LockTimeRemaining describes how long it is until a lock time is past, as blocks to go for a block height, or time to go for a unix time.
+func (bc *Blockchain) LockTimeRemaining(lockTime int64) (string, error) {
+	ctx, err := bc.NextSpendContext()
+	if err != nil {
+		return "", err
+	}
+
+	if ctx.lockTimePassed(lockTime) {
+		return "past", nil
+	}
+	if lockTime < lockTimeThreshold {
+		return fmt.Sprintf("%d block(s) to go", lockTime-int64(ctx.Height)), nil
+	}
+
+	// the time of the block before a spend has to be past the lock time, so after the clock is there it takes one more block
+	remaining := time.Until(time.Unix(lockTime, 0)).Round(time.Second)
+	if remaining <= 0 {
+		return "once the next block is made", nil
+	}
+	return fmt.Sprintf("%s to go", remaining), nil
+}
+
+// NewHTLCTransaction creates and signs a transaction that pays amount from one of our wallets to a contract. The contract is always the
+// first output.
+func (bc *Blockchain) NewHTLCTransaction(from string, h HTLC, amount int, opts TxOptions) (Transaction, error) {
+	return bc.NewTransaction(from, []Payment{{Amount: amount, Script: h.Script()}}, opts)
+}
+
+// GetHTLC looks up the contract of an unspent output.
+func (u UTXO) GetHTLC(txID []byte, index int) (HTLC, UnspentOutput, error) {
+	uo, found, err := u.GetUnspentOutput(txID, index)
+	if err != nil {
+		return HTLC{}, uo, err
+	}
+	if !found {
+		return HTLC{}, uo, fmt.Errorf("ERROR: output %s:%d is spent or doesn't exist", hex.EncodeToString(txID), index)
+	}
+
+	h, err := ParseHTLC(uo.Output.Script)
+	return h, uo, err
+}
+
+// RedeemHTLC creates and signs a transaction that redeems a contract with its secret, and pays it to the recipient, minus fee.
+func (bc *Blockchain) RedeemHTLC(txID []byte, index int, secret []byte, fee int) (Transaction, error) {
+	h, uo, err := UTXO{Blockchain: bc}.GetHTLC(txID, index)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	hash := sha256.Sum256(secret)
+	if len(secret) != secretLen || bytes.Compare(hash[:], h.SecretHash) != 0 {
+		return Transaction{}, errors.New("ERROR: that is not the secret of this contract")
+	}
+
+	var sb ScriptBuilder
+	return bc.spendHTLC(uo, h.Recipient, fee, 0, func(signature, pubKey []byte) []byte {
+		return sb.AddData(signature).AddData(pubKey).AddData(secret).AddOp(OpTrue).Script()
+	})
+}
+
+// RefundHTLC creates and signs a transaction that refunds a contract once its lock time is past, and pays it back to the sender, minus
+// fee.
+func (bc *Blockchain) RefundHTLC(txID []byte, index int, fee int) (Transaction, error) {
+	h, uo, err := UTXO{Blockchain: bc}.GetHTLC(txID, index)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	ctx, err := bc.NextSpendContext()
+	if err != nil {
+		return Transaction{}, err
+	}
+	if !ctx.lockTimePassed(h.LockTime) {
+		return Transaction{}, fmt.Errorf("ERROR: contract can't be refunded until %s", FormatLockTime(h.LockTime))
+	}
+
+	var sb ScriptBuilder
+	// OpCheckLockTimeVerify checks the lock time of the refund itself, which keeps it out of the chain until the contract's is past
+	return bc.spendHTLC(uo, h.Refund, fee, h.LockTime, func(signature, pubKey []byte) []byte {
+		return sb.AddData(signature).AddData(pubKey).AddOp(OpFalse).Script()
+	})
+}
+
+// spendHTLC creates a transaction that spends a contract to the wallet of pubKeyHash, with the unlocking script that unlock makes. The
+// transaction is locked until lockTime.
+func (bc *Blockchain) spendHTLC(uo UnspentOutput, pubKeyHash []byte, fee int, lockTime int64, unlock func(signature, pubKey []byte) []byte) (Transaction, error) {
+	wallets, err := ReadWalletsFromFile()
+	if err != nil {
+		fmt.Printf("error reading wallets from file for spending a contract: %v\n", err)
+		return Transaction{}, err
+	}
+
+	var (
+		wallet  Wallet
+		address string
+	)
+	for add, w := range wallets.Wallets {
+		hash, err := HashPublicKey(w.PublicKey)
+		if err != nil {
+			return Transaction{}, err
+		}
+		if bytes.Compare(hash, pubKeyHash) == 0 {
+			wallet, address = w, add
+		}
+	}
+	if address == "" {
+		return Transaction{}, errors.New("ERROR: none of our wallets can spend this contract")
+	}
+
+	if fee < 0 || uo.Output.Value-fee <= 0 {
+		return Transaction{}, fmt.Errorf("ERROR: a fee of %d doesn't leave anything of the %d in the contract", fee, uo.Output.Value)
+	}
+
+	tx := Transaction{
+		Vin:       []Input{{TransactionID: uo.TransactionID, OutputIndex: uo.Index}},
+		Vout:      []Output{CreateOutput(address, uo.Output.Value-fee)},
+		Timestamp: time.Now().Unix(),
+		LockTime:  lockTime,
+	}
+	tx.ID, err = tx.Hash()
+	if err != nil {
+		return tx, err
+	}
+
+	hash, err := tx.sigHash(0, uo.Output)
+	if err != nil {
+		return tx, err
+	}
+	signature, err := signHash(wallet.PrivateKey, hash)
+	if err != nil {
+		fmt.Printf("error signing contract spend: %v\n", err)
+		return tx, err
+	}
+	tx.Vin[0].Script = unlock(signature, wallet.PublicKey)
+
+	return tx, nil
+}
+
+// ExtractSecret finds the secret behind secretHash in the unlocking scripts of a transaction, which is how the participant of a swap
+// learns the secret once the initiator redeems.
+func ExtractSecret(tx Transaction, secretHash []byte) ([]byte, error) {
+	for _, in := range tx.Vin {
+		ops, err := parseScript(in.Script)
+		if err != nil {
+			continue
+		}
+		for _, so := range ops {
+			hash := sha256.Sum256(so.data)
+			if so.isPush() && len(so.data) == secretLen && bytes.Compare(hash[:], secretHash) == 0 {
+				return so.data, nil
+			}
+		}
+	}
+	return nil, errors.New("ERROR: transaction doesn't have the secret")
+}
+
+// FindSpendingTransaction finds the transaction on the main chain that spends the output txID:index. It goes through the blocks from the
+// tip down, until it finds it or gets to the transaction txID itself.
+func (bc *Blockchain) FindSpendingTransaction(txID []byte, index int) (Transaction, error) {
+	tipHeight, err := bc.GetChainHeight()
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	for height := int(tipHeight); height >= 0; height-- {
+		block, err := bc.GetBlockByHeight(height)
+		if err != nil {
+			fmt.Printf("error reading block #%d while looking for a spend: %v\n", height, err)
+			return Transaction{}, err
+		}
+
+		for _, tx := range block.Transactions {
+			if bytes.Compare(tx.ID, txID) == 0 {
+				return Transaction{}, fmt.Errorf("ERROR: output %s:%d isn't spent", hex.EncodeToString(txID), index)
+			}
+			for _, in := range tx.Vin {
+				if bytes.Compare(in.TransactionID, txID) == 0 && in.OutputIndex == index {
+					return tx, nil
+				}
+			}
+		}
+	}
+
+	return Transaction{}, fmt.Errorf("ERROR: transaction %s is not on the main chain", hex.EncodeToString(txID))
+}
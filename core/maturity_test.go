@@ -0,0 +1,49 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestCoinbaseMaturity(t *testing.T) {
+	tc := newTestChain(t)
+	_, other := newTestWallet(t)
+	utxo := UTXO{Blockchain: tc.Blockchain}
+
+	coinbase := tc.mine(t, 0).Transactions[0]
+	reward := coinbase.Vout[0].Value
+
+	// spendable reports whether FindSpendableOutputs picks the coinbase output
+	spendable := func() bool {
+		_, selected, err := utxo.FindSpendableOutputs([]byte(tc.address), 100+reward, LargestFirst{})
+		if err != nil {
+			return false
+		}
+		for _, uo := range selected {
+			if bytes.Equal(uo.TransactionID, coinbase.ID) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// the coinbase of block #1 can be spent from block #1+CoinbaseMaturity on
+	for height := 2; height <= 1+Params.CoinbaseMaturity; height++ {
+		mature := height == 1+Params.CoinbaseMaturity
+		if got := spendable(); got != mature {
+			t.Fatalf("block #%d: FindSpendableOutputs picked the coinbase: %v, want %v", height, got, mature)
+		}
+
+		want := fmt.Sprintf("can't be spent until block #%d", 1+Params.CoinbaseMaturity)
+		if mature {
+			want = ""
+		}
+		block := tc.nextBlock(t, reward-1, tc.spend(t, coinbase.ID, 0, other, 1))
+		checkError(t, tc.ValidateBlock(block), want)
+
+		if !mature {
+			tc.mine(t, 0)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha512"
+)
+
+// Merkle Tree
+
+// The merkle root commits a block header to every transaction in the block. The leaves of the tree are the witness hashes of the
+// transactions, the sha512 of the full encoded transaction, signatures and unlocking scripts included. That way nobody can change the
+// signatures of a block without changing its hash. Legacy blocks, see legacyBlockVersion, use the transaction IDs as leaves instead, and
+// every parent is the sha512 of its two children joined together. When a level has an odd number of nodes, the last one is paired with itself.
+// A merkle proof is the list of siblings on the way from a leaf up to the root, which is enough to prove that a transaction is in a
+// block with only the block header.
+
+// ComputeMerkleRoot computes the merkle root of the transactions in a block.
+func (b Block) ComputeMerkleRoot() []byte {
+	return MerkleRoot(b.MerkleLeaves())
+}
+
+// MerkleLeaves returns the leaves of the merkle tree of a block, in the order of its transactions.
+func (b Block) MerkleLeaves() [][]byte {
+	var leaves [][]byte
+	for _, tx := range b.Transactions {
+		if b.Version == legacyBlockVersion {
+			leaves = append(leaves, tx.ID)
+		} else {
+			leaves = append(leaves, tx.WitnessHash())
+		}
+	}
+	return leaves
+}
+
+// MerkleRoot computes the merkle root of a list of transaction IDs. An empty list has no root.
+func MerkleRoot(ids [][]byte) []byte {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	level := ids
+	for len(level) > 1 {
+		level = merkleParents(level)
+	}
+	return level[0]
+}
+
+// MerkleProof returns the proof that the transaction ID at index is part of the merkle tree of ids.
+func MerkleProof(ids [][]byte, index int) [][]byte {
+	var proof [][]byte
+
+	level := ids
+	for len(level) > 1 {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			sibling = index
+		}
+		proof = append(proof, level[sibling])
+
+		level = merkleParents(level)
+		index /= 2
+	}
+
+	return proof
+}
+
+// VerifyMerkleProof checks a proof from MerkleProof against a merkle root. index is the position of the transaction in its block.
+func VerifyMerkleProof(root, id []byte, index int, proof [][]byte) bool {
+	hash := id
+	for _, sibling := range proof {
+		if index%2 == 0 {
+			hash = merkleHash(hash, sibling)
+		} else {
+			hash = merkleHash(sibling, hash)
+		}
+		index /= 2
+	}
+	return bytes.Compare(hash, root) == 0
+}
+
+// merkleParents hashes every pair of nodes in a level of the tree into the level above it.
+func merkleParents(level [][]byte) [][]byte {
+	var parents [][]byte
+
+	for i := 0; i < len(level); i += 2 {
+		right := level[i]
+		if i+1 < len(level) {
+			right = level[i+1]
+		}
+		parents = append(parents, merkleHash(level[i], right))
+	}
+
+	return parents
+}
+
+func merkleHash(left, right []byte) []byte {
+	hash := sha512.Sum512(append(append([]byte{}, left...), right...))
+	return hash[:]
+}
@@ -0,0 +1,42 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMerkleRootCoversWitness(t *testing.T) {
+	for _, tt := range []struct {
+		version int32
+		covers  bool
+	}{
+		{version: legacyBlockVersion, covers: false},
+		{version: blockVersion, covers: true},
+	} {
+		block := testBlock(tt.version)
+		root := block.MerkleRoot
+
+		block.Transactions[1].Vin[0].Signature = fill(0xcc, 64)
+		if changed := !bytes.Equal(block.ComputeMerkleRoot(), root); changed != tt.covers {
+			t.Errorf("version %d: changing a signature changes the merkle root: %v, want %v", tt.version, changed, tt.covers)
+		}
+	}
+}
+
+func TestMerkleProof(t *testing.T) {
+	block := testBlock(blockVersion)
+	leaves := block.MerkleLeaves()
+
+	for n := 1; n <= len(leaves); n++ {
+		root := MerkleRoot(leaves[:n])
+		for index := 0; index < n; index++ {
+			proof := MerkleProof(leaves[:n], index)
+			if !VerifyMerkleProof(root, leaves[index], index, proof) {
+				t.Errorf("%d leaves: proof of leaf %d doesn't verify", n, index)
+			}
+			if n > 1 && VerifyMerkleProof(root, leaves[(index+1)%n], index, proof) {
+				t.Errorf("%d leaves: proof of leaf %d verifies another leaf", n, index)
+			}
+		}
+	}
+}
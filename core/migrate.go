@@ -0,0 +1,525 @@
+package core
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Migrations
+
+// The blocks bucket stores the version of the on disk format under the key 'v'. A chain without a 'v' key is version 0. Every time a
+// node opens its chain, each migration between the stored version and dbVersion is run in order.
+//
+// 1: blocks are stored in the canonical encoding instead of gob, and every block hash and transaction ID is recomputed with it.
+// 2: blocks have a header with a merkle root, and the block hash is the hash of the header.
+// 3: blocks are appended to rolling block files, and the blocks bucket indexes where each one is stored, see blockstore.go.
+// 4: the chainstate stores every unspent output under its own key, with an index by public key hash and cached balances, see utxo.go.
+// 5: the block index keeps the header of every block, and whether the block was pruned, see prune.go.
+// 6: the chainstate stores the hash of the block it is at, see recover.go.
+// 7: undo data is stored in the canonical encoding instead of gob, see undo.go.
+
+const (
+	// dbVersion is the current version of the on disk format.
+	dbVersion = 7
+	// migrationBucket is where migrateBlockFiles builds up the new blocks bucket, and migrationIDsBucket where it keeps the old and new
+	// IDs of transactions when it rehashes.
+	migrationBucket    = "blocksmigration"
+	migrationIDsBucket = "migrationids"
+	// migrateBatchSize is how many blocks migrateBlockFiles migrates per db transaction.
+	migrateBatchSize = 500
+)
+
+// legacySideBlocksDir returns where side branch blocks were stored before version 3, one file per block named after its hash.
+func legacySideBlocksDir() string {
+	return filepath.Join(blocksDir(), "side")
+}
+
+// legacyBlockFile returns the filename main chain blocks were stored in before version 3, one file per block named after its height.
+func legacyBlockFile(height int) string {
+	return filepath.Join(blocksDir(), fmt.Sprintf("%d.dat", height))
+}
+
+// migrate brings an existing chain up to date with the current on disk format.
+func (bc *Blockchain) migrate() error {
+	version, err := bc.getDBVersion()
+	if err != nil {
+		return err
+	}
+
+	// each of these rewrites every block in the current format, so only one of them ever has to run
+	if version < 1 {
+		fmt.Printf("migrating chain to the canonical encoding, this rehashes every block...\n")
+		if err := bc.migrateBlockFiles(true); err != nil {
+			fmt.Printf("error migrating chain to the canonical encoding: %v\n", err)
+			return err
+		}
+	} else if version < 2 {
+		fmt.Printf("migrating chain to block headers, this rehashes every block...\n")
+		if err := bc.migrateBlockFiles(true); err != nil {
+			fmt.Printf("error migrating chain to block headers: %v\n", err)
+			return err
+		}
+	} else if version < 3 {
+		fmt.Printf("migrating chain to block files...\n")
+		if err := bc.migrateBlockFiles(false); err != nil {
+			fmt.Printf("error migrating chain to block files: %v\n", err)
+			return err
+		}
+	} else if version < 5 {
+		fmt.Printf("adding headers to the block index...\n")
+		if err := bc.migrateBlockIndex(); err != nil {
+			fmt.Printf("error adding headers to the block index: %v\n", err)
+			return err
+		}
+	}
+
+	// rebuilding the chainstate takes care of both transaction IDs that changed before version 2, and the chainstate layout of version 4
+	if version < 4 {
+		fmt.Printf("rebuilding the chainstate...\n")
+		utxo := UTXO{Blockchain: bc}
+		if err := utxo.Reindex(); err != nil {
+			fmt.Printf("error rebuilding the chainstate: %v\n", err)
+			return err
+		}
+	} else if version < 6 {
+		if err := bc.migrateChainstateTip(); err != nil {
+			fmt.Printf("error marking the block the chainstate is at: %v\n", err)
+			return err
+		}
+	}
+
+	// a chainstate that was just rebuilt already has its undo data in the canonical encoding, migrateUndo leaves it alone
+	if version < 7 {
+		fmt.Printf("migrating undo data to the canonical encoding...\n")
+		if err := bc.migrateUndo(); err != nil {
+			fmt.Printf("error migrating undo data to the canonical encoding: %v\n", err)
+			return err
+		}
+	}
+
+	if version < dbVersion {
+		return bc.setDBVersion(dbVersion)
+	}
+
+	return nil
+}
+
+func (bc *Blockchain) getDBVersion() (int, error) {
+	version := 0
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		enc := b.Get([]byte("v"))
+		if enc == nil {
+			return nil
+		}
+
+		var err error
+		version, err = strconv.Atoi(string(enc))
+		return err
+	})
+
+	return version, err
+}
+
+func (bc *Blockchain) setDBVersion(version int) error {
+	return bc.DB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(blocksBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("v"), []byte(strconv.Itoa(version)))
+	})
+}
+
+// upgradeLegacyBlock recomputes every transaction ID, the merkle root and the hash of a block from an older format. Inputs that reference a transaction whose ID
+// changed are pointed at the new ID, using newIDs, which maps old hex IDs to new IDs and gets filled in as we go. prevHash is the new
+// hash of the previous block.
+//
+// Signatures of gob era transactions were made over the old gob hashes, so they can't be verified anymore. Upgraded blocks are only
+// trusted because they were already validated before the upgrade.
+func upgradeLegacyBlock(blk Block, prevHash []byte, newIDs map[string][]byte) (Block, error) {
+	var err error
+
+	for txIdx := range blk.Transactions {
+		tx := &blk.Transactions[txIdx]
+
+		if !tx.IsCoinbase() {
+			for inIdx := range tx.Vin {
+				if newID, ok := newIDs[hex.EncodeToString(tx.Vin[inIdx].TransactionID)]; ok {
+					tx.Vin[inIdx].TransactionID = newID
+				}
+			}
+		}
+
+		oldID := hex.EncodeToString(tx.ID)
+		tx.ID, err = tx.Hash()
+		if err != nil {
+			return blk, err
+		}
+		newIDs[oldID] = tx.ID
+	}
+
+	blk.PrevHash = prevHash
+	blk.MerkleRoot = blk.ComputeMerkleRoot()
+	blk.Hash, err = blk.GenerateHash()
+	return blk, err
+}
+
+// migrateBlockFiles moves every block from the one file per block layout into the block files, see blockstore.go. If rehash is set, the
+// blocks are from before version 2 and get upgraded with upgradeLegacyBlock first. Since every hash changes then, side branch blocks and
+// invalid marks are dropped, they can always be downloaded again, and the chainstate has to be rebuilt.
+//
+// The new block index is built up in the migration bucket, migrateBatchSize blocks per db transaction, so only one block is in memory at
+// a time, and an interrupted migration picks up after the last batch it committed. Once every block is in, the migration bucket replaces
+// the blocks bucket in one go, and only then are the old files removed.
+func (bc *Blockchain) migrateBlockFiles(rehash bool) error {
+	tipHeight, err := bc.GetChainHeight()
+	if err != nil {
+		return err
+	}
+
+	// only the new layout has a current block file, so if it is there the migration got as far as swapping in the new index
+	var switched bool
+	if err := bc.DB.View(func(tx *bolt.Tx) error {
+		switched = tx.Bucket([]byte(blocksBucket)).Get([]byte("f")) != nil
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if !switched {
+		if err := bc.migrateMainBlocks(int(tipHeight), rehash); err != nil {
+			return err
+		}
+		if !rehash {
+			if err := bc.migrateSideBlocks(); err != nil {
+				return err
+			}
+		}
+		if err := bc.switchBlocksBucket(rehash); err != nil {
+			return err
+		}
+	}
+
+	// the blocks are all in the block files now, so the old files can go
+	for height := 0; height <= int(tipHeight); height++ {
+		if err := os.Remove(legacyBlockFile(height)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.RemoveAll(legacySideBlocksDir())
+}
+
+// migrateMainBlocks writes the main chain blocks up to tipHeight into the block files, and indexes them in the migration bucket. It
+// starts after the last block a previous run committed, which the 'l' key of the migration bucket points at.
+func (bc *Blockchain) migrateMainBlocks(tipHeight int, rehash bool) error {
+	var (
+		next     int
+		prevHash []byte
+	)
+
+	if err := bc.DB.View(func(tx *bolt.Tx) error {
+		mb := tx.Bucket([]byte(migrationBucket))
+		if mb == nil || mb.Get([]byte("l")) == nil {
+			return nil
+		}
+		last, err := strconv.Atoi(string(mb.Get([]byte("l"))))
+		if err != nil {
+			return err
+		}
+		next = last + 1
+		prevHash = append([]byte{}, mb.Get(FormatH(last))...)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if next > 0 {
+		fmt.Printf("resuming the migration at block #%d\n", next)
+	}
+
+	for start := next; start <= tipHeight; start += migrateBatchSize {
+		end := start + migrateBatchSize - 1
+		if end > tipHeight {
+			end = tipHeight
+		}
+
+		if err := bc.DB.Update(func(tx *bolt.Tx) error {
+			mb, err := tx.CreateBucketIfNotExists([]byte(migrationBucket))
+			if err != nil {
+				return err
+			}
+			ids, err := tx.CreateBucketIfNotExists([]byte(migrationIDsBucket))
+			if err != nil {
+				return err
+			}
+
+			for height := start; height <= end; height++ {
+				blk, err := readLegacyBlock(legacyBlockFile(height))
+				if err != nil {
+					return err
+				}
+
+				if rehash {
+					blk, err = upgradeMigratedBlock(ids, blk, prevHash)
+					if err != nil {
+						return err
+					}
+					prevHash = blk.Hash
+				}
+
+				if err := putBlock(mb, blk); err != nil {
+					return err
+				}
+				if err := mb.Put(FormatH(blk.Height), blk.Hash); err != nil {
+					return err
+				}
+			}
+
+			return mb.Put([]byte("l"), []byte(strconv.Itoa(end)))
+		}); err != nil {
+			fmt.Printf("error migrating blocks #%d to #%d: %v\n", start, end, err)
+			return err
+		}
+
+		fmt.Printf("migrated %d of %d blocks\n", end+1, tipHeight+1)
+	}
+
+	return nil
+}
+
+// upgradeMigratedBlock upgrades a block with upgradeLegacyBlock. The new IDs of the transactions migrated so far are kept in the bucket
+// ids instead of in memory, so only the ones this block spends are looked up, and the ones it adds are stored.
+func upgradeMigratedBlock(ids *bolt.Bucket, blk Block, prevHash []byte) (Block, error) {
+	newIDs := make(map[string][]byte)
+	for _, tx := range blk.Transactions {
+		for _, in := range tx.Vin {
+			if newID := ids.Get(in.TransactionID); newID != nil {
+				newIDs[hex.EncodeToString(in.TransactionID)] = append([]byte{}, newID...)
+			}
+		}
+	}
+
+	blk, err := upgradeLegacyBlock(blk, prevHash, newIDs)
+	if err != nil {
+		return blk, err
+	}
+
+	for oldID, newID := range newIDs {
+		key, err := hex.DecodeString(oldID)
+		if err != nil {
+			return blk, err
+		}
+		if err := ids.Put(key, newID); err != nil {
+			return blk, err
+		}
+	}
+	return blk, nil
+}
+
+// migrateSideBlocks writes the side branch blocks into the block files, and indexes them in the migration bucket. Blocks a previous run
+// already indexed are skipped.
+func (bc *Blockchain) migrateSideBlocks() error {
+	files, err := ioutil.ReadDir(legacySideBlocksDir())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for start := 0; start < len(files); start += migrateBatchSize {
+		end := start + migrateBatchSize
+		if end > len(files) {
+			end = len(files)
+		}
+
+		if err := bc.DB.Update(func(tx *bolt.Tx) error {
+			mb, err := tx.CreateBucketIfNotExists([]byte(migrationBucket))
+			if err != nil {
+				return err
+			}
+
+			for _, file := range files[start:end] {
+				blk, err := readLegacyBlock(filepath.Join(legacySideBlocksDir(), file.Name()))
+				if err != nil {
+					return err
+				}
+				if mb.Get(FormatB(blk.Hash)) != nil {
+					continue
+				}
+				if err := putBlock(mb, blk); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}); err != nil {
+			fmt.Printf("error migrating side branch blocks: %v\n", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// switchBlocksBucket replaces the blocks bucket with the migration bucket. Bolt can't rename a bucket, so the index is copied over, it is
+// small next to the blocks themselves.
+func (bc *Blockchain) switchBlocksBucket(rehash bool) error {
+	return bc.DB.Update(func(tx *bolt.Tx) error {
+		old := tx.Bucket([]byte(blocksBucket))
+		mb := tx.Bucket([]byte(migrationBucket))
+		if mb == nil {
+			return fmt.Errorf("ERROR: the migration bucket is missing")
+		}
+
+		// invalid marks are only kept if the hashes they refer to stay the same
+		if !rehash {
+			c := old.Cursor()
+			for k, _ := c.Seek([]byte("x")); k != nil && k[0] == 'x'; k, _ = c.Next() {
+				if err := mb.Put(k, []byte{1}); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := tx.DeleteBucket([]byte(blocksBucket)); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket([]byte(blocksBucket))
+		if err != nil {
+			return err
+		}
+		if err := mb.ForEach(func(k, v []byte) error {
+			return b.Put(k, v)
+		}); err != nil {
+			return err
+		}
+
+		if err := tx.DeleteBucket([]byte(migrationBucket)); err != nil {
+			return err
+		}
+		if tx.Bucket([]byte(migrationIDsBucket)) != nil {
+			return tx.DeleteBucket([]byte(migrationIDsBucket))
+		}
+		return nil
+	})
+}
+
+// migrateChainstateTip stores which block the chainstate is at. A chainstate from before version 6 could have been left behind the tip
+// by a crash, so it is rebuilt, which stores the tip along the way. A pruned chain can't be rebuilt, so its chainstate is trusted to be at
+// the tip.
+func (bc *Blockchain) migrateChainstateTip() error {
+	pruneHeight, err := bc.GetPruneHeight()
+	if err != nil {
+		return err
+	}
+
+	if pruneHeight < 0 {
+		fmt.Printf("rebuilding the chainstate...\n")
+		utxo := UTXO{Blockchain: bc}
+		return utxo.Reindex()
+	}
+
+	tipHash, err := bc.GetTailHash()
+	if err != nil {
+		return err
+	}
+
+	return bc.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(UTXOBucket)).Put([]byte("t"), tipHash)
+	})
+}
+
+// migrateBlockIndex rewrites the index of every block from before version 5 with the header of the block, which it reads from the block
+// files.
+func (bc *Blockchain) migrateBlockIndex() error {
+	return bc.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.Seek([]byte("b")); k != nil && k[0] == 'b'; k, _ = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+
+		for _, key := range keys {
+			bi, err := decodeLegacyIndex(b.Get(key))
+			if err != nil {
+				return err
+			}
+			blk, err := readBlock(bi)
+			if err != nil {
+				fmt.Printf("error reading block #%d for the block index: %v\n", bi.Height, err)
+				return err
+			}
+			bi.Header = blk.BlockHeader
+			if err := b.Put(key, bi.EncodeIndex()); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// migrateUndo rewrites the undo data of every block from before version 7 in the canonical encoding. It can't be rebuilt with the
+// chainstate instead, the blocks of a pruned chain are gone.
+func (bc *Blockchain) migrateUndo() error {
+	return bc.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(undoBucket))
+		if b == nil {
+			return nil
+		}
+
+		legacy := make(map[string][]byte)
+		if err := b.ForEach(func(k, v []byte) error {
+			if isLegacyGob(v) {
+				legacy[string(k)] = append([]byte{}, v...)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for hash, data := range legacy {
+			undo, err := decodeLegacyUndo(data)
+			if err != nil {
+				return err
+			}
+			if err := putBlockUndo(tx, []byte(hash), undo); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// decodeLegacyIndex decodes a block index from before version 5, which had no header:
+//   int64 Height | uint32 File | int64 Offset | uint32 Length
+func decodeLegacyIndex(data []byte) (BlockIndex, error) {
+	var bi BlockIndex
+
+	d := newDecoder(data)
+	bi.Height = int(d.readInt64())
+	bi.File = int(d.readUint32())
+	bi.Offset = d.readInt64()
+	bi.Length = int(d.readUint32())
+
+	return bi, d.finish()
+}
+
+// readLegacyBlock reads in a block that is stored in a file of its own.
+func readLegacyBlock(path string) (Block, error) {
+	encBlock, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Printf("error reading legacy block file %s: %v\n", path, err)
+		return Block{}, err
+	}
+
+	return DecodeBlock(encBlock)
+}
@@ -0,0 +1,323 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Multisig
+
+// A multisig output is locked to N public keys, and can only be spent with signatures from M of them. The output doesn't hold the keys
+// themselves, only the hash of the multisig script that lists them, the same way a normal output only holds the hash of a public key:
+//
+//   uint32 Required | uint32 len(PubKeys) | bytes PubKey...
+//
+// The public keys of a script are always sorted, so the same keys make the same script no matter what order they are given in. A
+// multisig address is the hash of the script with the network's MultisigVersion byte in front, see NetworkParams, and any output sent to
+// one is a multisig output, see Output.Lock.
+//
+// An input that spends a multisig output has the script in its PubKey, where a normal input has its public key, and a list with a
+// signature slot for every public key of the script in its Signature:
+//
+//   uint32 len(PubKeys) | bytes Signature...
+//
+// A slot is empty until the owner of that key signs. Every signer signs the same hash, see Transaction.sigHash, so the signatures of
+// different signers can be made on their own copy of the transaction and combined afterwards, see CombineMultisig. The input is valid
+// once at least Required slots hold a valid signature, and no slot holds an invalid one.
+
+const (
+	// maxMultisigKeys is the most public keys a multisig script can have.
+	maxMultisigKeys = 16
+	// pubKeyLen is the length of a public key, see NewKeyPair.
+	pubKeyLen = 64
+)
+
+// MultisigScript is the M of N public keys that a multisig output is locked to.
+type MultisigScript struct {
+	Required int      // Required is the number of signatures needed to spend, M.
+	PubKeys  [][]byte // PubKeys are the N public keys that can sign, sorted.
+}
+
+// NewMultisigScript creates the script that needs required signatures out of pubKeys.
+func NewMultisigScript(required int, pubKeys [][]byte) (MultisigScript, error) {
+	script := MultisigScript{
+		Required: required,
+		PubKeys:  append([][]byte{}, pubKeys...),
+	}
+	sort.Slice(script.PubKeys, func(i, j int) bool {
+		return bytes.Compare(script.PubKeys[i], script.PubKeys[j]) < 0
+	})
+
+	return script, script.check()
+}
+
+// check makes sure a script can be spent, and that its public keys are sorted and all different.
+func (ms MultisigScript) check() error {
+	if len(ms.PubKeys) == 0 || len(ms.PubKeys) > maxMultisigKeys {
+		return fmt.Errorf("ERROR: a multisig script needs between 1 and %d public keys, not %d", maxMultisigKeys, len(ms.PubKeys))
+	}
+	if ms.Required < 1 || ms.Required > len(ms.PubKeys) {
+		return fmt.Errorf("ERROR: a multisig script of %d public keys can't require %d signatures", len(ms.PubKeys), ms.Required)
+	}
+
+	for i, pubKey := range ms.PubKeys {
+		if len(pubKey) != pubKeyLen {
+			return fmt.Errorf("ERROR: public key #%d is %d bytes, public keys are %d bytes", i, len(pubKey), pubKeyLen)
+		}
+		if i > 0 && bytes.Compare(ms.PubKeys[i-1], pubKey) >= 0 {
+			return errors.New("ERROR: the public keys of a multisig script have to be sorted and different")
+		}
+	}
+
+	return nil
+}
+
+// Encode encodes a multisig script, see the description at the top of this file.
+func (ms MultisigScript) Encode() []byte {
+	var e encoder
+	e.writeUint32(uint32(ms.Required))
+	e.writeUint32(uint32(len(ms.PubKeys)))
+	for _, pubKey := range ms.PubKeys {
+		e.writeBytes(pubKey)
+	}
+	return e.buff.Bytes()
+}
+
+// DecodeMultisigScript decodes and checks a multisig script.
+func DecodeMultisigScript(data []byte) (MultisigScript, error) {
+	var ms MultisigScript
+
+	d := newDecoder(data)
+	ms.Required = int(d.readUint32())
+	count := d.readCount(4)
+	for i := 0; i < count && d.err == nil; i++ {
+		ms.PubKeys = append(ms.PubKeys, d.readBytes())
+	}
+	if err := d.finish(); err != nil {
+		return ms, err
+	}
+
+	return ms, ms.check()
+}
+
+// Hash returns the hash a multisig output is locked to, which is hashed the same way as a public key.
+func (ms MultisigScript) Hash() ([]byte, error) {
+	return HashPublicKey(ms.Encode())
+}
+
+// Address returns the multisig address of the script on the current network.
+func (ms MultisigScript) Address() ([]byte, error) {
+	hash, err := ms.Hash()
+	if err != nil {
+		return nil, err
+	}
+	return encodeAddress(Params.MultisigVersion, hash), nil
+}
+
+// encodeMultisigSignatures encodes the signature slots of a multisig input.
+func encodeMultisigSignatures(signatures [][]byte) []byte {
+	var e encoder
+	e.writeUint32(uint32(len(signatures)))
+	for _, signature := range signatures {
+		e.writeBytes(signature)
+	}
+	return e.buff.Bytes()
+}
+
+// decodeMultisigSignatures decodes the signature slots of a multisig input, which has to have a slot for each of the keys keys.
+func decodeMultisigSignatures(data []byte, keys int) ([][]byte, error) {
+	d := newDecoder(data)
+	signatures := make([][]byte, d.readCount(4))
+	for i := range signatures {
+		signatures[i] = d.readBytes()
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	if len(signatures) != keys {
+		return nil, fmt.Errorf("ERROR: multisig input has %d signature slots for %d public keys", len(signatures), keys)
+	}
+	return signatures, nil
+}
+
+// checkMultisig checks the signature slots of an input that spends a multisig output against its multisig script, see OpCheckMultisig.
+// hash is the hash they have to sign.
+func checkMultisig(encScript, encSignatures, hash []byte) (bool, error) {
+	script, err := DecodeMultisigScript(encScript)
+	if err != nil {
+		return false, err
+	}
+	signatures, err := decodeMultisigSignatures(encSignatures, len(script.PubKeys))
+	if err != nil {
+		return false, err
+	}
+
+	signed := 0
+	for k, signature := range signatures {
+		if len(signature) == 0 {
+			continue
+		}
+		if !verifySignature(script.PubKeys[k], hash, signature) {
+			return false, nil
+		}
+		signed++
+	}
+
+	return signed >= script.Required, nil
+}
+
+// MultisigProgress returns how many signatures a multisig input has, and how many it needs.
+func (in Input) MultisigProgress() (int, int, error) {
+	script, err := DecodeMultisigScript(in.PubKey)
+	if err != nil {
+		return 0, 0, err
+	}
+	signatures, err := decodeMultisigSignatures(in.Signature, len(script.PubKeys))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	signed := 0
+	for _, signature := range signatures {
+		if len(signature) > 0 {
+			signed++
+		}
+	}
+	return signed, script.Required, nil
+}
+
+// NewMultisigTransaction creates a transaction that makes every payment from the multisig address of script, with the change going back
+// to it. The transaction isn't signed, every signer signs it with SignMultisigTransaction, and the signatures are put together with
+// CombineMultisig.
+func (bc *Blockchain) NewMultisigTransaction(script MultisigScript, payments []Payment, opts TxOptions) (Transaction, error) {
+	if err := script.check(); err != nil {
+		return Transaction{}, err
+	}
+
+	address, err := script.Address()
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	tx, err := bc.buildTransaction(string(address), script.Encode(), payments, opts)
+	if err != nil {
+		return tx, err
+	}
+
+	// the signatures aren't part of the ID, so the empty slots can be filled in without changing it
+	for inIdx := range tx.Vin {
+		tx.Vin[inIdx].Signature = encodeMultisigSignatures(make([][]byte, len(script.PubKeys)))
+	}
+
+	return tx, nil
+}
+
+// SignMultisigTransaction signs every multisig input of tx with every key of wallets that is part of its script, and whose slot is still
+// empty. It returns how many signatures it added.
+func (u UTXO) SignMultisigTransaction(tx *Transaction, wallets Wallets) (int, error) {
+	prevTXs, err := u.FindReferencedOutputs(*tx)
+	if err != nil {
+		fmt.Printf("error finding referenced outputs for signing: %v\n", err)
+		return 0, err
+	}
+
+	added := 0
+	for inIdx, in := range tx.Vin {
+		prevTX, ok := prevTXs[hex.EncodeToString(in.TransactionID)]
+		if !ok || in.OutputIndex >= len(prevTX.Vout) || !prevTX.Vout[in.OutputIndex].Multisig {
+			continue
+		}
+
+		script, err := DecodeMultisigScript(in.PubKey)
+		if err != nil {
+			return added, err
+		}
+		signatures, err := decodeMultisigSignatures(in.Signature, len(script.PubKeys))
+		if err != nil {
+			return added, err
+		}
+
+		hash, err := tx.sigHash(inIdx, prevTX.Vout[in.OutputIndex])
+		if err != nil {
+			return added, err
+		}
+
+		for k, pubKey := range script.PubKeys {
+			if len(signatures[k]) > 0 {
+				continue
+			}
+			for _, wallet := range wallets.Wallets {
+				if bytes.Compare(wallet.PublicKey, pubKey) != 0 {
+					continue
+				}
+				signatures[k], err = signHash(wallet.PrivateKey, hash)
+				if err != nil {
+					fmt.Printf("error signing multisig input #%d: %v\n", inIdx, err)
+					return added, err
+				}
+				added++
+			}
+		}
+
+		tx.Vin[inIdx].Signature = encodeMultisigSignatures(signatures)
+	}
+
+	return added, nil
+}
+
+// CombineMultisig puts the signatures of several signed copies of the same multisig transaction together into one transaction. The IDs of
+// the copies are recomputed, since a copy can claim any ID, and every copy has to have exactly the same inputs and outputs.
+func CombineMultisig(txs []Transaction) (Transaction, error) {
+	if len(txs) == 0 {
+		return Transaction{}, errors.New("ERROR: no transactions to combine")
+	}
+
+	for _, tx := range txs {
+		id, err := tx.Hash()
+		if err != nil {
+			return Transaction{}, err
+		}
+		if bytes.Compare(id, tx.ID) != 0 {
+			return Transaction{}, fmt.Errorf("ERROR: transaction %s doesn't hash to its ID", hex.EncodeToString(tx.ID))
+		}
+	}
+
+	combined := txs[0]
+	combined.Vin = append([]Input{}, txs[0].Vin...)
+
+	for _, tx := range txs[1:] {
+		// the ID covers every input and output, so equal IDs mean the same transaction, apart from the signatures
+		if bytes.Compare(tx.ID, combined.ID) != 0 || len(tx.Vin) != len(combined.Vin) || len(tx.Vout) != len(combined.Vout) {
+			return combined, fmt.Errorf("ERROR: transaction %s is not the same transaction as %s", hex.EncodeToString(tx.ID), hex.EncodeToString(combined.ID))
+		}
+
+		for inIdx, in := range tx.Vin {
+			script, err := DecodeMultisigScript(in.PubKey)
+			if err != nil {
+				return combined, fmt.Errorf("ERROR: input #%d is not a multisig input: %v", inIdx, err)
+			}
+
+			have, err := decodeMultisigSignatures(combined.Vin[inIdx].Signature, len(script.PubKeys))
+			if err != nil {
+				return combined, err
+			}
+			signatures, err := decodeMultisigSignatures(in.Signature, len(script.PubKeys))
+			if err != nil {
+				return combined, err
+			}
+
+			for k := range have {
+				if len(have[k]) == 0 {
+					have[k] = signatures[k]
+				}
+			}
+			combined.Vin[inIdx].Signature = encodeMultisigSignatures(have)
+		}
+	}
+
+	return combined, nil
+}
@@ -0,0 +1,173 @@
+package core
+
+import (
+	"testing"
+)
+
+// newTestMultisig creates the wallets of a required of n multisig script, in the order of the public keys of the script.
+func newTestMultisig(t *testing.T, required, n int) (MultisigScript, []Wallet) {
+	t.Helper()
+
+	var pubKeys [][]byte
+	byKey := make(map[string]Wallet)
+	for i := 0; i < n; i++ {
+		w, _ := newTestWallet(t)
+		pubKeys = append(pubKeys, w.PublicKey)
+		byKey[string(w.PublicKey)] = w
+	}
+
+	script, err := NewMultisigScript(required, pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wallets []Wallet
+	for _, pubKey := range script.PubKeys {
+		wallets = append(wallets, byKey[string(pubKey)])
+	}
+	return script, wallets
+}
+
+func TestCheckMultisig(t *testing.T) {
+	script, wallets := newTestMultisig(t, 2, 3)
+	hash := fill(0x42, 64)
+
+	sign := func(k int) []byte {
+		signature, err := signHash(wallets[k].PrivateKey, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+	signatures := [][]byte{sign(0), sign(1), sign(2)}
+	invalid := append([]byte{}, signatures[2]...)
+	invalid[len(invalid)-1] ^= 0xff
+
+	tests := []struct {
+		name   string
+		script []byte
+		slots  [][]byte
+		want   bool
+		err    string
+	}{
+		{name: "required signatures", slots: [][]byte{signatures[0], nil, signatures[2]}, want: true},
+		{name: "every signature", slots: signatures, want: true},
+		{name: "too few signatures", slots: [][]byte{nil, signatures[1], nil}},
+		{name: "no signatures", slots: [][]byte{nil, nil, nil}},
+		{name: "signature in the wrong slot", slots: [][]byte{signatures[1], signatures[0], nil}},
+		{name: "invalid signature next to enough valid ones", slots: [][]byte{signatures[0], signatures[1], invalid}},
+		{name: "signature of another hash", slots: [][]byte{signatures[0], fill(0x01, len(signatures[1])), nil}},
+		{name: "too few slots", slots: [][]byte{signatures[0], signatures[1]}, err: "2 signature slots for 3 public keys"},
+		{name: "too many slots", slots: [][]byte{signatures[0], signatures[1], nil, nil}, err: "4 signature slots for 3 public keys"},
+		{
+			name:   "script that can't be spent",
+			script: MultisigScript{Required: 4, PubKeys: script.PubKeys}.Encode(),
+			slots:  signatures,
+			err:    "can't require 4 signatures",
+		},
+		{name: "not a multisig script", script: fill(0x01, 8), slots: signatures, err: "longer than the remaining data"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc := script.Encode()
+			if tt.script != nil {
+				enc = tt.script
+			}
+
+			verified, err := checkMultisig(enc, encodeMultisigSignatures(tt.slots), hash)
+			checkError(t, err, tt.err)
+			if verified != tt.want {
+				t.Errorf("verified is %v, want %v", verified, tt.want)
+			}
+		})
+	}
+
+	t.Run("slots that don't decode", func(t *testing.T) {
+		_, err := checkMultisig(script.Encode(), fill(0xff, 3), hash)
+		checkError(t, err, "ERROR")
+	})
+}
+
+func TestCombineMultisig(t *testing.T) {
+	tc := newTestChain(t)
+	script, wallets := newTestMultisig(t, 2, 3)
+
+	address, err := script.Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.mine(t, 1, tc.pay(t, string(address), 30, 1))
+
+	unsigned, err := tc.NewMultisigTransaction(script, []Payment{{Address: tc.address, Amount: 20}}, TxOptions{Fee: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every signer signs a copy of their own
+	utxo := UTXO{Blockchain: tc.Blockchain}
+	signedBy := func(k int) Transaction {
+		tx := unsigned
+		tx.Vin = append([]Input{}, unsigned.Vin...)
+		added, err := utxo.SignMultisigTransaction(&tx, Wallets{Wallets: map[string]Wallet{"signer": wallets[k]}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added != 1 {
+			t.Fatalf("signer %d added %d signatures, want 1", k, added)
+		}
+		return tx
+	}
+	first, third := signedBy(0), signedBy(2)
+
+	other, err := tc.NewMultisigTransaction(script, []Payment{{Address: tc.address, Amount: 19}}, TxOptions{Fee: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := first
+	forged.ID = fill(0x01, 64)
+	badSlots := first
+	badSlots.Vin = []Input{first.Vin[0]}
+	badSlots.Vin[0].Signature = encodeMultisigSignatures([][]byte{nil, nil})
+
+	tests := []struct {
+		name   string
+		txs    []Transaction
+		signed int
+		err    string
+	}{
+		{name: "one copy", txs: []Transaction{first}, signed: 1},
+		{name: "two copies", txs: []Transaction{first, third}, signed: 2},
+		{name: "same copy twice", txs: []Transaction{first, first}, signed: 1},
+		{name: "unsigned copy", txs: []Transaction{unsigned, third}, signed: 1},
+		{name: "no copies", err: "no transactions to combine"},
+		{name: "different transaction", txs: []Transaction{first, other}, err: "is not the same transaction"},
+		{name: "forged ID", txs: []Transaction{first, forged}, err: "doesn't hash to its ID"},
+		{name: "wrong number of slots", txs: []Transaction{first, badSlots}, err: "2 signature slots for 3 public keys"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			combined, err := CombineMultisig(tt.txs)
+			checkError(t, err, tt.err)
+			if err != nil {
+				return
+			}
+
+			signed, required, err := combined.Vin[0].MultisigProgress()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if signed != tt.signed || required != 2 {
+				t.Errorf("combined transaction has %d of %d signatures, want %d of 2", signed, required, tt.signed)
+			}
+		})
+	}
+
+	// a single signature isn't enough, the combined transaction spends the multisig output
+	checkError(t, tc.ValidateBlock(tc.nextBlock(t, 1, first)), "doesn't unlock")
+	combined, err := CombineMultisig([]Transaction{first, third})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.mine(t, 1, combined)
+}
@@ -0,0 +1,234 @@
+package core
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Networks
+
+// A node runs on one network at a time. Every network has its own genesis block, port, address version byte and data directory, so
+// the chains, wallets and peers of different networks never mix.
+//
+// All of a node's files are kept in its data directory, ~/.blemflarck by default. Mainnet uses the data directory itself, the other
+// networks use a subdirectory of it named after the network:
+//
+//   <datadir>/<network>/blemflarck.db
+//   <datadir>/<network>/wallets.dat
+//   <datadir>/<network>/blocks_gen/blk00000.dat, ...
+//   <datadir>/<network>/genesis
+//
+// Before there were networks, a node kept its files in the working directory. When a node is started with the default data directory and
+// finds those files in the working directory, it moves them to the mainnet data directory, see adoptLegacyFiles.
+
+// NetworkParams is everything that sets a network apart from the others.
+type NetworkParams struct {
+	Name            string   // Name is used to select the network, see SelectNetwork.
+	Port            int      // Port is the port nodes on this network listen on.
+	AddressVersion  byte     // AddressVersion is the first byte of every address on this network, see Wallet.GetAddress.
+	MultisigVersion byte     // MultisigVersion is the first byte of every multisig address on this network, see multisig.go.
+	GenesisFile     string   // GenesisFile is the name of the genesis block file that is built into the binary, see GenesisFiles.
+	GenesisHash     string   // GenesisHash is the hex hash of the network's genesis block. Any genesis block is accepted if it is empty, see genesis.go.
+	Subdir          string   // Subdir is the subdirectory of the data directory that the network keeps its files in.
+	Seeds           []string // Seeds are the IPs of the nodes a new node first connects to.
+	// CoinbaseMaturity is the number of blocks a coinbase output has to be buried under before it can be spent, see UnspentOutput.Mature.
+	CoinbaseMaturity int
+	// CoinbaseMaturityHeight is the height from which CoinbaseMaturity is enforced. A chain that spent coinbase outputs as soon as they
+	// were mined would set it to its tip height, so those blocks stay valid. Every network is at 0: the seeds of mainnet and testnet are
+	// still placeholders, so neither has a chain past the genesis block that ships with the source, and the genesis allocations are
+	// mature anyway.
+	CoinbaseMaturityHeight int
+	// MigrationHeight is the last height a block can have legacyBlockVersion at, see CheckBlock. Blocks from before version 2 keep it, so a
+	// chain that has them would set it to its tip height at the upgrade. Every network is at 0, for the same reason as
+	// CoinbaseMaturityHeight, so only the genesis block is a legacy block.
+	MigrationHeight int
+	// Snapshots are the hex content hashes of known good chainstate snapshots, by the height of their tip, see LoadSnapshot. None are
+	// pinned yet.
+	Snapshots map[int]string
+}
+
+var (
+	// MainNet is the main network, where blemflarcks have value.
+	MainNet = NetworkParams{
+		Name:                   "mainnet",
+		Port:                   8069,
+		AddressVersion:         0x00,
+		MultisigVersion:        0x05,
+		GenesisFile:            "genesis",
+		GenesisHash:            "cfc17b11dc97283e06ff94c8703c7cb466aea1a0a3e1d614f8f711b7e8bbb47d16f87162459e1922e0cc3aac1365ddf7f1f7d4f0cfde42afbad9ddff1d8ad2d2",
+		Subdir:                 "",
+		Seeds:                  []string{"10.0.0.1"},
+		CoinbaseMaturity:       100,
+		CoinbaseMaturityHeight: 0,
+		MigrationHeight:        0,
+	}
+	// TestNet is a public network for testing, its coins have no value.
+	TestNet = NetworkParams{
+		Name:                   "testnet",
+		Port:                   18069,
+		AddressVersion:         0x6f,
+		MultisigVersion:        0xc4,
+		GenesisFile:            "genesis.testnet",
+		GenesisHash:            "3b60bb6be0d75e139cd777d2dc1046c44a2a47d3813d5e687aed251e0048f5328ac9e3f4c6c96ea9920317e1212d58fb598f8086a73070f76c8ac9a6ebe38c30",
+		Subdir:                 "testnet",
+		Seeds:                  []string{"10.0.0.1"},
+		CoinbaseMaturity:       100,
+		CoinbaseMaturityHeight: 0,
+		MigrationHeight:        0,
+	}
+	// RegTest is a network for testing on a single machine. It has no seeds, nodes are connected by hand. It accepts any genesis block,
+	// so private networks can run on it, see genesis.go.
+	RegTest = NetworkParams{
+		Name:                   "regtest",
+		Port:                   18469,
+		AddressVersion:         0x6f,
+		MultisigVersion:        0xc4,
+		GenesisFile:            "genesis.regtest",
+		Subdir:                 "regtest",
+		CoinbaseMaturity:       10,
+		CoinbaseMaturityHeight: 0,
+		MigrationHeight:        0,
+	}
+
+	networks = []NetworkParams{MainNet, TestNet, RegTest}
+)
+
+var (
+	// Params are the parameters of the network this node is running on. Set with SelectNetwork.
+	Params = MainNet
+	// dataDir is the data directory of the node, without the network subdirectory.
+	dataDir = defaultDataDir()
+	// GenesisFiles holds the genesis block files that ship with the source, by GenesisFile. The main package embeds them into the binary,
+	// so a node doesn't depend on the directory it is started from.
+	GenesisFiles fs.FS
+)
+
+// defaultDataDir returns ~/.blemflarck, or the working directory if there is no home directory.
+func defaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(home, ".blemflarck")
+}
+
+// SelectNetwork sets the network this node runs on, and the data directory it keeps its files in. An empty dir keeps the default data
+// directory. The network's directory is created if it doesn't exist yet.
+func SelectNetwork(name, dir string) error {
+	found := false
+	for _, params := range networks {
+		if params.Name == name {
+			Params = params
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("ERROR: unknown network %q, must be one of mainnet, testnet or regtest", name)
+	}
+
+	if dir != "" {
+		dataDir = dir
+	}
+
+	if err := os.MkdirAll(NetworkDir(), 0777); err != nil {
+		fmt.Printf("error creating data directory %s: %v\n", NetworkDir(), err)
+		return err
+	}
+
+	if dir == "" && Params.Name == MainNet.Name {
+		return adoptLegacyFiles()
+	}
+	return nil
+}
+
+// adoptLegacyFiles moves the db, wallets and block files of a node from before there were data directories out of the working directory,
+// and into the mainnet data directory. Nothing is moved if the data directory already has a chain or wallets of its own, then the old
+// files are left alone. If the files can't be moved, for instance because the data directory is on another file system, the working
+// directory is used as the data directory instead.
+func adoptLegacyFiles() error {
+	legacy := map[string]string{
+		dbFile:       dbPath(),
+		walletFile:   walletPath(),
+		"blocks_gen": blocksDir(),
+	}
+
+	// nothing to do if the data directory is the working directory
+	wd, err := filepath.Abs(".")
+	if err != nil {
+		return err
+	}
+	if dir, err := filepath.Abs(NetworkDir()); err != nil || dir == wd {
+		return err
+	}
+
+	var found []string
+	for name, path := range legacy {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			fmt.Printf("found the files of an old node in the working directory, but %s already exists, leaving them where they are\n", path)
+			return nil
+		}
+		found = append(found, name)
+	}
+
+	for i, name := range found {
+		fmt.Printf("moving %s from the working directory to %s\n", name, legacy[name])
+		if err := os.Rename(name, legacy[name]); err != nil {
+			fmt.Printf("error moving %s to the data directory, using the working directory as the data directory: %v\n", name, err)
+			// the files have to stay together, so the ones that were already moved go back
+			for _, moved := range found[:i] {
+				if err := os.Rename(legacy[moved], moved); err != nil {
+					return err
+				}
+			}
+			dataDir = "."
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// NetworkDir returns the directory the current network keeps its files in.
+func NetworkDir() string {
+	return filepath.Join(dataDir, Params.Subdir)
+}
+
+// dbPath returns the path of the bolt db of the current network.
+func dbPath() string {
+	return filepath.Join(NetworkDir(), dbFile)
+}
+
+// walletPath returns the path of the wallet file of the current network.
+func walletPath() string {
+	return filepath.Join(NetworkDir(), walletFile)
+}
+
+// blocksDir returns the directory the block files of the current network are in.
+func blocksDir() string {
+	return filepath.Join(NetworkDir(), "blocks_gen")
+}
+
+// readGenesis reads in the encoded genesis block of the current network. A genesis file in the network's directory is used first,
+// otherwise the one built into the binary, see GenesisFiles.
+func readGenesis() ([]byte, error) {
+	enc, err := ioutil.ReadFile(networkGenesisPath())
+	if err == nil || !os.IsNotExist(err) {
+		return enc, err
+	}
+
+	if GenesisFiles == nil {
+		return nil, fmt.Errorf("ERROR: there is no %s genesis block in %s, and none is built into the binary", Params.Name, NetworkDir())
+	}
+	return fs.ReadFile(GenesisFiles, Params.GenesisFile)
+}
+
+// networkGenesisPath returns the path of the genesis file in the current network's directory, see WriteGenesis.
+func networkGenesisPath() string {
+	return filepath.Join(NetworkDir(), "genesis")
+}
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Payments
+
+// A transaction can pay any number of addresses at once, with an output for each payment and a single change output back to the sender.
+// Batch payments can be read in from a file, either JSON:
+//
+//   [{"address": "1...", "amount": 50}, {"address": "1...", "amount": 25}]
+//
+// or CSV, with a line per payment:
+//
+//   address,amount
+//   1...,50
+//   1...,25
+//
+// Files ending in .json are read as JSON, anything else as CSV. The header line of a CSV file is optional, and lines starting with '#'
+// are skipped.
+
+// Payment is an amount paid to an address.
+type Payment struct {
+	Address string `json:"address"`
+	Amount  int    `json:"amount"`
+	// Script pays to a locking script of its own instead of to Address, see script.go. It can't be set in a file.
+	Script []byte `json:"-"`
+	// Data makes the payment a data output that carries it, with no Address or Amount, see anchor.go. It can't be set in a file.
+	Data []byte `json:"-"`
+}
+
+// checkPayments makes sure every payment is to an address of the current network or to a script, with a positive amount, and returns
+// their sum. Data payments carry no amount.
+func checkPayments(payments []Payment) (int, error) {
+	if len(payments) == 0 {
+		return 0, errors.New("ERROR: a transaction needs at least one payment")
+	}
+
+	total := 0
+	for _, p := range payments {
+		if len(p.Data) > 0 {
+			if p.Amount != 0 || p.Address != "" || len(p.Script) > 0 {
+				return 0, errors.New("ERROR: a data payment can't have an address, amount or script")
+			}
+			continue
+		}
+		if len(p.Script) == 0 && !CheckValidAddress([]byte(p.Address)) {
+			return 0, fmt.Errorf("ERROR: %s is not a valid %s address", p.Address, Params.Name)
+		}
+		if p.Amount <= 0 {
+			return 0, fmt.Errorf("ERROR: payment of %d to %s, amounts have to be positive", p.Amount, p.Address)
+		}
+		if total+p.Amount < total {
+			return 0, errors.New("ERROR: payments add up to more than can be sent")
+		}
+		total += p.Amount
+	}
+
+	return total, nil
+}
+
+// ReadPayments reads in a file of payments, see the description at the top of this file.
+func ReadPayments(path string) ([]Payment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("error opening payments file %s: %v\n", path, err)
+		return nil, err
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		var payments []Payment
+		if err := json.NewDecoder(f).Decode(&payments); err != nil {
+			fmt.Printf("error decoding payments file %s: %v\n", path, err)
+			return nil, err
+		}
+		return payments, nil
+	}
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+
+	var payments []Payment
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return payments, nil
+		}
+		if err != nil {
+			fmt.Printf("error reading payments file %s: %v\n", path, err)
+			return nil, err
+		}
+
+		amount, err := strconv.Atoi(strings.TrimSpace(record[1]))
+		if err != nil {
+			// the first line can be a header
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("ERROR: bad amount %q in payments file %s", record[1], path)
+		}
+
+		payments = append(payments, Payment{Address: strings.TrimSpace(record[0]), Amount: amount})
+	}
+}
@@ -0,0 +1,149 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadPayments(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    []Payment
+		err     string
+	}{
+		{
+			name:    "json",
+			file:    "payments.json",
+			content: `[{"address": "1abc", "amount": 50}, {"address": "1def", "amount": 25}]`,
+			want:    []Payment{{Address: "1abc", Amount: 50}, {Address: "1def", Amount: 25}},
+		},
+		{
+			name:    "json extension in upper case",
+			file:    "payments.JSON",
+			content: `[{"address": "1abc", "amount": 50}]`,
+			want:    []Payment{{Address: "1abc", Amount: 50}},
+		},
+		{name: "json bad amount", file: "payments.json", content: `[{"address": "1abc", "amount": "50"}]`, err: "cannot unmarshal"},
+		{
+			name:    "csv with a header",
+			file:    "payments.csv",
+			content: "address,amount\n1abc,50\n1def,25\n",
+			want:    []Payment{{Address: "1abc", Amount: 50}, {Address: "1def", Amount: 25}},
+		},
+		{
+			name:    "csv without a header, with comments and spaces",
+			file:    "payments.txt",
+			content: "# rent\n1abc, 50\n\n# the rest\n 1def , 25 \n",
+			want:    []Payment{{Address: "1abc", Amount: 50}, {Address: "1def", Amount: 25}},
+		},
+		{name: "csv only a header", file: "payments.csv", content: "address,amount\n"},
+		{name: "csv bad amount", file: "payments.csv", content: "address,amount\n1abc,fifty\n", err: "bad amount \"fifty\""},
+		{name: "csv wrong number of fields", file: "payments.csv", content: "1abc,50\n1def\n", err: "wrong number of fields"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			payments, err := ReadPayments(path)
+			checkError(t, err, tt.err)
+			if !reflect.DeepEqual(payments, tt.want) {
+				t.Errorf("got %+v, want %+v", payments, tt.want)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := ReadPayments(filepath.Join(t.TempDir(), "payments.csv"))
+		checkError(t, err, "no such file")
+	})
+}
+
+func TestCheckPayments(t *testing.T) {
+	if err := SelectNetwork(RegTest.Name, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	_, address := newTestWallet(t)
+	script := new(ScriptBuilder).AddOp(OpTrue).Script()
+
+	tests := []struct {
+		name     string
+		payments []Payment
+		total    int
+		err      string
+	}{
+		{name: "single", payments: []Payment{{Address: address, Amount: 5}}, total: 5},
+		{name: "batch", payments: []Payment{{Address: address, Amount: 5}, {Address: address, Amount: 7}}, total: 12},
+		{name: "script", payments: []Payment{{Script: script, Amount: 3}}, total: 3},
+		{name: "data", payments: []Payment{{Data: []byte("hello")}, {Address: address, Amount: 1}}, total: 1},
+		{name: "no payments", err: "at least one payment"},
+		{name: "invalid address", payments: []Payment{{Address: "1abc", Amount: 5}}, err: "1abc is not a valid regtest address"},
+		{name: "zero amount", payments: []Payment{{Address: address}}, err: "amounts have to be positive"},
+		{name: "negative amount", payments: []Payment{{Address: address, Amount: -5}}, err: "amounts have to be positive"},
+		{name: "zero amount script", payments: []Payment{{Script: script}}, err: "amounts have to be positive"},
+		{
+			name:     "overflow",
+			payments: []Payment{{Address: address, Amount: math.MaxInt64}, {Address: address, Amount: 1}},
+			err:      "add up to more than can be sent",
+		},
+		{name: "data with an amount", payments: []Payment{{Data: []byte("hello"), Amount: 1}}, err: "data payment can't"},
+		{name: "data with an address", payments: []Payment{{Data: []byte("hello"), Address: address}}, err: "data payment can't"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total, err := checkPayments(tt.payments)
+			checkError(t, err, tt.err)
+			if total != tt.total {
+				t.Errorf("total is %d, want %d", total, tt.total)
+			}
+		})
+	}
+}
+
+func TestBatchPayment(t *testing.T) {
+	tc := newTestChain(t)
+	_, first := newTestWallet(t)
+	_, second := newTestWallet(t)
+
+	payments := []Payment{{Address: first, Amount: 20}, {Address: second, Amount: 30}, {Address: first, Amount: 5}}
+	tx, err := tc.buildTransaction(tc.address, tc.wallet.PublicKey, payments, TxOptions{Fee: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an output for each payment in order, then the change
+	want := []Output{CreateOutput(first, 20), CreateOutput(second, 30), CreateOutput(first, 5), CreateOutput(tc.address, 43)}
+	if len(tx.Vout) != len(want) {
+		t.Fatalf("transaction has %d outputs, want %d", len(tx.Vout), len(want))
+	}
+	for i, out := range tx.Vout {
+		if out.Value != want[i].Value || !bytes.Equal(out.PubKeyHash, want[i].PubKeyHash) {
+			t.Errorf("output %d pays %d to %x, want %d to %x", i, out.Value, out.PubKeyHash, want[i].Value, want[i].PubKeyHash)
+		}
+	}
+
+	if err := (UTXO{Blockchain: tc.Blockchain}).SignTransaction(tx, tc.wallet.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	tc.mine(t, 2, tx)
+
+	// the change of 43 is all that can be spent, the coinbase isn't mature yet, so paying all of it out leaves no change
+	payments = []Payment{{Address: first, Amount: 40}}
+	tx, err = tc.buildTransaction(tc.address, tc.wallet.PublicKey, payments, TxOptions{Fee: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.Vout) != 1 {
+		t.Errorf("transaction has %d outputs, want no change output", len(tx.Vout))
+	}
+}
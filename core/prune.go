@@ -0,0 +1,177 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"os"
+	"strconv"
+)
+
+// Pruning
+
+// Once a block is connected, the chainstate and the undo data have everything needed to validate new blocks and to disconnect it again.
+// The block itself is only still needed by Reindex, by the optional indexes when they are built, and by peers that sync from us. A
+// pruned node deletes its oldest block files once all of them together take up more than PruneTarget MiB. Only whole files are deleted,
+// and never the file blocks are being appended to, or one with a block within PruneDepth of the tip, so a reorg that isn't deeper than
+// that still works.
+//
+// The block index keeps the header of every pruned block, see BlockIndex, and the undo data and chainstate are never pruned. The blocks
+// bucket stores the height of the highest block that was pruned under the key 'p', which is what the node advertises to its peers.
+
+var (
+	// PruneTarget is the most MiB the block files are allowed to take up. 0 turns pruning off.
+	PruneTarget int64
+	// PruneDepth is how many blocks below the tip are never pruned.
+	PruneDepth = 288
+	// ErrBlockPruned is returned when reading in a block whose block file was deleted by pruning.
+	ErrBlockPruned = errors.New("ERROR: block has been pruned")
+	// ErrChainPruned is returned when something needs every block of the main chain, but the chain is pruned.
+	ErrChainPruned = errors.New("ERROR: the chain is pruned, it has to be downloaded again to do this")
+)
+
+// GetPruneHeight returns the height of the highest block that was pruned, or -1 if no block was ever pruned.
+func (bc Blockchain) GetPruneHeight() (int, error) {
+	height := -1
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		enc := tx.Bucket([]byte(blocksBucket)).Get([]byte("p"))
+		if enc == nil {
+			return nil
+		}
+
+		var err error
+		height, err = strconv.Atoi(string(enc))
+		return err
+	})
+
+	return height, err
+}
+
+// checkNotPruned returns ErrChainPruned if any block of the chain was pruned.
+func (bc Blockchain) checkNotPruned() error {
+	pruneHeight, err := bc.GetPruneHeight()
+	if err != nil {
+		return err
+	}
+	if pruneHeight >= 0 {
+		return ErrChainPruned
+	}
+	return nil
+}
+
+// blockFileSize returns the size of a block file, 0 if it doesn't exist.
+func blockFileSize(file int) (int64, error) {
+	info, err := os.Stat(BlockFilePath(file))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// prune deletes the oldest block files until the block files fit in PruneTarget, see the description at the top of this file.
+func (bc *Blockchain) prune() error {
+	if PruneTarget <= 0 {
+		return nil
+	}
+
+	tipHeight, err := bc.GetChainHeight()
+	if err != nil {
+		return err
+	}
+
+	var pruned []int
+
+	err = bc.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		current := currentBlockFile(b)
+
+		sizes := make([]int64, current+1)
+		var total int64
+		for file := range sizes {
+			size, err := blockFileSize(file)
+			if err != nil {
+				return err
+			}
+			sizes[file] = size
+			total += size
+		}
+		if total <= PruneTarget*1024*1024 {
+			return nil
+		}
+
+		// the blocks still stored in each file, and the highest height in it
+		keys := make(map[int][][]byte)
+		maxHeight := make(map[int]int)
+		c := b.Cursor()
+		for k, v := c.Seek([]byte("b")); k != nil && k[0] == 'b'; k, v = c.Next() {
+			bi, err := DecodeIndex(v)
+			if err != nil {
+				return err
+			}
+			if bi.Pruned {
+				continue
+			}
+			keys[bi.File] = append(keys[bi.File], append([]byte{}, k...))
+			if height, ok := maxHeight[bi.File]; !ok || bi.Height > height {
+				maxHeight[bi.File] = bi.Height
+			}
+		}
+
+		pruneHeight := -1
+		if enc := b.Get([]byte("p")); enc != nil {
+			pruneHeight, err = strconv.Atoi(string(enc))
+			if err != nil {
+				return err
+			}
+		}
+
+		for file := 0; file < current && total > PruneTarget*1024*1024; file++ {
+			if len(keys[file]) == 0 {
+				continue
+			}
+			if maxHeight[file] > int(tipHeight)-PruneDepth {
+				break
+			}
+
+			for _, key := range keys[file] {
+				bi, err := DecodeIndex(b.Get(key))
+				if err != nil {
+					return err
+				}
+				bi.Pruned = true
+				if err := b.Put(key, bi.EncodeIndex()); err != nil {
+					return err
+				}
+			}
+
+			if maxHeight[file] > pruneHeight {
+				pruneHeight = maxHeight[file]
+			}
+			total -= sizes[file]
+			pruned = append(pruned, file)
+		}
+
+		if len(pruned) == 0 {
+			return nil
+		}
+		return b.Put([]byte("p"), []byte(strconv.Itoa(pruneHeight)))
+	})
+	if err != nil {
+		fmt.Printf("error pruning block files: %v\n", err)
+		return err
+	}
+
+	// the index no longer points into these files, so a file that fails to be removed only wastes space
+	for _, file := range pruned {
+		fmt.Printf("pruning block file #%d\n", file)
+		if err := os.Remove(BlockFilePath(file)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("error removing block file #%d: %v\n", file, err)
+		}
+	}
+
+	return nil
+}
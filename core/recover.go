@@ -0,0 +1,117 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"os"
+)
+
+// Recovery
+
+// Connecting or disconnecting a block touches the blocks bucket, the chainstate, the undo data and the indexes all in one db
+// transaction, so the db is never left with half a block applied. What the db can't cover is the block files, and chains written before
+// that was the case. Every time a chain is opened, recover checks that:
+//
+// - the current block file ends with the last block that is indexed in it. Anything after it is part of a block that was being
+//   written when the process died, or a block whose index was never committed, and is cut off. A block file that was started after the
+//   current one is removed for the same reason.
+// - the chainstate is at the tip of the main chain, see the 't' key of the chainstate. If it isn't, the chainstate is rebuilt from the
+//   blocks with Reindex.
+
+// recover brings the block files and the chainstate back in line with the blocks bucket, after the process died while writing them.
+func (bc *Blockchain) recover() error {
+	if err := bc.repairBlockFiles(); err != nil {
+		fmt.Printf("error repairing the block files: %v\n", err)
+		return err
+	}
+
+	return bc.checkChainstate()
+}
+
+// repairBlockFiles cuts off everything after the last indexed block of the current block file, and removes any block file after it.
+func (bc *Blockchain) repairBlockFiles() error {
+	var (
+		current int
+		end     int64
+	)
+
+	if err := bc.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		current = currentBlockFile(b)
+
+		c := b.Cursor()
+		for k, v := c.Seek([]byte("b")); k != nil && k[0] == 'b'; k, v = c.Next() {
+			bi, err := DecodeIndex(v)
+			if err != nil {
+				return err
+			}
+			if bi.File == current && !bi.Pruned && bi.Offset+int64(blockRecordHeader+bi.Length) > end {
+				end = bi.Offset + int64(blockRecordHeader+bi.Length)
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	size, err := blockFileSize(current)
+	if err != nil {
+		return err
+	}
+	if size > end {
+		fmt.Printf("cutting %d unindexed byte(s) off the end of block file #%d\n", size-end, current)
+		if err := os.Truncate(BlockFilePath(current), end); err != nil {
+			return err
+		}
+	}
+
+	// a new file is only started when a block doesn't fit in the current one, and 'f' is moved with the block's index
+	for file := current + 1; ; file++ {
+		if _, err := os.Stat(BlockFilePath(file)); os.IsNotExist(err) {
+			return nil
+		}
+		fmt.Printf("removing unindexed block file #%d\n", file)
+		if err := os.Remove(BlockFilePath(file)); err != nil {
+			return err
+		}
+	}
+}
+
+// checkChainstate makes sure the chainstate is at the tip of the main chain, and rebuilds it if it isn't.
+func (bc *Blockchain) checkChainstate() error {
+	var at []byte
+
+	if err := bc.DB.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(UTXOBucket)); b != nil {
+			at = append([]byte{}, b.Get([]byte("t"))...)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	tipHash, err := bc.GetTailHash()
+	if err != nil {
+		return err
+	}
+	if bytes.Compare(at, tipHash) == 0 {
+		return nil
+	}
+
+	if len(at) == 0 {
+		fmt.Printf("the chainstate doesn't say which block it is at, rebuilding it...\n")
+	} else {
+		fmt.Printf("the chainstate is at block %s instead of the tip, rebuilding it...\n", hex.EncodeToString(at))
+	}
+
+	utxo := UTXO{Blockchain: bc}
+	if err := utxo.Reindex(); err != nil {
+		fmt.Printf("error rebuilding the chainstate: %v\n", err)
+		return err
+	}
+
+	return nil
+}
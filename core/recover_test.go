@@ -0,0 +1,104 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// TestCrashAcrossBlockFiles crashes between writing a block to a new block file and committing its index, and then stores another
+// block, either in the same process or after the chain was opened again.
+func TestCrashAcrossBlockFiles(t *testing.T) {
+	errCrash := errors.New("crash")
+
+	tests := []struct {
+		name    string
+		restart bool
+	}{
+		{name: "same process", restart: false},
+		{name: "after restart", restart: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := newTestChain(t)
+			bc := tc.Blockchain
+
+			first := tc.nextBlock(t, 0)
+			if err := bc.storeBlock(first); err != nil {
+				t.Fatal(err)
+			}
+			// fill up the rest of block file #0, so the next block has to go in block file #1
+			if err := os.Truncate(BlockFilePath(0), maxBlockFileSize-blockRecordHeader); err != nil {
+				t.Fatal(err)
+			}
+
+			lost := tc.nextBlock(t, 0)
+			err := bc.DB.Update(func(tx *bolt.Tx) error {
+				if err := putBlock(tx.Bucket([]byte(blocksBucket)), lost); err != nil {
+					return err
+				}
+				return errCrash
+			})
+			if err != errCrash {
+				t.Fatalf("putBlock: got %v, want the crash", err)
+			}
+			staleSize, err := blockFileSize(1)
+			if err != nil || staleSize == 0 {
+				t.Fatalf("block file #1 has %d bytes (%v), want the lost block", staleSize, err)
+			}
+
+			wantFile, wantOffset := 1, staleSize
+			if tt.restart {
+				if err := bc.repairBlockFiles(); err != nil {
+					t.Fatal(err)
+				}
+				// the unindexed padding of block file #0 is cut off too, so there is room in it again
+				if _, err := os.Stat(BlockFilePath(1)); !os.IsNotExist(err) {
+					t.Errorf("block file #1 wasn't removed: %v", err)
+				}
+				firstIndex, _, err := bc.getIndex(first.Hash)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantFile, wantOffset = 0, firstIndex.Offset+int64(blockRecordHeader+firstIndex.Length)
+			}
+
+			next := tc.nextBlock(t, 0)
+			if err := bc.storeBlock(next); err != nil {
+				t.Fatal(err)
+			}
+
+			bi, found, err := bc.getIndex(next.Hash)
+			if err != nil || !found {
+				t.Fatalf("block isn't indexed: %v", err)
+			}
+			if bi.File != wantFile || bi.Offset != wantOffset {
+				t.Errorf("block indexed at #%d:%d, want #%d:%d", bi.File, bi.Offset, wantFile, wantOffset)
+			}
+			if _, found, _ := bc.getIndex(lost.Hash); found {
+				t.Errorf("the lost block is indexed")
+			}
+
+			for _, block := range []Block{first, next} {
+				got, err := bc.GetBlock(block.Hash)
+				if err != nil {
+					t.Fatalf("reading block back: %v", err)
+				}
+				if string(got.Hash) != string(block.Hash) {
+					t.Errorf("read block %x, want %x", got.Hash, block.Hash)
+				}
+			}
+
+			// the next time the chain is opened nothing indexed may be cut off
+			if err := bc.repairBlockFiles(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := bc.GetBlock(next.Hash); err != nil {
+				t.Errorf("block lost after repairing the block files: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package core
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"strconv"
+)
+
+// Forks
+
+// Two nodes can create different blocks at the same height, and then each keeps building on its own block. Every block we hear about
+// is kept, blocks that don't build on our main chain are stored on a side branch. Once a side branch becomes better than the main
+// chain, we reorganize: every main chain block above the fork point is disconnected, which leaves it on a side branch, and the blocks
+// of the new branch are connected in their place.
+
+var (
+	// ErrKnownBlock is returned when a block that is already stored gets added again.
+	ErrKnownBlock = errors.New("ERROR: block is already known")
+	// ErrOrphanBlock is returned when the previous block of a new block is unknown, so there is nothing to attach it to.
+	ErrOrphanBlock = errors.New("ERROR: previous block is unknown")
+)
+
+// betterChain is the best chain selection rule. There is no proof of work, so a chain is heavier simply if it is longer. When two
+// chains have the same height we keep the one we saw first, so that nodes don't flip back and forth between them.
+func betterChain(candidateHeight, tipHeight int) bool {
+	return candidateHeight > tipHeight
+}
+
+// findFork walks back from the tip of a side branch until it hits a block on the main chain. It returns the height of that block
+// (the fork point), and the side branch blocks ordered from the fork point up to newTip.
+func (bc *Blockchain) findFork(newTip Block) (int, []Block, error) {
+	branch := []Block{newTip}
+	hash := newTip.PrevHash
+
+	for {
+		height, found, err := bc.GetBlockHeight(hash)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !found {
+			return 0, nil, ErrOrphanBlock
+		}
+
+		main, err := bc.IsMainChain(height, hash)
+		if err != nil {
+			return 0, nil, err
+		}
+		if main {
+			return height, branch, nil
+		}
+
+		blk, err := bc.GetBlock(hash)
+		if err != nil {
+			return 0, nil, err
+		}
+		branch = append([]Block{blk}, branch...)
+		hash = blk.PrevHash
+	}
+}
+
+// reorganize switches the main chain over to the branch that ends with newTip. It returns the blocks it disconnected and the blocks it
+// connected, both from the fork point up. If the new branch turns out invalid, the old branch is put back and neither is returned.
+func (bc *Blockchain) reorganize(newTip Block) (disconnected, connected []Block, err error) {
+	forkHeight, branch, err := bc.findFork(newTip)
+	if err != nil {
+		fmt.Printf("error finding fork point for block %s: %v\n", hex.EncodeToString(newTip.Hash), err)
+		return nil, nil, err
+	}
+	// the blocks of a snapshot have no undo data, and the snapshot was trusted, so no branch can fork off below it
+	if err := bc.checkAboveSnapshot(forkHeight); err != nil {
+		fmt.Printf("not reorganizing onto block %s, it forks off at #%d: %v\n", hex.EncodeToString(newTip.Hash), forkHeight, err)
+		return nil, nil, err
+	}
+
+	tipHeight, err := bc.GetChainHeight()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fmt.Printf("reorganizing: fork at #%d, disconnecting %d block(s), connecting %d block(s)\n", forkHeight, int(tipHeight)-forkHeight, len(branch))
+
+	// take the old main chain blocks above the fork point off the chain, but remember them in case the new branch turns out invalid. The old
+	// branch sits on top of the block at base, which is the fork point once all of it is off the chain.
+	var oldBranch []Block
+	base := int(tipHeight)
+
+	// restore puts the old branch back on top of base after the reorg failed with reorgErr, and returns reorgErr. If the old branch can't
+	// be put back, that error is returned instead.
+	restore := func(reorgErr error) error {
+		if switchErr := bc.switchBranch(base, oldBranch); switchErr != nil {
+			fmt.Printf("error going back to the old branch: %v\n", switchErr)
+			return switchErr
+		}
+		return reorgErr
+	}
+
+	for height := int(tipHeight); height > forkHeight; height-- {
+		blk, err := bc.GetBlockByHeight(height)
+		if err != nil {
+			return nil, nil, restore(err)
+		}
+		if err := bc.disconnectTip(height); err != nil {
+			fmt.Printf("error disconnecting block #%d during reorg: %v\n", height, err)
+			return nil, nil, restore(err)
+		}
+		oldBranch = append([]Block{blk}, oldBranch...)
+		base = height - 1
+	}
+
+	for _, blk := range branch {
+		// side blocks were never validated against the chainstate, that can only be done now that their parent is the tip
+		if validErr := bc.ValidateBlock(blk); validErr != nil {
+			fmt.Printf("block #%d on the new branch is invalid, going back to the old branch: %v\n", blk.Height, validErr)
+			// the old branch goes back either way, but failing to remember the invalid block is the error worth reporting
+			if markErr := bc.markInvalid(blk.Hash); markErr != nil {
+				fmt.Printf("error marking block #%d invalid: %v\n", blk.Height, markErr)
+				return nil, nil, restore(markErr)
+			}
+			return nil, nil, restore(validErr)
+		}
+
+		if err := bc.connectBlock(blk); err != nil {
+			fmt.Printf("error connecting block #%d during reorg, going back to the old branch: %v\n", blk.Height, err)
+			return nil, nil, restore(err)
+		}
+	}
+
+	fmt.Printf("reorganized onto block #%d %s\n", newTip.Height, hex.EncodeToString(newTip.Hash))
+	return oldBranch, branch, nil
+}
+
+// switchBranch disconnects the main chain down to forkHeight, and connects branch in its place. The blocks of branch are trusted, since
+// they were already validated when they were on the main chain before.
+func (bc *Blockchain) switchBranch(forkHeight int, branch []Block) error {
+	tipHeight, err := bc.GetChainHeight()
+	if err != nil {
+		return err
+	}
+
+	for height := int(tipHeight); height > forkHeight; height-- {
+		if err := bc.disconnectTip(height); err != nil {
+			return err
+		}
+	}
+
+	for _, blk := range branch {
+		if err := bc.connectBlock(blk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// markInvalid remembers that a block failed validation, so that neither it nor any block building on it is tried again.
+func (bc *Blockchain) markInvalid(hash []byte) error {
+	return bc.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		return b.Put(FormatX(hash), []byte{1})
+	})
+}
+
+// IsInvalid checks if a block was marked as invalid.
+func (bc Blockchain) IsInvalid(hash []byte) (bool, error) {
+	invalid := false
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		invalid = b.Get(FormatX(hash)) != nil
+		return nil
+	})
+
+	return invalid, err
+}
+
+// disconnectTip takes the tip block at height off of the chainstate and the main chain, and makes its parent the new tip. The block stays
+// in the block files, so it is now simply on a side branch. Like connectBlock, this happens in a single db transaction.
+func (bc *Blockchain) disconnectTip(height int) error {
+	blk, err := bc.GetBlockByHeight(height)
+	if err != nil {
+		return err
+	}
+
+	utxo := UTXO{Blockchain: bc}
+
+	err = bc.DB.Update(func(tx *bolt.Tx) error {
+		if err := utxo.disconnect(tx, blk); err != nil {
+			return err
+		}
+
+		b := tx.Bucket([]byte(blocksBucket))
+		if err := b.Delete(FormatH(height)); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("l"), []byte(strconv.Itoa(height-1))); err != nil {
+			return err
+		}
+		return unindexBlock(tx, blk)
+	})
+	if err != nil {
+		fmt.Printf("error disconnecting block #%d: %v\n", height, err)
+	}
+
+	return err
+}
+
+// RewindTo disconnects blocks from the tip of the main chain until height is the new tip. The disconnected blocks are kept on a side
+// branch, so the chain can move forward onto them again.
+func (bc *Blockchain) RewindTo(height int) error {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	tipHeight, err := bc.GetChainHeight()
+	if err != nil {
+		return err
+	}
+
+	if height < 0 || height > int(tipHeight) {
+		return fmt.Errorf("ERROR: can't rewind to height %d, the chain height is %d", height, tipHeight)
+	}
+	if err := bc.checkAboveSnapshot(height); err != nil {
+		return err
+	}
+
+	for h := int(tipHeight); h > height; h-- {
+		if err := bc.disconnectTip(h); err != nil {
+			fmt.Printf("error disconnecting block #%d during rewind: %v\n", h, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// BlockLocator describes our main chain to a peer, so it can find the point where its chain and ours split. It lists the hashes of the
+// last 10 blocks, then steps back exponentially, and always ends with the genesis block.
+func (bc Blockchain) BlockLocator() ([][]byte, error) {
+	var locator [][]byte
+
+	tipHeight, err := bc.GetChainHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	step := 1
+	for height := int(tipHeight); height > 0; height -= step {
+		hash, err := bc.GetMainHash(height)
+		if err != nil {
+			return nil, err
+		}
+		locator = append(locator, hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+
+	genesis, err := bc.GetMainHash(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(locator, genesis), nil
+}
+
+// FindLocatorFork returns the height of the first block in a peer's locator that is on our main chain. If none are, it returns 0, which
+// means the peer only shares the genesis block with us.
+func (bc Blockchain) FindLocatorFork(locator [][]byte) (int, error) {
+	for _, hash := range locator {
+		height, found, err := bc.GetBlockHeight(hash)
+		if err != nil {
+			return 0, err
+		}
+		if !found {
+			continue
+		}
+
+		main, err := bc.IsMainChain(height, hash)
+		if err != nil {
+			return 0, err
+		}
+		if main {
+			return height, nil
+		}
+	}
+
+	return 0, nil
+}
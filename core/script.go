@@ -0,0 +1,605 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Scripts
+
+// Every output is locked by a locking script, and the input that spends it has an unlocking script. To check an input, its unlocking
+// script runs first, and then the locking script of the output it spends runs on the stack the unlocking script left behind. The input
+// is valid if the locking script finishes with a true value on top of the stack. Unlocking scripts can only push data.
+//
+// A script is a list of opcodes. Most opcodes are a single byte, except for the ones that push data, which are followed by the data:
+//
+//   0x00          OpFalse pushes an empty value
+//   0x01-0x4b     pushes the next 1 to 75 bytes
+//   0x4c          OpPushData1 pushes the number of bytes in the next byte
+//   0x4d          OpPushData2 pushes the number of bytes in the next 2 bytes
+//   0x51-0x60     OpTrue to Op16 push the numbers 1 to 16
+//
+// Numbers on the stack are unsigned and big endian, at most 8 bytes, and the empty value is zero. A value is true if any of its bytes
+// isn't zero. The rest of the opcodes are listed below. Scripts are bounded, see maxScriptSize, maxScriptOps, maxScriptElementSize and
+// maxScriptStack, and nothing in a script depends on anything but the transaction and the output it spends, so every node gets the same
+// result.
+//
+// Outputs from before scripts existed, and any output sent to an address, keep the compact form of a public key hash, and are locked by
+// one of the standard templates, see Output.LockingScript:
+//
+//   pay to public key hash:  OpDup OpHash <public key hash> OpEqualVerify OpCheckSig
+//   multisig:                OpDup OpHash <multisig script hash> OpEqualVerify OpCheckMultisig
+//
+// The inputs that spend them keep their Signature and PubKey, which are the unlocking script <Signature> <PubKey>, see
+// Input.UnlockingScript. Any other output carries its locking script in Script, and its PubKeyHash is the hash of that script.
+
+const (
+	OpFalse     byte = 0x00
+	OpPushData1 byte = 0x4c
+	OpPushData2 byte = 0x4d
+	OpTrue      byte = 0x51
+	Op16        byte = 0x60
+
+	OpIf     byte = 0x63 // OpIf pops a value, and runs until OpElse or OpEndIf only if it is true.
+	OpNotIf  byte = 0x64 // OpNotIf pops a value, and runs until OpElse or OpEndIf only if it is false.
+	OpElse   byte = 0x67 // OpElse runs until OpEndIf only if the matching OpIf or OpNotIf didn't run.
+	OpEndIf  byte = 0x68 // OpEndIf ends an OpIf or OpNotIf.
+	OpVerify byte = 0x69 // OpVerify pops a value, and fails if it is false.
+	OpReturn byte = 0x6a // OpReturn fails.
+
+	OpDrop byte = 0x75 // OpDrop pops a value.
+	OpDup  byte = 0x76 // OpDup pushes a copy of the top value.
+	OpSwap byte = 0x7c // OpSwap swaps the top two values.
+	OpSize byte = 0x82 // OpSize pushes the length of the top value, without popping it.
+
+	OpEqual       byte = 0x87 // OpEqual pops two values, and pushes whether they are the same.
+	OpEqualVerify byte = 0x88 // OpEqualVerify is OpEqual followed by OpVerify.
+
+	OpSha256 byte = 0xa8 // OpSha256 pops a value, and pushes its sha256.
+	OpHash   byte = 0xa9 // OpHash pops a value, and pushes its sha512, RIPEMD160 hash, the same hash as HashPublicKey.
+	OpSha512 byte = 0xaa // OpSha512 pops a value, and pushes its sha512.
+
+	OpCheckSig       byte = 0xac // OpCheckSig pops a public key and a signature, and pushes whether the signature signs the input.
+	OpCheckSigVerify byte = 0xad // OpCheckSigVerify is OpCheckSig followed by OpVerify.
+	OpCheckMultisig  byte = 0xae // OpCheckMultisig pops a multisig script and its signature slots, see multisig.go, and pushes whether enough of them sign the input.
+
+	OpCheckLockTimeVerify byte = 0xb1 // OpCheckLockTimeVerify pops a lock time, and fails unless the LockTime of the transaction is at least that, and of the same kind, see SpendContext.
+	OpCheckSequenceVerify byte = 0xb2 // OpCheckSequenceVerify pops a number of blocks, and fails unless the Sequence of the input is at least that.
+)
+
+const (
+	// maxScriptSize is the longest a script can be, in bytes.
+	maxScriptSize = 10000
+	// maxScriptOps is the most opcodes that aren't pushes a script can have.
+	maxScriptOps = 201
+	// maxScriptElementSize is the largest value that can be on the stack. It fits the largest multisig script.
+	maxScriptElementSize = 2048
+	// maxScriptStack is the most values the stack can hold.
+	maxScriptStack = 1000
+	// lockTimeThreshold splits lock times into block heights below it, and unix timestamps from it on.
+	lockTimeThreshold = 500000000
+)
+
+var (
+	// errScriptFailed is returned when a script runs fine, but one of its checks fails.
+	errScriptFailed = errors.New("ERROR: script failed")
+
+	opNames = map[byte]string{
+		OpFalse:               "OpFalse",
+		OpPushData1:           "OpPushData1",
+		OpPushData2:           "OpPushData2",
+		OpIf:                  "OpIf",
+		OpNotIf:               "OpNotIf",
+		OpElse:                "OpElse",
+		OpEndIf:               "OpEndIf",
+		OpVerify:              "OpVerify",
+		OpReturn:              "OpReturn",
+		OpDrop:                "OpDrop",
+		OpDup:                 "OpDup",
+		OpSwap:                "OpSwap",
+		OpSize:                "OpSize",
+		OpEqual:               "OpEqual",
+		OpEqualVerify:         "OpEqualVerify",
+		OpSha256:              "OpSha256",
+		OpHash:                "OpHash",
+		OpSha512:              "OpSha512",
+		OpCheckSig:            "OpCheckSig",
+		OpCheckSigVerify:      "OpCheckSigVerify",
+		OpCheckMultisig:       "OpCheckMultisig",
+		OpCheckLockTimeVerify: "OpCheckLockTimeVerify",
+		OpCheckSequenceVerify: "OpCheckSequenceVerify",
+	}
+)
+
+// SpendContext is where a transaction is being spent, for the checks of its LockTime and the Sequence of its inputs, see checkLocks. A lock time below lockTimeThreshold is a block
+// height, and is past once Height reaches it. Any other lock time is a unix timestamp, and is past once PrevTime reaches it. The time of
+// the previous block is used instead of the block's own, so that a transaction in the mempool is checked the same way as in a block.
+type SpendContext struct {
+	Height   int   // Height is the height of the block the transaction is in.
+	PrevTime int64 // PrevTime is the timestamp of the block before it.
+}
+
+// lockTimePassed checks if a lock time is past in this context.
+func (ctx SpendContext) lockTimePassed(lockTime int64) bool {
+	if lockTime < lockTimeThreshold {
+		return int64(ctx.Height) >= lockTime
+	}
+	return ctx.PrevTime >= lockTime
+}
+
+// FormatLockTime turns a lock time into readable text.
+func FormatLockTime(lockTime int64) string {
+	if lockTime < lockTimeThreshold {
+		return fmt.Sprintf("block %d", lockTime)
+	}
+	return time.Unix(lockTime, 0).UTC().Format(time.RFC3339)
+}
+
+// ScriptBuilder builds up a script.
+type ScriptBuilder struct {
+	buff bytes.Buffer
+}
+
+// AddOp adds opcodes to the script.
+func (sb *ScriptBuilder) AddOp(ops ...byte) *ScriptBuilder {
+	sb.buff.Write(ops)
+	return sb
+}
+
+// AddData adds an opcode that pushes data.
+func (sb *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	switch {
+	case len(data) == 0:
+		sb.buff.WriteByte(OpFalse)
+	case len(data) < int(OpPushData1):
+		sb.buff.WriteByte(byte(len(data)))
+	case len(data) <= 0xff:
+		sb.buff.WriteByte(OpPushData1)
+		sb.buff.WriteByte(byte(len(data)))
+	default:
+		var b [2]byte
+		binary.BigEndian.PutUint16(b[:], uint16(len(data)))
+		sb.buff.WriteByte(OpPushData2)
+		sb.buff.Write(b[:])
+	}
+	sb.buff.Write(data)
+	return sb
+}
+
+// AddInt adds an opcode that pushes a number.
+func (sb *ScriptBuilder) AddInt(n int64) *ScriptBuilder {
+	if n >= 1 && n <= 16 {
+		return sb.AddOp(OpTrue + byte(n-1))
+	}
+	return sb.AddData(encodeScriptNum(n))
+}
+
+// Script returns the script that was built.
+func (sb *ScriptBuilder) Script() []byte {
+	return sb.buff.Bytes()
+}
+
+// P2PKHScript returns the locking script of the pay to public key hash template.
+func P2PKHScript(pubKeyHash []byte) []byte {
+	var sb ScriptBuilder
+	return sb.AddOp(OpDup, OpHash).AddData(pubKeyHash).AddOp(OpEqualVerify, OpCheckSig).Script()
+}
+
+// multisigLockingScript returns the locking script of the multisig template.
+func multisigLockingScript(scriptHash []byte) []byte {
+	var sb ScriptBuilder
+	return sb.AddOp(OpDup, OpHash).AddData(scriptHash).AddOp(OpEqualVerify, OpCheckMultisig).Script()
+}
+
+// scriptOp is a single opcode of a script, with the data it pushes.
+type scriptOp struct {
+	op   byte
+	data []byte
+}
+
+// isPush checks if an opcode only pushes data.
+func (so scriptOp) isPush() bool {
+	return so.op <= OpPushData2 || (so.op >= OpTrue && so.op <= Op16)
+}
+
+// parseScript splits a script up into its opcodes.
+func parseScript(script []byte) ([]scriptOp, error) {
+	if len(script) > maxScriptSize {
+		return nil, fmt.Errorf("ERROR: script is %d bytes, the most is %d", len(script), maxScriptSize)
+	}
+
+	var ops []scriptOp
+	for i := 0; i < len(script); {
+		so := scriptOp{op: script[i]}
+		i++
+
+		length := 0
+		switch {
+		case so.op > OpFalse && so.op < OpPushData1:
+			length = int(so.op)
+		case so.op == OpPushData1:
+			if i+1 > len(script) {
+				return nil, errors.New("ERROR: script ends in the middle of OpPushData1")
+			}
+			length = int(script[i])
+			i++
+		case so.op == OpPushData2:
+			if i+2 > len(script) {
+				return nil, errors.New("ERROR: script ends in the middle of OpPushData2")
+			}
+			length = int(binary.BigEndian.Uint16(script[i:]))
+			i += 2
+		case so.op >= OpTrue && so.op <= Op16:
+			so.data = []byte{so.op - OpTrue + 1}
+		}
+
+		if length > 0 {
+			if i+length > len(script) {
+				return nil, fmt.Errorf("ERROR: script pushes %d bytes, but only %d are left", length, len(script)-i)
+			}
+			so.data = script[i : i+length]
+			i += length
+		}
+		ops = append(ops, so)
+	}
+
+	return ops, nil
+}
+
+// DisassembleScript turns a script into readable text, with the data it pushes in hex.
+func DisassembleScript(script []byte) (string, error) {
+	ops, err := parseScript(script)
+	if err != nil {
+		return "", err
+	}
+
+	var parts []string
+	for _, so := range ops {
+		switch {
+		case so.op >= OpTrue && so.op <= Op16:
+			parts = append(parts, fmt.Sprintf("%d", so.op-OpTrue+1))
+		case so.isPush():
+			parts = append(parts, "<"+hex.EncodeToString(so.data)+">")
+		case opNames[so.op] != "":
+			parts = append(parts, opNames[so.op])
+		default:
+			parts = append(parts, fmt.Sprintf("OpUnknown(0x%02x)", so.op))
+		}
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// scriptNum reads a number off of the stack.
+func scriptNum(data []byte) (int64, error) {
+	if len(data) > 8 || (len(data) == 8 && data[0]&0x80 != 0) {
+		return 0, errors.New("ERROR: script number is too big")
+	}
+	var n int64
+	for _, b := range data {
+		n = n<<8 | int64(b)
+	}
+	return n, nil
+}
+
+// encodeScriptNum encodes a number for the stack, with as few bytes as it takes.
+func encodeScriptNum(n int64) []byte {
+	var data []byte
+	for ; n > 0; n >>= 8 {
+		data = append([]byte{byte(n)}, data...)
+	}
+	return data
+}
+
+// scriptBool checks if a value on the stack is true.
+func scriptBool(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeScriptBool encodes a bool for the stack.
+func encodeScriptBool(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return nil
+}
+
+// scriptChecker checks the signatures and time locks of the scripts of a single input. The time locks of a script are only checked against
+// the transaction itself, which is what keeps a script from depending on the block it is in. checkLocks makes sure the lock time and
+// sequence of the transaction are past in the block, so a script that requires them to be high enough requires that too.
+type scriptChecker struct {
+	hash     []byte // hash is what the signatures of the input sign, see Transaction.sigHash.
+	lockTime int64  // lockTime is the LockTime of the transaction.
+	sequence int    // sequence is the Sequence of the input.
+}
+
+// scriptStack is the stack the scripts of an input run on.
+type scriptStack [][]byte
+
+func (s *scriptStack) push(data []byte) error {
+	if len(data) > maxScriptElementSize {
+		return fmt.Errorf("ERROR: script value of %d bytes is bigger than %d", len(data), maxScriptElementSize)
+	}
+	if len(*s) >= maxScriptStack {
+		return errors.New("ERROR: script stack is too big")
+	}
+	*s = append(*s, data)
+	return nil
+}
+
+func (s *scriptStack) pop() ([]byte, error) {
+	if len(*s) == 0 {
+		return nil, errors.New("ERROR: script pops from an empty stack")
+	}
+	data := (*s)[len(*s)-1]
+	*s = (*s)[:len(*s)-1]
+	return data, nil
+}
+
+func (s *scriptStack) popNum() (int64, error) {
+	data, err := s.pop()
+	if err != nil {
+		return 0, err
+	}
+	return scriptNum(data)
+}
+
+// executeScripts runs the unlocking script of an input, and then the locking script of the output it spends. It returns false if a
+// check of the scripts fails, and an error if a script is malformed.
+func executeScripts(unlocking, locking []byte, c scriptChecker) (bool, error) {
+	var stack scriptStack
+
+	ops, err := parseScript(unlocking)
+	if err != nil {
+		return false, err
+	}
+	for _, so := range ops {
+		if !so.isPush() {
+			return false, errors.New("ERROR: unlocking script can only push data")
+		}
+	}
+
+	for _, script := range [][]byte{unlocking, locking} {
+		if err := runScript(script, &stack, c); err != nil {
+			if err == errScriptFailed {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+
+	if len(stack) == 0 {
+		return false, nil
+	}
+	return scriptBool(stack[len(stack)-1]), nil
+}
+
+// runScript runs a single script on the stack.
+func runScript(script []byte, stack *scriptStack, c scriptChecker) error {
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+
+	var (
+		// conditions holds whether each OpIf we are in runs, the opcodes only run if they all do
+		conditions []bool
+		count      int
+	)
+
+	for _, so := range ops {
+		if !so.isPush() {
+			if count++; count > maxScriptOps {
+				return fmt.Errorf("ERROR: script has more than %d opcodes", maxScriptOps)
+			}
+		}
+
+		running := true
+		for _, cond := range conditions {
+			running = running && cond
+		}
+
+		switch so.op {
+		case OpIf, OpNotIf:
+			cond := false
+			if running {
+				data, err := stack.pop()
+				if err != nil {
+					return err
+				}
+				cond = scriptBool(data) == (so.op == OpIf)
+			}
+			conditions = append(conditions, cond)
+			continue
+		case OpElse:
+			if len(conditions) == 0 {
+				return errors.New("ERROR: script has OpElse without OpIf")
+			}
+			conditions[len(conditions)-1] = !conditions[len(conditions)-1]
+			continue
+		case OpEndIf:
+			if len(conditions) == 0 {
+				return errors.New("ERROR: script has OpEndIf without OpIf")
+			}
+			conditions = conditions[:len(conditions)-1]
+			continue
+		}
+
+		if !running {
+			continue
+		}
+		if err := runOp(so, stack, c); err != nil {
+			return err
+		}
+	}
+
+	if len(conditions) != 0 {
+		return errors.New("ERROR: script has OpIf without OpEndIf")
+	}
+	return nil
+}
+
+// runOp runs a single opcode that isn't part of a conditional.
+func runOp(so scriptOp, stack *scriptStack, c scriptChecker) error {
+	if so.isPush() {
+		return stack.push(so.data)
+	}
+
+	switch so.op {
+	case OpVerify:
+		data, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		if !scriptBool(data) {
+			return errScriptFailed
+		}
+
+	case OpReturn:
+		return errScriptFailed
+
+	case OpDrop:
+		_, err := stack.pop()
+		return err
+
+	case OpDup:
+		data, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		if err := stack.push(data); err != nil {
+			return err
+		}
+		return stack.push(data)
+
+	case OpSwap:
+		a, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		b, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		if err := stack.push(a); err != nil {
+			return err
+		}
+		return stack.push(b)
+
+	case OpSize:
+		data, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		if err := stack.push(data); err != nil {
+			return err
+		}
+		return stack.push(encodeScriptNum(int64(len(data))))
+
+	case OpEqual, OpEqualVerify:
+		a, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		b, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		equal := bytes.Compare(a, b) == 0
+		if so.op == OpEqualVerify {
+			if !equal {
+				return errScriptFailed
+			}
+			return nil
+		}
+		return stack.push(encodeScriptBool(equal))
+
+	case OpSha256, OpHash, OpSha512:
+		data, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		var hash []byte
+		switch so.op {
+		case OpSha256:
+			sum := sha256.Sum256(data)
+			hash = sum[:]
+		case OpSha512:
+			sum := sha512.Sum512(data)
+			hash = sum[:]
+		default:
+			if hash, err = HashPublicKey(data); err != nil {
+				return err
+			}
+		}
+		return stack.push(hash)
+
+	case OpCheckSig, OpCheckSigVerify:
+		pubKey, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		verified := verifySignature(pubKey, c.hash, signature)
+		if so.op == OpCheckSigVerify {
+			if !verified {
+				return errScriptFailed
+			}
+			return nil
+		}
+		return stack.push(encodeScriptBool(verified))
+
+	case OpCheckMultisig:
+		script, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		signatures, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		verified, err := checkMultisig(script, signatures, c.hash)
+		if err != nil {
+			return err
+		}
+		return stack.push(encodeScriptBool(verified))
+
+	case OpCheckLockTimeVerify:
+		lockTime, err := stack.popNum()
+		if err != nil {
+			return err
+		}
+		// a block height can't be compared with a time
+		if (lockTime < lockTimeThreshold) != (c.lockTime < lockTimeThreshold) || lockTime > c.lockTime {
+			return errScriptFailed
+		}
+
+	case OpCheckSequenceVerify:
+		age, err := stack.popNum()
+		if err != nil {
+			return err
+		}
+		if age > int64(c.sequence) {
+			return errScriptFailed
+		}
+
+	default:
+		return fmt.Errorf("ERROR: script has unknown opcode 0x%02x", so.op)
+	}
+
+	return nil
+}
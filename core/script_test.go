@@ -0,0 +1,296 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+// testChecker checks an input with a sequence of 5, of a transaction locked until block #10.
+var testChecker = scriptChecker{
+	hash:     fill(0x42, 64),
+	lockTime: 10,
+	sequence: 5,
+}
+
+// skippedScript returns a script of size bytes that skips all but its last opcode, which leaves true on the stack.
+func skippedScript(size int) []byte {
+	script := append([]byte{OpIf}, fill(OpTrue, size-3)...)
+	return append(script, OpEndIf, OpTrue)
+}
+
+func TestScripts(t *testing.T) {
+	secretHash := sha256.Sum256([]byte("secret"))
+
+	tests := []struct {
+		name      string
+		unlocking []byte
+		locking   []byte
+		want      bool
+		err       bool
+	}{
+		{name: "true", locking: []byte{OpTrue}, want: true},
+		{name: "false", locking: []byte{OpFalse}},
+		{name: "empty stack", locking: nil},
+		{name: "push data", unlocking: new(ScriptBuilder).AddData(fill(0x01, 300)).Script(), locking: nil, want: true},
+		{name: "push numbers", unlocking: new(ScriptBuilder).AddInt(16).AddInt(1000).Script(), locking: new(ScriptBuilder).AddInt(1000).AddOp(OpEqual).Script(), want: true},
+
+		{name: "if taken", unlocking: []byte{OpTrue}, locking: []byte{OpIf, OpTrue, OpElse, OpFalse, OpEndIf}, want: true},
+		{name: "else taken", unlocking: []byte{OpFalse}, locking: []byte{OpIf, OpFalse, OpElse, OpTrue, OpEndIf}, want: true},
+		{name: "notif", unlocking: []byte{OpFalse}, locking: []byte{OpNotIf, OpTrue, OpElse, OpFalse, OpEndIf}, want: true},
+		{name: "nested if", unlocking: []byte{OpTrue, OpFalse}, locking: []byte{OpIf, OpIf, OpFalse, OpElse, OpTrue, OpEndIf, OpEndIf}, want: true},
+		{name: "skipped branch doesn't run", unlocking: []byte{OpFalse}, locking: []byte{OpIf, OpReturn, OpEndIf, OpTrue}, want: true},
+
+		{name: "verify true", locking: []byte{OpTrue, OpVerify, OpTrue}, want: true},
+		{name: "verify false", locking: []byte{OpFalse, OpVerify, OpTrue}},
+		{name: "return", locking: []byte{OpTrue, OpReturn}},
+		{name: "drop", unlocking: []byte{OpTrue, OpFalse}, locking: []byte{OpDrop}, want: true},
+		{name: "dup", unlocking: []byte{OpTrue}, locking: []byte{OpDup, OpEqual}, want: true},
+		{name: "swap", unlocking: []byte{OpTrue, Op16}, locking: []byte{OpSwap, OpTrue, OpEqual}, want: true},
+		{name: "size", unlocking: new(ScriptBuilder).AddData(fill(0x01, 5)).Script(), locking: []byte{OpSize, OpTrue + 4, OpEqual}, want: true},
+		{name: "equal", unlocking: []byte{OpTrue, OpTrue}, locking: []byte{OpEqual}, want: true},
+		{name: "not equal", unlocking: []byte{OpTrue, Op16}, locking: []byte{OpEqual}},
+		{name: "equal verify fails", unlocking: []byte{OpTrue, Op16}, locking: []byte{OpEqualVerify, OpTrue}},
+		{
+			name:      "sha256",
+			unlocking: new(ScriptBuilder).AddData([]byte("secret")).Script(),
+			locking:   new(ScriptBuilder).AddOp(OpSha256).AddData(secretHash[:]).AddOp(OpEqual).Script(),
+			want:      true,
+		},
+		{
+			name:      "sha256 of something else",
+			unlocking: new(ScriptBuilder).AddData([]byte("secrets")).Script(),
+			locking:   new(ScriptBuilder).AddOp(OpSha256).AddData(secretHash[:]).AddOp(OpEqual).Script(),
+		},
+
+		{name: "unlocking script with an opcode", unlocking: []byte{OpTrue, OpDup}, locking: []byte{OpEqual}, err: true},
+		{name: "unknown opcode", locking: []byte{0xff}, err: true},
+		{name: "pop from empty stack", locking: []byte{OpDrop}, err: true},
+		{name: "else without if", locking: []byte{OpElse, OpTrue}, err: true},
+		{name: "endif without if", locking: []byte{OpEndIf, OpTrue}, err: true},
+		{name: "if without endif", unlocking: []byte{OpTrue}, locking: []byte{OpIf, OpTrue}, err: true},
+		{name: "push past the end", locking: []byte{0x05, 0x01}, err: true},
+		{name: "pushdata1 past the end", locking: []byte{OpPushData1}, err: true},
+		{name: "number too big", unlocking: new(ScriptBuilder).AddData(fill(0x01, 9)).Script(), locking: []byte{OpCheckSequenceVerify, OpTrue}, err: true},
+
+		{name: "largest script", unlocking: []byte{OpFalse}, locking: skippedScript(maxScriptSize), want: true},
+		{name: "script too big", unlocking: []byte{OpFalse}, locking: skippedScript(maxScriptSize + 1), err: true},
+		{name: "largest value", unlocking: new(ScriptBuilder).AddData(fill(0x01, maxScriptElementSize)).Script(), want: true},
+		{name: "value too big", unlocking: new(ScriptBuilder).AddData(fill(0x01, maxScriptElementSize+1)).Script(), err: true},
+		{name: "largest stack", unlocking: fill(OpTrue, maxScriptStack), want: true},
+		{name: "stack too big", unlocking: fill(OpTrue, maxScriptStack+1), err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := executeScripts(tt.unlocking, tt.locking, testChecker)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want an error: %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeLocks(t *testing.T) {
+	lockTimeScript := func(lockTime int64) []byte {
+		return new(ScriptBuilder).AddInt(lockTime).AddOp(OpCheckLockTimeVerify, OpTrue).Script()
+	}
+	sequenceScript := func(age int64) []byte {
+		return new(ScriptBuilder).AddInt(age).AddOp(OpCheckSequenceVerify, OpTrue).Script()
+	}
+
+	tests := []struct {
+		name     string
+		lockTime int64
+		sequence int
+		locking  []byte
+		want     bool
+	}{
+		{name: "lock height reached", lockTime: 10, locking: lockTimeScript(10), want: true},
+		{name: "lock height past", lockTime: 12, locking: lockTimeScript(10), want: true},
+		{name: "transaction lock height too low", lockTime: 9, locking: lockTimeScript(10)},
+		{name: "transaction not locked", lockTime: 0, locking: lockTimeScript(10)},
+		{name: "lock time reached", lockTime: lockTimeThreshold + 100, locking: lockTimeScript(lockTimeThreshold + 100), want: true},
+		{name: "transaction lock time too low", lockTime: lockTimeThreshold + 99, locking: lockTimeScript(lockTimeThreshold + 100)},
+		{name: "lock time against a lock height", lockTime: 10, locking: lockTimeScript(lockTimeThreshold + 1)},
+		{name: "lock height against a lock time", lockTime: lockTimeThreshold + 100, locking: lockTimeScript(10)},
+
+		{name: "sequence reached", sequence: 5, locking: sequenceScript(5), want: true},
+		{name: "sequence past", sequence: 7, locking: sequenceScript(5), want: true},
+		{name: "input sequence too low", sequence: 4, locking: sequenceScript(5)},
+		{name: "input not locked", sequence: 0, locking: sequenceScript(1)},
+		{name: "no sequence needed", sequence: 0, locking: sequenceScript(0), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := scriptChecker{hash: testChecker.hash, lockTime: tt.lockTime, sequence: tt.sequence}
+			got, err := executeScripts(nil, tt.locking, checker)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScriptOpcodeLimit(t *testing.T) {
+	// every OpDup counts, the pushes don't
+	for _, tt := range []struct {
+		ops int
+		err bool
+	}{
+		{ops: maxScriptOps, err: false},
+		{ops: maxScriptOps + 1, err: true},
+	} {
+		locking := append([]byte{OpTrue}, fill(OpDup, tt.ops)...)
+		verified, err := executeScripts(nil, locking, testChecker)
+		if (err != nil) != tt.err || verified == tt.err {
+			t.Errorf("%d opcodes: got %v, %v, want an error: %v", tt.ops, verified, err, tt.err)
+		}
+	}
+}
+
+// testKey is a key pair that signs the hash of testChecker.
+type testKey struct {
+	pubKey     []byte
+	pubKeyHash []byte
+	signature  []byte
+}
+
+func newTestKey(t *testing.T) testKey {
+	t.Helper()
+
+	w, err := CreateWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKeyHash, err := HashPublicKey(w.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := signHash(w.PrivateKey, testChecker.hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{pubKey: w.PublicKey, pubKeyHash: pubKeyHash, signature: signature}
+}
+
+func TestTemplates(t *testing.T) {
+	alice, bob, carol := newTestKey(t), newTestKey(t), newTestKey(t)
+
+	p2pkh := func(signature, pubKey []byte) []byte {
+		return new(ScriptBuilder).AddData(signature).AddData(pubKey).Script()
+	}
+
+	ms, err := NewMultisigScript(2, [][]byte{alice.pubKey, bob.pubKey, carol.pubKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msHash, err := ms.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// multisig fills the signature slots of the keys in signers, in the order of the script's public keys
+	multisig := func(slots int, signers ...testKey) []byte {
+		signatures := make([][]byte, slots)
+		for k, pubKey := range ms.PubKeys {
+			for _, signer := range signers {
+				if k < slots && bytes.Equal(pubKey, signer.pubKey) {
+					signatures[k] = signer.signature
+				}
+			}
+		}
+		return new(ScriptBuilder).AddData(encodeMultisigSignatures(signatures)).AddData(ms.Encode()).Script()
+	}
+
+	// alice signs in the slot of bob's key
+	swapSlots := make([][]byte, 3)
+	for k, pubKey := range ms.PubKeys {
+		switch {
+		case bytes.Equal(pubKey, bob.pubKey):
+			swapSlots[k] = alice.signature
+		case bytes.Equal(pubKey, carol.pubKey):
+			swapSlots[k] = carol.signature
+		}
+	}
+	swapped := new(ScriptBuilder).AddData(encodeMultisigSignatures(swapSlots)).AddData(ms.Encode()).Script()
+
+	secret := fill(0x5e, secretLen)
+	secretHash := sha256.Sum256(secret)
+	contract := HTLC{SecretHash: secretHash[:], Recipient: alice.pubKeyHash, Refund: bob.pubKeyHash, LockTime: 10}
+	redeem := func(key testKey, secret []byte) []byte {
+		return new(ScriptBuilder).AddData(key.signature).AddData(key.pubKey).AddData(secret).AddOp(OpTrue).Script()
+	}
+	refund := func(key testKey) []byte {
+		return new(ScriptBuilder).AddData(key.signature).AddData(key.pubKey).AddOp(OpFalse).Script()
+	}
+	locked := contract
+	locked.LockTime = 11
+
+	tests := []struct {
+		name      string
+		unlocking []byte
+		locking   []byte
+		want      bool
+		err       bool
+	}{
+		{name: "p2pkh", unlocking: p2pkh(alice.signature, alice.pubKey), locking: P2PKHScript(alice.pubKeyHash), want: true},
+		{name: "p2pkh other key", unlocking: p2pkh(bob.signature, bob.pubKey), locking: P2PKHScript(alice.pubKeyHash)},
+		{name: "p2pkh other signature", unlocking: p2pkh(bob.signature, alice.pubKey), locking: P2PKHScript(alice.pubKeyHash)},
+		{name: "p2pkh no signature", unlocking: p2pkh(nil, alice.pubKey), locking: P2PKHScript(alice.pubKeyHash)},
+
+		{name: "multisig 2 of 3", unlocking: multisig(3, alice, carol), locking: multisigLockingScript(msHash), want: true},
+		{name: "multisig 3 of 3", unlocking: multisig(3, alice, bob, carol), locking: multisigLockingScript(msHash), want: true},
+		{name: "multisig 1 of 3", unlocking: multisig(3, bob), locking: multisigLockingScript(msHash)},
+		{name: "multisig signature in the wrong slot", unlocking: swapped, locking: multisigLockingScript(msHash)},
+		{name: "multisig other script", unlocking: multisig(3, alice, bob), locking: multisigLockingScript(alice.pubKeyHash)},
+		{name: "multisig missing slot", unlocking: multisig(2, alice, bob), locking: multisigLockingScript(msHash), err: true},
+
+		{name: "htlc redeem", unlocking: redeem(alice, secret), locking: contract.Script(), want: true},
+		{name: "htlc redeem wrong secret", unlocking: redeem(alice, fill(0x00, secretLen)), locking: contract.Script()},
+		{name: "htlc redeem short secret", unlocking: redeem(alice, secret[1:]), locking: contract.Script()},
+		{name: "htlc redeem by the refund key", unlocking: redeem(bob, secret), locking: contract.Script()},
+		{name: "htlc refund", unlocking: refund(bob), locking: contract.Script(), want: true},
+		{name: "htlc refund before the lock time", unlocking: refund(bob), locking: locked.Script()},
+		{name: "htlc refund by the recipient", unlocking: refund(alice), locking: contract.Script()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := executeScripts(tt.unlocking, tt.locking, testChecker)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want an error: %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHTLC(t *testing.T) {
+	secretHash := sha256.Sum256(fill(0x5e, secretLen))
+	contract := HTLC{SecretHash: secretHash[:], Recipient: fill(0x01, 20), Refund: fill(0x02, 20), LockTime: lockTimeThreshold + 5}
+
+	parsed, err := ParseHTLC(contract.Script())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed.Script(), contract.Script()) || parsed.LockTime != contract.LockTime {
+		t.Errorf("contract changed after parsing: %+v", parsed)
+	}
+
+	changed := contract.Script()
+	changed[len(changed)-1] = OpCheckSigVerify
+	for _, script := range [][]byte{P2PKHScript(fill(0x01, 20)), changed, nil} {
+		if _, err := ParseHTLC(script); err == nil {
+			t.Errorf("parsed %x as a contract", script)
+		}
+	}
+}
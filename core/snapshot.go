@@ -0,0 +1,321 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"strconv"
+)
+
+// Snapshots
+
+// A new node normally downloads every block and replays it to build its chainstate. A snapshot lets it skip all of that: it is the
+// chainstate of another node at its tip, along with the header of every main chain block up to that tip. Loading one gives a node the
+// same tip and chainstate, as if it had connected every block itself, but with every block up to the tip pruned, see prune.go.
+//
+// A snapshot file is in the canonical encoding, see encoding.go:
+//
+//   uint32 version | bytes Network | uint32 len(Headers) | BlockHeader... | uint32 len(Coins) | Coin... | bytes Hash
+// Coin:
+//   bytes TransactionID | uint32 Index | bytes UnspentOutput, see encodeUnspent
+//
+// Headers start at the genesis block, and the last header is the tip. Only the unspent outputs are in the snapshot, the public key hash
+// index and the balances are rebuilt from them when it is loaded. Hash is the sha512 of everything in front of it, and is what a
+// snapshot is known by. A snapshot is only loaded if its hash is pinned for the network at its height, see NetworkParams.Snapshots, or
+// if the user passes the hash they expect.
+//
+// No snapshots are pinned yet, so for now every snapshot is loaded on the user's word. The hash only proves the file is the one the user
+// expects, nothing checks its coins against the blocks, so load-utxo trusts whoever made the file. The snapshot also comes without undo
+// data, so its blocks can never be disconnected: the blocks bucket stores the height of the snapshot under the key 's', and the chain
+// refuses to reorganize or rewind below it, see checkAboveSnapshot. For the same reason the optional indexes, which need every block,
+// can't be built for a chain loaded from a snapshot, and a snapshot isn't loaded while any of them is enabled, see checkNoIndexes.
+
+const (
+	// snapshotVersion is the version of the snapshot file encoding.
+	snapshotVersion = 1
+)
+
+// ErrBelowSnapshot is returned when a reorg or rewind would disconnect a block of the snapshot the chain was loaded from.
+var ErrBelowSnapshot = errors.New("ERROR: the chain was loaded from a snapshot, it can't go back below the snapshot's tip")
+
+// SnapshotInfo describes a snapshot file.
+type SnapshotInfo struct {
+	Height  int    // Height is the height of the tip of the snapshot.
+	TipHash []byte // TipHash is the hash of the tip of the snapshot.
+	Coins   int    // Coins is the number of unspent outputs in the snapshot.
+	Hash    []byte // Hash is the content hash of the snapshot.
+}
+
+// DumpSnapshot writes the chainstate at the tip, and the header of every main chain block, to a snapshot file at path.
+func (bc Blockchain) DumpSnapshot(path string) (SnapshotInfo, error) {
+	var (
+		info SnapshotInfo
+		e    encoder
+	)
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		blocks := tx.Bucket([]byte(blocksBucket))
+
+		tipHeight, err := strconv.Atoi(string(blocks.Get([]byte("l"))))
+		if err != nil {
+			return err
+		}
+
+		e.writeUint32(snapshotVersion)
+		e.writeBytes([]byte(Params.Name))
+
+		e.writeUint32(uint32(tipHeight + 1))
+		for height := 0; height <= tipHeight; height++ {
+			hash := blocks.Get(FormatH(height))
+			if hash == nil {
+				return fmt.Errorf("ERROR: no main chain block at height %d", height)
+			}
+			bi, err := DecodeIndex(blocks.Get(FormatB(hash)))
+			if err != nil {
+				return err
+			}
+			bi.Header.encode(&e)
+			info.TipHash = append([]byte{}, hash...)
+		}
+		info.Height = tipHeight
+
+		// only the unspent outputs, the rest of the chainstate is built from them
+		c := tx.Bucket([]byte(UTXOBucket)).Cursor()
+		var coins encoder
+		for k, v := c.Seek([]byte("o")); k != nil && k[0] == 'o'; k, v = c.Next() {
+			// 'o' + transaction ID + 4-byte index, see FormatO
+			coins.writeBytes(k[1 : len(k)-4])
+			coins.writeUint32(binary.BigEndian.Uint32(k[len(k)-4:]))
+			coins.writeBytes(v)
+			info.Coins++
+		}
+		e.writeUint32(uint32(info.Coins))
+		e.buff.Write(coins.buff.Bytes())
+
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("error reading the chainstate for the snapshot: %v\n", err)
+		return info, err
+	}
+
+	hash := sha512.Sum512(e.buff.Bytes())
+	info.Hash = hash[:]
+	e.writeBytes(info.Hash)
+
+	// a half written snapshot never has the name of a good one
+	if err := WriteFileAtomic(path, e.buff.Bytes(), 0644); err != nil {
+		fmt.Printf("error writing snapshot file %s: %v\n", path, err)
+		return info, err
+	}
+
+	return info, nil
+}
+
+// LoadSnapshot replaces the chainstate of a new chain with the snapshot at path, see the description at the top of this file. The
+// snapshot has to be pinned for the network, or its content hash has to be trusted, which is the hash the user expects. trusted can be
+// nil. A trusted snapshot is taken as it is, its coins aren't checked against anything.
+func (bc *Blockchain) LoadSnapshot(path string, trusted []byte) (SnapshotInfo, error) {
+	var info SnapshotInfo
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Printf("error reading snapshot file %s: %v\n", path, err)
+		return info, err
+	}
+
+	d := newDecoder(data)
+	d.readVersion(snapshotVersion)
+	network := string(d.readBytes())
+
+	headers := make([]BlockHeader, d.readCount(36))
+	for i := range headers {
+		headers[i] = decodeHeader(d)
+	}
+
+	coins := make([]UnspentOutput, d.readCount(12))
+	for i := range coins {
+		txID := d.readBytes()
+		index := int(d.readUint32())
+		enc := d.readBytes()
+		if d.err != nil {
+			break
+		}
+		if coins[i], err = decodeUnspent(txID, index, enc); err != nil {
+			return info, err
+		}
+	}
+
+	content := len(data) - d.r.Len()
+	info.Hash = d.readBytes()
+	if err := d.finish(); err != nil {
+		fmt.Printf("error decoding snapshot file %s: %v\n", path, err)
+		return info, err
+	}
+
+	hash := sha512.Sum512(data[:content])
+	if !bytes.Equal(hash[:], info.Hash) {
+		return info, fmt.Errorf("ERROR: snapshot %s is corrupt, its content doesn't match its hash", path)
+	}
+	if network != Params.Name {
+		return info, fmt.Errorf("ERROR: snapshot is for %s, not %s", network, Params.Name)
+	}
+	if len(headers) == 0 {
+		return info, fmt.Errorf("ERROR: snapshot has no headers")
+	}
+
+	info.Height = len(headers) - 1
+	info.TipHash = headers[info.Height].Hash()
+	info.Coins = len(coins)
+
+	if pinned, ok := Params.Snapshots[info.Height]; ok {
+		if pinned != hex.EncodeToString(info.Hash) {
+			return info, fmt.Errorf("ERROR: snapshot hash %s doesn't match the %s snapshot pinned at height %d", hex.EncodeToString(info.Hash), Params.Name, info.Height)
+		}
+	} else if trusted == nil {
+		return info, fmt.Errorf("ERROR: no %s snapshot is pinned at height %d, pass its hash %s to trust it", Params.Name, info.Height, hex.EncodeToString(info.Hash))
+	} else if !bytes.Equal(trusted, info.Hash) {
+		return info, fmt.Errorf("ERROR: snapshot hash %s isn't the trusted hash %s", hex.EncodeToString(info.Hash), hex.EncodeToString(trusted))
+	}
+
+	// the headers have to be a chain that starts at our own genesis block
+	genesisHash, err := bc.GetMainHash(0)
+	if err != nil {
+		return info, err
+	}
+	prevHash := genesisHash
+	for height, header := range headers {
+		if header.Height != height {
+			return info, fmt.Errorf("ERROR: snapshot header #%d has height %d", height, header.Height)
+		}
+		if height == 0 {
+			if !bytes.Equal(header.Hash(), genesisHash) {
+				return info, fmt.Errorf("ERROR: snapshot is of a chain with a different genesis block")
+			}
+			continue
+		}
+		if !bytes.Equal(header.PrevHash, prevHash) {
+			return info, fmt.Errorf("ERROR: snapshot header #%d doesn't build on header #%d", height, height-1)
+		}
+		prevHash = header.Hash()
+	}
+
+	tipHeight, err := bc.GetChainHeight()
+	if err != nil {
+		return info, err
+	}
+	if tipHeight != 0 {
+		return info, fmt.Errorf("ERROR: a snapshot can only be loaded onto a new chain, this chain is at height %d", tipHeight)
+	}
+	if err := bc.checkNoIndexes(); err != nil {
+		return info, err
+	}
+
+	err = bc.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+
+		// none of the blocks are stored, only their headers, so every block is pruned
+		for height := 1; height < len(headers); height++ {
+			hash := headers[height].Hash()
+			bi := BlockIndex{Height: height, Pruned: true, Header: headers[height]}
+			if err := b.Put(FormatB(hash), bi.EncodeIndex()); err != nil {
+				return err
+			}
+			if err := b.Put(FormatH(height), hash); err != nil {
+				return err
+			}
+		}
+		if err := b.Put([]byte("l"), []byte(strconv.Itoa(info.Height))); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("p"), []byte(strconv.Itoa(info.Height))); err != nil {
+			return err
+		}
+		// s : height of the snapshot, there is no undo data to disconnect any block up to it
+		if err := b.Put([]byte("s"), []byte(strconv.Itoa(info.Height))); err != nil {
+			return err
+		}
+
+		for _, name := range []string{UTXOBucket, undoBucket} {
+			if err := tx.DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			if _, err := tx.CreateBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+
+		chainstate := tx.Bucket([]byte(UTXOBucket))
+		for _, uo := range coins {
+			if err := putUnspent(chainstate, uo); err != nil {
+				return err
+			}
+		}
+
+		return chainstate.Put([]byte("t"), info.TipHash)
+	})
+	if err != nil {
+		fmt.Printf("error loading snapshot: %v\n", err)
+	}
+
+	return info, err
+}
+
+// checkNoIndexes makes sure none of the optional indexes are enabled, since they can't be built without the blocks a snapshot leaves
+// out, and can't be built later either once every block up to the snapshot is pruned.
+func (bc Blockchain) checkNoIndexes() error {
+	indexes := []struct {
+		enabled bool
+		bucket  string
+		flag    string
+	}{
+		{BuildTxIndex, txIndexBucket, "--txindex"},
+		{BuildAddrIndex, addrIndexBucket, "--addrindex"},
+		{BuildAnchorIndex, anchorIndexBucket, "--anchorindex"},
+	}
+
+	return bc.DB.View(func(tx *bolt.Tx) error {
+		for _, index := range indexes {
+			if index.enabled || tx.Bucket([]byte(index.bucket)) != nil {
+				return fmt.Errorf("ERROR: the %s index is enabled, and can't be built from a snapshot. Load the snapshot on a new chain, without %s", index.bucket, index.flag)
+			}
+		}
+		return nil
+	})
+}
+
+// GetSnapshotHeight returns the height of the snapshot the chain was loaded from, or -1 if it wasn't loaded from a snapshot.
+func (bc Blockchain) GetSnapshotHeight() (int, error) {
+	height := -1
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		enc := tx.Bucket([]byte(blocksBucket)).Get([]byte("s"))
+		if enc == nil {
+			return nil
+		}
+
+		var err error
+		height, err = strconv.Atoi(string(enc))
+		return err
+	})
+
+	return height, err
+}
+
+// checkAboveSnapshot returns ErrBelowSnapshot if height is below the snapshot the chain was loaded from, so the block at height can't
+// become the tip again.
+func (bc Blockchain) checkAboveSnapshot(height int) error {
+	snapshotHeight, err := bc.GetSnapshotHeight()
+	if err != nil {
+		return err
+	}
+	if height < snapshotHeight {
+		return ErrBelowSnapshot
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSnapshotWithIndexes(t *testing.T) {
+	tc := newTestChain(t)
+	tc.mine(t, 0)
+	tc.mine(t, 0)
+
+	genesis, err := tc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "snapshot")
+	info, err := tc.DumpSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		index *bool
+		want  string
+	}{
+		{name: "no indexes"},
+		{name: "transaction index", index: &BuildTxIndex, want: "txindex index is enabled"},
+		{name: "address index", index: &BuildAddrIndex, want: "addrindex index is enabled"},
+		{name: "anchor index", index: &BuildAnchorIndex, want: "anchorindex index is enabled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.index != nil {
+				*tt.index = true
+				defer func() { *tt.index = false }()
+			}
+
+			// a new chain with the same genesis block
+			if err := SelectNetwork(RegTest.Name, t.TempDir()); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := WriteGenesis(genesis, false); err != nil {
+				t.Fatal(err)
+			}
+			bc, err := CreateBlockchain()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer bc.DB.Close()
+
+			_, err = bc.LoadSnapshot(path, info.Hash)
+			checkError(t, err, tt.want)
+
+			height, err := bc.GetChainHeight()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := 0
+			if tt.want == "" {
+				want = info.Height
+			}
+			if int(height) != want {
+				t.Errorf("chain is at height %d, want %d", height, want)
+			}
+		})
+	}
+}
@@ -16,6 +16,8 @@ import (
 
 const (
 	coinbaseReward = 10
+	// signatureLen is the length of a signature, see signHash.
+	signatureLen = 64
 )
 
 // Transactions
@@ -23,6 +25,13 @@ const (
 // The initial transaction created is called a coinbase transaction. A coinbase transaction has inputs that don't reference any outputs,
 // and are locked to the individual being rewarded. For example, if someone mines a block, they get a coinbase transaction. Also in this
 // implementation, a random address that is hosting a file, would also be getting a transaction.
+//
+// A transaction's inputs can spend more than its outputs pay out, and the difference is its fee. The fees of a block are claimed by the
+// block producer in the coinbase, on top of the reward, see ValidateBlock.
+//
+// A transaction can be locked until a block height or time with LockTime, and each of its inputs until the output it spends is old
+// enough with Sequence. Both are signed, so a transaction can be signed ahead of time, and handed out to be submitted once it unlocks.
+// See checkLocks.
 
 type Transaction struct {
 	ID   []byte
@@ -30,6 +39,8 @@ type Transaction struct {
 	Vin  []Input
 	// implemented since two cb tx's were ending up with duplicate hashes
 	Timestamp int64
+	// LockTime keeps the transaction out of any block before it, see SpendContext. 0 means the transaction isn't locked.
+	LockTime int64
 }
 
 // TOOD: update this as transaction gets more complicated
@@ -37,13 +48,27 @@ func (tx Transaction) IsCoinbase() bool {
 	return tx.Vin[0].OutputIndex == -1
 }
 
-func NewCoinbaseTransaction(address string) (Transaction, error) {
+// NewCoinbaseTransaction creates a coinbase transaction that pays the reward, plus the fees of the other transactions in the block, to
+// address.
+func NewCoinbaseTransaction(address string, fees int) (Transaction, error) {
 	var err error
 
-	out := CreateOutput(address, coinbaseReward)
+	if fees < 0 {
+		return Transaction{}, errors.New("ERROR: fees can't be negative")
+	}
+
+	out := CreateOutput(address, coinbaseReward+fees)
+
+	// a coinbase input has no sender, so its PubKey holds random extra data instead. Two coinbase transactions to the same address in
+	// the same second would otherwise end up with the same ID.
+	extra := make([]byte, 8)
+	if _, err := rand.Read(extra); err != nil {
+		return Transaction{}, err
+	}
 
 	in := Input{
 		OutputIndex: -1,
+		PubKey:      extra,
 	}
 
 	tx := Transaction{
@@ -61,32 +86,46 @@ func NewCoinbaseTransaction(address string) (Transaction, error) {
 	return tx, nil
 }
 
+// Hash creates the ID of a transaction. It is the sha512 of the canonical encoding of the transaction, leaving out the ID itself and
+// the signatures, see encoding.go.
 func (tx Transaction) Hash() ([]byte, error) {
-	enc, err := tx.Serialize()
-	if err != nil {
-		return nil, err
-	}
-	hash := sha512.Sum512(enc)
+	var e encoder
+	tx.encode(&e, true)
+	hash := sha512.Sum512(e.buff.Bytes())
 	return hash[:], nil
 }
 
-func (tx Transaction) Serialize() ([]byte, error) {
-	var buff bytes.Buffer
-
-	enc := gob.NewEncoder(&buff)
-	if err := enc.Encode(tx); err != nil {
-		fmt.Printf("error serializing transaction: %v\n", err)
-		return nil, err
-	}
+// WitnessHash is the sha512 of the full canonical encoding of a transaction. Unlike the ID it covers the signatures and unlocking scripts,
+// it is what the merkle tree of a block commits to, see merkle.go.
+func (tx Transaction) WitnessHash() []byte {
+	var e encoder
+	tx.encode(&e, false)
+	hash := sha512.Sum512(e.buff.Bytes())
+	return hash[:]
+}
 
-	return buff.Bytes(), nil
+// Serialize encodes a full transaction with the canonical encoding.
+func (tx Transaction) Serialize() ([]byte, error) {
+	var e encoder
+	tx.encode(&e, false)
+	return e.buff.Bytes(), nil
 }
 
 func DeserializeTransaction(data []byte) (Transaction, error) {
 	var tx Transaction
 
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	if err := dec.Decode(&tx); err != nil {
+	if isLegacyGob(data) {
+		dec := gob.NewDecoder(bytes.NewReader(data))
+		if err := dec.Decode(&tx); err != nil {
+			fmt.Printf("error decoding legacy transaction with data of len %d: %v", len(data), err)
+			return tx, err
+		}
+		return tx, nil
+	}
+
+	d := newDecoder(data)
+	tx = decodeTransaction(d)
+	if err := d.finish(); err != nil {
 		fmt.Printf("error decoding transaction with data of len %d: %v", len(data), err)
 		return tx, err
 	}
@@ -94,71 +133,127 @@ func DeserializeTransaction(data []byte) (Transaction, error) {
 	return tx, nil
 }
 
-func (bc *Blockchain) NewTransaction(from, to string, amount int) (Transaction, error) {
-	var (
-		tx Transaction
-	)
+// TxOptions are the options of a new transaction.
+type TxOptions struct {
+	Fee          int          // Fee is left for the block producer, on top of the amount.
+	CoinSelector CoinSelector // CoinSelector picks the outputs the transaction spends. LargestFirst if it is nil.
+	LockTime     int64        // LockTime is the lock time of the transaction.
+	Sequence     int          // Sequence is the relative lock of every input, in blocks.
+}
 
+// NewTransaction creates and signs a transaction that makes every payment from one of our wallets, with an output for each. The change
+// goes back to the sender.
+func (bc *Blockchain) NewTransaction(from string, payments []Payment, opts TxOptions) (Transaction, error) {
 	wallets, err := ReadWalletsFromFile()
 	if err != nil {
 		fmt.Printf("error reading wallets from file for new TX: %v\n", err)
-		return tx, err
+		return Transaction{}, err
 	}
 
 	wallet := wallets.Wallets[from]
 	if wallet.PublicKey == nil {
-		return tx, errors.New("ERROR: this address was not found")
+		return Transaction{}, errors.New("ERROR: this address was not found")
+	}
+
+	tx, err := bc.buildTransaction(from, wallet.PublicKey, payments, opts)
+	if err != nil {
+		return tx, err
+	}
+
+	utxo := UTXO{ Blockchain: bc}
+	if err := utxo.SignTransaction(tx, wallet.PrivateKey); err != nil {
+		fmt.Printf("error signing tx: %v\n", err)
+		return tx, err
+	}
+
+	return tx, nil
+}
+
+// buildTransaction creates an unsigned transaction that makes every payment from the address from, with pubKey in every input. The
+// change goes back to from.
+func (bc *Blockchain) buildTransaction(from string, pubKey []byte, payments []Payment, opts TxOptions) (Transaction, error) {
+	var (
+		tx Transaction
+	)
+
+	amount, err := checkPayments(payments)
+	if err != nil {
+		return tx, err
+	}
+	if opts.Fee < 0 {
+		return tx, errors.New("ERROR: fee can't be negative")
+	}
+	if amount+opts.Fee < amount {
+		return tx, errors.New("ERROR: payments and fee add up to more than can be sent")
+	}
+	if opts.LockTime < 0 || opts.Sequence < 0 {
+		return tx, errors.New("ERROR: lock time and sequence can't be negative")
+	}
+	if opts.CoinSelector == nil {
+		opts.CoinSelector = LargestFirst{}
 	}
 
 	utxo := UTXO{ Blockchain: bc}
 
-	acc, UTXOs, err := utxo.FindSpendableOutputs([]byte(from), amount)
+	// a transaction needs at least one input, even if it only carries data without a fee
+	target := amount + opts.Fee
+	if target == 0 {
+		target = 1
+	}
+	acc, UTXOs, err := utxo.FindSpendableOutputs([]byte(from), target, opts.CoinSelector)
 	if err != nil {
 		return tx, err
 	}
 
-	for txID, outs := range UTXOs {
-		id, err := hex.DecodeString(txID)
-		if err != nil {
-			return tx, err
+	for _, uo := range UTXOs {
+		inp := Input{
+			TransactionID: uo.TransactionID,
+			OutputIndex:   uo.Index,
+			PubKey:        pubKey,
+			Signature:     nil,
+			Sequence:      opts.Sequence,
 		}
-		for _, outIdx := range outs {
-			inp := Input{
-				TransactionID: id,
-				OutputIndex:   outIdx,
-				PubKey:        wallet.PublicKey,
-				Signature:     nil,
+		tx.Vin = append(tx.Vin, inp)
+	}
+
+	for _, p := range payments {
+		if len(p.Data) > 0 {
+			out, err := NewDataOutput(p.Data)
+			if err != nil {
+				return tx, err
 			}
-			tx.Vin = append(tx.Vin, inp)
+			tx.Vout = append(tx.Vout, out)
+			continue
+		}
+		if len(p.Script) == 0 {
+			tx.Vout = append(tx.Vout, CreateOutput(p.Address, p.Amount))
+			continue
 		}
+		out, err := NewScriptOutput(p.Amount, p.Script)
+		if err != nil {
+			return tx, err
+		}
+		tx.Vout = append(tx.Vout, out)
 	}
 
-	out := CreateOutput(to, amount)
-
-	tx.Vout = append(tx.Vout, out)
-
-	if acc-amount > 0 {
-		remainingOut := CreateOutput(from, acc-amount)
+	if acc-amount-opts.Fee > 0 {
+		remainingOut := CreateOutput(from, acc-amount-opts.Fee)
 		tx.Vout = append(tx.Vout, remainingOut)
 	}
 
 	tx.Timestamp = time.Now().Unix()
+	tx.LockTime = opts.LockTime
 	tx.ID, err = tx.Hash()
 	if err != nil {
 		fmt.Printf("error hashing tx for newTransaction: %v", err)
 		return tx, err
 	}
 
-	if err := utxo.SignTransaction(tx, wallet.PrivateKey); err != nil {
-		fmt.Printf("error signing tx: %v\n", err)
-		return tx, err
-	}
-
 	return tx, nil
 }
 
-// TrimmedTransaction takes a transaction and removes the pubKey + signature from the inputs. This is in preparation for signing,
-// as we don't need to sign the entire tx.
+// TrimmedTransaction takes a transaction and removes the pubKey + signature + unlocking script from the inputs. This is in preparation
+// for signing, as we don't need to sign the entire tx.
 func (tx Transaction) TrimmedTransaction() Transaction {
 	var trimmedTX Transaction
 
@@ -168,12 +263,15 @@ func (tx Transaction) TrimmedTransaction() Transaction {
 			OutputIndex:   in.OutputIndex,
 			Signature:     nil,
 			PubKey:        nil,
+			Sequence:      in.Sequence,
 		}
 		trimmedTX.Vin = append(trimmedTX.Vin, inp)
 	}
 
 	trimmedTX.Vout = tx.Vout
 	trimmedTX.ID = tx.ID
+	trimmedTX.Timestamp = tx.Timestamp
+	trimmedTX.LockTime = tx.LockTime
 	return trimmedTX
 }
 
@@ -186,66 +284,91 @@ func (tx Transaction) TrimmedTransaction() Transaction {
 // and then hashing that trimmed transaction. Then the private key and trimmed id get signed together to form a two piece signature. Those are appended
 // and that is the signature. That signature can now be verified with the public key, and the end result of the same hashedTX process.
 func (tx *Transaction) Sign(private ecdsa.PrivateKey, prevTXs map[string]Transaction) error {
-	var err error
-
 	if tx.IsCoinbase() {
 		return nil
 	}
 
-	trimmed := tx.TrimmedTransaction()
-
-	for inIdx, in := range trimmed.Vin {
+	for inIdx, in := range tx.Vin {
 		prevTX := prevTXs[hex.EncodeToString(in.TransactionID)]
-		trimmed.Vin[inIdx].PubKey = prevTX.Vout[in.OutputIndex].PubKeyHash
-		// remove signature for safety
-		trimmed.Vin[inIdx].Signature = nil
-		trimmed.ID, err = trimmed.Hash(); if err != nil {
+		hash, err := tx.sigHash(inIdx, prevTX.Vout[in.OutputIndex])
+		if err != nil {
 			fmt.Println("error hashing trimmed transaction during signing")
 			return err
 		}
-		// set pubKey back to nil for safety
-		trimmed.Vin[inIdx].PubKey = nil
 
-		r, s, err := ecdsa.Sign(rand.Reader, &private, trimmed.ID)
+		tx.Vin[inIdx].Signature, err = signHash(private, hash)
 		if err != nil {
 			fmt.Printf("error siging transaction: %v\n", err)
 			return err
 		}
-		tx.Vin[inIdx].Signature = append(r.Bytes(), s.Bytes()...)
 	}
 	return nil
 }
 
-func (tx Transaction) Verify(prevTXs map[string]Transaction) (bool, error) {
-	var err error
-
+// sigHash returns the hash that the signatures of the input at inIdx sign. It is the hash of the trimmed transaction, with the public key
+// hash of the output the input spends in place of the input's PubKey, which is the hash of its script for an output with a script of its
+// own. Every signer of a multisig input signs the same hash.
+func (tx Transaction) sigHash(inIdx int, prevOut Output) ([]byte, error) {
 	trimmed := tx.TrimmedTransaction()
-	curve := elliptic.P256()
+	trimmed.Vin[inIdx].PubKey = prevOut.PubKeyHash
+	return trimmed.Hash()
+}
+
+// signHash signs a hash with a private key.
+func signHash(private ecdsa.PrivateKey, hash []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, &private, hash)
+	if err != nil {
+		return nil, err
+	}
+	// r and s are padded to the same length, so that verifySignature can split the signature back in half
+	return append(padBytes(r.Bytes(), 32), padBytes(s.Bytes(), 32)...), nil
+}
+
+// verifySignature checks a signature of a hash against a public key. Scripts can put anything in either, so they are checked first.
+func verifySignature(pubKey, hash, signature []byte) bool {
+	if len(pubKey) != pubKeyLen || len(signature) != signatureLen {
+		return false
+	}
+
+	x, y := big.Int{}, big.Int{}
+	pubKeyLen := len(pubKey)
+	x.SetBytes(pubKey[:pubKeyLen/2])
+	y.SetBytes(pubKey[pubKeyLen/2:])
+
+	r, s := big.Int{}, big.Int{}
+	signatureLen := len(signature)
+	r.SetBytes(signature[:signatureLen/2])
+	s.SetBytes(signature[signatureLen/2:])
+
+	key := ecdsa.PublicKey{Curve: elliptic.P256(), X: &x, Y: &y}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return false
+	}
+	return ecdsa.Verify(&key, hash, &r, &s)
+}
+
+// Verify runs the scripts of every input of a transaction, see script.go. prevOuts are the outputs the inputs spend, in the same order as
+// the inputs. The scripts only see the transaction, checkLocks checks it against where it is being spent.
+func (tx Transaction) Verify(prevOuts []UnspentOutput) (bool, error) {
+	if len(prevOuts) != len(tx.Vin) {
+		return false, fmt.Errorf("ERROR: transaction has %d inputs, but %d referenced outputs", len(tx.Vin), len(prevOuts))
+	}
 
 	for inIdx, in := range tx.Vin {
-		prevTX := prevTXs[hex.EncodeToString(in.TransactionID)]
-		trimmed.Vin[inIdx].PubKey = prevTX.Vout[in.OutputIndex].PubKeyHash
-		trimmed.Vin[inIdx].Signature = nil
-		trimmed.ID, err = trimmed.Hash()
+		prevOut := prevOuts[inIdx]
+
+		hash, err := tx.sigHash(inIdx, prevOut.Output)
 		if err != nil {
 			fmt.Println("error hashing trimmed during verification")
 			return false, err
 		}
-		trimmed.Vin[inIdx].PubKey = nil
 
-		x, y := big.Int{}, big.Int{}
-		pubKeyLen := len(tx.Vin[inIdx].PubKey)
-		x.SetBytes(in.PubKey[:pubKeyLen/2])
-		y.SetBytes(in.PubKey[pubKeyLen/2:])
-
-		r,s := big.Int{}, big.Int{}
-		signatureLen := len(in.Signature)
-		r.SetBytes(in.Signature[:signatureLen/2])
-		s.SetBytes(in.Signature[signatureLen/2:])
-
-		pubKey := ecdsa.PublicKey{Curve: curve, X: &x ,Y: &y}
-
-		if !ecdsa.Verify(&pubKey, trimmed.ID, &r, &s) {
+		checker := scriptChecker{hash: hash, lockTime: tx.LockTime, sequence: in.Sequence}
+		verified, err := executeScripts(in.UnlockingScript(), prevOut.Output.LockingScript(), checker)
+		if err != nil {
+			return false, fmt.Errorf("%v, in input #%d", err, inIdx)
+		}
+		if !verified {
 			return false, nil
 		}
 	}
@@ -267,18 +390,61 @@ func (u UTXO) SignTransaction(tx Transaction, private ecdsa.PrivateKey) error {
 	return nil
 }
 
-func (u UTXO) VerifyTransaction(tx Transaction) (bool, error) {
-	prevTXs, err := u.FindReferencedOutputs(tx)
-	if err != nil {
-		fmt.Printf("error finding referenced outputs during verification: %v\n", err)
+// VerifyTransaction checks that every input of a transaction spends an output that is still unspent, that the transaction isn't locked,
+// and runs its scripts. ctx is where the transaction is being spent, see NextSpendContext.
+func (u UTXO) VerifyTransaction(tx Transaction, ctx SpendContext) (bool, error) {
+	// every input has to reference an output that is still unspent
+	prevOuts := make([]UnspentOutput, len(tx.Vin))
+	for inIdx, in := range tx.Vin {
+		uo, found, err := u.GetUnspentOutput(in.TransactionID, in.OutputIndex)
+		if err != nil {
+			return false, err
+		}
+		if !found {
+			return false, fmt.Errorf("ERROR: transaction %s spends an output that is spent or doesn't exist", hex.EncodeToString(tx.ID))
+		}
+		prevOuts[inIdx] = uo
+	}
+
+	if err := tx.checkLocks(prevOuts, ctx); err != nil {
 		return false, err
 	}
 
-	verified, err := tx.Verify(prevTXs)
+	verified, err := tx.Verify(prevOuts)
 	if err != nil {
 		fmt.Printf("error verifiying transaction: %v\n", err)
-		return false, err
+		return false, WitnessError{err}
 	}
 
 	return verified, err
-}
\ No newline at end of file
+}
+
+// WitnessError is a transaction failing on the signatures or unlocking scripts of its inputs. They aren't part of the transaction ID, see
+// WitnessHash.
+type WitnessError struct {
+	Err error
+}
+
+func (e WitnessError) Error() string {
+	return e.Err.Error()
+}
+
+// checkLocks makes sure a transaction can be spent in ctx. Its LockTime has to be past, every output it spends has to be at least as many
+// blocks old as the Sequence of the input that spends it, and coinbase outputs have to be mature. prevOuts are in the same order as the
+// inputs.
+func (tx Transaction) checkLocks(prevOuts []UnspentOutput, ctx SpendContext) error {
+	if tx.LockTime != 0 && !ctx.lockTimePassed(tx.LockTime) {
+		return fmt.Errorf("ERROR: transaction %s is locked until %s", hex.EncodeToString(tx.ID), FormatLockTime(tx.LockTime))
+	}
+
+	for inIdx, in := range tx.Vin {
+		if age := ctx.Height - prevOuts[inIdx].BlockHeight; age < in.Sequence {
+			return fmt.Errorf("ERROR: input #%d of transaction %s spends an output that is %d blocks old, it has to be %d", inIdx, hex.EncodeToString(tx.ID), age, in.Sequence)
+		}
+		if !prevOuts[inIdx].Mature(ctx.Height) {
+			return fmt.Errorf("ERROR: input #%d of transaction %s spends a coinbase output from block #%d, that can't be spent until block #%d", inIdx, hex.EncodeToString(tx.ID), prevOuts[inIdx].BlockHeight, prevOuts[inIdx].BlockHeight+Params.CoinbaseMaturity)
+		}
+	}
+
+	return nil
+}
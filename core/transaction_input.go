@@ -1,15 +1,23 @@
 package core
 
-import (
-
-)
-
 // Input is a single Transaction input
 // Inputs always reference outputs, unless they are part of a coinbase transaction.
 type Input struct {
 	TransactionID []byte // TransactionID is the ID of the transaction that houses the output that this input references.
 	OutputIndex   int // OutputIndex is the index of the output on the transaction.
 	Signature     []byte // Signature stores the signature of the transaction after it gets signed. This signature can then be verified.
-	PubKey        []byte // PubKey is the full public key of the one who created this input by creating a transaction. I.e: the sender.
+	PubKey        []byte // PubKey is the full public key of the one who created this input by creating a transaction. I.e: the sender. A coinbase input holds extra data here instead.
+	Script        []byte // Script is the unlocking script of an input that spends an output with a script of its own, see script.go. It is empty for any other input.
+	Sequence      int // Sequence is how many blocks old the output has to be before this input can spend it. 0 means the input isn't locked.
+}
+
+// UnlockingScript returns the unlocking script of the input. An input without a Script of its own unlocks a standard template with its
+// signature and public key.
+func (in Input) UnlockingScript() []byte {
+	if len(in.Script) > 0 {
+		return in.Script
+	}
+	var sb ScriptBuilder
+	return sb.AddData(in.Signature).AddData(in.PubKey).Script()
 }
 
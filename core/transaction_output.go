@@ -2,7 +2,7 @@ package core
 
 import (
 	"bytes"
-	"encoding/gob"
+	"errors"
 	"fmt"
 )
 
@@ -10,12 +10,27 @@ import (
 type Output struct {
 	Value      int // The amount of 'coins' stored in this output.
 	PubKeyHash []byte // The public key hash of the owner of the coins. This hash is a double sha512 hash of the owners public key.
+	Multisig   bool // Multisig is set if PubKeyHash is the hash of a multisig script instead of a public key, see multisig.go.
+	Script     []byte // Script is the locking script of an output that isn't locked to an address, see script.go. PubKeyHash is then the hash of the script.
 }
 
-type UTXOutputs struct {
-	Outputs []Output // A list of outputs
-	Indexes []int // Indexes are the indexes of where the output is in the transaction
-	BlockHeight int // BlockHeight is the height of the block that contains this TX
+// UnspentOutput is an output that hasn't been spent yet, as it is stored in the chainstate.
+type UnspentOutput struct {
+	TransactionID []byte // TransactionID is the ID of the transaction that created the output.
+	Index         int    // Index is where the output is on its transaction.
+	Output        Output // Output is the output itself.
+	BlockHeight   int    // BlockHeight is the height of the block that contains the transaction.
+	Coinbase      bool   // Coinbase is set if the output was created by a coinbase transaction.
+}
+
+// Mature checks if the output can be spent in a block at height. A coinbase output has to be Params.CoinbaseMaturity blocks deep first,
+// so that the reward of a block that gets replaced in a reorg can't have been spent yet. The allocations of the genesis block can never be
+// replaced, they are always mature. So is every output spent below Params.CoinbaseMaturityHeight, before maturity was enforced.
+func (uo UnspentOutput) Mature(height int) bool {
+	if !uo.Coinbase || uo.BlockHeight == 0 || height < Params.CoinbaseMaturityHeight {
+		return true
+	}
+	return height-uo.BlockHeight >= Params.CoinbaseMaturity
 }
 
 // CreateOutput creates an output for an address, with an amount, and then locks the output to that address
@@ -30,37 +45,127 @@ func CreateOutput(address string, amount int) Output {
 }
 
 // Lock is responsible for locking an output to an address. It gets the public key hash by decoding the address, and then removing the
-// version and checksum from the hash.
+// version and checksum from the hash. An output locked to a multisig address is a multisig output.
 func (out *Output) Lock(address []byte) {
+	out.PubKeyHash = PubKeyHashFromAddress(address)
+	out.Multisig = IsMultisigAddress(address)
+}
+
+// NewScriptOutput creates an output that is locked by a script of its own.
+func NewScriptOutput(amount int, script []byte) (Output, error) {
+	if _, err := parseScript(script); err != nil {
+		return Output{}, err
+	}
+
+	hash, err := HashPublicKey(script)
+	if err != nil {
+		return Output{}, err
+	}
+	return Output{Value: amount, PubKeyHash: hash, Script: script}, nil
+}
+
+// checkScript makes sure an output with a script of its own is indexed under the hash of its script.
+func (out Output) checkScript() error {
+	if len(out.Script) == 0 {
+		return nil
+	}
+	if out.Multisig {
+		return errors.New("ERROR: output with a script can't be a multisig output")
+	}
+	if len(out.Script) > maxScriptSize {
+		return fmt.Errorf("ERROR: locking script is %d bytes, the most is %d", len(out.Script), maxScriptSize)
+	}
+
+	hash, err := HashPublicKey(out.Script)
+	if err != nil {
+		return err
+	}
+	if bytes.Compare(hash, out.PubKeyHash) != 0 {
+		return errors.New("ERROR: output public key hash is not the hash of its script")
+	}
+	return nil
+}
+
+// LockingScript returns the locking script of the output. An output without a Script of its own is locked by the standard template of
+// its public key hash.
+func (out Output) LockingScript() []byte {
+	switch {
+	case len(out.Script) > 0:
+		return out.Script
+	case out.Multisig:
+		return multisigLockingScript(out.PubKeyHash)
+	default:
+		return P2PKHScript(out.PubKeyHash)
+	}
+}
+
+// Address returns the address the output is locked to. An output with a script of its own has no address, and returns nil.
+func (out Output) Address() []byte {
+	if len(out.Script) > 0 {
+		return nil
+	}
+	if out.Multisig {
+		return encodeAddress(Params.MultisigVersion, out.PubKeyHash)
+	}
+	return AddressFromPubKeyHash(out.PubKeyHash)
+}
+
+// PubKeyHashFromAddress decodes an address, and removes the version and checksum, leaving the public key hash.
+func PubKeyHashFromAddress(address []byte) []byte {
 	dec := Base58Decode(address)
-	out.PubKeyHash = dec[1:len(dec)-checksumLen]
+	return dec[1:len(dec)-checksumLen]
 }
 
 // CanBeUnlocked checks if an address is the one who locked the output.
 func (out Output) CanBeUnlocked(address []byte) bool {
-	dec := Base58Decode(address)
-	pubKeyHash := dec[1:len(dec)-checksumLen]
-	return bytes.Compare(pubKeyHash, out.PubKeyHash) == 0
+	return out.IsLockedWithKey(PubKeyHashFromAddress(address))
 }
 
-func (uo UTXOutputs) SerializeOutputs() ([]byte, error) {
-	var buff bytes.Buffer
+// IsLockedWithKey checks if the output is locked to a public key hash. When checking many outputs against the same address, decode the
+// address once with PubKeyHashFromAddress and use this instead of CanBeUnlocked.
+func (out Output) IsLockedWithKey(pubKeyHash []byte) bool {
+	return bytes.Compare(pubKeyHash, out.PubKeyHash) == 0
+}
 
-	enc := gob.NewEncoder(&buff)
-	err := enc.Encode(uo)
-	if err != nil {
-		fmt.Printf("error serializing outputs: %v\n", err)
+// encodeUnspent encodes an unspent output for the chainstate with the canonical encoding. The transaction ID and index are already in
+// the key.
+//   int64 Value | bytes PubKeyHash | int64 BlockHeight | bool Coinbase [| bool Multisig [| bytes Script]]
+// Multisig is only written for multisig outputs and outputs with a script, and Script only for the latter, so every output from before
+// them is still encoded the same.
+func (uo UnspentOutput) encodeUnspent() []byte {
+	var e encoder
+	e.writeInt64(int64(uo.Output.Value))
+	e.writeBytes(uo.Output.PubKeyHash)
+	e.writeInt64(int64(uo.BlockHeight))
+	e.writeBool(uo.Coinbase)
+	if uo.Output.Multisig || len(uo.Output.Script) > 0 {
+		e.writeBool(uo.Output.Multisig)
 	}
-	return buff.Bytes(), err
+	if len(uo.Output.Script) > 0 {
+		e.writeBytes(uo.Output.Script)
+	}
+	return e.buff.Bytes()
 }
 
-func DecodeOutputs(data []byte) (UTXOutputs, error) {
-	var uo UTXOutputs
+// decodeUnspent decodes an unspent output of the transaction txID at index, that was encoded with encodeUnspent.
+func decodeUnspent(txID []byte, index int, data []byte) (UnspentOutput, error) {
+	uo := UnspentOutput{TransactionID: txID, Index: index}
 
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	err := dec.Decode(&uo)
-	if err != nil {
-		fmt.Printf("error decoding outputs of len %d: %v\n", len(data), err)
+	d := newDecoder(data)
+	uo.Output.Value = int(d.readInt64())
+	uo.Output.PubKeyHash = d.readBytes()
+	uo.BlockHeight = int(d.readInt64())
+	uo.Coinbase = d.readBool()
+	if d.err == nil && d.r.Len() > 0 {
+		uo.Output.Multisig = d.readBool()
 	}
-	return uo, err
-}
\ No newline at end of file
+	if d.err == nil && d.r.Len() > 0 {
+		uo.Output.Script = d.readBytes()
+	}
+
+	if err := d.finish(); err != nil {
+		fmt.Printf("error decoding unspent output of len %d: %v\n", len(data), err)
+		return uo, err
+	}
+	return uo, nil
+}
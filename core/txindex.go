@@ -0,0 +1,205 @@
+// TxIndex Bucket
+
+// 64-byte transaction ID : location of the transaction on the main chain, see TxLocation
+
+package core
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+)
+
+// The chainstate only knows about transactions that still have unspent outputs. The transaction index remembers where every
+// transaction on the main chain is, so any transaction can be looked up by its ID alone. It is optional, since it grows with every
+// transaction ever made. Once the bucket exists it is kept up to date whenever a block is connected or disconnected, so it only has
+// to be built once, see BuildTxIndex.
+
+const (
+	txIndexBucket = "txindex"
+)
+
+var (
+	// BuildTxIndex is set to build the transaction index when the chain is opened, if it doesn't exist yet.
+	BuildTxIndex bool
+	// ErrNoTxIndex is returned when looking up a transaction while the transaction index isn't enabled.
+	ErrNoTxIndex = errors.New("ERROR: the transaction index is not enabled, run with --txindex to build it")
+)
+
+// TxLocation is where a transaction is on the main chain.
+type TxLocation struct {
+	BlockHash []byte // BlockHash is the hash of the block the transaction is in.
+	Height    int    // Height is the height of that block.
+	Position  int    // Position is the index of the transaction in the block's transactions.
+}
+
+// EncodeLocation encodes a transaction location with the canonical encoding:
+//   bytes BlockHash | int64 Height | uint32 Position
+func (loc TxLocation) EncodeLocation() []byte {
+	var e encoder
+	e.writeBytes(loc.BlockHash)
+	e.writeInt64(int64(loc.Height))
+	e.writeUint32(uint32(loc.Position))
+	return e.buff.Bytes()
+}
+
+// DecodeLocation decodes a transaction location that was encoded with EncodeLocation.
+func DecodeLocation(data []byte) (TxLocation, error) {
+	var loc TxLocation
+
+	d := newDecoder(data)
+	loc.BlockHash = d.readBytes()
+	loc.Height = int(d.readInt64())
+	loc.Position = int(d.readUint32())
+
+	return loc, d.finish()
+}
+
+// indexBlock adds every transaction of a block that was just connected to the transaction index, if it is enabled.
+func indexBlock(tx *bolt.Tx, block Block) error {
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	for pos, t := range block.Transactions {
+		loc := TxLocation{BlockHash: block.Hash, Height: block.Height, Position: pos}
+		if err := b.Put(t.ID, loc.EncodeLocation()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexBlock removes every transaction of a block that was just disconnected from the transaction index, if it is enabled.
+func unindexBlock(tx *bolt.Tx, block Block) error {
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	for _, t := range block.Transactions {
+		if err := b.Delete(t.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// buildTxIndex creates the transaction index, and fills it with every transaction on the main chain.
+func (bc *Blockchain) buildTxIndex() error {
+	if err := bc.checkNotPruned(); err != nil {
+		return err
+	}
+
+	tipHeight, err := bc.GetChainHeight()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("building the transaction index, this could take a bit of time...\n")
+
+	return bc.DB.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte(txIndexBucket)); err != nil {
+			fmt.Printf("error creating %s bucket: %v\n", txIndexBucket, err)
+			return err
+		}
+
+		blocks := tx.Bucket([]byte(blocksBucket))
+		for height := 0; height <= int(tipHeight); height++ {
+			blk, err := readMainBlock(blocks, height)
+			if err != nil {
+				return err
+			}
+			if err := indexBlock(tx, blk); err != nil {
+				fmt.Printf("error indexing block #%d: %v\n", height, err)
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// enableIndexes builds the optional indexes that were asked for, and don't exist yet.
+func (bc *Blockchain) enableIndexes() error {
+	indexes := []struct {
+		enabled bool
+		bucket  string
+		build   func() error
+	}{
+		{BuildTxIndex, txIndexBucket, bc.buildTxIndex},
+		{BuildAddrIndex, addrIndexBucket, bc.buildAddrIndex},
+		{BuildAnchorIndex, anchorIndexBucket, bc.buildAnchorIndex},
+	}
+
+	for _, index := range indexes {
+		if !index.enabled {
+			continue
+		}
+
+		exists := false
+		if err := bc.DB.View(func(tx *bolt.Tx) error {
+			exists = tx.Bucket([]byte(index.bucket)) != nil
+			return nil
+		}); err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		if err := index.build(); err != nil {
+			fmt.Printf("error building the %s index: %v\n", index.bucket, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetTransaction looks up any transaction on the main chain by its ID, using the transaction index.
+func (bc Blockchain) GetTransaction(txID []byte) (Transaction, TxLocation, error) {
+	var (
+		loc   TxLocation
+		found bool
+	)
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(txIndexBucket))
+		if b == nil {
+			return ErrNoTxIndex
+		}
+
+		enc := b.Get(txID)
+		if enc == nil {
+			return nil
+		}
+
+		var err error
+		loc, err = DecodeLocation(enc)
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		return Transaction{}, loc, err
+	}
+	if !found {
+		return Transaction{}, loc, fmt.Errorf("ERROR: transaction %s not found", hex.EncodeToString(txID))
+	}
+
+	block, err := bc.GetBlock(loc.BlockHash)
+	if err != nil {
+		fmt.Printf("error reading block %s for transaction %s: %v\n", hex.EncodeToString(loc.BlockHash), hex.EncodeToString(txID), err)
+		return Transaction{}, loc, err
+	}
+
+	if loc.Position >= len(block.Transactions) {
+		return Transaction{}, loc, fmt.Errorf("ERROR: transaction index points past the end of block #%d", loc.Height)
+	}
+
+	return block.Transactions[loc.Position], loc, nil
+}
@@ -0,0 +1,140 @@
+// Undo Bucket
+
+// 64-byte block hash : the undo data of that block
+
+package core
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/boltdb/bolt"
+)
+
+// Connecting a block deletes the outputs it spends from the chainstate. Once they are gone, there is no way to know what they were, so
+// the block could never be taken back off of the chain. Undo data keeps a copy of every output a block spent, so it can be put back.
+
+// SpentOutput is an output that was removed from the chainstate because an input spent it.
+type SpentOutput struct {
+	TransactionID []byte // TransactionID is the ID of the transaction that created the output.
+	Index         int    // Index is where the output lives on its transaction.
+	Output        Output // Output is the spent output itself.
+	BlockHeight   int    // BlockHeight is the height of the block that created the output.
+	Coinbase      bool   // Coinbase is set if the output was created by a coinbase transaction.
+}
+
+// TxUndo is the undo data of a single transaction. Coinbase transactions don't spend anything, so their Spent is empty.
+type TxUndo struct {
+	Spent []SpentOutput // Spent is in the same order as the inputs of the transaction.
+}
+
+// BlockUndo is the undo data of a whole block. Transactions is in the same order as the transactions of the block.
+type BlockUndo struct {
+	Transactions []TxUndo
+}
+
+// undoEncodingVersion is the version encoded undo data starts with.
+const undoEncodingVersion uint32 = 1
+
+// EncodeUndo encodes the undo data of a block with the canonical encoding, so it can be stored in the undo bucket:
+//   uint32 version | uint32 len(Transactions) | Transactions...
+// TxUndo:
+//   uint32 len(Spent) | Spent...
+// SpentOutput:
+//   bytes TransactionID | int32 Index | int64 Value | bytes PubKeyHash | bool Multisig | bytes Script | int64 BlockHeight | bool Coinbase
+func (bu BlockUndo) EncodeUndo() ([]byte, error) {
+	var e encoder
+
+	e.writeUint32(undoEncodingVersion)
+	e.writeUint32(uint32(len(bu.Transactions)))
+	for _, txUndo := range bu.Transactions {
+		e.writeUint32(uint32(len(txUndo.Spent)))
+		for _, so := range txUndo.Spent {
+			e.writeBytes(so.TransactionID)
+			e.writeInt32(int32(so.Index))
+			e.writeInt64(int64(so.Output.Value))
+			e.writeBytes(so.Output.PubKeyHash)
+			e.writeBool(so.Output.Multisig)
+			e.writeBytes(so.Output.Script)
+			e.writeInt64(int64(so.BlockHeight))
+			e.writeBool(so.Coinbase)
+		}
+	}
+
+	return e.buff.Bytes(), nil
+}
+
+// DecodeUndo decodes undo data that was encoded with EncodeUndo.
+func DecodeUndo(data []byte) (BlockUndo, error) {
+	var bu BlockUndo
+
+	d := newDecoder(data)
+	d.readVersion(undoEncodingVersion)
+
+	// a TxUndo is at least 4 bytes, a SpentOutput at least 4+4+8+4+1+4+8+1
+	count := d.readCount(4)
+	for i := 0; i < count && d.err == nil; i++ {
+		var txUndo TxUndo
+		spent := d.readCount(34)
+		for j := 0; j < spent && d.err == nil; j++ {
+			var so SpentOutput
+			so.TransactionID = d.readBytes()
+			so.Index = int(d.readInt32())
+			so.Output.Value = int(d.readInt64())
+			so.Output.PubKeyHash = d.readBytes()
+			so.Output.Multisig = d.readBool()
+			so.Output.Script = d.readBytes()
+			so.BlockHeight = int(d.readInt64())
+			so.Coinbase = d.readBool()
+			txUndo.Spent = append(txUndo.Spent, so)
+		}
+		bu.Transactions = append(bu.Transactions, txUndo)
+	}
+
+	if err := d.finish(); err != nil {
+		fmt.Printf("error decoding block undo of len %d: %v\n", len(data), err)
+		return bu, err
+	}
+	return bu, nil
+}
+
+// decodeLegacyUndo decodes undo data from before version 7, which was encoded with gob. It is only used to migrate it, see migrateUndo.
+func decodeLegacyUndo(data []byte) (BlockUndo, error) {
+	var bu BlockUndo
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&bu); err != nil {
+		fmt.Printf("error decoding legacy block undo of len %d: %v\n", len(data), err)
+		return bu, err
+	}
+
+	return bu, nil
+}
+
+func putBlockUndo(tx *bolt.Tx, hash []byte, undo BlockUndo) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(undoBucket))
+	if err != nil {
+		return err
+	}
+
+	enc, err := undo.EncodeUndo()
+	if err != nil {
+		return err
+	}
+
+	return b.Put(hash, enc)
+}
+
+func getBlockUndo(tx *bolt.Tx, hash []byte) (BlockUndo, error) {
+	b := tx.Bucket([]byte(undoBucket))
+	if b == nil {
+		return BlockUndo{}, fmt.Errorf("ERROR: no undo data found, run reindex to rebuild it")
+	}
+
+	enc := b.Get(hash)
+	if enc == nil {
+		return BlockUndo{}, fmt.Errorf("ERROR: no undo data found for this block, run reindex to rebuild it")
+	}
+
+	return DecodeUndo(enc)
+}
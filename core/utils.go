@@ -2,11 +2,11 @@ package core
 
 import (
 	"bytes"
-	"encoding/gob"
+	"encoding/binary"
 	"fmt"
-	"io/ioutil"
 	"math/big"
 	"os"
+	"path/filepath"
 )
 
 var b58Alphabet = []byte("123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz")
@@ -20,30 +20,66 @@ func FormatB(hash []byte) []byte {
 	return last
 }
 
-func FormatC(txID []byte) []byte {
-	last := bytes.Join(
-		[][]byte{[]byte("C"), txID},
-		[]byte{},
-	)
-	return last
+// FormatX formats a block hash, and joins it with the letter 'x'. Used to mark a block as invalid
+func FormatX(hash []byte) []byte {
+	return append([]byte("x"), hash...)
+}
+
+// FormatO formats an outpoint, the transaction ID and index of an output, and joins it with the letter 'o'. Used to store an unspent
+// output in the chainstate.
+func FormatO(txID []byte, index int) []byte {
+	key := append([]byte("o"), txID...)
+	var idx [4]byte
+	binary.BigEndian.PutUint32(idx[:], uint32(index))
+	return append(key, idx[:]...)
+}
+
+// FormatP formats a public key hash and an outpoint, and joins them with the letter 'p'. Used to find the unspent outputs of an
+// address in the chainstate.
+func FormatP(pubKeyHash, txID []byte, index int) []byte {
+	key := append([]byte("p"), pubKeyHash...)
+	return append(key, FormatO(txID, index)[1:]...)
+}
+
+// FormatBalance formats a public key hash, and joins it with the letter 'B'. Used to store the balance of an address in the chainstate.
+func FormatBalance(pubKeyHash []byte) []byte {
+	return append([]byte("B"), pubKeyHash...)
 }
 
 func ReformatKey(key []byte) []byte {
 	return key[1:]
 }
 
-// BlockFile takes in a block height and returns a string with that heights filename
-func BlockFile(h int) string {
-	return fmt.Sprintf("./blocks_gen/%d.dat", h)
+// BlockFilePath takes in the number of a block file and returns its filename, see blockstore.go
+func BlockFilePath(file int) string {
+	return filepath.Join(blocksDir(), fmt.Sprintf("blk%05d.dat", file))
+}
+
+// FormatH formats a block height, and joins it with the letter 'h'. Used to store the hash of the main chain block at that height.
+// The height is big endian, so the keys are sorted by height.
+func FormatH(height int) []byte {
+	key := make([]byte, 9)
+	key[0] = 'h'
+	binary.BigEndian.PutUint64(key[1:], uint64(height))
+	return key
 }
 
 // ChainExists checks if there is already a chain
 func ChainExists() bool {
-	files, err := ioutil.ReadDir("./blocks_gen")
-	if err != nil {
-		os.Mkdir("./blocks_gen", 0777)
+	if _, err := os.Stat(blocksDir()); os.IsNotExist(err) {
+		os.MkdirAll(blocksDir(), 0777)
+	}
+
+	// the first block files may have been pruned, but the file blocks are appended to never is
+	if files, err := filepath.Glob(filepath.Join(blocksDir(), "blk*.dat")); err == nil && len(files) > 0 {
+		return true
+	}
+
+	// chains from before block files were appended to are still stored as one file per height, see migrate.go
+	if _, err := os.Stat(legacyBlockFile(0)); err == nil {
+		return true
 	}
-	return len(files) > 0
+	return false
 }
 
 // Base58Encode encodes a byte array to Base58
@@ -96,12 +132,48 @@ func ReverseBytes(data []byte) {
 	}
 }
 
-func GobEncode(i interface{}) ([]byte, error) {
-	var buff bytes.Buffer
-	enc := gob.NewEncoder(&buff)
-	if err := enc.Encode(i); err != nil {
-		fmt.Printf("error encoding for interface %v: %v",i, err)
-		return nil, err
+// padBytes left pads a big endian number with zeros, so it is always size bytes long.
+func padBytes(data []byte, size int) []byte {
+	if len(data) >= size {
+		return data
+	}
+	return append(make([]byte, size-len(data)), data...)
+}
+
+// WriteFileAtomic writes data to a file, so that the file either has all of the new data or still has all of the old data, even if the
+// process is killed or the machine goes down halfway. The data is written to a temporary file, flushed to disk, and then renamed over the
+// old file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes a directory to disk, so that files that were just created or renamed in it stay there.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
 	}
-	return buff.Bytes(), nil
-}
\ No newline at end of file
+	defer d.Close()
+	return d.Sync()
+}
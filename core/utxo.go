@@ -1,7 +1,19 @@
+// Chainstate Bucket
+
+// 'o' + 64-byte transaction ID + 4-byte output index : an unspent output, see UnspentOutput
+// 'p' + 20-byte public key hash + 64-byte transaction ID + 4-byte output index : empty, marks an unspent output of that public key hash
+// 'B' + 20-byte public key hash : int64 sum of the unspent outputs of that public key hash
+// 't' : hash of the block the chainstate is at, which is the tip of the main chain unless something went wrong, see recover.go
+
+// Every unspent output is stored under its own key, so spending one output only deletes that output. The 'p' keys of an address are a
+// single range, so the spendable outputs of an address can be found without going through the whole chainstate, and 'B' keeps the
+// balance of every address up to date as outputs come and go.
+
 package core
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -11,6 +23,7 @@ import (
 
 const (
 	UTXOBucket = "chainstate"
+	undoBucket = "undo"
 )
 
 // UTXO stands for unspent transaction outputs.
@@ -18,55 +31,54 @@ type UTXO struct {
 	Blockchain *Blockchain
 }
 
-// We want to store a list of all UTXO's in a chainstate bucket, that way we can easily look up if an output was referenced
-// bc.FindUTXOs
-// FindSpendableOutputs
-
-// FindUTXOs can be used for reindexing, and then findSpendableOutputs can then be used to find throughout the chainstate bucket
-// Also make an update function that removes or adds UTXOs every time a block is creates
-// run through the inputs of each tx, and find which output they are referencing. Then remove that output
-// Append every output on the block to chainstate
-
+// Reindex rebuilds the chainstate from scratch by replaying every block on the main chain, starting from genesis. This also rebuilds
+// the undo data of every block, and the transaction and address indexes if they are enabled.
 func (u UTXO) Reindex() error {
-	if err := u.Blockchain.DB.Update(func(tx *bolt.Tx) error {
-		if err := tx.DeleteBucket([]byte(UTXOBucket)); err != nil {
-			if !strings.Contains(err.Error(), "not found") {
-				fmt.Printf("error deleting UTXO bucket: %v\n", err)
-				return err
-			}
-		}
-
-		_, err := tx.CreateBucket([]byte(UTXOBucket))
-		if err != nil {
-			fmt.Printf("error creating UTXO bucket: %v\n", err)
-		}
-
-		return nil
-	}); err != nil {
-		fmt.Printf("error opening db connection for Reindex: %v\n", err)
+	// every block is replayed, so they all have to still be around
+	if err := u.Blockchain.checkNotPruned(); err != nil {
 		return err
 	}
 
-	UTXOs, err := u.Blockchain.FindUTXOs()
+	tipHeight, err := u.Blockchain.GetChainHeight()
 	if err != nil {
-		fmt.Printf("error finding UTXOs for Reindex: %v\n", err)
+		fmt.Printf("error getting chain height for Reindex: %v\n", err)
 		return err
 	}
 
 	if err := u.Blockchain.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(UTXOBucket))
-		for txID, outputs := range UTXOs {
-			serialized, err := outputs.SerializeOutputs(); if err != nil {
+		buckets := []string{UTXOBucket, undoBucket}
+		for _, index := range []string{txIndexBucket, addrIndexBucket, anchorIndexBucket} {
+			if tx.Bucket([]byte(index)) != nil {
+				buckets = append(buckets, index)
+			}
+		}
+
+		for _, bucket := range buckets {
+			if err := tx.DeleteBucket([]byte(bucket)); err != nil {
+				if !strings.Contains(err.Error(), "not found") {
+					fmt.Printf("error deleting %s bucket: %v\n", bucket, err)
+					return err
+				}
+			}
+
+			if _, err := tx.CreateBucket([]byte(bucket)); err != nil {
+				fmt.Printf("error creating %s bucket: %v\n", bucket, err)
 				return err
 			}
+		}
 
-			byteID, err := hex.DecodeString(txID)
+		blocks := tx.Bucket([]byte(blocksBucket))
+		for height := 0; height <= int(tipHeight); height++ {
+			blk, err := readMainBlock(blocks, height)
 			if err != nil {
 				return err
 			}
-
-			if err := b.Put(FormatC(byteID), serialized); err != nil {
-				fmt.Printf("error putting in outputs during reindex: %v\n", err)
+			if err := u.update(tx, blk); err != nil {
+				fmt.Printf("error replaying block #%d during reindex: %v\n", height, err)
+				return err
+			}
+			if err := indexBlock(tx, blk); err != nil {
+				fmt.Printf("error indexing block #%d during reindex: %v\n", height, err)
 				return err
 			}
 		}
@@ -79,93 +91,188 @@ func (u UTXO) Reindex() error {
 	return nil
 }
 
-func (u UTXO) FindUTXOs() (map[string]*UTXOutputs, error) {
-	UTXOs := make(map[string]*UTXOutputs)
+// FindUnspentOutputs returns every unspent output locked to a public key hash.
+func (u UTXO) FindUnspentOutputs(pubKeyHash []byte) ([]UnspentOutput, error) {
+	var UTXOs []UnspentOutput
 
 	err := u.Blockchain.DB.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(UTXOBucket))
+		prefix := append([]byte("p"), pubKeyHash...)
+
 		c := b.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			output, err := DecodeOutputs(v)
-			if err != nil{
-				return err
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			outpoint := k[len(prefix):]
+			if len(outpoint) <= 4 {
+				return errors.New("ERROR: bad public key hash key in chainstate")
 			}
+			txID := outpoint[:len(outpoint)-4]
+			index := int(binary.BigEndian.Uint32(outpoint[len(outpoint)-4:]))
 
-			txID:= hex.EncodeToString(ReformatKey(k))
-
-			UTXOs[txID] = &output
+			uo, err := decodeUnspent(append([]byte{}, txID...), index, b.Get(FormatO(txID, index)))
+			if err != nil {
+				return err
+			}
+			UTXOs = append(UTXOs, uo)
 		}
 		return nil
-	}); if  err != nil {
+	})
+	if err != nil {
 		fmt.Printf("error finding UTXOs: %v\n", err)
 	}
 	return UTXOs, err
 }
 
-func (u UTXO) FindSpendableOutputs(address []byte, amount int) (int, map[string][]int, error) {
-	outputs := make(map[string][]int)
-	accumulated := 0
+// GetBalance returns the sum of the unspent outputs locked to a public key hash.
+func (u UTXO) GetBalance(pubKeyHash []byte) (int, error) {
+	balance := 0
+
+	err := u.Blockchain.DB.View(func(tx *bolt.Tx) error {
+		balance = getBalance(tx.Bucket([]byte(UTXOBucket)), pubKeyHash)
+		return nil
+	})
+
+	return balance, err
+}
 
-	UTXOs, err := u.FindUTXOs()
+// GetImmatureBalance returns the part of the balance of a public key hash that is in coinbase outputs that can't be spent in the next
+// block yet, see UnspentOutput.Mature.
+func (u UTXO) GetImmatureBalance(pubKeyHash []byte) (int, error) {
+	UTXOs, err := u.FindUnspentOutputs(pubKeyHash)
+	if err != nil {
+		return 0, err
+	}
+	ctx, err := u.Blockchain.NextSpendContext()
+	if err != nil {
+		return 0, err
+	}
+
+	balance := 0
+	for _, uo := range UTXOs {
+		if !uo.Mature(ctx.Height) {
+			balance += uo.Output.Value
+		}
+	}
+	return balance, nil
+}
+
+// FindSpendableOutputs picks unspent outputs of an address that add up to at least amount, with a coin selector. Only outputs that can be
+// spent in the next block are picked, immature coinbase outputs are left out. It returns what they add up to, and the outputs in the order
+// they should be spent.
+func (u UTXO) FindSpendableOutputs(address []byte, amount int, selector CoinSelector) (int, []UnspentOutput, error) {
+	UTXOs, err := u.FindUnspentOutputs(PubKeyHashFromAddress(address))
 	if err != nil {
 		fmt.Printf("error getting UTXOs for findBalance: %v\n", err)
-		return 0, outputs, err
+		return 0, nil, err
 	}
 
-	for txID, outs := range UTXOs {
-		for outIdx, out := range outs.Outputs {
-			if out.CanBeUnlocked(address) && accumulated < amount {
-				accumulated += out.Value
-				outputs[txID] = append(outputs[txID], outIdx)
-			} else if accumulated >= amount {
-				break
-			}
+	ctx, err := u.Blockchain.NextSpendContext()
+	if err != nil {
+		return 0, nil, err
+	}
+	var mature []UnspentOutput
+	for _, uo := range UTXOs {
+		if uo.Mature(ctx.Height) {
+			mature = append(mature, uo)
 		}
 	}
 
-	if accumulated < amount {
-		return accumulated, outputs, errors.New("ERROR: not enough funds")
+	selected, err := selector.Select(mature, amount)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	accumulated := 0
+	for _, uo := range selected {
+		accumulated += uo.Output.Value
+	}
+
+	return accumulated, selected, nil
+}
+
+// HasTransaction checks if a transaction still has unspent outputs in the chainstate.
+func (u UTXO) HasTransaction(txID []byte) (bool, error) {
+	found := false
+
+	err := u.Blockchain.DB.View(func(tx *bolt.Tx) error {
+		prefix := append([]byte("o"), txID...)
+		k, _ := tx.Bucket([]byte(UTXOBucket)).Cursor().Seek(prefix)
+		found = k != nil && len(k) == len(prefix)+4 && bytes.HasPrefix(k, prefix)
+		return nil
+	})
+
+	return found, err
+}
+
+// GetUnspentOutput looks up the output at index on the transaction txID. The bool is false if it is spent, or never existed.
+func (u UTXO) GetUnspentOutput(txID []byte, index int) (UnspentOutput, bool, error) {
+	var (
+		uo    UnspentOutput
+		found bool
+	)
+
+	err := u.Blockchain.DB.View(func(tx *bolt.Tx) error {
+		enc := tx.Bucket([]byte(UTXOBucket)).Get(FormatO(txID, index))
+		if enc == nil {
+			return nil
+		}
+
+		var err error
+		uo, err = decodeUnspent(txID, index, enc)
+		found = err == nil
+		return err
+	})
+
+	return uo, found, err
+}
+
+// IsUnspent checks if the output at index on the transaction txID is still in the chainstate.
+func (u UTXO) IsUnspent(txID []byte, index int) (bool, error) {
+	if index < 0 {
+		return false, nil
 	}
 
-	return accumulated, outputs, nil
+	_, unspent, err := u.GetUnspentOutput(txID, index)
+	return unspent, err
 }
 
+// FindReferencedOutputs looks up the outputs that the inputs of tx spend, for signing and verifying it. They are returned as the
+// transactions they belong to, keyed by the hex of the transaction ID, but only the outputs that tx spends are filled in. Everything
+// comes from the chainstate, so the blocks these transactions are in are never read, and may have been pruned.
 func (u UTXO) FindReferencedOutputs(tx Transaction) (map[string]Transaction, error) {
 	referenced := make(map[string]Transaction)
 
-	// get all the outputs that are unspent
-	UTXOs, err := u.FindUTXOs()
-	if err != nil {
-		fmt.Printf("error finding UTXOs for FindReferencedOutputs: %v\n", err)
-		return referenced, err
-	}
-
-	// run through each output, and check if the ID from any of the txInputs match the outputs txID.
-	// for every transaction that has unspent outputs:
-	for txID, utxo := range UTXOs {
-		// for every input in the new transaction
-		for _, in := range tx.Vin {
-			// is the transaction with open outputs the one that the new transaction is referencing?
-			if txID == hex.EncodeToString(in.TransactionID) {
-				// find that transaction
-				referencedTX, err := u.FindTransaction(in.TransactionID, utxo.BlockHeight)
-				if err != nil {
-					fmt.Printf("error finding referencedTX: %v", err)
-					return referenced, err
-				}
-				// add that transaction to the list of transaction this new transaction references
-				referenced[txID] = referencedTX
-			}
+	// for every input in the new transaction
+	for _, in := range tx.Vin {
+		if in.OutputIndex < 0 {
+			continue
 		}
+
+		uo, found, err := u.GetUnspentOutput(in.TransactionID, in.OutputIndex)
+		if err != nil {
+			return referenced, err
+		}
+		if !found {
+			continue
+		}
+
+		// add the output to the transaction it belongs to
+		txID := hex.EncodeToString(in.TransactionID)
+		referencedTX := referenced[txID]
+		referencedTX.ID = in.TransactionID
+		for len(referencedTX.Vout) <= in.OutputIndex {
+			referencedTX.Vout = append(referencedTX.Vout, Output{})
+		}
+		referencedTX.Vout[in.OutputIndex] = uo.Output
+		referenced[txID] = referencedTX
 	}
 	// return the referenced transactions list
-	return  referenced, nil
+	return referenced, nil
 }
 
 func (u UTXO) FindTransaction(txID []byte, blockHeight int) (Transaction, error) {
 	var tx Transaction
 
-	block, err := ReadBlockFromFile(blockHeight)
+	block, err := u.Blockchain.GetBlockByHeight(blockHeight)
 	if err != nil {
 		fmt.Println("error reading block from file for findTransaction")
 		return tx, err
@@ -179,83 +286,198 @@ func (u UTXO) FindTransaction(txID []byte, blockHeight int) (Transaction, error)
 	return tx, errors.New("ERROR: cannot find transaction in that block")
 }
 
+// Update updates the chainstate with a newly connected block in a db transaction of its own, see update. It only touches the chainstate,
+// connecting a block to the chain is up to connectBlock, which does this along with the rest in a single db transaction.
 func (u UTXO) Update(block Block) error {
-	if err := u.Blockchain.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(UTXOBucket))
+	return u.Blockchain.DB.Update(func(tx *bolt.Tx) error {
+		return u.update(tx, block)
+	})
+}
 
-		// for every transaction in this new block
-		for _, tx := range block.Transactions {
-			// delete all UTXOs that are now referenced by inputs
-			// skip coinbase since it has no valid inputs
-			if !tx.IsCoinbase() {
-				// first we check for referenced outputs by seeing what each input references
-				for _, in := range tx.Vin {
-					// get the current UTXOs of a referenced transaction
-					encOuts := b.Get(FormatC(in.TransactionID))
-					// if for some reason there is no actual transaction, freak out
-					if len(encOuts) == 0 {
-						return errors.New("ERROR: for some reason referenced output couldn't be found in chainstate")
-					}
-
-					outs, err := DecodeOutputs(encOuts)
-					if err != nil {
-						return err
-					}
-
-					// create a new UTXOutputs to store the newly updated outputs
-					updatedOuts := UTXOutputs{BlockHeight: outs.BlockHeight}
-
-					// for every output in the range of unspent outputs
-					for outIdx, out := range outs.Outputs {
-						// If the index of where on the transaction this output lives, is equal to the index that the input references, then it's
-						// that output that the input is referencing. Since we want every output that isn't referenced we find those that are not
-						// equal.
-						if outs.Indexes[outIdx] != in.OutputIndex {
-							// if it isn't the one being referenced, then keep it
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-							updatedOuts.Indexes = append(updatedOuts.Indexes, outs.Indexes[outIdx])
-						}
-					}
-
-					// if there are no more outputs, delete the entire transaction
-					if len(updatedOuts.Outputs) == 0 {
-						if err := b.Delete(FormatC(in.TransactionID)); err != nil {
-							fmt.Printf("error deleting tx with UTXOs from chainstate: %v\n", err)
-							return err
-						}
-					// otherwise update the transaction with the new amount of UTXOs
-					} else {
-						enc, err := updatedOuts.SerializeOutputs(); if err != nil {
-							return err
-						}
-						if err := b.Put(FormatC(in.TransactionID), enc); err != nil {
-							return err
-						}
-					}
+// update updates the chainstate with a newly connected block, inside the db transaction that connects it, see connectBlock. Every output
+// the block spends is removed, every output it creates is added, and the removed outputs are saved as the block's undo data so the block
+// can be disconnected again later.
+func (u UTXO) update(dbTX *bolt.Tx, block Block) error {
+	b := dbTX.Bucket([]byte(UTXOBucket))
+	undo := BlockUndo{Transactions: make([]TxUndo, len(block.Transactions))}
+
+	// for every transaction in this new block
+	for txIdx, tx := range block.Transactions {
+		// delete all UTXOs that are now referenced by inputs
+		// skip coinbase since it has no valid inputs
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Vin {
+				uo, found, err := removeUnspent(b, in.TransactionID, in.OutputIndex)
+				if err != nil {
+					return err
 				}
+				if !found {
+					return errors.New("ERROR: referenced output was already spent")
+				}
+
+				// remember it so it can be put back if this block is ever disconnected
+				undo.Transactions[txIdx].Spent = append(undo.Transactions[txIdx].Spent, SpentOutput{
+					TransactionID: uo.TransactionID,
+					Index:         uo.Index,
+					Output:        uo.Output,
+					BlockHeight:   uo.BlockHeight,
+					Coinbase:      uo.Coinbase,
+				})
 			}
+		}
 
-			// add all new outputs to chainstate
-			var outputs = UTXOutputs{BlockHeight: block.Height, Outputs: tx.Vout}
-			// create a slice of int ranging from 0 to amountOfOutputs-1, since every output is a free output
-			for outIdx, _ := range tx.Vout {
-				outputs.Indexes = append(outputs.Indexes, outIdx)
+		// add all new outputs to chainstate, except data outputs, which can never be spent
+		for outIdx, out := range tx.Vout {
+			if out.IsData() {
+				continue
+			}
+			uo := UnspentOutput{
+				TransactionID: tx.ID,
+				Index:         outIdx,
+				Output:        out,
+				BlockHeight:   block.Height,
+				Coinbase:      tx.IsCoinbase(),
+			}
+			if err := putUnspent(b, uo); err != nil {
+				return err
 			}
+		}
+	}
 
-			enc, err := outputs.SerializeOutputs()
-			if err != nil {
+	if err := indexAddresses(dbTX, block, undo); err != nil {
+		return err
+	}
+	if err := indexAnchors(dbTX, block); err != nil {
+		return err
+	}
+
+	if err := b.Put([]byte("t"), block.Hash); err != nil {
+		return err
+	}
+
+	return putBlockUndo(dbTX, block.Hash, undo)
+}
+
+// Disconnect takes the tip block off of the chainstate in a db transaction of its own, see disconnect. Like Update, it only touches the
+// chainstate.
+func (u UTXO) Disconnect(block Block) error {
+	return u.Blockchain.DB.Update(func(tx *bolt.Tx) error {
+		return u.disconnect(tx, block)
+	})
+}
+
+// disconnect is the opposite of update. It takes the tip block off of the chainstate, by removing every output the block created and
+// putting back every output it spent, using the undo data that was saved when the block was connected.
+func (u UTXO) disconnect(dbTX *bolt.Tx, block Block) error {
+	b := dbTX.Bucket([]byte(UTXOBucket))
+
+	undo, err := getBlockUndo(dbTX, block.Hash)
+	if err != nil {
+		return err
+	}
+	if len(undo.Transactions) != len(block.Transactions) {
+		return errors.New("ERROR: undo data does not match the block")
+	}
+
+	// go backwards, so that an output that was both created and spent inside this block is restored before it gets removed
+	for txIdx := len(block.Transactions) - 1; txIdx >= 0; txIdx-- {
+		tx := block.Transactions[txIdx]
+
+		for outIdx, out := range tx.Vout {
+			if out.IsData() {
+				continue
+			}
+			if _, _, err := removeUnspent(b, tx.ID, outIdx); err != nil {
 				return err
 			}
+		}
 
-			if err := b.Put(FormatC(tx.ID), enc); err != nil {
+		spent := undo.Transactions[txIdx].Spent
+		for i := len(spent) - 1; i >= 0; i-- {
+			uo := UnspentOutput{
+				TransactionID: spent[i].TransactionID,
+				Index:         spent[i].Index,
+				Output:        spent[i].Output,
+				BlockHeight:   spent[i].BlockHeight,
+				Coinbase:      spent[i].Coinbase,
+			}
+			if b.Get(FormatO(uo.TransactionID, uo.Index)) != nil {
+				return errors.New("ERROR: restored output is already in the chainstate")
+			}
+			if err := putUnspent(b, uo); err != nil {
 				return err
 			}
 		}
-		return nil
-	}); err != nil {
-		fmt.Printf("error during UTXO Update: %v\n", err)
+	}
+
+	if err := unindexAddresses(dbTX, block, undo); err != nil {
+		return err
+	}
+	if err := unindexAnchors(dbTX, block); err != nil {
 		return err
 	}
 
-	return nil
-}
\ No newline at end of file
+	if err := b.Put([]byte("t"), block.PrevHash); err != nil {
+		return err
+	}
+
+	return dbTX.Bucket([]byte(undoBucket)).Delete(block.Hash)
+}
+
+// putUnspent adds an unspent output to the chainstate b, along with its public key hash key, and adds its value to the balance of its
+// public key hash.
+func putUnspent(b *bolt.Bucket, uo UnspentOutput) error {
+	if err := b.Put(FormatO(uo.TransactionID, uo.Index), uo.encodeUnspent()); err != nil {
+		return err
+	}
+	if err := b.Put(FormatP(uo.Output.PubKeyHash, uo.TransactionID, uo.Index), []byte{}); err != nil {
+		return err
+	}
+	return putBalance(b, uo.Output.PubKeyHash, getBalance(b, uo.Output.PubKeyHash)+uo.Output.Value)
+}
+
+// removeUnspent removes an unspent output from the chainstate b, and returns it. The bool is false if the output wasn't there.
+func removeUnspent(b *bolt.Bucket, txID []byte, index int) (UnspentOutput, bool, error) {
+	enc := b.Get(FormatO(txID, index))
+	if enc == nil {
+		return UnspentOutput{}, false, nil
+	}
+
+	uo, err := decodeUnspent(txID, index, enc)
+	if err != nil {
+		return uo, false, err
+	}
+
+	if err := b.Delete(FormatO(txID, index)); err != nil {
+		return uo, false, err
+	}
+	if err := b.Delete(FormatP(uo.Output.PubKeyHash, txID, index)); err != nil {
+		return uo, false, err
+	}
+	if err := putBalance(b, uo.Output.PubKeyHash, getBalance(b, uo.Output.PubKeyHash)-uo.Output.Value); err != nil {
+		return uo, false, err
+	}
+
+	return uo, true, nil
+}
+
+// getBalance reads the cached balance of a public key hash from the chainstate b.
+func getBalance(b *bolt.Bucket, pubKeyHash []byte) int {
+	enc := b.Get(FormatBalance(pubKeyHash))
+	if len(enc) != 8 {
+		return 0
+	}
+	return int(int64(binary.BigEndian.Uint64(enc)))
+}
+
+// putBalance stores the cached balance of a public key hash in the chainstate b. An empty balance is deleted, so addresses that were
+// emptied don't take up space.
+func putBalance(b *bolt.Bucket, pubKeyHash []byte, balance int) error {
+	if balance == 0 {
+		return b.Delete(FormatBalance(pubKeyHash))
+	}
+
+	enc := make([]byte, 8)
+	binary.BigEndian.PutUint64(enc, uint64(int64(balance)))
+	return b.Put(FormatBalance(pubKeyHash), enc)
+}
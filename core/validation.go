@@ -0,0 +1,276 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Validation
+
+// Every block that comes from another node is validated before it touches the chainstate. CheckBlock does every check that only needs
+// the block itself, ValidateBlock adds the checks that need the chain, meaning the tip the block builds on and the chainstate at that tip.
+//
+// No transaction can create value. Whatever its inputs spend that its outputs don't pay out is its fee, see TransactionFee, and the fees
+// of every transaction in a block go to the block producer. The coinbase can pay out at most coinbaseReward plus those fees.
+
+const (
+	// maxFutureBlockTime is how far in the future, in seconds, a block's timestamp can be. Clocks are never perfectly in sync.
+	maxFutureBlockTime = 2 * 60 * 60
+)
+
+// CheckBlock runs every check on a block that doesn't depend on the state of the chain.
+func (b Block) CheckBlock() error {
+	if len(b.Transactions) == 0 {
+		return errors.New("ERROR: block has no transactions")
+	}
+
+	if b.Version != legacyBlockVersion && b.Version != blockVersion {
+		return fmt.Errorf("ERROR: unknown block version %d", b.Version)
+	}
+	// the hash of a legacy block doesn't cover the signatures of its transactions, so only the blocks from before version 2 can have it
+	if b.Version == legacyBlockVersion && b.Height > Params.MigrationHeight {
+		return fmt.Errorf("ERROR: block #%d has legacy version %d, only blocks up to #%d can", b.Height, b.Version, Params.MigrationHeight)
+	}
+
+	hash, err := b.GenerateHash()
+	if err != nil {
+		return err
+	}
+	if bytes.Compare(hash, b.Hash) != 0 {
+		return errors.New("ERROR: block hash does not match its header")
+	}
+
+	if b.Timestamp > time.Now().Unix()+maxFutureBlockTime {
+		return errors.New("ERROR: block timestamp is too far in the future")
+	}
+
+	coinbases := 0
+	txIDs := make(map[string]bool)
+	// every output that is referenced by an input of this block, to make sure none of them get spent twice
+	spent := make(map[string]bool)
+
+	for _, tx := range b.Transactions {
+		if err := tx.CheckTransaction(); err != nil {
+			return err
+		}
+
+		id := hex.EncodeToString(tx.ID)
+		if txIDs[id] {
+			return fmt.Errorf("ERROR: transaction %s is in the block twice", id)
+		}
+		txIDs[id] = true
+
+		if tx.IsCoinbase() {
+			coinbases++
+			continue
+		}
+
+		for _, in := range tx.Vin {
+			outpoint := fmt.Sprintf("%s:%d", hex.EncodeToString(in.TransactionID), in.OutputIndex)
+			if spent[outpoint] {
+				return fmt.Errorf("ERROR: output %s is spent twice in the block", outpoint)
+			}
+			spent[outpoint] = true
+		}
+	}
+
+	// the transaction IDs were checked above, so this makes sure the header commits to exactly these transactions, and from blockVersion
+	// on to their signatures and unlocking scripts too
+	if bytes.Compare(b.ComputeMerkleRoot(), b.MerkleRoot) != 0 {
+		return errors.New("ERROR: merkle root does not match the transactions")
+	}
+
+	if coinbases != 1 {
+		return fmt.Errorf("ERROR: block has %d coinbase transactions, it needs exactly 1", coinbases)
+	}
+
+	return nil
+}
+
+// ValidateBlock runs the full consensus validation of a block. The block has to build on our tip, and the chainstate has to be at the
+// tip, so that every input of the block can be looked up.
+func (bc *Blockchain) ValidateBlock(block Block) error {
+	if err := block.CheckBlock(); err != nil {
+		return err
+	}
+
+	tip, err := bc.getTip()
+	if err != nil {
+		return err
+	}
+
+	if bytes.Compare(block.PrevHash, tip.Hash) != 0 {
+		return errors.New("ERROR: block does not build on the tip of the chain")
+	}
+	if block.Height != tip.Height+1 {
+		return fmt.Errorf("ERROR: block height is %d, expected %d", block.Height, tip.Height+1)
+	}
+	if block.Timestamp < tip.Timestamp {
+		return errors.New("ERROR: block timestamp is before its previous block")
+	}
+
+	utxo := UTXO{Blockchain: bc}
+	ctx := SpendContext{Height: block.Height, PrevTime: tip.Timestamp}
+
+	var (
+		coinbase Transaction
+		fees     int
+	)
+
+	for _, tx := range block.Transactions {
+		// a transaction can't reuse the ID of one that still has unspent outputs, it would overwrite them in the chainstate
+		exists, err := utxo.HasTransaction(tx.ID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("ERROR: transaction %s already exists in the chainstate", hex.EncodeToString(tx.ID))
+		}
+
+		if tx.IsCoinbase() {
+			coinbase = tx
+			continue
+		}
+
+		verified, err := utxo.VerifyTransaction(tx, ctx)
+		if err != nil {
+			return err
+		}
+		if !verified {
+			return WitnessError{fmt.Errorf("ERROR: transaction %s doesn't unlock the outputs it spends", hex.EncodeToString(tx.ID))}
+		}
+
+		fee, err := utxo.TransactionFee(tx)
+		if err != nil {
+			return err
+		}
+		if fees+fee < fees {
+			return errors.New("ERROR: block fees overflow")
+		}
+		fees += fee
+	}
+
+	// the coinbase is checked last, once the fees of every other transaction are known
+	reward, err := coinbase.OutputValue()
+	if err != nil {
+		return err
+	}
+	if reward > coinbaseReward+fees {
+		return fmt.Errorf("ERROR: coinbase pays %d, the reward is %d plus %d in fees", reward, coinbaseReward, fees)
+	}
+
+	return nil
+}
+
+// OutputValue returns the sum of the outputs of a transaction.
+func (tx Transaction) OutputValue() (int, error) {
+	total := 0
+	for _, out := range tx.Vout {
+		if total+out.Value < total {
+			return 0, fmt.Errorf("ERROR: outputs of transaction %s overflow", hex.EncodeToString(tx.ID))
+		}
+		total += out.Value
+	}
+	return total, nil
+}
+
+// TransactionFee returns the fee of a transaction, which is what its inputs spend minus what its outputs pay out. Every input has to
+// spend an output in the chainstate, and a transaction that pays out more than it spends is invalid.
+func (u UTXO) TransactionFee(tx Transaction) (int, error) {
+	in := 0
+	for _, input := range tx.Vin {
+		uo, found, err := u.GetUnspentOutput(input.TransactionID, input.OutputIndex)
+		if err != nil {
+			return 0, err
+		}
+		if !found {
+			return 0, fmt.Errorf("ERROR: transaction %s spends an output that is spent or doesn't exist", hex.EncodeToString(tx.ID))
+		}
+		if in+uo.Output.Value < in {
+			return 0, fmt.Errorf("ERROR: inputs of transaction %s overflow", hex.EncodeToString(tx.ID))
+		}
+		in += uo.Output.Value
+	}
+
+	out, err := tx.OutputValue()
+	if err != nil {
+		return 0, err
+	}
+	if out > in {
+		return 0, fmt.Errorf("ERROR: transaction %s pays out %d but only spends %d", hex.EncodeToString(tx.ID), out, in)
+	}
+
+	return in - out, nil
+}
+
+// CheckTransaction runs every check on a transaction that doesn't depend on the state of the chain.
+func (tx Transaction) CheckTransaction() error {
+	if len(tx.Vin) == 0 {
+		return errors.New("ERROR: transaction has no inputs")
+	}
+	if len(tx.Vout) == 0 {
+		return errors.New("ERROR: transaction has no outputs")
+	}
+
+	for _, out := range tx.Vout {
+		if out.IsData() {
+			if err := out.checkData(); err != nil {
+				return err
+			}
+		} else if out.Value <= 0 {
+			return errors.New("ERROR: transaction has an output with a value that isn't positive")
+		}
+		if err := out.checkScript(); err != nil {
+			return err
+		}
+	}
+	if tx.LockTime < 0 {
+		return errors.New("ERROR: transaction has a negative lock time")
+	}
+	for _, in := range tx.Vin {
+		if in.Sequence < 0 || int64(in.Sequence) > math.MaxUint32 {
+			return fmt.Errorf("ERROR: input sequence %d is out of range", in.Sequence)
+		}
+		if len(in.Script) == 0 {
+			continue
+		}
+		if len(in.Signature) > 0 || len(in.PubKey) > 0 {
+			return errors.New("ERROR: input with an unlocking script can't also have a signature or public key")
+		}
+		if len(in.Script) > maxScriptSize {
+			return fmt.Errorf("ERROR: unlocking script is %d bytes, the most is %d", len(in.Script), maxScriptSize)
+		}
+	}
+	if _, err := tx.OutputValue(); err != nil {
+		return err
+	}
+
+	if tx.IsCoinbase() {
+		if len(tx.Vin) != 1 || len(tx.Vin[0].TransactionID) != 0 {
+			return errors.New("ERROR: coinbase transaction can only have a single empty input")
+		}
+		if tx.LockTime != 0 || tx.Vin[0].Sequence != 0 {
+			return errors.New("ERROR: coinbase transaction can't be locked")
+		}
+	} else {
+		for _, in := range tx.Vin {
+			if in.OutputIndex < 0 {
+				return errors.New("ERROR: non coinbase transaction has a negative output index")
+			}
+		}
+	}
+
+	id, err := tx.Hash()
+	if err != nil {
+		return err
+	}
+	if bytes.Compare(id, tx.ID) != 0 {
+		return fmt.Errorf("ERROR: transaction ID %s does not match its contents", hex.EncodeToString(tx.ID))
+	}
+
+	return nil
+}
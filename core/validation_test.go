@@ -0,0 +1,191 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckBlock(t *testing.T) {
+	// a coinbase and a single transfer, see testTransactions
+	valid := func() Block {
+		block := testBlock(blockVersion)
+		block.Transactions = block.Transactions[:2]
+		rehash(&block)
+		return block
+	}
+
+	tests := []struct {
+		name   string
+		change func(b *Block)
+		want   string
+	}{
+		{name: "valid", change: func(b *Block) {}},
+		{name: "legacy genesis", change: func(b *Block) { b.Version = legacyBlockVersion; b.Height = 0; rehash(b) }},
+		{
+			name:   "legacy version above the migration height",
+			change: func(b *Block) { b.Version = legacyBlockVersion; rehash(b) },
+			want:   "has legacy version",
+		},
+		{name: "no transactions", change: func(b *Block) { b.Transactions = nil; rehash(b) }, want: "no transactions"},
+		{name: "unknown version", change: func(b *Block) { b.Version = blockVersion + 1; rehash(b) }, want: "unknown block version"},
+		{name: "hash mismatch", change: func(b *Block) { b.Height++ }, want: "hash does not match"},
+		{
+			name:   "future timestamp",
+			change: func(b *Block) { b.Timestamp = time.Now().Unix() + maxFutureBlockTime + 60; rehash(b) },
+			want:   "too far in the future",
+		},
+		{
+			name:   "invalid transaction",
+			change: func(b *Block) { b.Transactions[1].Vout[0].Value = 0; rehash(b) },
+			want:   "isn't positive",
+		},
+		{
+			name:   "transaction ID mismatch",
+			change: func(b *Block) { b.Transactions[1].Vout[0].Value++; rehash(b) },
+			want:   "does not match its contents",
+		},
+		{
+			name:   "duplicate transaction",
+			change: func(b *Block) { b.Transactions = append(b.Transactions, b.Transactions[1]); rehash(b) },
+			want:   "in the block twice",
+		},
+		{
+			name: "double spend",
+			change: func(b *Block) {
+				tx := b.Transactions[1]
+				tx.Vout = []Output{{Value: 1, PubKeyHash: fill(0x99, 20)}}
+				tx.ID, _ = tx.Hash()
+				b.Transactions = append(b.Transactions, tx)
+				rehash(b)
+			},
+			want: "spent twice",
+		},
+		{
+			name:   "merkle root mismatch",
+			change: func(b *Block) { b.MerkleRoot = fill(0x00, 64); b.Hash, _ = b.GenerateHash() },
+			want:   "merkle root",
+		},
+		{
+			name:   "changed signature",
+			change: func(b *Block) { b.Transactions[1].Vin[0].Signature = fill(0xcc, 64) },
+			want:   "merkle root",
+		},
+		{name: "no coinbase", change: func(b *Block) { b.Transactions = b.Transactions[1:]; rehash(b) }, want: "0 coinbase"},
+		{
+			name: "two coinbases",
+			change: func(b *Block) {
+				cb := b.Transactions[0]
+				cb.Timestamp++
+				cb.ID, _ = cb.Hash()
+				b.Transactions = append(b.Transactions, cb)
+				rehash(b)
+			},
+			want: "2 coinbase",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block := valid()
+			tt.change(&block)
+			checkError(t, block.CheckBlock(), tt.want)
+		})
+	}
+}
+
+func TestValidateBlock(t *testing.T) {
+	tc := newTestChain(t)
+	_, other := newTestWallet(t)
+
+	tip, err := tc.getTip()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// newTransfer pays 30 of the genesis allocation to the other wallet, with a fee of 2
+	newTransfer := func() Transaction {
+		return tc.pay(t, other, 30, 2)
+	}
+
+	tests := []struct {
+		name    string
+		block   func() Block
+		want    string
+		witness bool
+	}{
+		{
+			name: "valid",
+			block: func() Block {
+				return tc.nextBlock(t, 2, newTransfer())
+			},
+		},
+		{
+			name: "not on the tip",
+			block: func() Block {
+				block := tc.nextBlock(t, 0)
+				block.PrevHash = fill(0x01, 64)
+				rehash(&block)
+				return block
+			},
+			want: "does not build on the tip",
+		},
+		{
+			name: "wrong height",
+			block: func() Block {
+				block := tc.nextBlock(t, 0)
+				block.Height++
+				rehash(&block)
+				return block
+			},
+			want: "height is 2, expected 1",
+		},
+		{
+			name: "timestamp before its previous block",
+			block: func() Block {
+				block := tc.nextBlock(t, 0)
+				block.Timestamp = tip.Timestamp - 1
+				rehash(&block)
+				return block
+			},
+			want: "before its previous block",
+		},
+		{
+			name: "coinbase pays more than the fees",
+			block: func() Block {
+				return tc.nextBlock(t, 3, newTransfer())
+			},
+			want: "coinbase pays 13",
+		},
+		{
+			name: "missing input",
+			block: func() Block {
+				tx := newTransfer()
+				tx.Vin[0].TransactionID = fill(0x01, 64)
+				tx.ID, _ = tx.Hash()
+				return tc.nextBlock(t, 0, tx)
+			},
+			want: "spent or doesn't exist",
+		},
+		{
+			name: "bad signature",
+			block: func() Block {
+				tx := newTransfer()
+				tx.Vin[0].Signature[len(tx.Vin[0].Signature)-1] ^= 0xff
+				return tc.nextBlock(t, 2, tx)
+			},
+			want:    "doesn't unlock",
+			witness: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tc.ValidateBlock(tt.block())
+			checkError(t, err, tt.want)
+			if witness := errors.As(err, &WitnessError{}); witness != tt.witness {
+				t.Errorf("witness error: %v, want %v", witness, tt.witness)
+			}
+		})
+	}
+}
@@ -11,14 +11,14 @@ import (
 )
 
 // An address is a hash put through a base58 encoder. That hash is made of three parts. The first byte is the version, and the last 4 bytes are a checksum.
+// The version is the address version byte of the network, see network.go, so an address can't be used on the wrong network. Multisig
+// addresses have a version byte of their own, and hash a multisig script instead of a public key, see multisig.go.
 // Everything in between is a sha512, RIPEMD160 of the public key
 
 const (
 	// checksumLen is the length of the checksum in bytes. The checksum is appended to the end of a publicKeyHash, and
 	// it allows us to verify a publicKeyHash
 	checksumLen = 4
-	// version of the publicKey
-	version = 0x00
 )
 
 // Wallet is an instance of a single Wallet
@@ -48,7 +48,8 @@ func NewKeyPair() (ecdsa.PrivateKey, []byte, error) {
 		fmt.Printf("error creating wallet keypair: %v", err)
 		return ecdsa.PrivateKey{}, nil, err
 	}
-	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	// X and Y are padded, so that the key can always be split exactly in half
+	pubKey := append(padBytes(private.PublicKey.X.Bytes(), 32), padBytes(private.PublicKey.Y.Bytes(), 32)...)
 
 	return *private, pubKey, err
 }
@@ -60,6 +61,16 @@ func (w Wallet) GetAddress() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	return AddressFromPubKeyHash(hashPubKey), nil
+}
+
+// AddressFromPubKeyHash turns a public key hash back into the address of the current network it belongs to.
+func AddressFromPubKeyHash(hashPubKey []byte) []byte {
+	return encodeAddress(Params.AddressVersion, hashPubKey)
+}
+
+// encodeAddress turns a version byte and a hash into an address.
+func encodeAddress(version byte, hashPubKey []byte) []byte {
 	// add the version to the beginning of that hash
 	versionPayload := append([]byte{version}, hashPubKey...)
 	// create a checksum with that hash+version
@@ -67,7 +78,7 @@ func (w Wallet) GetAddress() ([]byte, error) {
 	// the full payload is version+hash+checksum
 	fullPayload := append(versionPayload, checksum...)
 	// an address is a base58 version+hash+checksum
-	return Base58Encode(fullPayload), nil
+	return Base58Encode(fullPayload)
 }
 
 // HashPublicKey hashes a public key. First it runs a sha512 hashing on the key, then sends that output through a RIPEMD160 Hasher.
@@ -93,12 +104,24 @@ func CreateChecksum(payload []byte) []byte {
 // CheckValidAddress checks if a wallet address is indeed a valid address.
 // It does so by reversing the process used to create the address, and then checks the checksums against each other.
 // First it base58 decodes the address. Then separates the version, pubKeyHash, and checksum.
-// Then it checks if the checksum of the version+hash matches the address's checksum
+// Then it checks if the checksum of the version+hash matches the address's checksum, and that the version is one of the current network.
 func CheckValidAddress(address []byte) bool {
+	if len(address) == 0 {
+		return false
+	}
 	decoded := Base58Decode(address)
+	if len(decoded) <= checksumLen || (decoded[0] != Params.AddressVersion && decoded[0] != Params.MultisigVersion) {
+		return false
+	}
 	// checksum is the last 4 bytes of the decoded address
 	checksum := decoded[len(decoded)-checksumLen:]
 	// Create a checksum based off of the decodedAddress minus the checksum. That value should be equal to the checksum on the decodedAddress.
 	targetChecksum := CreateChecksum(decoded[:len(decoded)-checksumLen])
 	return bytes.Compare(checksum, targetChecksum) == 0
-}
\ No newline at end of file
+}
+
+// IsMultisigAddress checks if a valid address is a multisig address.
+func IsMultisigAddress(address []byte) bool {
+	decoded := Base58Decode(address)
+	return len(decoded) > 0 && decoded[0] == Params.MultisigVersion
+}
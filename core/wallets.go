@@ -15,6 +15,8 @@ const (
 
 type Wallets struct {
 	Wallets map[string]Wallet
+	// Multisig are the multisig scripts we know of, keyed by their address. Wallet files from before multisig don't have them.
+	Multisig map[string]MultisigScript
 }
 
 func (ws Wallets) SaveToFile() error {
@@ -22,7 +24,7 @@ func (ws Wallets) SaveToFile() error {
 	if err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(walletFile, enc, 0666); err != nil {
+	if err := WriteFileAtomic(walletPath(), enc, 0666); err != nil {
 		fmt.Printf("error writing wallets to file: %v\n", err)
 	}
 	return nil
@@ -33,14 +35,15 @@ func ReadWalletsFromFile() (Wallets, error) {
 
 	// without this line, if wallets.dat doesn't exist, errors will be thrown
 	wallets.Wallets = make(map[string]Wallet)
+	wallets.Multisig = make(map[string]MultisigScript)
 
-	encWallets, err :=  ioutil.ReadFile(walletFile)
+	encWallets, err :=  ioutil.ReadFile(walletPath())
 	if err != nil {
 		if strings.Contains(err.Error(), " file") {
-			_ = ioutil.WriteFile(walletFile, nil, 0666)
+			_ = ioutil.WriteFile(walletPath(), nil, 0666)
 			return wallets, nil
 		}
-		fmt.Printf("error reading in wallets from file %s: %v\n", walletFile, err)
+		fmt.Printf("error reading in wallets from file %s: %v\n", walletPath(), err)
 		return wallets, err
 	}
 
@@ -50,6 +53,9 @@ func ReadWalletsFromFile() (Wallets, error) {
 			fmt.Printf("error decoding wallets, during ReadWalletsFromFile\n")
 		}
 	}
+	if wallets.Multisig == nil {
+		wallets.Multisig = make(map[string]MultisigScript)
+	}
 
 	return wallets, err
 }
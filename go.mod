@@ -1,6 +1,6 @@
 module github.com/chezky/blemflarck
 
-go 1.15
+go 1.16
 
 require (
 	github.com/boltdb/bolt v1.3.1
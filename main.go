@@ -1,7 +1,18 @@
 package main
 
-import "github.com/chezky/blemflarck/cmd"
+import (
+	"embed"
+
+	"github.com/chezky/blemflarck/cmd"
+	"github.com/chezky/blemflarck/core"
+)
+
+// the genesis blocks of every network are built into the binary, see core.GenesisFiles
+//
+//go:embed genesis genesis.testnet genesis.regtest
+var genesisFiles embed.FS
 
 func main() {
+	core.GenesisFiles = genesisFiles
 	cmd.Execute()
 }
@@ -0,0 +1,351 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/chezky/blemflarck/core"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Mempool
+
+// The mempool holds transactions that have been validated against the chainstate, but aren't in a block yet. A block producer pulls
+// the transactions that pay the highest fee for their size with Select, and claims their fees in its coinbase, see core.ValidateBlock.
+//
+// Every transaction in the mempool spends outputs that are in the chainstate, and no two of them spend the same output. A transaction
+// that spends an output that another transaction in the mempool already spends is a double spend, and is rejected, so any set of
+// transactions in the mempool can go in a block together. Once a block is connected, BlockConnected removes the transactions in it, and
+// any transaction left that spends an output that is no longer unspent. When a reorg takes blocks off the main chain, BlockDisconnected
+// puts their transactions back, as long as they are still valid on the new main chain. After a reorg, BlockDisconnected is called for
+// every block that was taken off, from the fork point up, and then BlockConnected for every block of the new branch, see
+// core.Blockchain.UpdateWithNewBlock.
+//
+// The mempool is kept under MaxSize bytes of encoded transactions. When a new transaction doesn't fit, the transactions with the lowest
+// fee per byte are evicted to make room, but only if they pay less per byte than the new one. Transactions that have been waiting longer
+// than expiry are dropped.
+
+const (
+	// DefaultMaxSize is the default number of bytes of encoded transactions the mempool holds, 16 MiB.
+	DefaultMaxSize = 16 * 1024 * 1024
+	// expiry is how long a transaction is kept in the mempool without making it into a block, two weeks.
+	expiry = 14 * 24 * time.Hour
+)
+
+var (
+	// ErrKnownTransaction is returned when adding a transaction that is already in the mempool.
+	ErrKnownTransaction = errors.New("ERROR: transaction is already in the mempool")
+	// ErrConflict is returned when adding a transaction that spends an output a transaction in the mempool already spends.
+	ErrConflict = errors.New("ERROR: transaction spends an output that a transaction in the mempool already spends")
+	// ErrMempoolFull is returned when the mempool is full of transactions that pay at least as much per byte as a new one.
+	ErrMempoolFull = errors.New("ERROR: mempool is full, the transaction doesn't pay enough to get in")
+)
+
+// Entry is a transaction in the mempool.
+type Entry struct {
+	Tx    core.Transaction // Tx is the transaction itself.
+	Fee   int              // Fee is what the inputs of the transaction spend minus what its outputs pay out.
+	Size  int              // Size is the length of the encoded transaction in bytes.
+	Added time.Time        // Added is when the transaction was added to the mempool.
+}
+
+// Mempool holds unconfirmed transactions. It is safe to use from multiple goroutines.
+type Mempool struct {
+	utxo    core.UTXO
+	maxSize int
+
+	lock   sync.Mutex
+	txs    map[string]*Entry // txs are the transactions, keyed by the hex of their ID
+	spends map[string]string // spends maps every outpoint spent in the mempool to the hex ID of the transaction that spends it
+	size   int               // size is the sum of the sizes of every transaction
+}
+
+// New creates an empty mempool on top of the chainstate of bc, that holds at most maxSize bytes of transactions. A maxSize of 0 is
+// DefaultMaxSize.
+func New(bc *core.Blockchain, maxSize int) *Mempool {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+
+	return &Mempool{
+		utxo:    core.UTXO{Blockchain: bc},
+		maxSize: maxSize,
+		txs:     make(map[string]*Entry),
+		spends:  make(map[string]string),
+	}
+}
+
+// outpoint returns the key of the output at index of the transaction txID in spends.
+func outpoint(txID []byte, index int) string {
+	return fmt.Sprintf("%s:%d", hex.EncodeToString(txID), index)
+}
+
+// feeRateLess checks if a pays less per byte than b.
+func feeRateLess(a, b *Entry) bool {
+	return a.Fee*b.Size < b.Fee*a.Size
+}
+
+// Add validates a transaction against the chainstate and the mempool, and adds it. It returns the entry of the transaction.
+func (mp *Mempool) Add(tx core.Transaction) (Entry, error) {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	mp.expire()
+	return mp.add(tx)
+}
+
+// add is Add, for when the lock is already held.
+func (mp *Mempool) add(tx core.Transaction) (Entry, error) {
+	id := hex.EncodeToString(tx.ID)
+	if _, ok := mp.txs[id]; ok {
+		return Entry{}, ErrKnownTransaction
+	}
+
+	if err := tx.CheckTransaction(); err != nil {
+		return Entry{}, err
+	}
+	if tx.IsCoinbase() {
+		return Entry{}, errors.New("ERROR: a coinbase transaction can only be in a block")
+	}
+
+	for _, in := range tx.Vin {
+		if _, ok := mp.spends[outpoint(in.TransactionID, in.OutputIndex)]; ok {
+			return Entry{}, ErrConflict
+		}
+	}
+
+	// the same checks ValidateBlock does for every transaction in a block
+	exists, err := mp.utxo.HasTransaction(tx.ID)
+	if err != nil {
+		return Entry{}, err
+	}
+	if exists {
+		return Entry{}, fmt.Errorf("ERROR: transaction %s already exists in the chainstate", id)
+	}
+
+	ctx, err := mp.utxo.Blockchain.NextSpendContext()
+	if err != nil {
+		return Entry{}, err
+	}
+	verified, err := mp.utxo.VerifyTransaction(tx, ctx)
+	if err != nil {
+		return Entry{}, err
+	}
+	if !verified {
+		return Entry{}, fmt.Errorf("ERROR: transaction %s doesn't unlock the outputs it spends", id)
+	}
+
+	fee, err := mp.utxo.TransactionFee(tx)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	enc, err := tx.Serialize()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	entry := &Entry{
+		Tx:    tx,
+		Fee:   fee,
+		Size:  len(enc),
+		Added: time.Now(),
+	}
+
+	if err := mp.makeRoom(entry); err != nil {
+		return Entry{}, err
+	}
+
+	mp.txs[id] = entry
+	for _, in := range tx.Vin {
+		mp.spends[outpoint(in.TransactionID, in.OutputIndex)] = id
+	}
+	mp.size += entry.Size
+
+	return *entry, nil
+}
+
+// makeRoom evicts the transactions that pay the least per byte until entry fits. Nothing is evicted if entry wouldn't fit even after
+// evicting every transaction that pays less per byte than it does.
+func (mp *Mempool) makeRoom(entry *Entry) error {
+	if entry.Size > mp.maxSize {
+		return ErrMempoolFull
+	}
+	if mp.size+entry.Size <= mp.maxSize {
+		return nil
+	}
+
+	var (
+		evict []*Entry
+		freed int
+	)
+	// sorted goes from the highest fee per byte to the lowest, so the cheapest are at the end
+	sorted := mp.sorted()
+	for i := len(sorted) - 1; i >= 0 && mp.size-freed+entry.Size > mp.maxSize; i-- {
+		if !feeRateLess(sorted[i], entry) {
+			return ErrMempoolFull
+		}
+		evict = append(evict, sorted[i])
+		freed += sorted[i].Size
+	}
+
+	for _, e := range evict {
+		fmt.Printf("evicting transaction %s from the mempool\n", hex.EncodeToString(e.Tx.ID))
+		mp.remove(hex.EncodeToString(e.Tx.ID))
+	}
+
+	return nil
+}
+
+// sorted returns every entry, from the highest fee per byte to the lowest. Entries that pay the same per byte are ordered by when they
+// were added.
+func (mp *Mempool) sorted() []*Entry {
+	entries := make([]*Entry, 0, len(mp.txs))
+	for _, e := range mp.txs {
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if feeRateLess(entries[j], entries[i]) {
+			return true
+		}
+		if feeRateLess(entries[i], entries[j]) {
+			return false
+		}
+		return entries[i].Added.Before(entries[j].Added)
+	})
+
+	return entries
+}
+
+// remove takes a transaction out of the mempool.
+func (mp *Mempool) remove(id string) {
+	entry, ok := mp.txs[id]
+	if !ok {
+		return
+	}
+
+	for _, in := range entry.Tx.Vin {
+		delete(mp.spends, outpoint(in.TransactionID, in.OutputIndex))
+	}
+	mp.size -= entry.Size
+	delete(mp.txs, id)
+}
+
+// expire drops every transaction that has been in the mempool for longer than expiry.
+func (mp *Mempool) expire() {
+	for id, entry := range mp.txs {
+		if time.Since(entry.Added) > expiry {
+			fmt.Printf("transaction %s expired from the mempool\n", id)
+			mp.remove(id)
+		}
+	}
+}
+
+// Select returns the transactions that pay the highest fee per byte, as many as fit in maxBytes, along with the sum of their fees. A
+// maxBytes of 0 returns every transaction. The transactions are left in the mempool until the block with them is connected.
+func (mp *Mempool) Select(maxBytes int) ([]core.Transaction, int) {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	var (
+		txs   []core.Transaction
+		fees  int
+		total int
+	)
+
+	for _, e := range mp.sorted() {
+		if maxBytes > 0 && total+e.Size > maxBytes {
+			continue
+		}
+		txs = append(txs, e.Tx)
+		fees += e.Fee
+		total += e.Size
+	}
+
+	return txs, fees
+}
+
+// BlockConnected removes the transactions of a block that was just connected, and any transaction that spends an output that isn't in
+// the chainstate anymore. Those were either double spent by the block, or their inputs went away in a reorg.
+func (mp *Mempool) BlockConnected(block core.Block) {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	for _, tx := range block.Transactions {
+		mp.remove(hex.EncodeToString(tx.ID))
+	}
+
+	for id, entry := range mp.txs {
+		for _, in := range entry.Tx.Vin {
+			unspent, err := mp.utxo.IsUnspent(in.TransactionID, in.OutputIndex)
+			if err != nil {
+				fmt.Printf("error checking input of mempool transaction %s: %v\n", id, err)
+			}
+			if err != nil || !unspent {
+				mp.remove(id)
+				break
+			}
+		}
+	}
+}
+
+// BlockDisconnected puts the transactions of a block that a reorg took off the main chain back in the mempool, if they are still valid on
+// the new main chain. The new tip can be lower or older than the old one, so a transaction that was valid before can have lock times that
+// haven't passed anymore, or spend a coinbase output that isn't mature anymore. Every transaction in the mempool is checked again first,
+// with the spend context of the new tip, and dropped if it fails.
+func (mp *Mempool) BlockDisconnected(block core.Block) {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	ctx, err := mp.utxo.Blockchain.NextSpendContext()
+	if err != nil {
+		fmt.Printf("error getting the spend context to check the mempool after a reorg: %v\n", err)
+		return
+	}
+
+	for id, entry := range mp.txs {
+		verified, err := mp.utxo.VerifyTransaction(entry.Tx, ctx)
+		if err != nil || !verified {
+			fmt.Printf("dropping mempool transaction %s, it isn't valid on the new main chain: %v\n", id, err)
+			mp.remove(id)
+		}
+	}
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+		if _, err := mp.add(tx); err != nil && err != ErrKnownTransaction {
+			fmt.Printf("dropping transaction %s of disconnected block #%d: %v\n", hex.EncodeToString(tx.ID), block.Height, err)
+		}
+	}
+}
+
+// Get returns the transaction with the hex ID id, if it is in the mempool.
+func (mp *Mempool) Get(id string) (core.Transaction, bool) {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	entry, ok := mp.txs[id]
+	if !ok {
+		return core.Transaction{}, false
+	}
+	return entry.Tx, true
+}
+
+// Has checks if the transaction with the hex ID id is in the mempool.
+func (mp *Mempool) Has(id string) bool {
+	_, ok := mp.Get(id)
+	return ok
+}
+
+// Count returns the number of transactions in the mempool, and the sum of their sizes in bytes.
+func (mp *Mempool) Count() (int, int) {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	return len(mp.txs), mp.size
+}
@@ -0,0 +1,376 @@
+package mempool
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chezky/blemflarck/core"
+)
+
+// testPool is an empty mempool on a regtest chain in a temporary data directory. The genesis block allocates 100 to wallet, and every
+// block mined with mine pays its reward to wallet too.
+type testPool struct {
+	*Mempool
+	bc      *core.Blockchain
+	wallet  core.Wallet
+	address string
+}
+
+// newTestPool creates a testPool that holds at most maxSize bytes, and closes its chain once the test is done.
+func newTestPool(t *testing.T, maxSize int) testPool {
+	t.Helper()
+
+	if err := core.SelectNetwork(core.RegTest.Name, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	w, address := newTestWallet(t)
+
+	genesis, err := core.NewGenesisBlock(core.GenesisParams{
+		Timestamp:   time.Now().Unix() - 60,
+		Allocations: []core.GenesisAllocation{{Address: address, Amount: 100}},
+		Validators:  []string{address},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := core.WriteGenesis(genesis, false); err != nil {
+		t.Fatal(err)
+	}
+
+	bc, err := core.CreateBlockchain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bc.DB.Close() })
+
+	return testPool{Mempool: New(bc, maxSize), bc: bc, wallet: w, address: address}
+}
+
+// newTestWallet creates a wallet, along with its address.
+func newTestWallet(t *testing.T) (core.Wallet, string) {
+	t.Helper()
+
+	w, err := core.CreateWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := w.GetAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, string(address)
+}
+
+// spend creates a transaction that pays amount to address out of the output at index of the transaction txID, which has to belong to the
+// wallet of the pool. Whatever is left of the output is the fee.
+func (tp testPool) spend(t *testing.T, txID []byte, index int, address string, amount int) core.Transaction {
+	t.Helper()
+
+	return tp.split(t, txID, index, core.CreateOutput(address, amount))
+}
+
+// split creates a transaction that spends the output at index of the transaction txID, which has to belong to the wallet of the pool,
+// into outs.
+func (tp testPool) split(t *testing.T, txID []byte, index int, outs ...core.Output) core.Transaction {
+	t.Helper()
+
+	tx := core.Transaction{
+		Vin:       []core.Input{{TransactionID: txID, OutputIndex: index, PubKey: tp.wallet.PublicKey}},
+		Vout:      outs,
+		Timestamp: time.Now().Unix(),
+	}
+	var err error
+	if tx.ID, err = tx.Hash(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (core.UTXO{Blockchain: tp.bc}).SignTransaction(tx, tp.wallet.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// tip returns the tip of the main chain.
+func (tp testPool) tip(t *testing.T) core.Block {
+	t.Helper()
+
+	hash, err := tp.bc.GetTailHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := tp.bc.GetBlock(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// nextBlock creates a block on prev with txs, and a coinbase that claims fees.
+func (tp testPool) nextBlock(t *testing.T, prev core.Block, fees int, txs ...core.Transaction) core.Block {
+	t.Helper()
+
+	coinbase, err := core.NewCoinbaseTransaction(tp.address, fees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := core.NewBlock(prev, append([]core.Transaction{coinbase}, txs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// process adds a block to the chain, and tells the mempool about every block that took off or put on the main chain, the way the p2p
+// package does.
+func (tp testPool) process(t *testing.T, block core.Block) {
+	t.Helper()
+
+	disconnected, connected, err := tp.bc.UpdateWithNewBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blk := range disconnected {
+		tp.BlockDisconnected(blk)
+	}
+	for _, blk := range connected {
+		tp.BlockConnected(blk)
+	}
+}
+
+// mine connects the next block with txs, and a coinbase that claims fees.
+func (tp testPool) mine(t *testing.T, fees int, txs ...core.Transaction) core.Block {
+	t.Helper()
+
+	block := tp.nextBlock(t, tp.tip(t), fees, txs...)
+	tp.process(t, block)
+	return block
+}
+
+// checkError fails the test unless err contains want, or is nil when want is empty.
+func checkError(t *testing.T, err error, want string) {
+	t.Helper()
+
+	if want == "" {
+		if err != nil {
+			t.Errorf("got %v, want no error", err)
+		}
+		return
+	}
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got %v, want an error with %q", err, want)
+	}
+}
+
+func TestAddImmatureCoinbase(t *testing.T) {
+	tp := newTestPool(t, 0)
+	_, other := newTestWallet(t)
+
+	coinbase := tp.mine(t, 0).Transactions[0]
+	for height := 2; height < 1+core.Params.CoinbaseMaturity; height++ {
+		_, err := tp.Add(tp.spend(t, coinbase.ID, 0, other, 1))
+		checkError(t, err, "can't be spent until block")
+		tp.mine(t, 0)
+	}
+
+	_, err := tp.Add(tp.spend(t, coinbase.ID, 0, other, 1))
+	checkError(t, err, "")
+}
+
+// fund splits the genesis allocation into n outputs of 10 to the wallet of the pool, and mines it, so that tests have n outputs to spend
+// independently. It returns the ID of the splitting transaction.
+func (tp testPool) fund(t *testing.T, n int) []byte {
+	t.Helper()
+
+	var outs []core.Output
+	for i := 0; i < n; i++ {
+		outs = append(outs, core.CreateOutput(tp.address, 10))
+	}
+	genesis, err := tp.bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := tp.split(t, genesis.Transactions[0].ID, 0, outs...)
+	tp.mine(t, 100-10*n, tx)
+	return tx.ID
+}
+
+func TestAdd(t *testing.T) {
+	tp := newTestPool(t, 0)
+	_, other := newTestWallet(t)
+	funds := tp.fund(t, 3)
+
+	first := tp.spend(t, funds, 0, other, 9)
+	coinbase, err := core.NewCoinbaseTransaction(other, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// signed while its output was unspent, then a block spends the output first
+	late := tp.spend(t, funds, 1, other, 9)
+	tp.mine(t, 2, tp.spend(t, funds, 1, other, 8))
+
+	tests := []struct {
+		name string
+		tx   core.Transaction
+		want string
+	}{
+		{name: "valid", tx: first},
+		{name: "already in the mempool", tx: first, want: ErrKnownTransaction.Error()},
+		{name: "double spend in the mempool", tx: tp.spend(t, funds, 0, other, 8), want: ErrConflict.Error()},
+		{name: "coinbase", tx: coinbase, want: "can only be in a block"},
+		{name: "spent in the chain", tx: late, want: "spent or doesn't exist"},
+		{name: "other output", tx: tp.spend(t, funds, 2, other, 9)},
+	}
+
+	// every case runs against the mempool the cases before it left behind
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tp.Add(tt.tx)
+			checkError(t, err, tt.want)
+		})
+	}
+
+	if count, _ := tp.Count(); count != 2 {
+		t.Errorf("mempool has %d transactions, want 2", count)
+	}
+}
+
+func TestMakeRoom(t *testing.T) {
+	tp := newTestPool(t, 0)
+	_, other := newTestWallet(t)
+	funds := tp.fund(t, 4)
+
+	// every transaction has the same size, so the one that pays the lowest fee pays the least per byte
+	cheap := tp.spend(t, funds, 0, other, 9)
+	entry, err := tp.Add(cheap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.maxSize = 2 * entry.Size
+
+	middle := tp.spend(t, funds, 1, other, 7)
+	if _, err := tp.Add(middle); err != nil {
+		t.Fatal(err)
+	}
+
+	// the mempool is full, a transaction that pays more per byte than the cheapest one takes its place
+	rich := tp.spend(t, funds, 2, other, 5)
+	if _, err := tp.Add(rich); err != nil {
+		t.Fatal(err)
+	}
+	if tp.Has(hex.EncodeToString(cheap.ID)) {
+		t.Error("the cheapest transaction wasn't evicted")
+	}
+	if !tp.Has(hex.EncodeToString(middle.ID)) || !tp.Has(hex.EncodeToString(rich.ID)) {
+		t.Error("a transaction that pays more than the cheapest was evicted")
+	}
+
+	// one that doesn't pay more than any of them stays out
+	if _, err := tp.Add(tp.spend(t, funds, 3, other, 7)); err != ErrMempoolFull {
+		t.Errorf("got %v, want %v", err, ErrMempoolFull)
+	}
+	if count, size := tp.Count(); count != 2 || size != tp.maxSize {
+		t.Errorf("mempool has %d transactions of %d bytes, want 2 of %d", count, size, tp.maxSize)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	tp := newTestPool(t, 0)
+	_, other := newTestWallet(t)
+	funds := tp.fund(t, 3)
+
+	// added from the lowest fee to the highest, the same size each
+	var txs []core.Transaction
+	size := 0
+	for i, fee := range []int{1, 5, 3} {
+		tx := tp.spend(t, funds, i, other, 10-fee)
+		entry, err := tp.Add(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, tx)
+		size = entry.Size
+	}
+
+	tests := []struct {
+		name     string
+		maxBytes int
+		want     []core.Transaction
+		fees     int
+	}{
+		{name: "everything", maxBytes: 0, want: []core.Transaction{txs[1], txs[2], txs[0]}, fees: 9},
+		{name: "the best two", maxBytes: 2*size + 1, want: []core.Transaction{txs[1], txs[2]}, fees: 8},
+		{name: "the best one", maxBytes: size, want: []core.Transaction{txs[1]}, fees: 5},
+		{name: "nothing fits", maxBytes: size - 1, fees: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, fees := tp.Select(tt.maxBytes)
+			if fees != tt.fees {
+				t.Errorf("fees are %d, want %d", fees, tt.fees)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("selected %d transactions, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if !bytes.Equal(got[i].ID, tt.want[i].ID) {
+					t.Errorf("transaction #%d is %x, want %x", i, got[i].ID, tt.want[i].ID)
+				}
+			}
+		})
+	}
+
+	// selecting leaves them in the mempool
+	if count, _ := tp.Count(); count != 3 {
+		t.Errorf("mempool has %d transactions, want 3", count)
+	}
+}
+
+func TestReorg(t *testing.T) {
+	tp := newTestPool(t, 0)
+	_, other := newTestWallet(t)
+	funds := tp.fund(t, 4)
+	fork := tp.tip(t)
+
+	// the old branch has one transaction only it has, one that double spends an output the new branch spends too, and one both have
+	onlyOld := tp.spend(t, funds, 0, other, 9)
+	doubleSpent := tp.spend(t, funds, 1, other, 9)
+	both := tp.spend(t, funds, 2, other, 9)
+	doubleSpend := tp.spend(t, funds, 1, other, 8)
+	old := tp.mine(t, 3, onlyOld, doubleSpent, both)
+
+	// and the mempool has one that the new branch confirms
+	pending := tp.spend(t, funds, 3, other, 9)
+	if _, err := tp.Add(pending); err != nil {
+		t.Fatal(err)
+	}
+
+	newFirst := tp.nextBlock(t, fork, 4, doubleSpend, both, pending)
+	tp.process(t, newFirst)
+	if !bytes.Equal(tp.tip(t).Hash, old.Hash) {
+		t.Fatal("a side block of the same height took over the main chain")
+	}
+	tp.process(t, tp.nextBlock(t, newFirst, 0))
+
+	tests := []struct {
+		name string
+		tx   core.Transaction
+		want bool
+	}{
+		{name: "only in the old branch", tx: onlyOld, want: true},
+		{name: "double spent by the new branch", tx: doubleSpent, want: false},
+		{name: "in both branches", tx: both, want: false},
+		{name: "coinbase of the old branch", tx: old.Transactions[0], want: false},
+		{name: "confirmed by the new branch", tx: pending, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tp.Has(hex.EncodeToString(tt.tx.ID)); got != tt.want {
+				t.Errorf("in the mempool: %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,9 +2,12 @@ package p2p
 
 import (
 	"bytes"
-	"encoding/gob"
 	"fmt"
+	"encoding/hex"
 	"github.com/chezky/blemflarck/core"
+	"github.com/chezky/blemflarck/mempool"
+	"sync"
+	"time"
 )
 
 //L -> R: Send version message with the local peer's version
@@ -16,15 +19,30 @@ import (
 
 var (
 	blocksNeeded = make(map[int32][]byte)
+	// orphanBlocks holds blocks whose previous block hasn't arrived yet, keyed by the hex of that previous hash. Blocks are requested
+	// all at once, so they can easily arrive out of order. A peer can also send orphans that never get a parent, so there are at most
+	// maxOrphanBlocks of them, and each one is dropped after orphanExpiry.
+	orphanBlocks = make(map[string][]orphanBlock)
+	orphanCount  int
+	orphanLock   sync.Mutex
 )
 
-func handleVersion(req []byte, bc *core.Blockchain) {
-	var (
-		payload Version
-	)
+const (
+	// maxOrphanBlocks is the most orphan blocks that are kept, once there are more the oldest one is dropped.
+	maxOrphanBlocks = 100
+	// orphanExpiry is how long an orphan block is kept waiting for its previous block.
+	orphanExpiry = 20 * time.Minute
+)
+
+// orphanBlock is a block waiting for its previous block, along with when it arrived.
+type orphanBlock struct {
+	block core.Block
+	added time.Time
+}
 
-	dec := gob.NewDecoder(bytes.NewReader(req))
-	if err := dec.Decode(&payload); err != nil {
+func handleVersion(req []byte, bc *core.Blockchain) {
+	payload, err := decodeVersion(req)
+	if err != nil {
 		fmt.Printf("error decoding handleVersion with payload of length %d: %v\n", len(req), err)
 		return
 	}
@@ -38,6 +56,11 @@ func handleVersion(req []byte, bc *core.Blockchain) {
 		knownNodes[payload.AddrFrom.IP.String()] = createNewAddress(payload.AddrFrom)
 	}
 
+	if node := knownNodes[payload.AddrFrom.IP.String()]; node != nil {
+		node.Pruned = payload.Pruned
+		node.PruneHeight = payload.PruneHeight
+	}
+
 	// If successfully received the Version message, confirm with the sender that it has been received, to update the this receiving node as successful handshake on
 	// the sender node.
 	sendVerack(payload.AddrFrom.String())
@@ -49,6 +72,9 @@ func handleVersion(req []byte, bc *core.Blockchain) {
 
 	if myBlockHeight > payload.BlockHeight {
 		fmt.Printf("my block height is higher haha!\n")
+	} else if payload.Pruned && myBlockHeight < payload.PruneHeight {
+		// a pruned node can't send us the blocks right after our tip, so another node has to
+		fmt.Printf("node %s is pruned up to block \"%d\", not syncing from it\n", payload.AddrFrom.String(), payload.PruneHeight)
 	} else if myBlockHeight < payload.BlockHeight {
 		sendGetBlocks(payload.AddrFrom, bc)
 	} else {
@@ -75,28 +101,37 @@ func handleVerack(address NetAddress) {
 
 // What I want to do, is when I get a "getblocks" command, verify that the
 func handleGetBlocks(req []byte, address NetAddress, bc *core.Blockchain) {
-	var payload GetBlocks
-
-	dec := gob.NewDecoder(bytes.NewReader(req))
-	if err := dec.Decode(&payload); err != nil {
+	payload, err := decodeGetBlocks(req)
+	if err != nil {
 		fmt.Printf("error decoding GetBlocks of length %d: %v\n", len(req), err)
 		return
 	}
 
-	fmt.Printf("getting blocks starting with height %d for address %s\n", payload.Height+1, address.String())
+	start := payload.Height
 
-	blk, err := core.ReadBlockFromFile(int(payload.Height))
-	if err != nil {
-		fmt.Printf("error reading block height %d from file: %v\n", payload.Height, err)
-		return
-	}
+	// the locator lets us find where the peer's chain and ours split, even if the peer is on a different branch
+	if len(payload.Locator) > 0 {
+		fork, err := bc.FindLocatorFork(payload.Locator)
+		if err != nil {
+			fmt.Printf("error finding fork from locator for address %s: %v\n", address.String(), err)
+			return
+		}
+		start = int32(fork)
+	} else {
+		hash, err := bc.GetMainHash(int(payload.Height))
+		if err != nil {
+			fmt.Printf("error reading block hash at height %d: %v\n", payload.Height, err)
+			return
+		}
 
-	if bytes.Compare(blk.Hash, payload.Hash) != 0 {
-	//	TODO: handle this MUCH better
-		fmt.Printf("ERROR: block height \"%d\" on address %s has a different hash than this node does!\n", payload.Height, address.String())
-		return
+		if bytes.Compare(hash, payload.Hash) != 0 {
+			fmt.Printf("ERROR: block height \"%d\" on address %s has a different hash than this node does!\n", payload.Height, address.String())
+			return
+		}
 	}
 
+	fmt.Printf("getting blocks starting with height %d for address %s\n", start+1, address.String())
+
 	myHeight, err := bc.GetChainHeight()
 	if err != nil {
 		fmt.Printf("error getting chain height for handleGetBlocks: %v\n", err)
@@ -107,16 +142,16 @@ func handleGetBlocks(req []byte, address NetAddress, bc *core.Blockchain) {
 		Kind:   "blocks",
 	}
 
-	for i:=payload.Height; i < myHeight; i++ {
+	for i:=start; i < myHeight; i++ {
 		// over here is i+1 since if i starts at their height we want to start with the next block up
-		blk, err := core.ReadBlockFromFile(int(i+1))
+		hash, err := bc.GetMainHash(int(i+1))
 		if err != nil {
 			fmt.Printf("error reading in block height \"%d\" for handleGetBlocks: %v\n", i, err)
 			return
 		}
 		// same here, we start with their height +1
 		inv.Height = append(inv.Height, i+1)
-		inv.Items = append(inv.Items, blk.Hash)
+		inv.Items = append(inv.Items, hash)
 	}
 
 	sendInv(address, inv)
@@ -125,10 +160,8 @@ func handleGetBlocks(req []byte, address NetAddress, bc *core.Blockchain) {
 // handleInventory handles calls to inventory. This can be triggered unsolicited, or in response to getblocks. When handling blocks, store the list of blocks you need to get,
 // and then get the blocks from multiple places.
 func handleInventory(req []byte, address NetAddress, bc *core.Blockchain) {
-	var payload Inventory
-
-	dec := gob.NewDecoder(bytes.NewReader(req))
-	if err := dec.Decode(&payload); err != nil {
+	payload, err := decodeInventory(req)
+	if err != nil {
 		fmt.Printf("error decoding handleInventory of length %d: %v\n", len(req), err)
 		return
 	}
@@ -141,49 +174,198 @@ func handleInventory(req []byte, address NetAddress, bc *core.Blockchain) {
 
 		sendGetData("blocks")
 	}
-}
 
-func handleGetData(req []byte, address NetAddress) {
-	var payload GetData
+	if payload.Kind == "tx" {
+		// only ask for the transactions we don't have yet
+		for _, id := range payload.Items {
+			if pool.Has(hex.EncodeToString(id)) {
+				continue
+			}
+			sendData("getdata", GetData{Hash: id, Kind: "tx"}, address)
+		}
+	}
+}
 
-	dec := gob.NewDecoder(bytes.NewReader(req))
-	if err := dec.Decode(&payload); err != nil {
+func handleGetData(req []byte, address NetAddress, bc *core.Blockchain) {
+	payload, err := decodeGetData(req)
+	if err != nil {
 		fmt.Printf("error deocding during handleGetData: %v\n", err)
 		return
 	}
 
 	if payload.Kind == "blocks" {
 		fmt.Printf("Address %s requested block \"%d\"\n", address.IP.String(), payload.Height)
-		blk, err := core.ReadBlockFromFile(int(payload.Height))
+		// look the block up by hash, so that blocks on a side branch can be served too
+		blk, err := bc.GetBlock(payload.Hash)
 		if err != nil {
+			// most likely the block was pruned, either way the node has to get it from someone else
 			fmt.Printf("error reading in block height \"%d\" for handleGetData: %v\n", payload.Height, err)
+			sendNotFound(payload, address)
 			return
 		}
 
-		if bytes.Compare(blk.Hash, payload.Hash) != 0 {
-			//TODO:// handle this. Maybe have some sort of way to send back errors
-			fmt.Printf("ERROR: block #%d and requested block #%d don't have matching hashes\n", blk.Height, payload.Height)
+		sendBlock(blk, address)
+	}
+
+	if payload.Kind == "tx" {
+		tx, ok := pool.Get(hex.EncodeToString(payload.Hash))
+		if !ok {
+			// the transaction must have made it into a block, or been evicted
+			sendNotFound(payload, address)
 			return
 		}
 
-		sendBlock(blk, address)
+		sendTx(tx, address)
 	}
 }
 
-func handleBlock(req []byte, bc *core.Blockchain) {
-	// TODO: wow i need tons of block verification work here
-	var block core.Block
+// handleNotFound handles a node telling us it doesn't have data we asked it for, usually because it pruned the block. The block is asked
+// for from another node, if there is one that still has it.
+func handleNotFound(req []byte, address NetAddress) {
+	payload, err := decodeGetData(req)
+	if err != nil {
+		fmt.Printf("error decoding handleNotFound of length %d: %v\n", len(req), err)
+		return
+	}
+
+	if payload.Kind != "blocks" {
+		return
+	}
+
+	fmt.Printf("Address %s doesn't have block \"%d\"\n", address.IP.String(), payload.Height)
+
+	// the node must have pruned the block, so don't ask it for anything that old again
+	if node := knownNodes[address.IP.String()]; node != nil && (!node.Pruned || node.PruneHeight < payload.Height) {
+		node.Pruned = true
+		node.PruneHeight = payload.Height
+	}
 
-	dec := gob.NewDecoder(bytes.NewReader(req))
-	if err := dec.Decode(&block); err != nil {
+	other, ok := getNodeWithBlock(payload.Height, address.IP.String())
+	if !ok {
+		fmt.Printf("ERROR: no other node has block \"%d\"\n", payload.Height)
+		return
+	}
+
+	sendData("getdata", payload, other)
+}
+
+// handleBlock handles a block sent by another node. The block is fully validated by UpdateWithNewBlock before it is added.
+func handleBlock(req []byte, bc *core.Blockchain) {
+	block, err := core.DecodeBlock(req)
+	if err != nil {
 		fmt.Printf("error decoding block for handleBlock, with request of length %d: %v", len(req), err)
 		return
 	}
 
-	if err := bc.UpdateWithNewBlock(block); err != nil {
+	processBlock(block, bc)
+}
+
+// processBlock adds a block to the chain. If the block's parent hasn't arrived yet, it is kept as an orphan. Once a block is added,
+// any orphans that were waiting on it are processed too. The mempool is told about every block the chain took off and put on, as
+// UpdateWithNewBlock returns them.
+func processBlock(block core.Block, bc *core.Blockchain) {
+	disconnected, connected, err := bc.UpdateWithNewBlock(block)
+	if err == core.ErrOrphanBlock {
+		fmt.Printf("block #%d is an orphan, waiting for its previous block\n", block.Height)
+		addOrphan(block)
+		return
+	}
+	if err == core.ErrKnownBlock {
+		fmt.Printf("already have block #%d\n", block.Height)
+		return
+	}
+	if err != nil {
 		fmt.Printf("error updating blockchain with new block #%d: %v\n", block.Height, err)
 		return
 	}
 
 	fmt.Printf("successfully added block #%d\n", block.Height)
-}
\ No newline at end of file
+
+	for _, blk := range disconnected {
+		pool.BlockDisconnected(blk)
+	}
+	for _, blk := range connected {
+		pool.BlockConnected(blk)
+	}
+
+	orphanLock.Lock()
+	children := orphanBlocks[hex.EncodeToString(block.Hash)]
+	delete(orphanBlocks, hex.EncodeToString(block.Hash))
+	orphanCount -= len(children)
+	orphanLock.Unlock()
+
+	for _, child := range children {
+		processBlock(child.block, bc)
+	}
+}
+
+// addOrphan keeps a block until its previous block arrives. Expired orphans are dropped first, and if there are still maxOrphanBlocks of
+// them the oldest one goes too.
+func addOrphan(block core.Block) {
+	orphanLock.Lock()
+	defer orphanLock.Unlock()
+
+	now := time.Now()
+	for prev, orphans := range orphanBlocks {
+		kept := orphans[:0]
+		for _, orphan := range orphans {
+			if now.Sub(orphan.added) < orphanExpiry {
+				kept = append(kept, orphan)
+			}
+		}
+		orphanCount -= len(orphans) - len(kept)
+		if len(kept) == 0 {
+			delete(orphanBlocks, prev)
+		} else {
+			orphanBlocks[prev] = kept
+		}
+	}
+
+	if orphanCount >= maxOrphanBlocks {
+		var (
+			oldestPrev string
+			oldest     time.Time
+		)
+		for prev, orphans := range orphanBlocks {
+			// the orphans of a previous block are in the order they arrived
+			if oldestPrev == "" || orphans[0].added.Before(oldest) {
+				oldestPrev, oldest = prev, orphans[0].added
+			}
+		}
+		fmt.Printf("too many orphan blocks, dropping block #%d\n", orphanBlocks[oldestPrev][0].block.Height)
+		if len(orphanBlocks[oldestPrev]) == 1 {
+			delete(orphanBlocks, oldestPrev)
+		} else {
+			orphanBlocks[oldestPrev] = orphanBlocks[oldestPrev][1:]
+		}
+		orphanCount--
+	}
+
+	prev := hex.EncodeToString(block.PrevHash)
+	orphanBlocks[prev] = append(orphanBlocks[prev], orphanBlock{block: block, added: now})
+	orphanCount++
+}
+
+// handleTx handles a transaction sent by another node, or by a wallet with send --node. The transaction is validated and added to the
+// mempool, and then announced to every other node.
+func handleTx(req []byte, address NetAddress) {
+	tx, err := core.DeserializeTransaction(req)
+	if err != nil {
+		fmt.Printf("error decoding transaction for handleTx, with request of length %d: %v\n", len(req), err)
+		return
+	}
+
+	entry, err := pool.Add(tx)
+	if err == mempool.ErrKnownTransaction {
+		return
+	}
+	if err != nil {
+		fmt.Printf("error adding transaction %s to the mempool: %v\n", hex.EncodeToString(tx.ID), err)
+		return
+	}
+
+	count, size := pool.Count()
+	fmt.Printf("added transaction %s with a fee of %d to the mempool, it holds %d transaction(s) in %d bytes\n", hex.EncodeToString(tx.ID), entry.Fee, count, size)
+
+	relayTx(tx, address.IP.String())
+}
@@ -1,6 +1,7 @@
 package p2p
 
 import (
+	"encoding/hex"
 	"fmt"
 	"github.com/chezky/blemflarck/core"
 )
@@ -17,15 +18,16 @@ func sendVersion(address NetAddress, bc *core.Blockchain) {
 		return
 	}
 
-	version := createVersion(address.IP, address.Port, height)
-
-	enc, err := core.GobEncode(version)
+	pruneHeight, err := bc.GetPruneHeight()
 	if err != nil {
+		fmt.Printf("error getting prune height for send version: %v\n", err)
 		return
 	}
 
+	version := createVersion(address.IP, address.Port, height, pruneHeight)
+
 	cmd := commandToBytes("version")
-	payload := append(cmd, enc...)
+	payload := append(cmd, version.encode()...)
 
 	if err := SendCmd(address.String(), payload); err != nil {
 		fmt.Printf("error sending version cmd: %v\n", err)
@@ -53,19 +55,20 @@ func sendGetBlocks(address NetAddress, bc *core.Blockchain) {
 		return
 	}
 
-	getBlocks := GetBlocks{
-		Height: height,
-		Hash:   hash,
-	}
-
-	enc, err := core.GobEncode(getBlocks)
+	locator, err := bc.BlockLocator()
 	if err != nil {
-		fmt.Printf("error encoding sendGetBlocks: %v\n", err)
+		fmt.Printf("error getting block locator for sendGetBlocks: %v\n", err)
 		return
 	}
 
+	getBlocks := GetBlocks{
+		Height:  height,
+		Hash:    hash,
+		Locator: locator,
+	}
+
 	cmd := commandToBytes("getblocks")
-	payload := append(cmd, enc...)
+	payload := append(cmd, getBlocks.encode()...)
 
 	err = SendCmd(address.String(), payload)
 	if err != nil {
@@ -75,14 +78,8 @@ func sendGetBlocks(address NetAddress, bc *core.Blockchain) {
 }
 
 func sendInv(address NetAddress, inv *Inventory) {
-	enc, err := core.GobEncode(&inv)
-	if err != nil {
-		fmt.Printf("error encoding payload for sendInv: %v\n", err)
-		return
-	}
-
 	cmd := commandToBytes("inv")
-	payload := append(cmd, enc...)
+	payload := append(cmd, inv.encode()...)
 
 	if err := SendCmd(address.String(), payload); err != nil {
 		fmt.Printf("error sending getInv command to %s: %v", address, err)
@@ -91,29 +88,39 @@ func sendInv(address NetAddress, inv *Inventory) {
 }
 
 func sendGetData(kind string) {
-	cmd := commandToBytes("getdata")
-	address := getRandomAddress()
-
 	if kind == "blocks" {
 		for height, hash := range blocksNeeded {
+			// pruned nodes can only be asked for blocks they still have
+			address, ok := getNodeWithBlock(height, "")
+			if !ok {
+				fmt.Printf("ERROR: no known node has block \"%d\" anymore\n", height)
+				continue
+			}
+
 			data := GetData{
 				Height: height,
 				Hash:   hash,
 				Kind:	kind,
 			}
 
-			enc, err := core.GobEncode(data)
-			if err != nil {
-				fmt.Printf("error encoding block for sendGetData: %v\n", err)
+			if err := sendData("getdata", data, address); err != nil {
 				return
 			}
-
-			payload := append(cmd, enc...)
-			SendCmd(address.String(), payload)
 		}
 	}
 }
 
+// sendNotFound tells a node that asked for data with getdata that we don't have it, so it can ask another node instead.
+func sendNotFound(data GetData, address NetAddress) {
+	sendData("notfound", data, address)
+}
+
+// sendData sends a getdata or notfound command for a single item.
+func sendData(command string, data GetData, address NetAddress) error {
+	payload := append(commandToBytes(command), data.encode()...)
+	return SendCmd(address.String(), payload)
+}
+
 func sendBlock(block core.Block, address NetAddress) {
 	enc, err := block.EncodeBlock()
 	if err != nil {
@@ -125,4 +132,39 @@ func sendBlock(block core.Block, address NetAddress) {
 	payload := append(cmd, enc...)
 
 	SendCmd(address.String(), payload)
-}
\ No newline at end of file
+}
+
+// sendTx sends a transaction from the mempool to a node that asked for it with getdata.
+func sendTx(tx core.Transaction, address NetAddress) {
+	if err := SendTransaction(address.String(), tx); err != nil {
+		fmt.Printf("error sending transaction %s to %s: %v\n", hex.EncodeToString(tx.ID), address.String(), err)
+	}
+}
+
+// SendTransaction sends a transaction to the node at address, which adds it to its mempool and announces it to the rest of the network.
+func SendTransaction(address string, tx core.Transaction) error {
+	enc, err := tx.Serialize()
+	if err != nil {
+		fmt.Printf("error encoding transaction %s: %v\n", hex.EncodeToString(tx.ID), err)
+		return err
+	}
+
+	payload := append(commandToBytes("tx"), enc...)
+	return SendCmd(address, payload)
+}
+
+// relayTx announces a transaction that was just added to the mempool to every node we have a handshake with, except the node with the IP
+// exclude, which sent it to us.
+func relayTx(tx core.Transaction, exclude string) {
+	inv := &Inventory{
+		Items: [][]byte{tx.ID},
+		Kind:  "tx",
+	}
+
+	for ip, node := range knownNodes {
+		if ip == exclude || !node.Handshake {
+			continue
+		}
+		sendInv(node.Address, inv)
+	}
+}
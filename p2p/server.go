@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/chezky/blemflarck/core"
+	"github.com/chezky/blemflarck/mempool"
 	"io"
 	"io/ioutil"
 	"net"
@@ -11,12 +12,15 @@ import (
 
 const (
 	cmdLength = 12
-	nodePort int = 8069
 )
 
 var (
 	knownNodes = make(map[string]*Address)
 	nodeVersion int32 = 1
+	// MempoolSize is the most MiB of unconfirmed transactions the node holds in its mempool
+	MempoolSize = mempool.DefaultMaxSize / 1024 / 1024
+	// pool holds the transactions the node has received that aren't in a block yet
+	pool *mempool.Mempool
 )
 
 func StartServer() error {
@@ -38,20 +42,24 @@ func StartServer() error {
 		return err
 	}
 
-	bc, err := core.CreateBlockchain("")
+	bc, err := core.CreateBlockchain()
 	if err != nil {
 		return err
 	}
 
 	defer bc.DB.Close()
 
-	// hardcoded now for testing locally
-	if getIPString() != fmt.Sprintf("%s:%d", "10.0.0.1", nodePort){
+	pool = mempool.New(bc, MempoolSize*1024*1024)
+
+	// connect to the seeds of the network, unless we are one
+	for _, seed := range core.Params.Seeds {
 		addr := NetAddress{
-			IP:   net.IPv4(10,0,0,1),
-			Port: nodePort,
+			IP:   net.ParseIP(seed),
+			Port: core.Params.Port,
+		}
+		if getIPString() != addr.String() {
+			sendVersion(addr, bc)
 		}
-		sendVersion(addr, bc)
 	}
 
 	for {
@@ -89,9 +97,13 @@ func HandleConnection(conn net.Conn, bc *core.Blockchain) {
 	case "inv":
 		handleInventory(req[cmdLength:], addr, bc)
 	case "getdata":
-		handleGetData(req[cmdLength:], addr)
+		handleGetData(req[cmdLength:], addr, bc)
+	case "notfound":
+		handleNotFound(req[cmdLength:], addr)
 	case "block":
 		handleBlock(req[cmdLength:], bc)
+	case "tx":
+		handleTx(req[cmdLength:], addr)
 	default:
 		fmt.Printf("ERROR: %s is an unknown command\n", cmd)
 	}
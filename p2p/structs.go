@@ -2,6 +2,7 @@ package p2p
 
 import (
 	"fmt"
+	"github.com/chezky/blemflarck/core"
 	"net"
 	"time"
 )
@@ -17,6 +18,8 @@ type Version struct {
 	AddrRecv NetAddress // eventually make this 26 bytes // address of where this is being sent
 	AddrFrom NetAddress // address to whom this came from
 	BlockHeight int32 // current height of the blockchain on the node
+	Pruned bool // Pruned is set if the node has deleted old blocks, and can't serve them anymore, see core/prune.go
+	PruneHeight int32 // PruneHeight is the height of the highest block the node has pruned. Only set if Pruned is.
 }
 
 type Inventory struct {
@@ -28,6 +31,7 @@ type Inventory struct {
 type GetBlocks struct {
 	Height int32 // Height of the latest block you have
 	Hash []byte // Hash of the last block you have
+	Locator [][]byte // Locator is a list of hashes going back along your main chain, see core.BlockLocator
 }
 
 type GetData struct {
@@ -40,6 +44,8 @@ type Address struct {
 	Address NetAddress
 	Handshake bool
 	Timestamp int64
+	Pruned bool // Pruned is set if the node told us in its version that it is pruned
+	PruneHeight int32 // PruneHeight is the height of the highest block the node has pruned
 }
 
 func createNewAddress(addr NetAddress) *Address {
@@ -55,19 +61,20 @@ func (addr NetAddress) String() string {
 	return fmt.Sprintf("%s:%d", addr.IP.String(), addr.Port)
 }
 
-// SetPort sets the port of an address. Default is nodePort. If the address is known tho, make the port the actual port of the address. Usually all ports are the same.
+// SetPort sets the port of an address. Default is the port of the network. If the address is known tho, make the port the actual port of the address. Usually all ports are the same.
 func (addr *NetAddress) SetPort() {
 	if !nodeIsKnow(addr.IP) {
-		addr.Port = nodePort
+		addr.Port = core.Params.Port
 		return
 	}
 
 	addr.Port = knownNodes[addr.IP.String()].Address.Port
 }
 
-// createVersion creates a new Version struct with an address, port, and height
-func createVersion(addr net.IP, port int, height int32) Version {
-	return Version{
+// createVersion creates a new Version struct with an address, port, and height. pruneHeight is the height of the highest block this node
+// has pruned, -1 if it has every block.
+func createVersion(addr net.IP, port int, height int32, pruneHeight int) Version {
+	version := Version{
 		Version:     nodeVersion,
 		Timestamp:   time.Now().Unix(),
 		AddrRecv:    NetAddress{
@@ -76,8 +83,176 @@ func createVersion(addr net.IP, port int, height int32) Version {
 		},
 		AddrFrom: NetAddress{
 			IP:   nodeIP(),
-			Port: nodePort,
+			Port: core.Params.Port,
 		},
 		BlockHeight: height,
 	}
-}
\ No newline at end of file
+
+	if pruneHeight >= 0 {
+		version.Pruned = true
+		version.PruneHeight = int32(pruneHeight)
+	}
+
+	return version
+}
+
+// hasBlock checks if the node still has the block at height, as far as we know.
+func (addr *Address) hasBlock(height int32) bool {
+	return !addr.Pruned || height > addr.PruneHeight
+}
+// Message Encoding
+
+// The version, getblocks, inv, getdata and notfound messages are in the canonical encoding, see core/encoding.go. Each one starts with the
+// uint32 version of its encoding, which is messageEncodingVersion.
+//
+// NetAddress:
+//   bytes IP | int32 Port
+// Version:
+//   uint32 version | int32 Version | int64 Timestamp | NetAddress AddrRecv | NetAddress AddrFrom | int32 BlockHeight | bool Pruned |
+//   int32 PruneHeight
+// GetBlocks:
+//   uint32 version | int32 Height | bytes Hash | uint32 len(Locator) | bytes...
+// Inventory:
+//   uint32 version | uint32 len(Height) | int32... | uint32 len(Items) | bytes... | bytes Kind
+// GetData, for both getdata and notfound:
+//   uint32 version | int32 Height | bytes Hash | bytes Kind
+
+// messageEncodingVersion is the version every encoded message starts with.
+const messageEncodingVersion uint32 = 1
+
+func (addr NetAddress) encode(e *core.Encoder) {
+	e.WriteBytes(addr.IP)
+	e.WriteInt32(int32(addr.Port))
+}
+
+func decodeNetAddress(d *core.Decoder) NetAddress {
+	return NetAddress{
+		IP:   net.IP(d.ReadBytes()),
+		Port: int(d.ReadInt32()),
+	}
+}
+
+// encode encodes a version message.
+func (v Version) encode() []byte {
+	var e core.Encoder
+	e.WriteUint32(messageEncodingVersion)
+	e.WriteInt32(v.Version)
+	e.WriteInt64(v.Timestamp)
+	v.AddrRecv.encode(&e)
+	v.AddrFrom.encode(&e)
+	e.WriteInt32(v.BlockHeight)
+	e.WriteBool(v.Pruned)
+	e.WriteInt32(v.PruneHeight)
+	return e.Bytes()
+}
+
+// decodeVersion decodes a version message that was encoded with Version.encode.
+func decodeVersion(data []byte) (Version, error) {
+	var v Version
+
+	d := core.NewDecoder(data)
+	d.ReadVersion(messageEncodingVersion)
+	v.Version = d.ReadInt32()
+	v.Timestamp = d.ReadInt64()
+	v.AddrRecv = decodeNetAddress(d)
+	v.AddrFrom = decodeNetAddress(d)
+	v.BlockHeight = d.ReadInt32()
+	v.Pruned = d.ReadBool()
+	v.PruneHeight = d.ReadInt32()
+
+	return v, d.Finish()
+}
+
+// encode encodes a getblocks message.
+func (gb GetBlocks) encode() []byte {
+	var e core.Encoder
+	e.WriteUint32(messageEncodingVersion)
+	e.WriteInt32(gb.Height)
+	e.WriteBytes(gb.Hash)
+	e.WriteUint32(uint32(len(gb.Locator)))
+	for _, hash := range gb.Locator {
+		e.WriteBytes(hash)
+	}
+	return e.Bytes()
+}
+
+// decodeGetBlocks decodes a getblocks message that was encoded with GetBlocks.encode.
+func decodeGetBlocks(data []byte) (GetBlocks, error) {
+	var gb GetBlocks
+
+	d := core.NewDecoder(data)
+	d.ReadVersion(messageEncodingVersion)
+	gb.Height = d.ReadInt32()
+	gb.Hash = d.ReadBytes()
+	count := d.ReadCount(4)
+	for i := 0; i < count; i++ {
+		gb.Locator = append(gb.Locator, d.ReadBytes())
+	}
+
+	return gb, d.Finish()
+}
+
+// encode encodes an inv message.
+func (inv Inventory) encode() []byte {
+	var e core.Encoder
+	e.WriteUint32(messageEncodingVersion)
+	e.WriteUint32(uint32(len(inv.Height)))
+	for _, height := range inv.Height {
+		e.WriteInt32(height)
+	}
+	e.WriteUint32(uint32(len(inv.Items)))
+	for _, item := range inv.Items {
+		e.WriteBytes(item)
+	}
+	e.WriteBytes([]byte(inv.Kind))
+	return e.Bytes()
+}
+
+// decodeInventory decodes an inv message that was encoded with Inventory.encode. Every block in it has a height, so a blocks inventory
+// with a different number of heights and items is rejected.
+func decodeInventory(data []byte) (Inventory, error) {
+	var inv Inventory
+
+	d := core.NewDecoder(data)
+	d.ReadVersion(messageEncodingVersion)
+	count := d.ReadCount(4)
+	for i := 0; i < count; i++ {
+		inv.Height = append(inv.Height, d.ReadInt32())
+	}
+	count = d.ReadCount(4)
+	for i := 0; i < count; i++ {
+		inv.Items = append(inv.Items, d.ReadBytes())
+	}
+	inv.Kind = string(d.ReadBytes())
+
+	if err := d.Finish(); err != nil {
+		return inv, err
+	}
+	if inv.Kind == "blocks" && len(inv.Height) != len(inv.Items) {
+		return inv, fmt.Errorf("ERROR: inventory has %d heights for %d blocks", len(inv.Height), len(inv.Items))
+	}
+	return inv, nil
+}
+
+// encode encodes a getdata or notfound message.
+func (gd GetData) encode() []byte {
+	var e core.Encoder
+	e.WriteUint32(messageEncodingVersion)
+	e.WriteInt32(gd.Height)
+	e.WriteBytes(gd.Hash)
+	e.WriteBytes([]byte(gd.Kind))
+	return e.Bytes()
+}
+
+// decodeGetData decodes a getdata or notfound message that was encoded with GetData.encode.
+func decodeGetData(data []byte) (GetData, error) {
+	var gd GetData
+
+	d := core.NewDecoder(data)
+	d.ReadVersion(messageEncodingVersion)
+	gd.Height = d.ReadInt32()
+	gd.Hash = d.ReadBytes()
+	gd.Kind = string(d.ReadBytes())
+
+	return gd, d.Finish()
+}
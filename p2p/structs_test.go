@@ -0,0 +1,99 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestMessageEncoding(t *testing.T) {
+	addr := NetAddress{IP: net.ParseIP("10.0.0.1").To4(), Port: 8069}
+	other := NetAddress{IP: net.ParseIP("fe80::1"), Port: 18069}
+
+	tests := []struct {
+		name string
+		msg  interface{}
+	}{
+		{
+			name: "version",
+			msg:  Version{Version: 1, Timestamp: 1600000000, AddrRecv: addr, AddrFrom: other, BlockHeight: 42, Pruned: true, PruneHeight: 7},
+		},
+		{
+			name: "getblocks",
+			msg:  GetBlocks{Height: 42, Hash: []byte{1, 2, 3}, Locator: [][]byte{{4, 5}, {6}}},
+		},
+		{
+			name: "block inventory",
+			msg:  Inventory{Height: []int32{43, 44}, Items: [][]byte{{7}, {8, 9}}, Kind: "blocks"},
+		},
+		{
+			name: "transaction inventory",
+			msg:  Inventory{Items: [][]byte{{10, 11}}, Kind: "tx"},
+		},
+		{
+			name: "getdata",
+			msg:  GetData{Height: 43, Hash: []byte{7}, Kind: "blocks"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				decoded interface{}
+				err     error
+			)
+			switch msg := tt.msg.(type) {
+			case Version:
+				decoded, err = decodeVersion(msg.encode())
+			case GetBlocks:
+				decoded, err = decodeGetBlocks(msg.encode())
+			case Inventory:
+				decoded, err = decodeInventory(msg.encode())
+			case GetData:
+				decoded, err = decodeGetData(msg.encode())
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, tt.msg) {
+				t.Errorf("message changed after a round trip:\n got %+v\nwant %+v", decoded, tt.msg)
+			}
+		})
+	}
+}
+
+func TestMessageDecodingErrors(t *testing.T) {
+	enc := GetData{Height: 43, Hash: []byte{7}, Kind: "blocks"}.encode()
+	mismatched := Inventory{Height: []int32{43}, Items: [][]byte{{7}, {8}}, Kind: "blocks"}.encode()
+
+	// how messages were sent before they were in the canonical encoding
+	var legacy bytes.Buffer
+	if err := gob.NewEncoder(&legacy).Encode(GetData{Height: 43, Hash: []byte{7}, Kind: "blocks"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: []byte{}},
+		{name: "truncated", data: enc[:len(enc)-1]},
+		{name: "trailing bytes", data: append(append([]byte{}, enc...), 0)},
+		{name: "unknown version", data: append([]byte{0, 0, 0, 2}, enc[4:]...)},
+		{name: "gob", data: legacy.Bytes()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeGetData(tt.data); err == nil {
+				t.Errorf("decoded without an error")
+			}
+		})
+	}
+
+	if _, err := decodeInventory(mismatched); err == nil {
+		t.Errorf("decoded a blocks inventory with a height missing without an error")
+	}
+}
@@ -2,6 +2,7 @@ package p2p
 
 import (
 	"fmt"
+	"github.com/chezky/blemflarck/core"
 	"net"
 	"time"
 )
@@ -10,7 +11,7 @@ func getIPString() string {
 	conn, _ := net.Dial("udp", "8.8.8.8:80")
 	defer conn.Close()
 	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return fmt.Sprintf("%s:%d", localAddr.IP.String(), nodePort)
+	return fmt.Sprintf("%s:%d", localAddr.IP.String(), core.Params.Port)
 }
 
 func nodeIP() net.IP {
@@ -59,4 +60,17 @@ func getRandomAddress() NetAddress {
 	}
 	fmt.Printf("ERROR: can't find a node that is accepted and has a heartbeat\n")
 	return node.Address
-}
\ No newline at end of file
+}
+// getNodeWithBlock returns a node that is accepted, has a heartbeat, and hasn't pruned the block at height. A node with the IP exclude is
+// skipped. The bool is false if there is no such node.
+func getNodeWithBlock(height int32, exclude string) (NetAddress, bool) {
+	for ip, node := range knownNodes {
+		if ip == exclude || !node.hasBlock(height) {
+			continue
+		}
+		if node.Handshake && (node.Timestamp + 1800) > time.Now().Unix() {
+			return node.Address, true
+		}
+	}
+	return NetAddress{}, false
+}